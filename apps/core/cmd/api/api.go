@@ -1,19 +1,29 @@
 package api
 
 import (
+	"context"
 	"fmt"
-	log "packages/logging"
 	"net/http"
+	log "packages/logging"
 	"sync"
 
 	"core/cmd/middleware"
-	"core/internal/k8s"
-	"core/internal/redis"
+	"core/internal/email"
+	"core/internal/oauth"
+	"core/internal/provisioner"
+	"core/internal/quota"
+	"core/internal/reconcile"
 	"core/internal/s3"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/internal/upgrade"
 	"core/pkg/dotenv"
+	"core/services/admin"
 	"core/services/auth"
 	"core/services/repl"
 	"core/services/runner"
+	templatesService "core/services/templates"
+	"core/services/tokens"
 	"packages/utils/json"
 
 	"github.com/rs/cors"
@@ -35,25 +45,51 @@ func (api *APIServer) Run() error {
 
 	router := http.NewServeMux()
 	s3Client := s3.NewS3Client()
-	rds := redis.NewRedisStore()
+	rs := store.NewReplStore()
+	prov := provisioner.NewProvisioner(s3Client, rs)
+
+	if err := templates.Load(templates.TEMPLATES_DIR); err != nil {
+		return err
+	}
+
+	if err := oauth.LoadProviders(); err != nil {
+		return err
+	}
+
+	if err := email.CheckSigningKeys(rs); err != nil {
+		return err
+	}
+
+	if err := quota.SeedPlans(rs); err != nil {
+		return err
+	}
+
+	rc := reconcile.NewReconciler(rs, s3Client, prov)
+	go rc.Start(context.Background())
+
+	if k, ok := prov.(*provisioner.Kubernetes); ok {
+		go k.KeepWarm(context.Background())
+	}
+
+	up := upgrade.NewUpgrader(rs, s3Client, prov)
 
 	router.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
 		var mu sync.Mutex
 		var wg sync.WaitGroup
 		wg.Add(3)
 		status := map[string]string{
-			"api":   "ok",
-			"k8s":   "ok",
-			"s3":    "ok",
-			"redis": "ok",
+			"api":         "ok",
+			"provisioner": "ok",
+			"s3":          "ok",
+			"store":       "ok",
 		}
 
 		go func() {
 			defer wg.Done()
-			if err := rds.Ping(); err != nil {
+			if err := rs.Ping(); err != nil {
 				mu.Lock()
 				status["api"] = "degraded"
-				status["redis"] = fmt.Sprintf("%v", err)
+				status["store"] = fmt.Sprintf("%v", err)
 				mu.Unlock()
 			}
 		}()
@@ -70,10 +106,10 @@ func (api *APIServer) Run() error {
 
 		go func() {
 			defer wg.Done()
-			if _, err := k8s.CheckStatus(); err != nil {
+			if err := prov.Ping(); err != nil {
 				mu.Lock()
 				status["api"] = "degraded"
-				status["k8s"] = fmt.Sprintf("%v", err)
+				status["provisioner"] = fmt.Sprintf("%s: %v", prov.Name(), err)
 				mu.Unlock()
 			}
 		}()
@@ -84,18 +120,29 @@ func (api *APIServer) Run() error {
 	})
 
 	//  Auth Routes
-	router.Handle("/auth/", http.StripPrefix("/auth", auth.NewAuthHandler()))
+	router.Handle("/auth/", http.StripPrefix("/auth", auth.NewAuthHandler(rs)))
+
+	// Template Routes
+	router.Handle("/api/templates/", http.StripPrefix("/api/templates", templatesService.NewHandler()))
 
 	// Runner Routes
-	router.Handle("/api/runner/", http.StripPrefix("/api/runner", runner.NewHandler(rds)))
+	router.Handle("/api/runner/", http.StripPrefix("/api/runner", runner.NewHandler(s3Client, rs, prov)))
 
 	// Protected Repl Routes
-	router.Handle("/api/repl/", middleware.AuthMiddleware(
-		http.StripPrefix("/api/repl", repl.NewHandler(s3Client, rds))))
+	router.Handle("/api/repl/", middleware.AuthMiddleware(rs,
+		http.StripPrefix("/api/repl", repl.NewHandler(s3Client, rs, prov))))
+
+	// Personal Access Token Routes
+	router.Handle("/api/tokens/", middleware.AuthMiddleware(rs,
+		http.StripPrefix("/api/tokens", tokens.NewHandler(rs))))
+
+	// Admin Routes
+	router.Handle("/api/admin/", middleware.AuthMiddleware(rs, middleware.AdminMiddleware(
+		http.StripPrefix("/api/admin", admin.NewHandler(rs, s3Client, prov, rc, up)))))
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{FRONTEND_URL, "http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 	})
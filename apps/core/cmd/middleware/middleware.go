@@ -4,58 +4,62 @@ import (
 	"context"
 	log "packages/logging"
 	"net/http"
+	"strings"
 	"time"
 
-	"core/internal/oauth"
+	"core/internal/accesstoken"
 	"core/internal/session"
+	"core/internal/store"
+	"core/internal/users"
 	"core/models"
+	"core/pkg/dotenv"
 
 	"packages/utils/json"
-
-	"golang.org/x/oauth2"
 )
 
 type contextKey string
 
-const UserContextKey contextKey = "user"
+const (
+	UserContextKey  contextKey = "user"
+	TokenContextKey contextKey = "token"
+)
 
-func AuthMiddleware(next http.Handler) http.Handler {
+// AuthMiddleware accepts the cookie session, or a personal access token sent
+// as "Authorization: Bearer <token>". Token requests carry the token in their
+// context, see RequireScope.
+func AuthMiddleware(rs store.ReplStore, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenInfo, err := session.GetSession(r)
-		if err != nil || tokenInfo == nil {
+		if header := r.Header.Get("Authorization"); header != "" {
+			secret, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				json.WriteError(w, http.StatusUnauthorized, "Unsupported authorization scheme")
+				return
+			}
+			token, err := accesstoken.Authenticate(rs, strings.TrimSpace(secret))
+			if err != nil {
+				json.WriteError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, &token.User)
+			ctx = context.WithValue(ctx, TokenContextKey, &token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		s, err := session.GetSession(rs, r)
+		if err != nil {
 			json.WriteError(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
+		tokenInfo := &s.TokenInfo
 
-		// Handle OAuth token refresh (skip for magic link sessions)
-		if tokenInfo.Token != nil {
-			// Check if token is expired
-			if time.Now().After(tokenInfo.ExpiresAt) {
-				// Try to refresh token
-				newToken, err := refreshToken(tokenInfo.Token)
-				if err != nil {
-					log.Error("Refresh token failed", "error", err)
-					session.ClearSession(w, r)
-					json.WriteError(w, http.StatusUnauthorized, "Token expired")
-					return
-				}
-				// Update token info
-				tokenInfo.Token = newToken
-				tokenInfo.ExpiresAt = newToken.Expiry
-				// Save updated session
-				if err := session.SaveSession(w, r, tokenInfo); err != nil {
-					log.Error("Save refreshed session failed", "error", err)
-					json.WriteError(w, http.StatusInternalServerError, "Internal server error")
-					return
-				}
-			}
-		} else {
-			// For magic link sessions, check if session is expired
-			if time.Now().After(tokenInfo.ExpiresAt) {
-				session.ClearSession(w, r)
-				json.WriteError(w, http.StatusUnauthorized, "Session expired")
-				return
-			}
+		// OAuth and magic link logins expire with the session, the provider's
+		// token isn't used after sign in so it's never refreshed
+		if time.Now().After(tokenInfo.ExpiresAt) {
+			session.ClearSession(rs, w, r)
+			json.WriteError(w, http.StatusUnauthorized, "Session expired")
+			return
 		}
 
 		// Add user to context
@@ -64,16 +68,57 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func refreshToken(token *oauth2.Token) (*oauth2.Token, error) {
-	tokenSource := oauth.GithubOauthConfig.TokenSource(context.Background(), token)
-	newToken, err := tokenSource.Token()
-	if err != nil {
-		return nil, err
+// RequireScope only lets personal access tokens through with a scope that
+// allows the request's scope. Cookie sessions act with every scope. It must be
+// wrapped by AuthMiddleware.
+func RequireScope(scopeOf func(r *http.Request) models.TokenScope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := GetTokenFromContext(r.Context()); ok {
+			if need := scopeOf(r); !token.Allows(need) {
+				json.WriteError(w, http.StatusForbidden, "Access token lacks the "+string(need)+" scope")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminMiddleware only lets through users listed in ADMIN_USERS (comma separated
+// account ids, handles can be renamed or taken over so they never match). It
+// must be wrapped by AuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	for _, admin := range strings.Split(dotenv.EnvString("ADMIN_USERS", ""), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && !users.IsId(admin) {
+			log.Warn("ADMIN_USERS entry isn't an account id and is ignored", "entry", admin)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok || !IsAdmin(user) {
+			json.WriteError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func IsAdmin(user *models.User) bool {
+	for _, admin := range strings.Split(dotenv.EnvString("ADMIN_USERS", ""), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && admin == user.ID {
+			return true
+		}
 	}
-	return newToken, nil
+	return false
 }
 
 func GetUserFromContext(ctx context.Context) (*models.User, bool) {
 	user, ok := ctx.Value(UserContextKey).(*models.User)
 	return user, ok
 }
+
+// GetTokenFromContext returns the personal access token the request was
+// authenticated with, if any
+func GetTokenFromContext(ctx context.Context) (*models.AccessToken, bool) {
+	token, ok := ctx.Value(TokenContextKey).(*models.AccessToken)
+	return token, ok
+}
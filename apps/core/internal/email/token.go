@@ -1,78 +1,182 @@
 package email
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	log "packages/logging"
+	"strings"
 	"time"
 
+	"core/internal/redis"
+	"core/internal/store"
+	"core/pkg/dotenv"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-// TODO: Load this from env
-var jwtSecretKey = []byte("your-super-secret-key-that-is-long-and-secure")
+// Comma separated signing keys, each "<kid>:<secret>" or just a secret. The
+// first signs new links, the others only verify, so a retired key keeps
+// working until its links expire.
+var MAGICLINK_SIGNING_KEYS = dotenv.EnvString("MAGICLINK_SIGNING_KEYS", "")
+
+const tokenIssuer = "devex"
+
+var ErrTokenUsed = errors.New("magic link already used")
+
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+var signingKeys, randomSigningKey = loadSigningKeys(MAGICLINK_SIGNING_KEYS)
 
 type MagicLinkClaims struct {
 	Email string `json:"email"`
+	// Set when the link adds the email to this account instead of signing in
+	LinkTo string `json:"link_to,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(email string) (string, error) {
+// loadSigningKeys parses the configured keys. Keys without an id get one
+// from their hash. Without any, links are signed with a random key and don't
+// survive a restart, random reports it.
+func loadSigningKeys(config string) (keys []signingKey, random bool) {
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			sum := sha256.Sum256([]byte(entry))
+			id, secret = hex.EncodeToString(sum[:4]), entry
+		}
+		if len(secret) < 32 {
+			log.Error("Magic link signing key too short, skipping it", "kid", id)
+			continue
+		}
+		keys = append(keys, signingKey{id: id, secret: []byte(secret)})
+	}
+	if len(keys) > 0 {
+		return keys, false
+	}
+
+	log.Warn("MAGICLINK_SIGNING_KEYS not set, signing magic links with a random key")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("generate magic link key: %v", err))
+	}
+	return []signingKey{{id: "random", secret: secret}}, true
+}
+
+// CheckSigningKeys refuses the random signing key with the Redis store: its
+// links are shared by every replica and outlive a restart, but the key isn't
+func CheckSigningKeys(rs store.ReplStore) error {
+	if _, ok := rs.(*redis.Redis); ok && randomSigningKey {
+		return errors.New("MAGICLINK_SIGNING_KEYS must be set with the redis store")
+	}
+	return nil
+}
+
+func GenerateToken(rs store.ReplStore, email string) (string, error) {
+	return generateToken(rs, email, "")
+}
+
+// GenerateLinkToken is a magic link that links the email to the user's
+// account, it only works in that user's session
+func GenerateLinkToken(rs store.ReplStore, email, userId string) (string, error) {
+	return generateToken(rs, email, userId)
+}
 
-	expirationTime := time.Now().Add(15 * time.Minute)
+// generateToken signs a link and records its jti, the link only verifies
+// while the store has it
+func generateToken(rs store.ReplStore, email, linkTo string) (string, error) {
+	now := time.Now()
+	expirationTime := now.Add(TokenLifetime)
+	jti := uuid.New().String()
 
 	// Create the claims for the token.
 	claims := &MagicLinkClaims{
-		Email: email,
+		Email:  email,
+		LinkTo: linkTo,
 		RegisteredClaims: jwt.RegisteredClaims{
-			// Set the expiration time in Unix format.
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			// You can also add other standard claims like IssuedAt, NotBefore, etc.
-			IssuedAt: jwt.NewNumericDate(time.Now()),
-			Issuer:   "your-app-name", // Optional: identifies the issuer of the token
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    tokenIssuer,
 		},
 	}
 
-	// Create a new token object, specifying the signing method (HS256) and the claims.
+	// Sign with the current key, its id tells verify which key to use
+	key := signingKeys[0]
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.id
 
-	// Sign the token with our secret key to generate the final token string.
-	tokenString, err := token.SignedString(jwtSecretKey)
+	tokenString, err := token.SignedString(key.secret)
 	if err != nil {
 		// If there's an error during signing, log it and return.
 		log.Error("Sign token failed", "error", err)
 		return "", err
 	}
 
+	if err := rs.SaveMagicLink(jti, expirationTime); err != nil {
+		log.Error("Save magic link failed", "error", err)
+		return "", err
+	}
+
 	return tokenString, nil
 }
 
-func ValidateToken(tokenString string) (string, error) {
+// ParseToken verifies the link without consuming it
+func ParseToken(tokenString string) (*MagicLinkClaims, error) {
 	// Parse the token with our custom claims struct.
-	// The key function provides the secret key for verification.
+	// The key function picks the verification key by the token's kid.
 	token, err := jwt.ParseWithClaims(tokenString, &MagicLinkClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the signing algorithm is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range signingKeys {
+			if key.id == kid {
+				return key.secret, nil
+			}
 		}
-		return jwtSecretKey, nil
-	})
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
 
 	if err != nil {
 		// This will catch various errors, including:
 		// - Token is expired (jwt.ErrTokenExpired)
-		// - Signature is invalid
+		// - Signature is invalid or its key was retired
 		// - Token is malformed
 		log.Warn("Parse or validate token failed", "error", err)
-		return "", err
+		return nil, err
 	}
 
-	// Check if the token is valid and extract the claims.
-	if claims, ok := token.Claims.(*MagicLinkClaims); ok && token.Valid {
-		// Token is valid, return the email.
-		return claims.Email, nil
+	claims, ok := token.Claims.(*MagicLinkClaims)
+	if !ok || !token.Valid || claims.ID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// ValidateToken verifies the link and consumes it, so it works only once
+func ValidateToken(rs store.ReplStore, tokenString string) (*MagicLinkClaims, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	unused, err := rs.ConsumeMagicLink(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		log.Warn("Magic link replayed", "jti", claims.ID)
+		return nil, ErrTokenUsed
 	}
 
-	// This case should ideally not be reached if the parsing above handles errors correctly,
-	// but it's good practice to have a fallback.
-	return "", fmt.Errorf("invalid token")
+	return claims, nil
 }
@@ -0,0 +1,71 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"core/internal/store"
+)
+
+func useSigningKeys(t *testing.T, config string) {
+	keys := signingKeys
+	signingKeys, _ = loadSigningKeys(config)
+	t.Cleanup(func() { signingKeys = keys })
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	oldKey := "old:" + strings.Repeat("o", 32)
+	newKey := "new:" + strings.Repeat("n", 32)
+
+	tests := []struct {
+		name   string
+		signed string
+		keys   string
+		valid  bool
+	}{
+		{"current key", oldKey, oldKey, true},
+		{"retired key still verifying", oldKey, newKey + "," + oldKey, true},
+		{"retired key dropped", oldKey, newKey, false},
+		{"same secret under another kid", oldKey, "other:" + strings.Repeat("o", 32), false},
+		{"short key skipped", oldKey, newKey + ",old:short", false},
+	}
+	for _, tt := range tests {
+		rs := store.NewMemoryStore("")
+		useSigningKeys(t, tt.signed)
+		token, err := GenerateToken(rs, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		useSigningKeys(t, tt.keys)
+		if _, err := ValidateToken(rs, token); (err == nil) != tt.valid {
+			t.Errorf("%s: error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestMagicLinkReplay(t *testing.T) {
+	useSigningKeys(t, strings.Repeat("k", 32))
+	rs := store.NewMemoryStore("")
+	token, err := GenerateLinkToken(rs, "alice@example.com", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking a link doesn't use it up
+	for range 2 {
+		if claims, err := ParseToken(token); err != nil || claims.Email != "alice@example.com" || claims.LinkTo != "user-1" {
+			t.Fatalf("ParseToken = %+v, %v", claims, err)
+		}
+	}
+	if _, err := ValidateToken(rs, token); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := ValidateToken(rs, token); !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("replay: %v, want ErrTokenUsed", err)
+	}
+	if _, err := ParseToken(token + "x"); err == nil {
+		t.Error("tampered token parsed")
+	}
+}
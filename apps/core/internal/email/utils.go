@@ -1,6 +1,7 @@
 package email
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/mail"
@@ -8,16 +9,21 @@ import (
 	"time"
 
 	"core/internal/session"
+	"core/internal/store"
 	"core/pkg/dotenv"
 )
 
 const (
 	TokenLength     = 32
 	TokenLifetime   = 15 * time.Minute
-	RateLimitWindow = 1 * time.Minute
-	MaxAttempts     = 3
+	RateLimitWindow = 15 * time.Minute
+	// Links sent per address and per client IP in a window
+	MaxEmailAttempts = 5
+	MaxIPAttempts    = 20
 )
 
+var ErrRateLimited = errors.New("rate limit exceeded")
+
 func ValidateEmail(email string) error {
 	email = strings.TrimSpace(email)
 	if email == "" {
@@ -32,46 +38,27 @@ func ValidateEmail(email string) error {
 	return nil
 }
 
-func CheckRateLimit(r *http.Request, email string) error {
-	// Get session for rate limiting
-	session, err := session.Store.Get(r, "rate-limit")
-	if err != nil {
-		return nil // Allow if we can't get session
+// CheckRateLimit counts the request against the address's and the client
+// IP's limits. The counters live in the store, so dropping cookies or
+// switching addresses doesn't reset them.
+func CheckRateLimit(rs store.ReplStore, r *http.Request, email string) error {
+	limits := []struct {
+		key string
+		max int64
+	}{
+		{"magic-link:email:" + email, MaxEmailAttempts},
+		{"magic-link:ip:" + session.ClientIP(r), MaxIPAttempts},
 	}
 
-	key := fmt.Sprintf("magic-link:%s", email)
-	now := time.Now()
-
-	// Get existing attempts
-	if data, exists := session.Values[key]; exists {
-		if attempts, ok := data.(map[string]any); ok {
-			if lastAttempt, ok := attempts["last_attempt"].(time.Time); ok {
-				if count, ok := attempts["count"].(int); ok {
-					// Reset counter if window expired
-					if now.Sub(lastAttempt) > RateLimitWindow {
-						count = 0
-					}
-
-					if count >= MaxAttempts {
-						return fmt.Errorf("rate limit exceeded")
-					}
-
-					// Update counter
-					attempts["count"] = count + 1
-					attempts["last_attempt"] = now
-				}
-			}
+	for _, limit := range limits {
+		count, err := rs.CountAttempt(limit.key, RateLimitWindow)
+		if err != nil {
+			return err
 		}
-	} else {
-		// First attempt
-		session.Values[key] = map[string]any{
-			"count":        1,
-			"last_attempt": now,
+		if count > limit.max {
+			return ErrRateLimited
 		}
 	}
-
-	session.Options.MaxAge = int(RateLimitWindow.Seconds())
-	session.Save(r, nil)
 	return nil
 }
 
@@ -179,7 +166,7 @@ func GenerateMagicLink(email, token string) (string, string) {
 			<div style="border-top: 1px solid #374151; padding-top: 20px; margin-top: 40px;">
 				<p style="color: #6b7280; font-size: 12px; margin: 0; text-align: center;">
 					If you didn't request this email, you can safely ignore it.<br>
-					This link expires in 15 minutes for security.
+					This link expires in 15 minutes and works only once.
 				</p>
 			</div>
 		</div>
@@ -0,0 +1,44 @@
+package k8s
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Field manager of the repl objects core applies
+const fieldManager = "devex-core"
+
+// applyOptions apply repl objects server side. Forcing takes over fields set
+// by other managers, such as objects created before core used apply, so a
+// repl converges to its template instead of failing on objects it left
+// behind.
+func applyOptions() metav1.PatchOptions {
+	return metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        boolPtr(true),
+	}
+}
+
+// applyPatch encodes the object as an apply patch. Typed objects need their
+// TypeMeta set, the API server reads the kind from the patch.
+func applyPatch(obj any) ([]byte, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.MarshalJSON()
+	}
+	return json.Marshal(obj)
+}
+
+// ownerReference makes an object garbage collected with owner, so deleting
+// a repl's deployment or claimed pod removes its service and routing objects
+// even when a step of the deletion fails
+func ownerReference(apiVersion, kind string, owner metav1.Object) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         apiVersion,
+		Kind:               kind,
+		Name:               owner.GetName(),
+		UID:                owner.GetUID(),
+		BlockOwnerDeletion: boolPtr(true),
+	}
+}
@@ -9,57 +9,103 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
 )
 
+// Host of the shared ingress when repls are routed by path
 var RUNNER_CLUSTER_IP = dotenv.EnvString("RUNNER_CLUSTER_IP", "localhost")
 var ENABLE_MCP_SIDECAR = dotenv.EnvString("ENABLE_MCP_SIDECAR", "false") == "true"
 
-func CreateReplDeploymentAndService(userName, replId, template string) error {
-	clientset, _ := getClientSet()
-	dynamicClient, _ := getDynamicClient()
-	ctx := context.Background()
+// MCP sidecar image, pin its tag like the templates' runner versions
+var MCP_IMAGE = dotenv.EnvString("MCP_IMAGE", "ghcr.io/parthkapoor-dev/devex/mcp:latest")
 
-	config, exists := models.TemplateConfigs[template]
-	if !exists {
-		return fmt.Errorf("unsupported template: %s", template)
+// CreateReplDeploymentAndService runs the repl with the given template in the
+// namespace, its resources already resolved for the owner's plan. Objects are
+// applied server side, so creating a repl again converges the objects that
+// exist to the template instead of failing. The service and route are owned
+// by the deployment. A failed create removes what it applied, except for the
+// persistent workspace volume, unless the deployment existed before: a repl
+// that's already serving keeps running as it was.
+func CreateReplDeploymentAndService(namespace, userName, replId string, config models.Template) (err error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	ingress, err := getIngressBackend()
+	if err != nil {
+		return err
 	}
+	ctx := context.Background()
+
+	template := config.Key
 
 	bucket := dotenv.EnvString("S3_BUCKET", "devex")
 	endpoint := dotenv.EnvString("S3_ENDPOINT", "https://<account_id>.r2.cloudflarestorage.com")
 	region := dotenv.EnvString("S3_REGION", "us-east-1")
 
+	if err := EnsureNamespace(namespace); err != nil {
+		return err
+	}
+	defer func() { forgetNamespace(namespace, err) }()
+
 	labels := map[string]string{
 		"app":      replId,
 		"template": template,
 	}
+	persistent := config.Storage == models.StoragePersistent
+	if persistent {
+		if err := ensureWorkspaceClaim(ctx, clientset, namespace, replId, config); err != nil {
+			return err
+		}
+	}
+	syncEnv, err := syncEnvVars(userName, replId, persistent)
+	if err != nil {
+		return err
+	}
+	keepSyncToken(ctx, clientset, namespace, replId, syncEnv)
+	syncEnv = append(syncEnv, runnerTokenEnvVars(replId)...)
+
+	// The init container sees the whole volume, to find the seeded marker
+	initMount := workspaceMount(false)
+	if persistent {
+		initMount.MountPath = "/data"
+	}
+
+	// The selector keeps the labels above, deployments can't change it
+	objectLabels := map[string]string{
+		"app":      replId,
+		"template": template,
+		replLabel:  replId,
+	}
 
 	// 1. Deployment
 	deployment := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: replId,
+			Name:      replId,
+			Namespace: namespace,
+			Labels:    objectLabels,
+			Annotations: map[string]string{
+				runnerVersionAnnotation: config.Version,
+			},
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: int32Ptr(1),
+			Strategy: deploymentStrategy(persistent),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
+					Labels: objectLabels,
 				},
 				Spec: corev1.PodSpec{
 					Volumes: []corev1.Volume{
-						{
-							Name: "workspace-vol",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
+						workspaceVolume(replId, config),
 					},
 					InitContainers: []corev1.Container{
 						{
@@ -67,99 +113,137 @@ func CreateReplDeploymentAndService(userName, replId, template string) error {
 							Image:   "amazon/aws-cli",
 							Command: []string{"sh", "-c"},
 							Args: []string{
-								fmt.Sprintf(`aws s3 cp s3://%s/repl/%s/%s/ /workspaces --recursive --endpoint-url %s --region %s && echo "Resources copied from S3/R2";`, bucket, userName, replId, endpoint, region),
+								downloadScript(fmt.Sprintf("s3://%s/repl/%s/%s/", bucket, userName, replId), endpoint, region, persistent),
 							},
 							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "workspace-vol",
-									MountPath: "/workspaces",
-								},
+								initMount,
 							},
-							Env: awsEnvVars(),
+							Env:       awsEnvVars(),
+							Resources: resourceRequirements(config.Resources.Sidecar),
 						},
 					},
-					Containers: func() []corev1.Container {
-						containers := []corev1.Container{
-							{
-								Name:            "runner",
-								Image:           fmt.Sprintf("ghcr.io/parthkapoor-dev/devex/runner-%s:latest", template),
-								ImagePullPolicy: corev1.PullAlways,
-								Env: []corev1.EnvVar{
-									{
-										Name:  "REPL_ID",
-										Value: replId,
-									},
-									{
-										Name:  "TEMPLATE",
-										Value: template,
-									},
-								},
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "workspace-vol",
-										MountPath: "/workspaces",
-									},
-								},
-								Ports: []corev1.ContainerPort{
-									{
-										Name:          "http",
-										ContainerPort: config.Port,
-									},
-									{
-										Name:          "grpc",
-										ContainerPort: 50051,
-										Protocol:      corev1.ProtocolTCP,
-									},
-								},
-							},
-						}
-
-						if ENABLE_MCP_SIDECAR {
-							containers = append(containers, corev1.Container{
-								Name:            "mcp-server",
-								Image:           "ghcr.io/parthkapoor-dev/devex/mcp:latest",
-								ImagePullPolicy: corev1.PullAlways,
-								Env: []corev1.EnvVar{
-									{
-										Name:  "REPL_ID",
-										Value: replId,
-									},
-									{
-										Name:  "TEMPLATE",
-										Value: template,
-									},
-								},
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "workspace-vol",
-										MountPath: "/workspaces",
-									},
-								},
-								Ports: []corev1.ContainerPort{
-									{
-										Name:          "mcp-http",
-										ContainerPort: 8080,
-										Protocol:      corev1.ProtocolTCP,
-									},
-								},
-							})
-						}
-						return containers
-					}(),
+					Containers: runnerContainers(corev1.EnvVar{Name: "REPL_ID", Value: replId}, config, persistent, syncEnv),
 				},
 			},
 		},
 	}
 
-	_, err := clientset.AppsV1().Deployments("default").Create(ctx, deployment, metav1.CreateOptions{})
+	secureReplPod(&deployment.Spec.Template.Spec, config)
+
+	// Unknown counts as existing, rolling back must not take down a serving
+	// repl
+	_, err = clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{})
+	existed := !apierrors.IsNotFound(err)
+
+	data, err := applyPatch(deployment)
 	if err != nil {
-		return fmt.Errorf("failed to create deployment: %w", err)
+		return err
+	}
+	applied, err := clientset.AppsV1().Deployments(namespace).Patch(ctx, replId, types.ApplyPatchType, data, applyOptions())
+	if err != nil {
+		return fmt.Errorf("failed to apply deployment: %w", err)
+	}
+
+	// 2. Service and route
+	owner := ownerReference("apps/v1", "Deployment", applied)
+	if err := exposeRepl(ctx, clientset, ingress, namespace, replId, labels, objectLabels, owner, config); err != nil {
+		if existed {
+			return err
+		}
+		// The deployment takes the objects it owns with it
+		if err := DeleteReplDeploymentAndService(userName, replId, false); err != nil {
+			log.Warn("Roll back repl failed", "repl_id", replId, "error", err)
+		}
+		return err
+	}
+
+	log.Info("Deployment and service applied", "repl_id", replId, "namespace", namespace, "template", template, "storage", config.Storage, "ingress", ingress.Name(), "mcp_sidecar", ENABLE_MCP_SIDECAR)
+	return nil
+}
+
+// runnerContainers are the runner and, when enabled, the MCP sidecar, both
+// with the workspace mounted and the repl id from replIdEnv. env is added to
+// the runner's environment.
+func runnerContainers(replIdEnv corev1.EnvVar, config models.Template, persistent bool, env []corev1.EnvVar) []corev1.Container {
+	template := config.Key
+
+	containers := []corev1.Container{
+		{
+			Name:            "runner",
+			Image:           config.ImageRef(),
+			ImagePullPolicy: imagePullPolicy(config.ImageRef()),
+			Resources:       resourceRequirements(config.Resources.ContainerResources),
+			Env: append([]corev1.EnvVar{
+				replIdEnv,
+				{
+					Name:  "TEMPLATE",
+					Value: template,
+				},
+				{
+					Name:  "RUN_COMMAND",
+					Value: config.Run,
+				},
+				{
+					Name:  "ENTRYPOINT",
+					Value: config.Entrypoint,
+				},
+			}, env...),
+			VolumeMounts: []corev1.VolumeMount{
+				workspaceMount(persistent),
+			},
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          "http",
+					ContainerPort: config.Port,
+				},
+				{
+					Name:          "grpc",
+					ContainerPort: 50051,
+					Protocol:      corev1.ProtocolTCP,
+				},
+			},
+		},
 	}
 
-	// 2. Service
+	if ENABLE_MCP_SIDECAR {
+		containers = append(containers, corev1.Container{
+			Name:            "mcp-server",
+			Image:           MCP_IMAGE,
+			ImagePullPolicy: imagePullPolicy(MCP_IMAGE),
+			Resources:       resourceRequirements(config.Resources.Sidecar),
+			Env: []corev1.EnvVar{
+				replIdEnv,
+				{
+					Name:  "TEMPLATE",
+					Value: template,
+				},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				workspaceMount(persistent),
+			},
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          "mcp-http",
+					ContainerPort: 8080,
+					Protocol:      corev1.ProtocolTCP,
+				},
+			},
+		})
+	}
+	return containers
+}
+
+// exposeRepl applies the repl's service, selecting its pod by labels, and
+// its route from outside the cluster through the configured ingress backend,
+// all owned by owner
+func exposeRepl(ctx context.Context, clientset *kubernetes.Clientset, ingress IngressBackend, namespace, replId string, labels, objectLabels map[string]string, owner metav1.OwnerReference, config models.Template) error {
 	service := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: replId,
+			Name:            replId,
+			Namespace:       namespace,
+			Labels:          objectLabels,
+			OwnerReferences: []metav1.OwnerReference{owner},
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: labels,
@@ -185,114 +269,29 @@ func CreateReplDeploymentAndService(userName, replId, template string) error {
 						Protocol:   corev1.ProtocolTCP,
 					})
 				}
+				for _, port := range appServicePorts(config) {
+					ports = append(ports, corev1.ServicePort{
+						Name:       fmt.Sprintf("app-%d", port),
+						Port:       port,
+						TargetPort: intstr.FromInt(int(port)),
+						Protocol:   corev1.ProtocolTCP,
+					})
+				}
 				return ports
 			}(),
 			Type: corev1.ServiceTypeClusterIP,
 		},
 	}
 
-	_, err = clientset.CoreV1().Services("default").Create(ctx, service, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to create service: %w", err)
-	}
-
-	// 3. Ingress Middleware (Traefik)
-	middlewareRes := schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
-
-	middleware := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"apiVersion": "traefik.io/v1alpha1",
-			"kind":       "Middleware",
-			"metadata": map[string]interface{}{
-				"name":      replId + "-stripprefix",
-				"namespace": "default",
-			},
-			"spec": map[string]interface{}{
-				"stripPrefix": map[string]interface{}{
-					"prefixes": func() []interface{} {
-						// Include both with and without trailing slash for better matching
-						p := []interface{}{"/" + replId, "/" + replId + "/"}
-						if ENABLE_MCP_SIDECAR {
-							p = append(p, "/mcp/"+replId, "/mcp/"+replId+"/")
-						}
-						return p
-					}(),
-				},
-			},
-		},
-	}
-
-	_, err = dynamicClient.Resource(middlewareRes).Namespace("default").Create(ctx, middleware, metav1.CreateOptions{})
+	data, err := applyPatch(service)
 	if err != nil {
-		return fmt.Errorf("failed to create middleware: %w", err)
+		return err
 	}
-
-	// 4. Ingress
-	ingress := &networkingv1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: replId + "-ingress",
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class":                      "traefik",
-				"cert-manager.io/cluster-issuer":                   "letsencrypt-cluster-issuer",
-				"traefik.ingress.kubernetes.io/router.middlewares": fmt.Sprintf("default-%s-stripprefix@kubernetescrd", replId),
-			},
-		},
-		Spec: networkingv1.IngressSpec{
-			TLS: []networkingv1.IngressTLS{
-				{
-					Hosts:      []string{RUNNER_CLUSTER_IP},
-					SecretName: "tls-secret",
-				},
-			},
-			Rules: []networkingv1.IngressRule{
-				{
-					Host: RUNNER_CLUSTER_IP,
-					IngressRuleValue: networkingv1.IngressRuleValue{
-						HTTP: &networkingv1.HTTPIngressRuleValue{
-							Paths: func() []networkingv1.HTTPIngressPath {
-								paths := []networkingv1.HTTPIngressPath{
-									{
-										Path:     "/" + replId,
-										PathType: pathTypePtr(networkingv1.PathTypePrefix),
-										Backend: networkingv1.IngressBackend{
-											Service: &networkingv1.IngressServiceBackend{
-												Name: replId,
-												Port: networkingv1.ServiceBackendPort{
-													Number: config.Port,
-												},
-											},
-										},
-									},
-								}
-
-								if ENABLE_MCP_SIDECAR {
-									paths = append(paths, networkingv1.HTTPIngressPath{
-										Path:     "/mcp/" + replId,
-										PathType: pathTypePtr(networkingv1.PathTypePrefix),
-										Backend: networkingv1.IngressBackend{
-											Service: &networkingv1.IngressServiceBackend{
-												Name: replId,
-												Port: networkingv1.ServiceBackendPort{
-													Number: 8080,
-												},
-											},
-										},
-									})
-								}
-								return paths
-							}(),
-						},
-					},
-				},
-			},
-		},
+	if _, err := clientset.CoreV1().Services(namespace).Patch(ctx, replId, types.ApplyPatchType, data, applyOptions()); err != nil {
+		return fmt.Errorf("failed to apply service: %w", err)
 	}
 
-	_, err = clientset.NetworkingV1().Ingresses("default").Create(ctx, ingress, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to create ingress: %w", err)
-	}
-
-	log.Info("Deployment and service created", "repl_id", replId, "template", template, "mcp_sidecar", ENABLE_MCP_SIDECAR)
-	return nil
+	route := replRoute(namespace, replId, objectLabels, config)
+	route.Owner = owner
+	return ingress.Expose(ctx, route)
 }
@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	log "packages/logging"
 	"time"
@@ -9,100 +10,163 @@ import (
 	"core/pkg/dotenv"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 )
 
-func DeleteReplDeploymentAndService(userName, replId string) error {
-	clientset, _ := getClientSet()
-	dynamicClient, _ := getDynamicClient()
+// DeleteReplDeploymentAndService uploads the workspace and deletes the repl's
+// resources. Persistent workspaces stay on their volume instead of being
+// uploaded, and upload is false when the runner already synced the workspace.
+// An empty userName deletes everything, volume included, without uploading.
+// Every resource is tried, the errors of those that couldn't be deleted are
+// returned together, resources already gone don't count.
+func DeleteReplDeploymentAndService(userName, replId string, upload bool) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
 	ctx := context.Background()
 
 	bucket := dotenv.EnvString("S3_BUCKET", "devex")
 	endpoint := dotenv.EnvString("S3_ENDPOINT", "https://<account_id>.r2.cloudflarestorage.com")
 	region := dotenv.EnvString("S3_REGION", "us-east-1")
 
-	// Step 1: Upload workspace from pod to S3/R2
-	log.Info("Uploading workspace from pod to S3/R2", "repl_id", replId, "user", userName, "bucket", bucket)
+	namespace, err := replNamespace(ctx, replId)
+	if err != nil {
+		return err
+	}
+
+	persistent := false
+	if deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{}); err == nil {
+		persistent = usesWorkspaceClaim(deployment.Spec.Template.Spec)
+	}
+
+	// Step 1: Upload workspace from pod to S3/R2, unless the repl no longer
+	// exists, keeps it on its volume or the runner synced it
+	if upload && userName != "" && !persistent {
+		log.Info("Uploading workspace from pod to S3/R2", "repl_id", replId, "user", userName, "bucket", bucket)
 
-	if err := InjectEphemeralUploader(clientset, ctx, replId, userName, endpoint, bucket, region); err != nil {
-		log.Warn("Inject uploader failed", "repl_id", replId, "error", err)
-	} else {
-		log.Info("Uploaded /workspaces to S3/R2", "repl_id", replId, "user", userName, "bucket", bucket)
+		if err := InjectEphemeralUploader(clientset, ctx, namespace, replId, userName, endpoint, bucket, region); err != nil {
+			log.Warn("Inject uploader failed", "repl_id", replId, "error", err)
+		} else {
+			log.Info("Uploaded /workspaces to S3/R2", "repl_id", replId, "user", userName, "bucket", bucket)
+		}
 	}
 
 	// Step 2: Delete resources
-	middlewareRes := schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
+	var errs []error
 	for _, resource := range []struct {
 		name string
 		del  func() error
 	}{
 		{
-			name: "Middleware",
+			name: "Route",
 			del: func() error {
-				return dynamicClient.Resource(middlewareRes).Namespace("default").Delete(ctx, replId+"-stripprefix", metav1.DeleteOptions{})
+				ingress, err := getIngressBackend()
+				if err != nil {
+					return err
+				}
+				return ingress.Remove(ctx, namespace, replId)
 			},
 		},
 		{
-			name: "Ingress",
+			name: "Service",
 			del: func() error {
-				return clientset.NetworkingV1().Ingresses("default").Delete(ctx, replId+"-ingress", metav1.DeleteOptions{})
+				return clientset.CoreV1().Services(namespace).Delete(ctx, replId, metav1.DeleteOptions{})
 			},
 		},
 		{
-			name: "Service",
+			name: "Deployment",
 			del: func() error {
-				return clientset.CoreV1().Services("default").Delete(ctx, replId, metav1.DeleteOptions{})
+				return clientset.AppsV1().Deployments(namespace).Delete(ctx, replId, metav1.DeleteOptions{})
 			},
 		},
 		{
-			name: "Deployment",
+			name: "Claimed warm pod",
 			del: func() error {
-				return clientset.AppsV1().Deployments("default").Delete(ctx, replId, metav1.DeleteOptions{})
+				return clientset.CoreV1().Pods(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+					LabelSelector: replLabel + "=" + replId + "," + poolLabel,
+				})
+			},
+		},
+		{
+			name: "PersistentVolumeClaim",
+			del: func() error {
+				if userName != "" {
+					return nil
+				}
+				return clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, workspaceClaimName(replId), metav1.DeleteOptions{})
 			},
 		},
 	} {
 		err := resource.del()
+		if apierrors.IsNotFound(err) {
+			continue
+		}
 		if err != nil {
 			log.Warn("Delete resource failed", "repl_id", replId, "resource", resource.name, "error", err)
+			errs = append(errs, fmt.Errorf("failed to delete %s: %w", resource.name, err))
 		} else {
-			log.Info("Resource deleted", "repl_id", replId, "resource", resource.name)
+			log.Info("Resource deleted", "repl_id", replId, "namespace", namespace, "resource", resource.name)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-// InjectEphemeralUploader injects an ephemeral container into the running REPL pod to upload files
-func InjectEphemeralUploader(clientset *kubernetes.Clientset, ctx context.Context, replId, userName, endpoint, bucket, region string) error {
-	const namespace = "default"
+// FlushWorkspace uploads the live /workspaces of an active REPL to S3/R2 without stopping it
+func FlushWorkspace(userName, replId string) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+
+	bucket := dotenv.EnvString("S3_BUCKET", "devex")
+	endpoint := dotenv.EnvString("S3_ENDPOINT", "https://<account_id>.r2.cloudflarestorage.com")
+	region := dotenv.EnvString("S3_REGION", "us-east-1")
 
+	ctx := context.Background()
+	namespace, err := replNamespace(ctx, replId)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Flushing workspace from pod to S3/R2", "repl_id", replId, "user", userName, "bucket", bucket)
+	return InjectEphemeralUploader(clientset, ctx, namespace, replId, userName, endpoint, bucket, region)
+}
+
+// InjectEphemeralUploader injects an ephemeral container into the running REPL pod to upload files
+func InjectEphemeralUploader(clientset *kubernetes.Clientset, ctx context.Context, namespace, replId, userName, endpoint, bucket, region string) error {
 	// Fetch the target pod
-	podList, err := clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("app=%s", replId),
 	})
-	if err != nil || len(podList.Items) == 0 {
+	if err != nil {
 		return err
 	}
+	if len(podList.Items) == 0 {
+		return fmt.Errorf("no running pod found for repl: %s", replId)
+	}
 	pod := podList.Items[0]
 
+	// Ephemeral containers can't be removed or reused, so every upload gets its own name
+	containerName := fmt.Sprintf("s3-uploader-%d", time.Now().Unix())
+
 	// Prepare the ephemeral container spec
 	ephemeral := corev1.EphemeralContainer{
 		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
-			Name:    "s3-uploader",
+			Name:    containerName,
 			Image:   "amazon/aws-cli",
 			Command: []string{"sh", "-c"},
 			Args: []string{
 				fmt.Sprintf(`aws s3 cp /workspaces s3://%s/repl/%s/%s/ --recursive --endpoint-url %s --region %s`, bucket, userName, replId, endpoint, region),
 			},
 			VolumeMounts: []corev1.VolumeMount{
-				{
-					Name:      "workspace-vol",
-					MountPath: "/workspaces",
-				},
+				workspaceMount(usesWorkspaceClaim(pod.Spec)),
 			},
-			Env: awsEnvVars(),
+			Env:             awsEnvVars(),
+			SecurityContext: containerSecurityContext(false),
 		},
 		// TargetContainerName: "runner", // optional but helps in debugging
 	}
@@ -115,18 +179,17 @@ func InjectEphemeralUploader(clientset *kubernetes.Clientset, ctx context.Contex
 	}
 	log.Info("Ephemeral uploader injected into pod", "repl_id", replId, "pod", pod.Name)
 
-	if err := waitForEphemeralUpload(clientset, pod.Name); err != nil {
+	if err := waitForEphemeralUpload(clientset, namespace, pod.Name, containerName); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func waitForEphemeralUpload(clientset *kubernetes.Clientset, podName string) error {
+func waitForEphemeralUpload(clientset *kubernetes.Clientset, namespace, podName, containerName string) error {
 	const (
-		namespace = "default"
-		timeout   = 2 * time.Minute
-		interval  = 2 * time.Second
+		timeout  = 2 * time.Minute
+		interval = 2 * time.Second
 	)
 
 	start := time.Now()
@@ -137,7 +200,7 @@ func waitForEphemeralUpload(clientset *kubernetes.Clientset, podName string) err
 		}
 
 		for _, ec := range pod.Status.EphemeralContainerStatuses {
-			if ec.Name == "s3-uploader" {
+			if ec.Name == containerName {
 				if ec.State.Terminated != nil {
 					if ec.State.Terminated.ExitCode == 0 {
 						log.Info("Ephemeral container finished successfully", "pod", pod.Name)
@@ -0,0 +1,134 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"core/pkg/dotenv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	// Gateway the repls' HTTPRoutes attach to, its listeners terminate TLS
+	GATEWAY_NAME      = dotenv.EnvString("GATEWAY_NAME", "devex")
+	GATEWAY_NAMESPACE = dotenv.EnvString("GATEWAY_NAMESPACE", "default")
+)
+
+var httpRouteRes = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+
+// gatewayRoute exposes repls with Gateway API HTTPRoutes, stripping their
+// prefixes with URLRewrite filters
+type gatewayRoute struct {
+	dynamicClient dynamic.Interface
+}
+
+func (g *gatewayRoute) Name() string {
+	return "gateway"
+}
+
+// httpRouteName names the route of the repl's i-th host, HTTPRoutes only
+// match hosts for all of their rules
+func httpRouteName(replId string, i int) string {
+	if i == 0 {
+		return replId + "-route"
+	}
+	return fmt.Sprintf("%s-route-%d", replId, i)
+}
+
+func (g *gatewayRoute) Expose(ctx context.Context, route Route) error {
+	labels := map[string]interface{}{}
+	for k, v := range route.Labels {
+		labels[k] = v
+	}
+
+	for i, host := range route.Hosts() {
+		var rules []interface{}
+		for _, path := range route.Paths {
+			if path.Host != host {
+				continue
+			}
+			rule := map[string]interface{}{
+				"matches": []interface{}{
+					map[string]interface{}{
+						"path": map[string]interface{}{"type": "PathPrefix", "value": path.Prefix},
+					},
+				},
+				"backendRefs": []interface{}{
+					map[string]interface{}{"name": route.ReplId, "port": int64(path.Port)},
+				},
+			}
+			if path.Prefix != "/" {
+				rule["filters"] = []interface{}{
+					map[string]interface{}{
+						"type": "URLRewrite",
+						"urlRewrite": map[string]interface{}{
+							"path": map[string]interface{}{"type": "ReplacePrefixMatch", "replacePrefixMatch": "/"},
+						},
+					},
+				}
+			}
+			rules = append(rules, rule)
+		}
+
+		httpRoute := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "gateway.networking.k8s.io/v1",
+				"kind":       "HTTPRoute",
+				"metadata": map[string]interface{}{
+					"name":      httpRouteName(route.ReplId, i),
+					"namespace": route.Namespace,
+					"labels":    labels,
+				},
+				"spec": map[string]interface{}{
+					"parentRefs": []interface{}{
+						map[string]interface{}{"name": GATEWAY_NAME, "namespace": GATEWAY_NAMESPACE},
+					},
+					"hostnames": []interface{}{host},
+					"rules":     rules,
+				},
+			},
+		}
+
+		httpRoute.SetOwnerReferences([]metav1.OwnerReference{route.Owner})
+
+		data, err := applyPatch(httpRoute)
+		if err != nil {
+			return err
+		}
+		_, err = g.dynamicClient.Resource(httpRouteRes).Namespace(route.Namespace).Patch(ctx, httpRoute.GetName(), types.ApplyPatchType, data, applyOptions())
+		if err != nil {
+			return fmt.Errorf("failed to apply http route: %w", err)
+		}
+	}
+	return nil
+}
+
+func (g *gatewayRoute) Remove(ctx context.Context, namespace, replId string) error {
+	err := g.dynamicClient.Resource(httpRouteRes).Namespace(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: replLabel + "=" + replId,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete http routes: %w", err)
+	}
+	return nil
+}
+
+func (g *gatewayRoute) List(ctx context.Context, namespace string) (map[string]bool, error) {
+	httpRoutes, err := g.dynamicClient.Resource(httpRouteRes).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: replLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list http routes: %w", err)
+	}
+
+	routes := map[string]bool{}
+	for _, httpRoute := range httpRoutes.Items {
+		if replId := httpRoute.GetLabels()[replLabel]; replId != "" {
+			routes[replId] = true
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"core/pkg/dotenv"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// How repls are exposed: "traefik" (default), "nginx" for ingress-nginx
+	// or "gateway" for Gateway API HTTPRoutes
+	INGRESS_BACKEND = dotenv.EnvString("INGRESS_BACKEND", "traefik")
+	// Ingress class of the traefik and nginx backends, defaults to the
+	// backend's name
+	INGRESS_CLASS = dotenv.EnvString("INGRESS_CLASS", "")
+	// cert-manager issuer of the repl ingresses' certificates, empty leaves
+	// TLS to an existing tlsSecretName
+	INGRESS_CLUSTER_ISSUER = dotenv.EnvString("INGRESS_CLUSTER_ISSUER", "letsencrypt-cluster-issuer")
+)
+
+// Certificate of the runner host, copied into tenant namespaces
+const tlsSecretName = "tls-secret"
+
+// IngressBackend exposes repl services through the cluster's ingress
+// controller
+type IngressBackend interface {
+	Name() string
+	// Expose applies the objects routing the route's paths to the repl's
+	// service, owned by the route's owner. Exposing a repl again updates them.
+	Expose(ctx context.Context, route Route) error
+	// Remove deletes the repl's routing objects, missing ones are skipped
+	Remove(ctx context.Context, namespace, replId string) error
+	// List returns the repls with routing objects in the namespace, found
+	// by their repl label, true when all of them exist
+	List(ctx context.Context, namespace string) (map[string]bool, error)
+}
+
+// Route is how a repl's service is reached from outside the cluster
+type Route struct {
+	ReplId    string
+	Namespace string
+	Labels    map[string]string
+	Paths     []RoutePath
+	// Certificate of the route's hosts in the repl's namespace, requested
+	// from INGRESS_CLUSTER_ISSUER when ManagedTLS is set
+	TLSSecret  string
+	ManagedTLS bool
+	// The repl's deployment or claimed pod, the routing objects are garbage
+	// collected with it
+	Owner metav1.OwnerReference
+}
+
+// RoutePath sends requests for Host under Prefix to Port of the repl's
+// service, with the prefix stripped
+type RoutePath struct {
+	Host   string
+	Prefix string
+	Port   int32
+}
+
+// Hosts returns the route's distinct hosts, in order
+func (r Route) Hosts() []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, path := range r.Paths {
+		if !seen[path.Host] {
+			seen[path.Host] = true
+			hosts = append(hosts, path.Host)
+		}
+	}
+	return hosts
+}
+
+// getIngressBackend returns the backend selected by INGRESS_BACKEND
+func getIngressBackend() (IngressBackend, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := getDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(INGRESS_BACKEND) {
+	case "traefik":
+		return &traefikIngress{clientset: clientset, dynamicClient: dynamicClient}, nil
+	case "nginx", "ingress-nginx":
+		return &nginxIngress{clientset: clientset}, nil
+	case "gateway", "gateway-api":
+		return &gatewayRoute{dynamicClient: dynamicClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown ingress backend %q", INGRESS_BACKEND)
+	}
+}
+
+func ingressName(replId string) string {
+	return replId + "-ingress"
+}
+
+func ingressClass(backend string) string {
+	if INGRESS_CLASS != "" {
+		return INGRESS_CLASS
+	}
+	return backend
+}
+
+// ingressAnnotations are the annotations every Ingress backend sets
+func ingressAnnotations(route Route) map[string]string {
+	annotations := map[string]string{}
+	if route.ManagedTLS && INGRESS_CLUSTER_ISSUER != "" {
+		annotations["cert-manager.io/cluster-issuer"] = INGRESS_CLUSTER_ISSUER
+	}
+	return annotations
+}
+
+// ingressTLS serves the route's hosts with its certificate
+func ingressTLS(route Route) []networkingv1.IngressTLS {
+	return []networkingv1.IngressTLS{
+		{
+			Hosts:      route.Hosts(),
+			SecretName: route.TLSSecret,
+		},
+	}
+}
+
+// ingressRules groups the route's paths by host, pathFor maps a prefix to
+// the backend's path syntax
+func ingressRules(route Route, pathType networkingv1.PathType, pathFor func(prefix string) string) []networkingv1.IngressRule {
+	var rules []networkingv1.IngressRule
+	for _, host := range route.Hosts() {
+		var paths []networkingv1.HTTPIngressPath
+		for _, path := range route.Paths {
+			if path.Host != host {
+				continue
+			}
+			paths = append(paths, networkingv1.HTTPIngressPath{
+				Path:     pathFor(path.Prefix),
+				PathType: pathTypePtr(pathType),
+				Backend: networkingv1.IngressBackend{
+					Service: &networkingv1.IngressServiceBackend{
+						Name: route.ReplId,
+						Port: networkingv1.ServiceBackendPort{
+							Number: path.Port,
+						},
+					},
+				},
+			})
+		}
+		rules = append(rules, networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{Paths: paths},
+			},
+		})
+	}
+	return rules
+}
+
+var ingressTypeMeta = metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "Ingress"}
+
+// ingressMeta names the route's Ingress, owned by the route's owner
+func ingressMeta(route Route, annotations map[string]string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            ingressName(route.ReplId),
+		Namespace:       route.Namespace,
+		Labels:          route.Labels,
+		Annotations:     annotations,
+		OwnerReferences: []metav1.OwnerReference{route.Owner},
+	}
+}
+
+// applyIngress applies the Ingress of the traefik and nginx backends
+func applyIngress(ctx context.Context, clientset *kubernetes.Clientset, ingress *networkingv1.Ingress) error {
+	data, err := applyPatch(ingress)
+	if err != nil {
+		return err
+	}
+	_, err = clientset.NetworkingV1().Ingresses(ingress.Namespace).Patch(ctx, ingress.Name, types.ApplyPatchType, data, applyOptions())
+	if err != nil {
+		return fmt.Errorf("failed to apply ingress: %w", err)
+	}
+	return nil
+}
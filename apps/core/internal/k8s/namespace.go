@@ -0,0 +1,427 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "packages/logging"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"core/pkg/dotenv"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var (
+	// Where repls run: "shared" (all in REPL_NAMESPACE), "user" (one namespace
+	// per user) or "org" (one per organization, users without one get their own)
+	NAMESPACE_STRATEGY = dotenv.EnvString("NAMESPACE_STRATEGY", "shared")
+	// The shared namespace, it also holds the secrets copied into tenant namespaces
+	REPL_NAMESPACE   = dotenv.EnvString("REPL_NAMESPACE", "default")
+	NAMESPACE_PREFIX = dotenv.EnvString("NAMESPACE_PREFIX", "devex-")
+	// Namespace of the ingress controller, the only source allowed to reach repl pods
+	INGRESS_NAMESPACE = dotenv.EnvString("INGRESS_NAMESPACE", "traefik")
+	// Comma separated ranges repl pods can't reach, covering the pod and service
+	// networks (and with them core and other tenants)
+	BLOCKED_CIDRS = dotenv.EnvString("BLOCKED_CIDRS", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16")
+)
+
+const (
+	// Set on every object of a repl, and on the pods the deployment creates
+	replLabel = "devex.io/repl"
+	// Set on the namespaces core created
+	managedLabel = "devex.io/managed"
+	// Runner version of a repl's deployment, see models.Template.Version
+	runnerVersionAnnotation = "devex.io/runner-version"
+
+	networkPolicyName = "repl-isolation"
+)
+
+// Secrets copied from REPL_NAMESPACE into tenant namespaces, secretKeyRefs and
+// ingress TLS can only use secrets of their own namespace
+var tenantSecrets = []struct {
+	name     string
+	optional bool
+}{
+	{name: "aws-creds"},
+	{name: tlsSecretName, optional: true},
+	{name: WILDCARD_TLS_SECRET, optional: true},
+}
+
+var (
+	ensuredMu sync.Mutex
+	// When each namespace was last ensured, PruneNamespaces keeps namespaces
+	// a create may still be filling
+	ensured    = map[string]time.Time{}
+	invalidDNS = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// TenantNamespace is the namespace new repls of the user are created in
+func TenantNamespace(userName, org string) string {
+	switch strings.ToLower(NAMESPACE_STRATEGY) {
+	case "user":
+		return namespaceName("user-" + userName)
+	case "org":
+		if org != "" {
+			return namespaceName("org-" + org)
+		}
+		return namespaceName("user-" + userName)
+	default:
+		return REPL_NAMESPACE
+	}
+}
+
+// namespaceName turns a tenant into a DNS label. Names that had to be changed
+// get a hash suffix, so "a.b" and "a-b" don't share a namespace.
+func namespaceName(tenant string) string {
+	name := strings.Trim(invalidDNS.ReplaceAllString(strings.ToLower(tenant), "-"), "-")
+	if name == tenant && len(NAMESPACE_PREFIX+name) <= 63 {
+		return NAMESPACE_PREFIX + name
+	}
+
+	sum := sha256.Sum256([]byte(tenant))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if max := 63 - len(NAMESPACE_PREFIX) - len(suffix); len(name) > max {
+		name = strings.TrimRight(name[:max], "-")
+	}
+	return NAMESPACE_PREFIX + name + suffix
+}
+
+// EnsureNamespace creates the tenant namespace with its secrets and the
+// isolation policy. It's called before every create, so it only talks to the
+// cluster the first time a namespace is seen, or again once forgetNamespace
+// found it gone.
+func EnsureNamespace(namespace string) error {
+	ensuredMu.Lock()
+	defer ensuredMu.Unlock()
+	if _, ok := ensured[namespace]; ok {
+		ensured[namespace] = time.Now()
+		return nil
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if namespace != REPL_NAMESPACE {
+		ns := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   namespace,
+				Labels: map[string]string{managedLabel: "true"},
+			},
+		}
+		_, err := clientset.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Nothing can be created in a namespace that's being deleted
+			existing, getErr := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if getErr != nil {
+				return fmt.Errorf("failed to get namespace: %w", getErr)
+			}
+			if existing.DeletionTimestamp != nil {
+				return fmt.Errorf("namespace %s is being deleted, try again shortly", namespace)
+			}
+		} else if err != nil {
+			return fmt.Errorf("failed to create namespace: %w", err)
+		}
+
+		for _, secret := range tenantSecrets {
+			if err := copySecret(ctx, secret.name, namespace); err != nil {
+				if secret.optional && apierrors.IsNotFound(err) {
+					continue
+				}
+				return fmt.Errorf("failed to copy secret %s: %w", secret.name, err)
+			}
+		}
+	}
+
+	if err := applyNetworkPolicy(ctx, namespace); err != nil {
+		return fmt.Errorf("failed to create network policy: %w", err)
+	}
+
+	log.Info("Namespace ready", "namespace", namespace, "strategy", NAMESPACE_STRATEGY)
+	ensured[namespace] = time.Now()
+	return nil
+}
+
+// forgetNamespace drops the namespace from the ensured ones when err shows
+// it's gone or going, deleted by hand or by PruneNamespaces, so the next
+// EnsureNamespace sets it up again instead of every create failing
+func forgetNamespace(namespace string, err error) {
+	if !apierrors.IsNotFound(err) && !apierrors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+		return
+	}
+	ensuredMu.Lock()
+	defer ensuredMu.Unlock()
+	if _, ok := ensured[namespace]; ok {
+		log.Warn("Namespace gone, ensuring it again on the next create", "namespace", namespace, "error", err)
+		delete(ensured, namespace)
+	}
+}
+
+// PruneNamespaces deletes the tenant namespaces core created that hold no
+// workloads or volumes anymore, like those of users who deleted their last
+// repl. Namespaces created or ensured within minAge are kept, a create may
+// still be filling them. It returns the deleted namespaces.
+func PruneNamespaces(minAge time.Duration) ([]string, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: managedLabel + "=true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+
+	// Held throughout, so no create ensures a namespace while it's deleted
+	ensuredMu.Lock()
+	defer ensuredMu.Unlock()
+
+	var deleted []string
+	for _, ns := range list.Items {
+		if ns.Name == REPL_NAMESPACE || ns.DeletionTimestamp != nil || time.Since(ns.CreationTimestamp.Time) < minAge {
+			continue
+		}
+		if at, ok := ensured[ns.Name]; ok && time.Since(at) < minAge {
+			continue
+		}
+
+		empty, err := namespaceEmpty(ctx, ns.Name)
+		if err != nil {
+			return deleted, err
+		}
+		if !empty {
+			continue
+		}
+
+		if err := clientset.CoreV1().Namespaces().Delete(ctx, ns.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return deleted, fmt.Errorf("failed to delete namespace %s: %w", ns.Name, err)
+		}
+		delete(ensured, ns.Name)
+		deleted = append(deleted, ns.Name)
+		log.Info("Namespace deleted", "namespace", ns.Name, "reason", "no repls left")
+	}
+	return deleted, nil
+}
+
+// namespaceEmpty reports whether the namespace has no deployments, pods,
+// services or volume claims, labelled as a repl's or not
+func namespaceEmpty(ctx context.Context, namespace string) (bool, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return false, err
+	}
+	opts := metav1.ListOptions{Limit: 1}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to list deployments: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to list pods: %w", err)
+	}
+	services, err := clientset.CoreV1().Services(namespace).List(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to list services: %w", err)
+	}
+	claims, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to list persistent volume claims: %w", err)
+	}
+	return len(deployments.Items)+len(pods.Items)+len(services.Items)+len(claims.Items) == 0, nil
+}
+
+// copySecret copies a secret of REPL_NAMESPACE, replacing an older copy so
+// rotated credentials reach the tenants when core restarts
+func copySecret(ctx context.Context, name, namespace string) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+
+	source, err := clientset.CoreV1().Secrets(REPL_NAMESPACE).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{managedLabel: "true"},
+		},
+		Type: source.Type,
+		Data: source.Data,
+	}
+
+	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// applyNetworkPolicy denies all traffic to and from repl pods except requests
+// from the ingress controller, DNS, and egress to addresses outside
+// BLOCKED_CIDRS. Repls can't reach each other, core or other cluster services.
+func applyNetworkPolicy(ctx context.Context, namespace string) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+
+	var blocked []string
+	for _, cidr := range strings.Split(BLOCKED_CIDRS, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			blocked = append(blocked, cidr)
+		}
+	}
+
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      networkPolicyName,
+			Namespace: namespace,
+			Labels:    map[string]string{managedLabel: "true"},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			// Only repl pods, the shared namespace may run other workloads
+			PodSelector: metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: replLabel, Operator: metav1.LabelSelectorOpExists},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+				networkingv1.PolicyTypeEgress,
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"kubernetes.io/metadata.name": INGRESS_NAMESPACE},
+							},
+						},
+					},
+				},
+			},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &udp, Port: &dns},
+						{Protocol: &tcp, Port: &dns},
+					},
+					To: []networkingv1.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"},
+							},
+						},
+					},
+				},
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						{
+							IPBlock: &networkingv1.IPBlock{
+								CIDR:   "0.0.0.0/0",
+								Except: blocked,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	policies := clientset.NetworkingV1().NetworkPolicies(namespace)
+	_, err = policies.Create(ctx, policy, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = policies.Update(ctx, policy, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// replNamespaces are the namespaces repls may run in
+func replNamespaces(ctx context.Context) ([]string, error) {
+	namespaces := []string{REPL_NAMESPACE}
+	if strings.ToLower(NAMESPACE_STRATEGY) == "shared" {
+		return namespaces, nil
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: managedLabel + "=true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	for _, ns := range list.Items {
+		if ns.Name != REPL_NAMESPACE {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	return namespaces, nil
+}
+
+// replNamespace finds the namespace holding the repl's objects. Repls that
+// can't be found, including ones created before objects were labelled, are
+// looked for in REPL_NAMESPACE.
+func replNamespace(ctx context.Context, replId string) (string, error) {
+	if strings.ToLower(NAMESPACE_STRATEGY) == "shared" {
+		return REPL_NAMESPACE, nil
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return "", err
+	}
+	opts := metav1.ListOptions{LabelSelector: replLabel + "=" + replId}
+
+	// A failed create or delete may have left only some of the objects
+	deployments, err := clientset.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to find repl namespace: %w", err)
+	}
+	if len(deployments.Items) > 0 {
+		return deployments.Items[0].Namespace, nil
+	}
+
+	services, err := clientset.CoreV1().Services(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to find repl namespace: %w", err)
+	}
+	if len(services.Items) > 0 {
+		return services.Items[0].Namespace, nil
+	}
+
+	ingresses, err := clientset.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to find repl namespace: %w", err)
+	}
+	if len(ingresses.Items) > 0 {
+		return ingresses.Items[0].Namespace, nil
+	}
+
+	return REPL_NAMESPACE, nil
+}
@@ -0,0 +1,73 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nginxIngress strips the repl's prefixes with ingress-nginx's regex paths
+// and rewrite-target
+type nginxIngress struct {
+	clientset *kubernetes.Clientset
+}
+
+func (n *nginxIngress) Name() string {
+	return "nginx"
+}
+
+// nginxPath captures the rest of the path after the prefix in $2
+func nginxPath(prefix string) string {
+	if prefix == "/" {
+		return "/()(.*)"
+	}
+	return prefix + "(/|$)(.*)"
+}
+
+func (n *nginxIngress) Expose(ctx context.Context, route Route) error {
+	annotations := ingressAnnotations(route)
+	annotations["nginx.ingress.kubernetes.io/use-regex"] = "true"
+	annotations["nginx.ingress.kubernetes.io/rewrite-target"] = "/$2"
+	// Terminals and the editor keep their websocket open for the whole session
+	annotations["nginx.ingress.kubernetes.io/proxy-read-timeout"] = "3600"
+	annotations["nginx.ingress.kubernetes.io/proxy-send-timeout"] = "3600"
+
+	ingress := &networkingv1.Ingress{
+		TypeMeta:   ingressTypeMeta,
+		ObjectMeta: ingressMeta(route, annotations),
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: strPtr(ingressClass(n.Name())),
+			TLS:              ingressTLS(route),
+			Rules:            ingressRules(route, networkingv1.PathTypeImplementationSpecific, nginxPath),
+		},
+	}
+
+	return applyIngress(ctx, n.clientset, ingress)
+}
+
+func (n *nginxIngress) Remove(ctx context.Context, namespace, replId string) error {
+	err := n.clientset.NetworkingV1().Ingresses(namespace).Delete(ctx, ingressName(replId), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete ingress: %w", err)
+	}
+	return nil
+}
+
+func (n *nginxIngress) List(ctx context.Context, namespace string) (map[string]bool, error) {
+	ingresses, err := n.clientset.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{LabelSelector: replLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ingresses: %w", err)
+	}
+
+	routes := map[string]bool{}
+	for _, ingress := range ingresses.Items {
+		if replId := ingress.Labels[replLabel]; replId != "" {
+			routes[replId] = true
+		}
+	}
+	return routes, nil
+}
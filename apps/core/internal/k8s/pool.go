@@ -0,0 +1,359 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "packages/logging"
+	"strconv"
+	"time"
+
+	"core/internal/runnersync"
+	"core/models"
+	"core/pkg/dotenv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+var (
+	// Idle runners kept started per template, a template's warmPool overrides it
+	WARM_POOL_SIZE, _ = strconv.Atoi(dotenv.EnvString("WARM_POOL_SIZE", "0"))
+	// Time between refills of the warm pools
+	WARM_POOL_INTERVAL, _ = time.ParseDuration(dotenv.EnvString("WARM_POOL_INTERVAL", "30s"))
+)
+
+const (
+	// Template of a warm pool pod. Claimed pods keep it, telling them apart
+	// from the pods of deployments.
+	poolLabel = "devex.io/pool"
+	// Hash of what the pod was started with, pods are only claimed for repls
+	// whose resolved template has the same one
+	poolConfigAnnotation = "devex.io/pool-config"
+	// How long a claimed runner may take to restore the workspace
+	claimTimeout = 2 * time.Minute
+)
+
+// warmPoolSize is how many idle runners the template keeps. Persistent
+// workspaces need their volume from the start and restoring needs workspace
+// sync, so they get none.
+func warmPoolSize(config models.Template) int {
+	if config.Storage == models.StoragePersistent || !runnersync.Enabled() {
+		return 0
+	}
+	if config.WarmPool != nil {
+		return *config.WarmPool
+	}
+	return WARM_POOL_SIZE
+}
+
+// poolConfig hashes everything that ends up in a runner pod's spec
+func poolConfig(config models.Template) string {
+	data, _ := json.Marshal(struct {
+		Image        string
+		Port         int32
+		Ports        []int32
+		Run          string
+		Entrypoint   string
+		Resources    models.TemplateResources
+		Security     models.SecurityProfile
+		RuntimeClass string
+		MCPImage     string
+	}{
+		Image:        config.ImageRef(),
+		Port:         config.Port,
+		Ports:        config.Ports,
+		Run:          config.Run,
+		Entrypoint:   config.Entrypoint,
+		Resources:    config.Resources,
+		Security:     config.Security,
+		RuntimeClass: config.RuntimeClass,
+		MCPImage:     map[bool]string{true: MCP_IMAGE}[ENABLE_MCP_SIDECAR],
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// KeepWarm refills the warm pools of the templates every WARM_POOL_INTERVAL
+// until the context is done
+func KeepWarm(ctx context.Context, templates func() []models.Template) {
+	if WARM_POOL_INTERVAL <= 0 {
+		log.Info("Warm pools disabled")
+		return
+	}
+
+	ticker := time.NewTicker(WARM_POOL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := FillWarmPools(templates()); err != nil {
+			log.Error("Fill warm pools failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// FillWarmPools starts the missing idle runners of every template in
+// REPL_NAMESPACE, and deletes idle runners that are failed, surplus or were
+// started from an older template
+func FillWarmPools(configs []models.Template) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	namespace := REPL_NAMESPACE
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: poolLabel})
+	if err != nil {
+		return fmt.Errorf("failed to list warm pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		empty := true
+		for _, config := range configs {
+			if warmPoolSize(config) > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			return nil
+		}
+	}
+
+	if err := EnsureNamespace(namespace); err != nil {
+		return err
+	}
+
+	wanted := map[string]models.Template{}
+	for _, config := range configs {
+		wanted[config.Key] = config
+	}
+
+	idle := map[string]int{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		key := pod.Labels[poolLabel]
+		if pod.Labels[replLabel] != "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		config, ok := wanted[key]
+		failed := pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded
+		if !ok || failed || pod.Annotations[poolConfigAnnotation] != poolConfig(config) || idle[key] >= warmPoolSize(config) {
+			if err := clientset.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				log.Warn("Delete warm pod failed", "pod", pod.Name, "error", err)
+			}
+			continue
+		}
+		idle[key]++
+	}
+
+	for _, config := range configs {
+		for n := idle[config.Key]; n < warmPoolSize(config); n++ {
+			pod, err := clientset.CoreV1().Pods(namespace).Create(ctx, warmPod(config), metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to create warm pod for %s: %w", config.Key, err)
+			}
+			log.Info("Warm pod created", "pod", pod.Name, "template", config.Key, "version", config.Version)
+		}
+	}
+	return nil
+}
+
+// warmPod runs the template's runner without a workspace. Its repl id is the
+// pod's name until core claims it, the name is picked here rather than by the
+// API server so the runner's token key can be derived from it.
+func warmPod(config models.Template) *corev1.Pod {
+	name := "warm-" + config.Key + "-" + utilrand.String(5)
+	replIdEnv := corev1.EnvVar{Name: "REPL_ID", Value: name}
+	env := append([]corev1.EnvVar{
+		{Name: "WARM_POOL", Value: "true"},
+		{Name: "CORE_URL", Value: runnersync.RUNNER_CORE_URL},
+		{Name: "SYNC_INTERVAL", Value: runnersync.RUNNER_SYNC_INTERVAL},
+	}, runnerTokenEnvVars(name)...)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"template": config.Key,
+				poolLabel:  config.Key,
+				// Empty until claimed, but set so the repl NetworkPolicy applies
+				replLabel: "",
+			},
+			Annotations: map[string]string{
+				poolConfigAnnotation:    poolConfig(config),
+				runnerVersionAnnotation: config.Version,
+			},
+		},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				workspaceVolume("", config),
+			},
+			Containers: runnerContainers(replIdEnv, config, false, env),
+		},
+	}
+
+	// Only runners that answer are claimed
+	pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: "/ping", Port: intstr.FromInt(int(config.Port))},
+		},
+		PeriodSeconds: 2,
+	}
+
+	secureReplPod(&pod.Spec, config)
+	return pod
+}
+
+// ClaimWarmPod hands an idle runner of the template to the repl: the pod is
+// relabelled so the repl's service selects it, the repl is routed to it and
+// the runner restores the workspace. It reports false when there is no
+// matching idle runner or the repl already has a deployment, and cleans up
+// after a failed claim so the caller can fall back to
+// CreateReplDeploymentAndService. A repl that already claimed a pod keeps it,
+// only its service and route are applied again.
+func ClaimWarmPod(namespace, userName, replId string, config models.Template) (bool, error) {
+	if namespace != REPL_NAMESPACE || warmPoolSize(config) == 0 {
+		return false, nil
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return false, err
+	}
+	ingress, err := getIngressBackend()
+	if err != nil {
+		return false, err
+	}
+	ctx := context.Background()
+	hash := poolConfig(config)
+
+	if pod, err := claimedPod(ctx, namespace, replId); err != nil {
+		return false, err
+	} else if pod != nil {
+		owner := ownerReference("v1", "Pod", pod)
+		return true, exposeRepl(ctx, clientset, ingress, namespace, replId, claimedLabels(replId, config), claimedObjectLabels(replId, config), owner, config)
+	}
+	if _, err := clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{}); err == nil {
+		return false, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: poolLabel + "=" + config.Key,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list warm pods: %w", err)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Labels[replLabel] != "" || pod.DeletionTimestamp != nil || pod.Annotations[poolConfigAnnotation] != hash || !podReady(pod) {
+			continue
+		}
+		poolId := pod.Name
+
+		// The update fails on a stale resourceVersion, so only one core
+		// claims each pod
+		pod.Labels["app"] = replId
+		pod.Labels[replLabel] = replId
+		claimed, err := clientset.CoreV1().Pods(namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("failed to claim warm pod: %w", err)
+		}
+
+		if err := startClaimed(ctx, namespace, userName, replId, claimed, config); err != nil {
+			if err := DeleteReplDeploymentAndService("", replId, false); err != nil {
+				log.Warn("Clean up claimed warm pod failed", "repl_id", replId, "pod", poolId, "error", err)
+			}
+			return false, err
+		}
+
+		log.Info("Warm pod claimed", "repl_id", replId, "pod", poolId, "namespace", namespace, "template", config.Key, "ingress", ingress.Name())
+		return true, nil
+	}
+
+	log.Info("No warm pod available", "repl_id", replId, "template", config.Key)
+	return false, nil
+}
+
+// startClaimed routes the repl to its claimed pod and has the runner restore
+// the workspace
+func startClaimed(ctx context.Context, namespace, userName, replId string, pod *corev1.Pod, config models.Template) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	ingress, err := getIngressBackend()
+	if err != nil {
+		return err
+	}
+
+	owner := ownerReference("v1", "Pod", pod)
+	if err := exposeRepl(ctx, clientset, ingress, namespace, replId, claimedLabels(replId, config), claimedObjectLabels(replId, config), owner, config); err != nil {
+		return err
+	}
+
+	syncToken, err := runnersync.Sign(userName, replId)
+	if err != nil {
+		return fmt.Errorf("failed to sign sync token: %w", err)
+	}
+	return runnersync.Claim(ReplURL(replId), pod.Name, replId, syncToken, claimTimeout)
+}
+
+// claimedLabels select a claimed pod, like a deployment's pods
+func claimedLabels(replId string, config models.Template) map[string]string {
+	return map[string]string{
+		"app":      replId,
+		"template": config.Key,
+	}
+}
+
+func claimedObjectLabels(replId string, config models.Template) map[string]string {
+	labels := claimedLabels(replId, config)
+	labels[replLabel] = replId
+	return labels
+}
+
+// claimedPod returns the warm pool pod the repl claimed, if any
+func claimedPod(ctx context.Context, namespace, replId string) (*corev1.Pod, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: replLabel + "=" + replId + "," + poolLabel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list claimed pods: %w", err)
+	}
+	for i := range pods.Items {
+		if pods.Items[i].DeletionTimestamp == nil {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,252 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	log "packages/logging"
+	"strings"
+	"time"
+
+	"core/models"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Waiting reasons that won't resolve by waiting longer
+var fatalWaitingReasons = map[string]models.FailureCode{
+	"ImagePullBackOff":           models.FailureImagePull,
+	"InvalidImageName":           models.FailureImagePull,
+	"ErrImageNeverPull":          models.FailureImagePull,
+	"CrashLoopBackOff":           models.FailureCrashLoop,
+	"CreateContainerConfigError": models.FailureConfig,
+	"CreateContainerError":       models.FailureConfig,
+}
+
+// WaitForRepl watches the repl's pod and its events until the pod is ready.
+// It returns a *models.ReplFailure as soon as the pod can't start, or with
+// the last warning seen when it isn't ready within timeout.
+func WaitForRepl(replId string, timeout time.Duration) error {
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	namespace, err := replNamespace(ctx, replId)
+	if err != nil {
+		return err
+	}
+
+	w := &podWatch{clientset: clientset, namespace: namespace, replId: replId}
+	for {
+		ready, err := w.run(ctx)
+		if ready || err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return w.timeoutFailure(timeout)
+		}
+		// The API server closed a watch, start over from a fresh list
+	}
+}
+
+type podWatch struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	replId    string
+	// Last warning event of the repl's pods, explains a timeout
+	lastWarning *corev1.Event
+}
+
+func (w *podWatch) podOptions() metav1.ListOptions {
+	return metav1.ListOptions{LabelSelector: "app=" + w.replId}
+}
+
+// run lists the repl's pods, then watches them and the namespace's pod
+// events until a pod is ready, fails, or a watch ends
+func (w *podWatch) run(ctx context.Context) (bool, error) {
+	pods, err := w.clientset.CoreV1().Pods(w.namespace).List(ctx, w.podOptions())
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list pods: %w", err)
+	}
+	for i := range pods.Items {
+		if ready, err := checkPod(&pods.Items[i]); ready || err != nil {
+			return ready, err
+		}
+	}
+
+	podOpts := w.podOptions()
+	podOpts.ResourceVersion = pods.ResourceVersion
+	podWatcher, err := w.clientset.CoreV1().Pods(w.namespace).Watch(ctx, podOpts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to watch pods: %w", err)
+	}
+	defer podWatcher.Stop()
+
+	// Events are only for the warning on timeout, the pods can be watched without them
+	var events <-chan watch.Event
+	eventWatcher, err := w.clientset.CoreV1().Events(w.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: "involvedObject.kind=Pod",
+	})
+	if err != nil {
+		log.Warn("Watch pod events failed", "repl_id", w.replId, "namespace", w.namespace, "error", err)
+	} else {
+		defer eventWatcher.Stop()
+		events = eventWatcher.ResultChan()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+
+		case event, ok := <-podWatcher.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok || event.Type == watch.Deleted {
+				continue
+			}
+			if ready, err := checkPod(pod); ready || err != nil {
+				return ready, err
+			}
+
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if e, ok := event.Object.(*corev1.Event); ok {
+				w.observe(e)
+			}
+		}
+	}
+}
+
+func (w *podWatch) observe(event *corev1.Event) {
+	if event.Type != corev1.EventTypeWarning || !strings.HasPrefix(event.InvolvedObject.Name, w.replId+"-") {
+		return
+	}
+	log.Debug("Repl pod warning", "repl_id", w.replId, "reason", event.Reason, "message", event.Message)
+	w.lastWarning = event
+}
+
+// timeoutFailure explains a pod that never became ready with its last warning
+func (w *podWatch) timeoutFailure(timeout time.Duration) error {
+	failure := &models.ReplFailure{
+		Code:    models.FailureTimeout,
+		Message: fmt.Sprintf("workspace not ready after %s", timeout),
+	}
+	if w.lastWarning != nil {
+		failure.Message = fmt.Sprintf("%s: %s", w.lastWarning.Reason, w.lastWarning.Message)
+		switch w.lastWarning.Reason {
+		case "FailedScheduling":
+			failure.Code = models.FailureUnschedulable
+		case "Failed", "ErrImagePull":
+			if strings.Contains(strings.ToLower(w.lastWarning.Message), "image") {
+				failure.Code = models.FailureImagePull
+			}
+		}
+	}
+	return failure
+}
+
+// checkPod reports whether the pod is ready, or why it will never be
+func checkPod(pod *corev1.Pod) (bool, error) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return true, nil
+		}
+	}
+
+	if pod.Status.Phase == corev1.PodFailed {
+		return false, &models.ReplFailure{
+			Code:    models.FailureCrashLoop,
+			Message: fmt.Sprintf("pod failed: %s %s", pod.Status.Reason, pod.Status.Message),
+		}
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if err := initContainerFailure(status); err != nil {
+			return false, err
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if err := containerFailure(status); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func initContainerFailure(status corev1.ContainerStatus) error {
+	code := models.FailureInitContainer
+	if status.Name == "s3-downloader" {
+		code = models.FailureS3Download
+	}
+
+	if t := status.State.Terminated; t != nil && t.ExitCode != 0 {
+		return &models.ReplFailure{
+			Code:    code,
+			Message: fmt.Sprintf("init container %s exited with code %d: %s", status.Name, t.ExitCode, terminationMessage(t)),
+		}
+	}
+	if w := status.State.Waiting; w != nil {
+		if fatal, ok := fatalWaitingReasons[w.Reason]; ok {
+			if fatal == models.FailureCrashLoop {
+				fatal = code
+			}
+			return &models.ReplFailure{
+				Code:    fatal,
+				Message: fmt.Sprintf("init container %s: %s: %s", status.Name, w.Reason, w.Message),
+			}
+		}
+	}
+	return nil
+}
+
+func containerFailure(status corev1.ContainerStatus) error {
+	if t := status.State.Terminated; t != nil && t.Reason == "OOMKilled" {
+		return oomFailure(status.Name)
+	}
+	if w := status.State.Waiting; w != nil {
+		code, ok := fatalWaitingReasons[w.Reason]
+		if !ok {
+			return nil
+		}
+		if t := status.LastTerminationState.Terminated; code == models.FailureCrashLoop && t != nil && t.Reason == "OOMKilled" {
+			return oomFailure(status.Name)
+		}
+		return &models.ReplFailure{
+			Code:    code,
+			Message: fmt.Sprintf("container %s: %s: %s", status.Name, w.Reason, w.Message),
+		}
+	}
+	return nil
+}
+
+func oomFailure(container string) error {
+	return &models.ReplFailure{
+		Code:    models.FailureOOMKilled,
+		Message: fmt.Sprintf("container %s ran out of memory", container),
+	}
+}
+
+func terminationMessage(t *corev1.ContainerStateTerminated) string {
+	if t.Message != "" {
+		return t.Message
+	}
+	return t.Reason
+}
@@ -0,0 +1,80 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"core/models"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func waiting(name, reason string) corev1.ContainerStatus {
+	return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: reason},
+	}}
+}
+
+func terminated(reason string, exitCode int32) corev1.ContainerState {
+	return corev1.ContainerState{
+		Terminated: &corev1.ContainerStateTerminated{Reason: reason, ExitCode: exitCode},
+	}
+}
+
+func TestCheckPod(t *testing.T) {
+	crashed := waiting("runner", "CrashLoopBackOff")
+	crashed.LastTerminationState = terminated("OOMKilled", 137)
+
+	tests := []struct {
+		name  string
+		pod   corev1.PodStatus
+		ready bool
+		code  models.FailureCode
+	}{
+		{"ready", corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}}, true, ""},
+		{"starting", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{waiting("runner", "ContainerCreating")}}, false, ""},
+		{"pod failed", corev1.PodStatus{Phase: corev1.PodFailed}, false, models.FailureCrashLoop},
+		{"image pull", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{waiting("runner", "ImagePullBackOff")}}, false, models.FailureImagePull},
+		{"crash loop", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{waiting("runner", "CrashLoopBackOff")}}, false, models.FailureCrashLoop},
+		{"crash loop after oom", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{crashed}}, false, models.FailureOOMKilled},
+		{"oom killed", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: "runner", State: terminated("OOMKilled", 137)}}}, false, models.FailureOOMKilled},
+		{"config error", corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{waiting("runner", "CreateContainerConfigError")}}, false, models.FailureConfig},
+		{"download failed", corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{Name: "s3-downloader", State: terminated("Error", 1)}}}, false, models.FailureS3Download},
+		{"download crash loop", corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{waiting("s3-downloader", "CrashLoopBackOff")}}, false, models.FailureS3Download},
+		{"init container failed", corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{Name: "setup", State: terminated("Error", 2)}}}, false, models.FailureInitContainer},
+		{"init image pull", corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{waiting("s3-downloader", "ErrImageNeverPull")}}, false, models.FailureImagePull},
+	}
+	for _, tt := range tests {
+		ready, err := checkPod(&corev1.Pod{Status: tt.pod})
+		var failure *models.ReplFailure
+		if errors.As(err, &failure) != (tt.code != "") {
+			t.Errorf("%s: error %v, want failure %q", tt.name, err, tt.code)
+			continue
+		}
+		if ready != tt.ready || (failure != nil && failure.Code != tt.code) {
+			t.Errorf("%s: ready %v, failure %+v, want %v, %q", tt.name, ready, failure, tt.ready, tt.code)
+		}
+	}
+}
+
+func TestTimeoutFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		warning *corev1.Event
+		code    models.FailureCode
+	}{
+		{"no warning", nil, models.FailureTimeout},
+		{"unschedulable", &corev1.Event{Reason: "FailedScheduling", Message: "0/3 nodes are available"}, models.FailureUnschedulable},
+		{"image pull", &corev1.Event{Reason: "Failed", Message: "Failed to pull image \"runner:v9\""}, models.FailureImagePull},
+		{"other failure", &corev1.Event{Reason: "Failed", Message: "Error: context deadline exceeded"}, models.FailureTimeout},
+		{"probe", &corev1.Event{Reason: "Unhealthy", Message: "Readiness probe failed"}, models.FailureTimeout},
+	}
+	for _, tt := range tests {
+		w := &podWatch{replId: "repl-1", lastWarning: tt.warning}
+		var failure *models.ReplFailure
+		if err := w.timeoutFailure(time.Minute); !errors.As(err, &failure) || failure.Code != tt.code {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	// "path" serves every repl under https://RUNNER_CLUSTER_IP/<replId>,
+	// "subdomain" gives each repl its own host under RUNNER_DOMAIN
+	ROUTING_MODE = dotenv.EnvString("ROUTING_MODE", "path")
+	// Parent domain of the repl hosts, with a wildcard DNS record pointing at
+	// the ingress
+	RUNNER_DOMAIN = dotenv.EnvString("RUNNER_DOMAIN", "")
+	// Certificate for *.RUNNER_DOMAIN, issued outside of core since wildcard
+	// certificates need a DNS-01 challenge
+	WILDCARD_TLS_SECRET = dotenv.EnvString("WILDCARD_TLS_SECRET", "wildcard-tls")
+)
+
+func subdomainRouting() bool {
+	return strings.ToLower(ROUTING_MODE) == "subdomain" && RUNNER_DOMAIN != ""
+}
+
+// ReplURL is the runner's base URL
+func ReplURL(replId string) string {
+	if subdomainRouting() {
+		return fmt.Sprintf("https://%s.%s", replId, RUNNER_DOMAIN)
+	}
+	return fmt.Sprintf("https://%s/%s", RUNNER_CLUSTER_IP, replId)
+}
+
+// PortURL is where the user's app listening on port is reached, its own host
+// with subdomain routing and the runner's /user-app/ proxy otherwise
+func PortURL(replId string, port int32) string {
+	if subdomainRouting() {
+		return fmt.Sprintf("https://%d-%s.%s", port, replId, RUNNER_DOMAIN)
+	}
+	return fmt.Sprintf("%s/user-app/%d/", ReplURL(replId), port)
+}
+
+// replRoute is how the repl's service is exposed in the current routing mode
+func replRoute(namespace, replId string, labels map[string]string, config models.Template) Route {
+	route := Route{
+		ReplId:     replId,
+		Namespace:  namespace,
+		Labels:     labels,
+		TLSSecret:  tlsSecretName,
+		ManagedTLS: true,
+	}
+
+	if !subdomainRouting() {
+		route.Paths = []RoutePath{
+			{Host: RUNNER_CLUSTER_IP, Prefix: "/" + replId, Port: config.Port},
+		}
+		if ENABLE_MCP_SIDECAR {
+			route.Paths = append(route.Paths, RoutePath{Host: RUNNER_CLUSTER_IP, Prefix: "/mcp/" + replId, Port: 8080})
+		}
+		return route
+	}
+
+	host := replId + "." + RUNNER_DOMAIN
+	route.TLSSecret = WILDCARD_TLS_SECRET
+	route.ManagedTLS = false
+	route.Paths = []RoutePath{
+		{Host: host, Prefix: "/", Port: config.Port},
+	}
+	if ENABLE_MCP_SIDECAR {
+		route.Paths = append(route.Paths, RoutePath{Host: host, Prefix: "/mcp", Port: 8080})
+	}
+	for _, port := range config.Ports {
+		route.Paths = append(route.Paths, RoutePath{
+			Host:   fmt.Sprintf("%d-%s.%s", port, replId, RUNNER_DOMAIN),
+			Prefix: "/",
+			Port:   port,
+		})
+	}
+	return route
+}
+
+// appServicePorts expose the user's app ports on the repl's service, for the
+// hosts of subdomain routing
+func appServicePorts(config models.Template) []int32 {
+	if !subdomainRouting() {
+		return nil
+	}
+	return config.Ports
+}
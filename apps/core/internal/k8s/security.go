@@ -0,0 +1,77 @@
+package k8s
+
+import (
+	"core/models"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Every repl container runs as this user, the workspace volume is
+	// group-owned by it
+	runnerUID int64 = 1000
+	// Writable home of the runner, shells and package managers keep their
+	// caches there
+	runnerHome = "/home/devex"
+)
+
+// podSecurityContext runs the whole pod, sidecars included, as runnerUID
+// under the RuntimeDefault seccomp profile
+func podSecurityContext() *corev1.PodSecurityContext {
+	onRootMismatch := corev1.FSGroupChangeOnRootMismatch
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot:        boolPtr(true),
+		RunAsUser:           int64Ptr(runnerUID),
+		RunAsGroup:          int64Ptr(runnerUID),
+		FSGroup:             int64Ptr(runnerUID),
+		FSGroupChangePolicy: &onRootMismatch,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// containerSecurityContext drops every capability and privilege escalation.
+// readOnlyRoot leaves only the container's volumes writable.
+func containerSecurityContext(readOnlyRoot bool) *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: boolPtr(false),
+		ReadOnlyRootFilesystem:   boolPtr(readOnlyRoot),
+		RunAsNonRoot:             boolPtr(true),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// secureReplPod applies the template's security profile to the repl's pod
+// spec. Containers running the user's code get a read-only root filesystem
+// under the restricted profile, with /tmp and runnerHome on scratch volumes.
+func secureReplPod(spec *corev1.PodSpec, config models.Template) {
+	spec.SecurityContext = podSecurityContext()
+	// Repls never talk to the Kubernetes API
+	spec.AutomountServiceAccountToken = boolPtr(false)
+	if config.RuntimeClass != "" {
+		spec.RuntimeClassName = strPtr(config.RuntimeClass)
+	}
+
+	spec.Volumes = append(spec.Volumes,
+		corev1.Volume{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		corev1.Volume{Name: "home", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	)
+
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].SecurityContext = containerSecurityContext(false)
+	}
+
+	readOnlyRoot := config.Security != models.SecurityBaseline
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		container.SecurityContext = containerSecurityContext(readOnlyRoot)
+		container.VolumeMounts = append(container.VolumeMounts,
+			corev1.VolumeMount{Name: "tmp", MountPath: "/tmp"},
+			corev1.VolumeMount{Name: "home", MountPath: runnerHome},
+		)
+		container.Env = append(container.Env, corev1.EnvVar{Name: "HOME", Value: runnerHome})
+	}
+}
@@ -0,0 +1,155 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ReplResources are the Kubernetes objects found for one repl
+type ReplResources struct {
+	ReplId    string
+	Namespace string
+	// The repl's deployment, or the warm pool pod it claimed
+	Deployment bool
+	Ready      bool
+	Service    bool
+	// Some of the ingress backend's routing objects exist, RouteComplete
+	// when all of them do
+	Route         bool
+	RouteComplete bool
+	// The persistent workspace volume
+	Volume bool
+}
+
+// ListReplResources groups the repl objects of every repl namespace by their
+// repl label. Objects without one aren't core's and are left alone, whatever
+// their name.
+func ListReplResources() (map[string]*ReplResources, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	ingress, err := getIngressBackend()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	namespaces, err := replNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repls := map[string]*ReplResources{}
+	for _, namespace := range namespaces {
+		if err := listNamespaceResources(ctx, clientset, ingress, namespace, repls); err != nil {
+			return nil, err
+		}
+	}
+
+	return repls, nil
+}
+
+func listNamespaceResources(ctx context.Context, clientset *kubernetes.Clientset, ingress IngressBackend, namespace string, repls map[string]*ReplResources) error {
+	// Idle warm pods carry an empty repl label, they belong to no repl yet
+	get := func(labels map[string]string) *ReplResources {
+		replId := labels[replLabel]
+		if replId == "" {
+			return nil
+		}
+		if repls[replId] == nil {
+			repls[replId] = &ReplResources{ReplId: replId, Namespace: namespace}
+		}
+		return repls[replId]
+	}
+
+	opts := metav1.ListOptions{LabelSelector: replLabel}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+	for _, deployment := range deployments.Items {
+		if res := get(deployment.Labels); res != nil {
+			res.Deployment = true
+			res.Ready = deployment.Status.ReadyReplicas > 0
+		}
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: poolLabel})
+	if err != nil {
+		return fmt.Errorf("failed to list warm pods: %w", err)
+	}
+	for i := range pods.Items {
+		if res := get(pods.Items[i].Labels); res != nil {
+			res.Deployment = true
+			res.Ready = podReady(&pods.Items[i])
+		}
+	}
+
+	services, err := clientset.CoreV1().Services(namespace).List(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	for _, service := range services.Items {
+		if res := get(service.Labels); res != nil {
+			res.Service = true
+		}
+	}
+
+	routes, err := ingress.List(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	for replId, complete := range routes {
+		if res := get(map[string]string{replLabel: replId}); res != nil {
+			res.Route = true
+			res.RouteComplete = complete
+		}
+	}
+
+	claims, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volume claims: %w", err)
+	}
+	for _, claim := range claims.Items {
+		if res := get(claim.Labels); res != nil {
+			res.Volume = true
+		}
+	}
+
+	return nil
+}
+
+// GetDeploymentStatus reports whether the repl's deployment, or the warm pool
+// pod it claimed, exists and has a ready runner pod
+func GetDeploymentStatus(replId string) (exists bool, ready bool, err error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return false, false, err
+	}
+
+	ctx := context.Background()
+	namespace, err := replNamespace(ctx, replId)
+	if err != nil {
+		return false, false, err
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		pod, err := claimedPod(ctx, namespace, replId)
+		if pod == nil || err != nil {
+			return false, false, err
+		}
+		return true, podReady(pod), nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	return true, deployment.Status.ReadyReplicas > 0, nil
+}
@@ -0,0 +1,139 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var middlewareRes = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
+
+// traefikIngress strips the repl's prefixes with a Traefik Middleware
+// referenced by a plain Ingress
+type traefikIngress struct {
+	clientset     *kubernetes.Clientset
+	dynamicClient dynamic.Interface
+}
+
+func (t *traefikIngress) Name() string {
+	return "traefik"
+}
+
+func middlewareName(replId string) string {
+	return replId + "-stripprefix"
+}
+
+func (t *traefikIngress) Expose(ctx context.Context, route Route) error {
+	var prefixes []interface{}
+	for _, path := range route.Paths {
+		if path.Prefix == "/" {
+			continue
+		}
+		// Include both with and without trailing slash for better matching
+		prefixes = append(prefixes, path.Prefix, path.Prefix+"/")
+	}
+
+	annotations := ingressAnnotations(route)
+	annotations["kubernetes.io/ingress.class"] = ingressClass(t.Name())
+
+	if len(prefixes) > 0 {
+		middleware := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "traefik.io/v1alpha1",
+				"kind":       "Middleware",
+				"metadata": map[string]interface{}{
+					"name":      middlewareName(route.ReplId),
+					"namespace": route.Namespace,
+					"labels":    map[string]interface{}{replLabel: route.ReplId},
+				},
+				"spec": map[string]interface{}{
+					"stripPrefix": map[string]interface{}{
+						"prefixes": prefixes,
+					},
+				},
+			},
+		}
+
+		middleware.SetOwnerReferences([]metav1.OwnerReference{route.Owner})
+
+		data, err := applyPatch(middleware)
+		if err != nil {
+			return err
+		}
+		_, err = t.dynamicClient.Resource(middlewareRes).Namespace(route.Namespace).Patch(ctx, middlewareName(route.ReplId), types.ApplyPatchType, data, applyOptions())
+		if err != nil {
+			return fmt.Errorf("failed to apply middleware: %w", err)
+		}
+		annotations["traefik.ingress.kubernetes.io/router.middlewares"] = fmt.Sprintf("%s-%s@kubernetescrd", route.Namespace, middlewareName(route.ReplId))
+	}
+
+	ingress := &networkingv1.Ingress{
+		TypeMeta:   ingressTypeMeta,
+		ObjectMeta: ingressMeta(route, annotations),
+		Spec: networkingv1.IngressSpec{
+			TLS: ingressTLS(route),
+			Rules: ingressRules(route, networkingv1.PathTypePrefix, func(prefix string) string {
+				return prefix
+			}),
+		},
+	}
+
+	return applyIngress(ctx, t.clientset, ingress)
+}
+
+func (t *traefikIngress) Remove(ctx context.Context, namespace, replId string) error {
+	err := t.dynamicClient.Resource(middlewareRes).Namespace(namespace).Delete(ctx, middlewareName(replId), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete middleware: %w", err)
+	}
+	err = t.clientset.NetworkingV1().Ingresses(namespace).Delete(ctx, ingressName(replId), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete ingress: %w", err)
+	}
+	return nil
+}
+
+// List only counts a route as complete with both its ingress and middleware,
+// ingresses without a middleware reference don't need one
+func (t *traefikIngress) List(ctx context.Context, namespace string) (map[string]bool, error) {
+	opts := metav1.ListOptions{LabelSelector: replLabel}
+	ingresses, err := t.clientset.NetworkingV1().Ingresses(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	middlewares, err := t.dynamicClient.Resource(middlewareRes).Namespace(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list middlewares: %w", err)
+	}
+
+	hasMiddleware := map[string]bool{}
+	for _, middleware := range middlewares.Items {
+		if replId := middleware.GetLabels()[replLabel]; replId != "" {
+			hasMiddleware[replId] = true
+		}
+	}
+
+	routes := map[string]bool{}
+	for _, ingress := range ingresses.Items {
+		replId := ingress.Labels[replLabel]
+		if replId == "" {
+			continue
+		}
+		_, wantsMiddleware := ingress.Annotations["traefik.ingress.kubernetes.io/router.middlewares"]
+		routes[replId] = hasMiddleware[replId] || !wantsMiddleware
+	}
+	for replId := range hasMiddleware {
+		if _, ok := routes[replId]; !ok {
+			routes[replId] = false
+		}
+	}
+	return routes, nil
+}
@@ -2,13 +2,18 @@ package k8s
 
 import (
 	"context"
+	"fmt"
 	log "packages/logging"
 	"path/filepath"
+	"strings"
 
+	"core/internal/runnersync"
+	"core/models"
 	"core/pkg/dotenv"
 
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/dynamic"
@@ -67,6 +72,10 @@ func CheckStatus() (bool, error) {
 		return false, err
 	}
 
+	if _, err := getIngressBackend(); err != nil {
+		return false, err
+	}
+
 	return true, nil
 }
 
@@ -87,8 +96,21 @@ func strPtr(s string) *string {
 	return &s
 }
 
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
 func awsEnvVars() []corev1.EnvVar {
 	return []corev1.EnvVar{
+		// The aws-cli image's home belongs to root, repl pods run as runnerUID
+		{
+			Name:  "HOME",
+			Value: "/tmp",
+		},
 		{
 			Name: "AWS_ACCESS_KEY_ID",
 			ValueFrom: &corev1.EnvVarSource{
@@ -113,3 +135,99 @@ func awsEnvVars() []corev1.EnvVar {
 		},
 	}
 }
+
+// runnerTokenEnvVars give the runner the key it verifies the tokens of
+// replId with, derived from RUNNER_TOKEN_SECRET so it's no good for other
+// repls. Without the secret the runner accepts every connection.
+func runnerTokenEnvVars(replId string) []corev1.EnvVar {
+	key := runnersync.TokenKey(replId)
+	if key == "" {
+		return nil
+	}
+	return []corev1.EnvVar{{Name: "RUNNER_TOKEN_KEY", Value: key}}
+}
+
+// syncEnvVars tell the runner where core is, give it the token it reports
+// its idle shutdown with as CORE_TOKEN and let it checkpoint an ephemeral
+// workspace to S3 through core. Persistent workspaces don't sync, their
+// volume outlives the pod.
+func syncEnvVars(userName, replId string, persistent bool) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	if runnersync.RUNNER_CORE_URL != "" {
+		env = append(env, corev1.EnvVar{Name: "CORE_URL", Value: runnersync.RUNNER_CORE_URL})
+	}
+	if !runnersync.Enabled() {
+		return env, nil
+	}
+	syncToken, err := runnersync.Sign(userName, replId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign sync token: %w", err)
+	}
+	env = append(env, corev1.EnvVar{Name: "CORE_TOKEN", Value: syncToken})
+	if persistent {
+		return env, nil
+	}
+	return append(env,
+		corev1.EnvVar{Name: "SYNC_TOKEN", Value: syncToken},
+		corev1.EnvVar{Name: "SYNC_INTERVAL", Value: runnersync.RUNNER_SYNC_INTERVAL},
+	), nil
+}
+
+// keepSyncToken reuses the sync and core tokens of the repl's current
+// deployment while they're valid. A new token changes the pod template, so
+// applying the repl again would restart its runner.
+func keepSyncToken(ctx context.Context, clientset *kubernetes.Clientset, namespace, replId string, env []corev1.EnvVar) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{})
+	if err != nil || len(deployment.Spec.Template.Spec.Containers) == 0 {
+		return
+	}
+	for _, current := range deployment.Spec.Template.Spec.Containers[0].Env {
+		if (current.Name != "SYNC_TOKEN" && current.Name != "CORE_TOKEN") || runnersync.Verify(current.Value, replId) != nil {
+			continue
+		}
+		for i := range env {
+			if env[i].Name == current.Name {
+				env[i].Value = current.Value
+			}
+		}
+	}
+}
+
+// resourceRequirements requests the resources and caps the container at the
+// same amount. Unset resources are left unbounded.
+func resourceRequirements(res models.ContainerResources) corev1.ResourceRequirements {
+	list := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:              res.CPU,
+		corev1.ResourceMemory:           res.Memory,
+		corev1.ResourceEphemeralStorage: res.EphemeralStorage,
+	} {
+		if value != "" {
+			list[name] = resource.MustParse(value)
+		}
+	}
+	if len(list) == 0 {
+		return corev1.ResourceRequirements{}
+	}
+	return corev1.ResourceRequirements{
+		Requests: list,
+		Limits:   list,
+	}
+}
+
+func quantityPtr(value string) *resource.Quantity {
+	if value == "" {
+		return nil
+	}
+	q := resource.MustParse(value)
+	return &q
+}
+
+// imagePullPolicy only pulls pinned images once per node, a moving tag is
+// pulled on every start to pick up new pushes
+func imagePullPolicy(image string) corev1.PullPolicy {
+	if strings.HasSuffix(image, ":latest") || !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		return corev1.PullAlways
+	}
+	return corev1.PullIfNotPresent
+}
@@ -0,0 +1,266 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	log "packages/logging"
+	"time"
+
+	"core/models"
+	"core/pkg/dotenv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Storage class of persistent workspaces, empty uses the cluster default
+var WORKSPACE_STORAGE_CLASS = dotenv.EnvString("WORKSPACE_STORAGE_CLASS", "")
+
+const (
+	// Persistent volumes hold the workspace in a sub directory, next to the
+	// marker telling the init container it was already seeded from S3
+	workspaceSubPath = "workspace"
+	seededMarker     = ".devex-seeded"
+)
+
+func workspaceClaimName(replId string) string {
+	return replId + "-workspace"
+}
+
+// workspaceVolume is the pod volume holding the workspace, the repl's own
+// claim for persistent storage or an EmptyDir filled from S3
+func workspaceVolume(replId string, config models.Template) corev1.Volume {
+	volume := corev1.Volume{Name: "workspace-vol"}
+	if config.Storage == models.StoragePersistent {
+		volume.VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: workspaceClaimName(replId),
+			},
+		}
+	} else {
+		volume.VolumeSource = corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				SizeLimit: quantityPtr(config.Resources.Workspace),
+			},
+		}
+	}
+	return volume
+}
+
+// workspaceMount mounts the workspace at /workspaces
+func workspaceMount(persistent bool) corev1.VolumeMount {
+	mount := corev1.VolumeMount{
+		Name:      "workspace-vol",
+		MountPath: "/workspaces",
+	}
+	if persistent {
+		mount.SubPath = workspaceSubPath
+	}
+	return mount
+}
+
+// downloadScript fills the workspace from S3. Persistent volumes are only
+// seeded once, afterwards they already hold the workspace.
+func downloadScript(source, endpoint, region string, persistent bool) string {
+	if !persistent {
+		return fmt.Sprintf(`aws s3 cp %s /workspaces --recursive --endpoint-url %s --region %s && echo "Resources copied from S3/R2";`, source, endpoint, region)
+	}
+	return fmt.Sprintf(`if [ -f /data/%[4]s ]; then echo "Workspace already on volume"; else mkdir -p /data/%[5]s && aws s3 cp %[1]s /data/%[5]s --recursive --endpoint-url %[2]s --region %[3]s && touch /data/%[4]s && echo "Resources copied from S3/R2"; fi`,
+		source, endpoint, region, seededMarker, workspaceSubPath)
+}
+
+// deploymentStrategy replaces the pod in place for persistent workspaces,
+// their volume can't be attached to a second pod during a rolling update
+func deploymentStrategy(persistent bool) appsv1.DeploymentStrategy {
+	if persistent {
+		return appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+	return appsv1.DeploymentStrategy{}
+}
+
+// ensureWorkspaceClaim creates the repl's claim unless it survived from an
+// earlier session
+func ensureWorkspaceClaim(ctx context.Context, clientset *kubernetes.Clientset, namespace, replId string, config models.Template) error {
+	size := config.Resources.Workspace
+	if size == "" {
+		size = "1Gi"
+	}
+
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   workspaceClaimName(replId),
+			Labels: map[string]string{replLabel: replId},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *quantityPtr(size),
+				},
+			},
+		},
+	}
+	if WORKSPACE_STORAGE_CLASS != "" {
+		claim.Spec.StorageClassName = strPtr(WORKSPACE_STORAGE_CLASS)
+	}
+
+	_, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, claim, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create workspace volume: %w", err)
+	}
+	log.Info("Workspace volume created", "repl_id", replId, "namespace", namespace, "size", size)
+	return nil
+}
+
+// usesWorkspaceClaim reports whether the pod keeps its workspace on a
+// persistent volume
+func usesWorkspaceClaim(spec corev1.PodSpec) bool {
+	for _, volume := range spec.Volumes {
+		if volume.Name == "workspace-vol" {
+			return volume.PersistentVolumeClaim != nil
+		}
+	}
+	return false
+}
+
+// UploadWorkspace uploads the persistent workspace of a stopped repl to S3
+// and keeps its volume. Repls without a volume are left alone.
+func UploadWorkspace(userName, replId string) error {
+	_, err := uploadVolume(userName, replId)
+	return err
+}
+
+// ArchiveWorkspace uploads the persistent workspace of a stopped repl to S3
+// and deletes its volume, the next start seeds a new one from S3. Repls
+// without a volume are left alone.
+func ArchiveWorkspace(userName, replId string) error {
+	namespace, err := uploadVolume(userName, replId)
+	if err != nil || namespace == "" {
+		return err
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	claims := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	if err := claims.Delete(context.Background(), workspaceClaimName(replId), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete workspace volume: %w", err)
+	}
+
+	log.Info("Workspace archived", "repl_id", replId, "user", userName, "namespace", namespace)
+	return nil
+}
+
+// uploadVolume syncs the repl's volume to S3 from a pod mounting it, and
+// returns the volume's namespace, empty when the repl has no volume
+func uploadVolume(userName, replId string) (string, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+
+	namespace, err := replNamespace(ctx, replId)
+	if err != nil {
+		return "", err
+	}
+
+	claims := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	if _, err := claims.Get(ctx, workspaceClaimName(replId), metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get workspace volume: %w", err)
+	}
+
+	// The volume can only be mounted by one node, and the runner may still write to it
+	if _, err := clientset.AppsV1().Deployments(namespace).Get(ctx, replId, metav1.GetOptions{}); err == nil {
+		return "", fmt.Errorf("repl %s is running", replId)
+	} else if !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	bucket := dotenv.EnvString("S3_BUCKET", "devex")
+	endpoint := dotenv.EnvString("S3_ENDPOINT", "https://<account_id>.r2.cloudflarestorage.com")
+	region := dotenv.EnvString("S3_REGION", "us-east-1")
+
+	podName := replId + "-archiver"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podName,
+			Labels: map[string]string{replLabel: replId},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                corev1.RestartPolicyNever,
+			SecurityContext:              podSecurityContext(),
+			AutomountServiceAccountToken: boolPtr(false),
+			Volumes: []corev1.Volume{
+				workspaceVolume(replId, models.Template{Storage: models.StoragePersistent}),
+			},
+			Containers: []corev1.Container{
+				{
+					Name:    "s3-uploader",
+					Image:   "amazon/aws-cli",
+					Command: []string{"sh", "-c"},
+					Args: []string{
+						// sync --delete, files removed on the volume must not come back with the next seed
+						fmt.Sprintf(`aws s3 sync /workspaces s3://%s/repl/%s/%s/ --delete --endpoint-url %s --region %s`, bucket, userName, replId, endpoint, region),
+					},
+					VolumeMounts:    []corev1.VolumeMount{workspaceMount(true)},
+					Env:             awsEnvVars(),
+					SecurityContext: containerSecurityContext(false),
+				},
+			},
+		},
+	}
+
+	pods := clientset.CoreV1().Pods(namespace)
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("failed to create archiver pod: %w", err)
+	}
+	defer func() {
+		if err := pods.Delete(ctx, podName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Warn("Delete archiver pod failed", "repl_id", replId, "error", err)
+		}
+	}()
+
+	if err := waitForPod(clientset, namespace, podName); err != nil {
+		return "", err
+	}
+
+	log.Info("Workspace uploaded from volume", "repl_id", replId, "user", userName, "namespace", namespace, "bucket", bucket)
+	return namespace, nil
+}
+
+func waitForPod(clientset *kubernetes.Clientset, namespace, podName string) error {
+	const (
+		timeout  = 10 * time.Minute
+		interval = 2 * time.Second
+	)
+
+	start := time.Now()
+	for time.Since(start) < timeout {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod: %w", err)
+		}
+
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			return nil
+		case corev1.PodFailed:
+			return fmt.Errorf("pod %s failed", podName)
+		}
+
+		log.Debug("Waiting for pod to complete", "pod", podName)
+		time.Sleep(interval)
+	}
+
+	return fmt.Errorf("timeout: pod %s did not finish in time", podName)
+}
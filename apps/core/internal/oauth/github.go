@@ -0,0 +1,49 @@
+package oauth
+
+import (
+	"context"
+	log "packages/logging"
+	"strconv"
+
+	"github.com/google/go-github/v57/github"
+	"golang.org/x/oauth2"
+)
+
+type githubProvider struct{}
+
+func (githubProvider) Name() string        { return "github" }
+func (githubProvider) DisplayName() string { return "GitHub" }
+
+func (githubProvider) Config(ctx context.Context) (*oauth2.Config, error) {
+	return GithubOauthConfig, nil
+}
+
+func (githubProvider) Profile(ctx context.Context, token *oauth2.Token) (Profile, error) {
+	client := github.NewClient(GithubOauthConfig.Client(ctx, token))
+	githubUser, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return Profile{}, err
+	}
+
+	// Get user emails
+	emails, _, err := client.Users.ListEmails(ctx, nil)
+	if err != nil {
+		log.Warn("Fetch GitHub user emails failed", "provider", "github", "error", err)
+	}
+
+	var primaryEmail string
+	for _, email := range emails {
+		if email.GetPrimary() {
+			primaryEmail = email.GetEmail()
+			break
+		}
+	}
+
+	return Profile{
+		Subject:   strconv.FormatInt(githubUser.GetID(), 10),
+		Login:     githubUser.GetLogin(),
+		Name:      githubUser.GetName(),
+		Email:     primaryEmail,
+		AvatarURL: githubUser.GetAvatarURL(),
+	}, nil
+}
@@ -0,0 +1,157 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider is any OpenID Connect provider (Keycloak, GitLab, Google...),
+// its endpoints come from the issuer's discovery document
+type oidcProvider struct {
+	name        string
+	displayName string
+	issuer      string
+	config      oauth2.Config
+
+	mu         sync.Mutex
+	discovered *discovery
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type userInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Nickname          string `json:"nickname"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	// A bool, but some providers send it as a string
+	EmailVerified any    `json:"email_verified"`
+	Picture       string `json:"picture"`
+}
+
+func (p *oidcProvider) Name() string        { return p.name }
+func (p *oidcProvider) DisplayName() string { return p.displayName }
+
+func (p *oidcProvider) Config(ctx context.Context) (*oauth2.Config, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.oauthConfig(d), nil
+}
+
+func (p *oidcProvider) oauthConfig(d *discovery) *oauth2.Config {
+	config := p.config
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  d.AuthorizationEndpoint,
+		TokenURL: d.TokenEndpoint,
+	}
+	return &config
+}
+
+// Profile reads the user from the userinfo endpoint, which answers for the
+// access token so no ID token has to be verified
+func (p *oidcProvider) Profile(ctx context.Context, token *oauth2.Token) (Profile, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.UserinfoEndpoint, nil)
+	if err != nil {
+		return Profile{}, err
+	}
+	resp, err := p.oauthConfig(d).Client(ctx, token).Do(req)
+	if err != nil {
+		return Profile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Profile{}, fmt.Errorf("userinfo returned %s", resp.Status)
+	}
+
+	var info userInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return Profile{}, fmt.Errorf("failed to decode userinfo: %w", err)
+	}
+	if info.Subject == "" {
+		return Profile{}, errors.New("userinfo has no subject")
+	}
+
+	email := info.Email
+	if verified, ok := info.EmailVerified.(bool); ok && !verified {
+		email = ""
+	}
+	if verified, ok := info.EmailVerified.(string); ok && verified != "true" {
+		email = ""
+	}
+
+	login := info.PreferredUsername
+	if login == "" {
+		login = info.Nickname
+	}
+	if login == "" {
+		login, _, _ = strings.Cut(email, "@")
+	}
+
+	return Profile{
+		Subject:   info.Subject,
+		Login:     login,
+		Name:      info.Name,
+		Email:     email,
+		AvatarURL: info.Picture,
+	}, nil
+}
+
+// discover fetches the issuer's discovery document once it succeeded, and
+// again on every use until it does
+func (p *oidcProvider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered != nil {
+		return p.discovered, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover %s: %s", p.name, resp.Status)
+	}
+
+	var d discovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("failed to decode %s discovery: %w", p.name, err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("%s discovery is for issuer %q", p.name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("%s discovery lacks an authorization, token or userinfo endpoint", p.name)
+	}
+
+	p.discovered = &d
+	return p.discovered, nil
+}
@@ -0,0 +1,144 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "packages/logging"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"core/pkg/dotenv"
+
+	"golang.org/x/oauth2"
+)
+
+// Comma separated names of the OIDC providers to offer next to GitHub, each
+// configured with OIDC_<NAME>_* variables
+var OIDC_PROVIDERS = dotenv.EnvString("OIDC_PROVIDERS", "")
+
+// Provider is a login provider speaking the OAuth2 code flow. Its name is
+// the /auth/{provider} path segment and the identity provider of its users.
+type Provider interface {
+	Name() string
+	DisplayName() string
+	// Config may have to look up the provider's endpoints first
+	Config(ctx context.Context) (*oauth2.Config, error)
+	// Profile fetches the signed in user with the token of the callback
+	Profile(ctx context.Context, token *oauth2.Token) (Profile, error)
+}
+
+// Profile is the user as the provider knows them. Subject identifies them for
+// good, Login is only the preferred handle.
+type Profile struct {
+	Subject   string
+	Login     string
+	Name      string
+	Email     string
+	AvatarURL string
+}
+
+var (
+	validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	// Names taken by other sign-in methods and /auth routes
+	reservedNames = []string{"github", "email", "magiclink", "sessions", "identities", "providers"}
+)
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{"github": githubProvider{}}
+)
+
+// LoadProviders reads the OIDC providers named in OIDC_PROVIDERS. Their
+// endpoints are discovered on first use, so a provider that's down doesn't
+// keep core from starting.
+func LoadProviders() error {
+	loaded := map[string]Provider{"github": githubProvider{}}
+
+	var errs []error
+	for _, name := range strings.Split(OIDC_PROVIDERS, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		provider, err := loadOIDC(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		loaded[name] = provider
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid OIDC providers: %w", errors.Join(errs...))
+	}
+
+	mu.Lock()
+	providers = loaded
+	mu.Unlock()
+
+	log.Info("Login providers loaded", "count", len(loaded))
+	return nil
+}
+
+func Get(name string) (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// List returns the providers sorted by name
+func List() []Provider {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	list := make([]Provider, 0, len(providers))
+	for _, provider := range providers {
+		list = append(list, provider)
+	}
+	slices.SortFunc(list, func(a, b Provider) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return list
+}
+
+func loadOIDC(name string) (Provider, error) {
+	if !validName.MatchString(name) {
+		return nil, errors.New("name must be lowercase letters, digits and dashes")
+	}
+	if slices.Contains(reservedNames, name) {
+		return nil, errors.New("name is reserved")
+	}
+
+	env := func(key, fallback string) string {
+		return dotenv.EnvString("OIDC_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))+"_"+key, fallback)
+	}
+
+	p := &oidcProvider{
+		name:        name,
+		displayName: env("DISPLAY_NAME", name),
+		issuer:      strings.TrimSuffix(env("ISSUER", ""), "/"),
+		config: oauth2.Config{
+			ClientID:     env("CLIENT_ID", ""),
+			ClientSecret: env("CLIENT_SECRET", ""),
+			RedirectURL:  env("REDIRECT_URL", "http://localhost:8080/auth/"+name+"/callback"),
+			Scopes:       strings.FieldsFunc(env("SCOPES", "openid,profile,email"), isScopeSeparator),
+		},
+	}
+	if p.issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	if p.config.ClientID == "" {
+		return nil, errors.New("client id is required")
+	}
+	if !slices.Contains(p.config.Scopes, "openid") {
+		return nil, errors.New("scopes must include openid")
+	}
+	return p, nil
+}
+
+func isScopeSeparator(r rune) bool {
+	return r == ',' || r == ' '
+}
@@ -0,0 +1,31 @@
+package provisioner
+
+import (
+	"fmt"
+	log "packages/logging"
+
+	"core/internal/store"
+	"core/models"
+)
+
+// Archiving runs work, a Save or Archive of the repl's volume, with the repl
+// archiving so it can't be started on a volume that's being read or deleted.
+// The repl gets its state back afterwards. It fails with
+// store.ErrStatusConflict when the repl isn't stopped or failed anymore.
+func Archiving(rs store.ReplStore, repl models.Repl, work func() error) error {
+	from := repl.State.Status
+	if from != models.ReplStopped && from != models.ReplFailed {
+		return fmt.Errorf("%w: %s is %s", store.ErrStatusConflict, repl.Id, from)
+	}
+	if err := store.TransitionFrom(rs, repl.Id, from, models.ReplArchiving, "saving the workspace"); err != nil {
+		return err
+	}
+
+	defer func() {
+		ok, err := rs.CompareAndSetReplStatus(repl.Id, models.ReplArchiving, repl.State)
+		if err != nil || !ok {
+			log.Warn("Restore repl status after archiving failed", "repl_id", repl.Id, "status", from, "error", err)
+		}
+	}()
+	return work()
+}
@@ -0,0 +1,54 @@
+package provisioner
+
+import (
+	"errors"
+	"testing"
+
+	"core/internal/store"
+	"core/models"
+)
+
+func TestArchivingHoldsRepl(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	repl, _ := rs.GetRepl("repl-1")
+
+	err := Archiving(rs, repl, func() error {
+		held, _ := rs.GetRepl("repl-1")
+		if held.State.Status != models.ReplArchiving {
+			t.Errorf("status while archiving = %s", held.State.Status)
+		}
+		if err := store.Transition(rs, "repl-1", models.ReplPending, ""); err == nil {
+			t.Error("repl started while its volume was archived")
+		}
+		return errors.New("upload failed")
+	})
+	if err == nil || err.Error() != "upload failed" {
+		t.Errorf("Archiving = %v, want the work's error", err)
+	}
+
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplStopped {
+		t.Errorf("status after archiving = %s, want stopped", repl.State.Status)
+	}
+}
+
+func TestArchivingRejectsLiveRepl(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	repl, _ := rs.GetRepl("repl-1")
+
+	// Started after the caller read it
+	store.Transition(rs, "repl-1", models.ReplPending, "")
+
+	ran := false
+	err := Archiving(rs, repl, func() error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, store.ErrStatusConflict) || ran {
+		t.Errorf("Archiving a started repl = %v, ran %v", err, ran)
+	}
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplPending {
+		t.Errorf("status = %s, want pending", repl.State.Status)
+	}
+}
@@ -0,0 +1,174 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	log "packages/logging"
+	"time"
+
+	"core/internal/k8s"
+	"core/internal/quota"
+	"core/internal/runnersync"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+)
+
+// Kubernetes runs each repl as a deployment, service and route in the
+// cluster of KUBE_CONFIG_PATH, in the namespace of the owner's tenant.
+// Persistent workspaces keep a volume claim while the repl is stopped.
+type Kubernetes struct {
+	s3Client *s3.S3Client
+	rs       store.ReplStore
+}
+
+func NewKubernetes(s3Client *s3.S3Client, rs store.ReplStore) *Kubernetes {
+	return &Kubernetes{s3Client: s3Client, rs: rs}
+}
+
+func (k *Kubernetes) Name() string {
+	return "kubernetes"
+}
+
+func (k *Kubernetes) Ping() error {
+	_, err := k8s.CheckStatus()
+	return err
+}
+
+func (k *Kubernetes) Create(userName, replId string, template models.Template) error {
+	org, err := k.rs.GetUserOrg(userName)
+	if err != nil {
+		return fmt.Errorf("failed to get user org: %w", err)
+	}
+	namespace := k8s.TenantNamespace(userName, org)
+
+	claimed, err := k8s.ClaimWarmPod(namespace, userName, replId, template)
+	if err != nil {
+		log.Warn("Claim warm pod failed, starting a new runner", "repl_id", replId, "error", err)
+	}
+	if claimed {
+		return nil
+	}
+	return k8s.CreateReplDeploymentAndService(namespace, userName, replId, template)
+}
+
+// KeepWarm keeps the warm pools of the loaded templates filled until the
+// context is done
+func (k *Kubernetes) KeepWarm(ctx context.Context) {
+	k8s.KeepWarm(ctx, templates.List)
+}
+
+// Delete lets the runner checkpoint its workspace before removing it, and
+// only falls back to the ephemeral uploader when that fails
+func (k *Kubernetes) Delete(userName, replId string) error {
+	upload := userName != ""
+	if upload && k.checkpoint(replId) {
+		upload = false
+	}
+	if upload {
+		if err := quota.CheckStorage(k.rs, k.s3Client, userName); err != nil {
+			log.Warn("Workspace not uploaded", "repl_id", replId, "user", userName, "error", err)
+			upload = false
+		}
+	}
+	return k8s.DeleteReplDeploymentAndService(userName, replId, upload)
+}
+
+func (k *Kubernetes) Flush(userName, replId string) error {
+	if k.checkpoint(replId) {
+		return nil
+	}
+	if err := quota.CheckStorage(k.rs, k.s3Client, userName); err != nil {
+		return err
+	}
+	return k8s.FlushWorkspace(userName, replId)
+}
+
+// checkpoint reports whether the runner synced its workspace to S3
+func (k *Kubernetes) checkpoint(replId string) bool {
+	if !runnersync.Enabled() {
+		return false
+	}
+	if err := runnersync.Checkpoint(k.Endpoint(replId), replId); err != nil {
+		log.Warn("Runner checkpoint failed, uploading the workspace instead", "repl_id", replId, "error", err)
+		return false
+	}
+	return true
+}
+
+func (k *Kubernetes) Save(userName, replId string) error {
+	if err := quota.CheckStorage(k.rs, k.s3Client, userName); err != nil {
+		return err
+	}
+	return k8s.UploadWorkspace(userName, replId)
+}
+
+// Archive keeps the volume when the owner is out of storage, nothing is lost
+func (k *Kubernetes) Archive(userName, replId string) error {
+	if err := quota.CheckStorage(k.rs, k.s3Client, userName); err != nil {
+		return err
+	}
+	return k8s.ArchiveWorkspace(userName, replId)
+}
+
+// WaitReady watches the repl's pod to fail fast with the reason it can't
+// start, then checks that the route to the runner works too
+func (k *Kubernetes) WaitReady(replId string) error {
+	if err := k8s.WaitForRepl(replId, REPL_READY_TIMEOUT); err != nil {
+		return err
+	}
+	return pingRunner(k.Endpoint(replId)+"/ping", routeTimeout)
+}
+
+func (k *Kubernetes) Status(replId string) (Status, error) {
+	exists, ready, err := k8s.GetDeploymentStatus(replId)
+	switch {
+	case err != nil:
+		return "", err
+	case !exists:
+		return StatusStopped, nil
+	case ready:
+		return StatusRunning, nil
+	default:
+		return StatusStarting, nil
+	}
+}
+
+func (k *Kubernetes) List() ([]Workspace, error) {
+	resources, err := k8s.ListReplResources()
+	if err != nil {
+		return nil, err
+	}
+
+	workspaces := make([]Workspace, 0, len(resources))
+	for _, res := range resources {
+		workspace := Workspace{
+			ReplId:     res.ReplId,
+			Status:     StatusStopped,
+			Complete:   res.Deployment && res.Service && res.RouteComplete,
+			VolumeOnly: res.Volume && !(res.Deployment || res.Service || res.Route),
+		}
+		if res.Ready {
+			workspace.Status = StatusRunning
+		} else if res.Deployment {
+			workspace.Status = StatusStarting
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, nil
+}
+
+func (k *Kubernetes) Prune(minAge time.Duration) ([]string, error) {
+	return k8s.PruneNamespaces(minAge)
+}
+
+// Endpoint is the repl's host with subdomain routing, or its path on the
+// shared ingress host, stripped before requests reach the runner
+func (k *Kubernetes) Endpoint(replId string) string {
+	return k8s.ReplURL(replId)
+}
+
+func (k *Kubernetes) PortEndpoint(replId string, port int32) string {
+	return k8s.PortURL(replId, port)
+}
@@ -0,0 +1,343 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	log "packages/logging"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"core/internal/quota"
+	"core/internal/runnersync"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	LOCAL_RUNNER_BIN     = dotenv.EnvString("LOCAL_RUNNER_BIN", "runner")
+	LOCAL_RUNNER_HOST    = dotenv.EnvString("LOCAL_RUNNER_HOST", "localhost")
+	LOCAL_WORKSPACES_DIR = dotenv.EnvString("LOCAL_WORKSPACES_DIR", filepath.Join(os.TempDir(), "devex-workspaces"))
+	// Where local runners report idle shutdowns, i.e. this core
+	LOCAL_CORE_URL = dotenv.EnvString("LOCAL_CORE_URL", "http://localhost:"+dotenv.EnvString("PORT", "8080"))
+	// Variables of core's environment passed on to local runners besides the
+	// basics, comma separated. Core's own credentials stay out of runners.
+	LOCAL_RUNNER_ENV = dotenv.EnvString("LOCAL_RUNNER_ENV", "")
+)
+
+// Variables of core's environment every local runner gets
+var localRunnerEnv = []string{"PATH", "HOME", "USER", "LANG", "TZ", "TMPDIR"}
+
+// Local runs each repl's runner binary as a subprocess on a free port, with
+// the workspace in a directory under LOCAL_WORKSPACES_DIR. It needs no cluster,
+// for self-hosting on a single machine and for integration tests.
+type Local struct {
+	mu       sync.Mutex
+	s3Client *s3.S3Client
+	rs       store.ReplStore
+	runners  map[string]*localRunner
+	// Repls whose runner Create is starting, it doesn't hold the lock while
+	// downloading their workspace. Delete sets them to false, so Create
+	// doesn't start a runner nobody would stop.
+	starting map[string]bool
+}
+
+type localRunner struct {
+	cmd  *exec.Cmd
+	port int
+	dir  string
+	done chan struct{} // closed when the process exits
+}
+
+func NewLocal(s3Client *s3.S3Client, rs store.ReplStore) *Local {
+	return &Local{
+		s3Client: s3Client,
+		rs:       rs,
+		runners:  make(map[string]*localRunner),
+		starting: make(map[string]bool),
+	}
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+func (l *Local) Ping() error {
+	if _, err := exec.LookPath(LOCAL_RUNNER_BIN); err != nil {
+		return fmt.Errorf("runner binary not found: %w", err)
+	}
+	return os.MkdirAll(LOCAL_WORKSPACES_DIR, 0o755)
+}
+
+// Create ignores the template's resources, local runners aren't limited
+func (l *Local) Create(userName, replId string, template models.Template) error {
+	l.mu.Lock()
+	if runner, ok := l.runners[replId]; (ok && !runner.exited()) || l.starting[replId] {
+		l.mu.Unlock()
+		return fmt.Errorf("runner for %s is already running", replId)
+	}
+	l.starting[replId] = true
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.starting, replId)
+		l.mu.Unlock()
+	}()
+
+	dir := filepath.Join(LOCAL_WORKSPACES_DIR, replId)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := l.s3Client.DownloadFolder(workspacePrefix(userName, replId), dir); err != nil {
+		return fmt.Errorf("failed to download workspace: %w", err)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	grpcPort, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(LOCAL_RUNNER_BIN)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Its own process group, so stopping the runner takes the processes it
+	// started with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(runnerEnv(),
+		"REPL_ID="+replId,
+		"TEMPLATE="+template.Key,
+		"RUN_COMMAND="+template.Run,
+		"ENTRYPOINT="+template.Entrypoint,
+		"WORKSPACE_DIR="+dir,
+		"PORT="+strconv.Itoa(port),
+		"GRPC_PORT="+strconv.Itoa(grpcPort),
+		"CORE_URL="+LOCAL_CORE_URL,
+	)
+	if key := runnersync.TokenKey(replId); key != "" {
+		cmd.Env = append(cmd.Env, "RUNNER_TOKEN_KEY="+key)
+	}
+	// Authorizes the runner's idle shutdown report
+	if runnersync.RUNNER_SYNC_SECRET != "" {
+		coreToken, err := runnersync.Sign(userName, replId)
+		if err != nil {
+			return fmt.Errorf("failed to sign core token: %w", err)
+		}
+		cmd.Env = append(cmd.Env, "CORE_TOKEN="+coreToken)
+	}
+	// Started and registered in one step, Delete either cancels the start or
+	// finds the runner
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.starting[replId] {
+		os.RemoveAll(dir)
+		return fmt.Errorf("runner for %s was deleted while starting", replId)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start runner: %w", err)
+	}
+
+	runner := &localRunner{cmd: cmd, port: port, dir: dir, done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		log.Info("Local runner exited", "repl_id", replId, "pid", cmd.Process.Pid, "error", err)
+		close(runner.done)
+	}()
+	l.runners[replId] = runner
+
+	log.Info("Local runner started", "repl_id", replId, "template", template.Key, "pid", cmd.Process.Pid, "port", port, "dir", dir)
+	return nil
+}
+
+func (l *Local) Delete(userName, replId string) error {
+	l.mu.Lock()
+	runner, ok := l.runners[replId]
+	delete(l.runners, replId)
+	if _, starting := l.starting[replId]; starting {
+		l.starting[replId] = false
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if userName != "" {
+		if err := l.upload(runner, userName, replId); err != nil {
+			log.Warn("Upload local workspace failed", "repl_id", replId, "user", userName, "error", err)
+		}
+	}
+
+	runner.stop()
+
+	return os.RemoveAll(runner.dir)
+}
+
+func (l *Local) Flush(userName, replId string) error {
+	l.mu.Lock()
+	runner, ok := l.runners[replId]
+	l.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no local runner for %s", replId)
+	}
+	return l.upload(runner, userName, replId)
+}
+
+func (l *Local) upload(runner *localRunner, userName, replId string) error {
+	if err := quota.CheckStorage(l.rs, l.s3Client, userName); err != nil {
+		return err
+	}
+	return l.s3Client.UploadFolder(runner.dir, workspacePrefix(userName, replId))
+}
+
+// Save and Archive are no-ops, local workspaces are uploaded to S3 whenever
+// they stop
+func (l *Local) Save(userName, replId string) error {
+	return nil
+}
+
+func (l *Local) Archive(userName, replId string) error {
+	return nil
+}
+
+func (l *Local) Status(replId string) (Status, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	runner, ok := l.runners[replId]
+	if !ok || runner.exited() {
+		return StatusStopped, nil
+	}
+	return StatusRunning, nil
+}
+
+func (l *Local) List() ([]Workspace, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	workspaces := make([]Workspace, 0, len(l.runners))
+	for replId, runner := range l.runners {
+		workspace := Workspace{ReplId: replId, Status: StatusRunning, Complete: true}
+		if runner.exited() {
+			workspace.Status = StatusStopped
+			workspace.Complete = false
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, nil
+}
+
+// WaitReady pings the runner, the subprocess has no events to watch
+func (l *Local) WaitReady(replId string) error {
+	return pingRunner(l.Endpoint(replId)+"/ping", REPL_READY_TIMEOUT)
+}
+
+// Prune has nothing to do, runners own nothing but their process and
+// workspace directory
+func (l *Local) Prune(minAge time.Duration) ([]string, error) {
+	return nil, nil
+}
+
+func (l *Local) Endpoint(replId string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	runner, ok := l.runners[replId]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("http://%s:%d", LOCAL_RUNNER_HOST, runner.port)
+}
+
+func (r *localRunner) exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop asks the runner to exit and kills it if it hasn't after 10 seconds
+func (r *localRunner) stop() {
+	if r.exited() {
+		return
+	}
+
+	if err := r.signal(syscall.SIGTERM); err != nil {
+		log.Warn("Signal local runner failed", "pid", r.cmd.Process.Pid, "error", err)
+	}
+
+	select {
+	case <-r.done:
+	case <-time.After(10 * time.Second):
+		r.signal(syscall.SIGKILL)
+		<-r.done
+	}
+}
+
+// signal sends sig to the runner's process group
+func (r *localRunner) signal(sig syscall.Signal) error {
+	if err := syscall.Kill(-r.cmd.Process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// runnerEnv is the part of core's environment local runners get
+func runnerEnv() []string {
+	names := append([]string{}, localRunnerEnv...)
+	for _, name := range strings.Split(LOCAL_RUNNER_ENV, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	var env []string
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+func workspacePrefix(userName, replId string) string {
+	return fmt.Sprintf("repl/%s/%s/", userName, replId)
+}
+
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+// PortEndpoint goes through the runner's /user-app/ proxy, local runners
+// have no host of their own
+func (l *Local) PortEndpoint(replId string, port int32) string {
+	endpoint := l.Endpoint(replId)
+	if endpoint == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/user-app/%d/", endpoint, port)
+}
@@ -0,0 +1,236 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"core/internal/quota"
+	"core/internal/s3"
+	"core/internal/s3/s3test"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+)
+
+// The test binary doubles as the runner binary the local provisioner starts
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_RUNNER") == "1" {
+		fakeRunner()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeRunner stands in for the runner: it edits the workspace like a user
+// would and answers core's pings until it's stopped
+func fakeRunner() {
+	// Core's credentials must not reach runners
+	if os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		os.Exit(1)
+	}
+	dir := os.Getenv("WORKSPACE_DIR")
+	if err := os.WriteFile(filepath.Join(dir, "edited.py"), []byte("print('edited')"), 0o644); err != nil {
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode("pong")
+	})
+	srv := &http.Server{Addr: "127.0.0.1:" + os.Getenv("PORT"), Handler: mux}
+
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM)
+		<-stop
+		srv.Close()
+	}()
+	srv.ListenAndServe()
+}
+
+func newLocal(t *testing.T) (*Local, *s3test.Server, store.ReplStore) {
+	t.Helper()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_RUNNER", "1")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "core's")
+
+	bin, dir, host, env := LOCAL_RUNNER_BIN, LOCAL_WORKSPACES_DIR, LOCAL_RUNNER_HOST, LOCAL_RUNNER_ENV
+	LOCAL_RUNNER_BIN, LOCAL_WORKSPACES_DIR, LOCAL_RUNNER_HOST, LOCAL_RUNNER_ENV = exe, t.TempDir(), "127.0.0.1", "FAKE_RUNNER"
+	t.Cleanup(func() {
+		LOCAL_RUNNER_BIN, LOCAL_WORKSPACES_DIR, LOCAL_RUNNER_HOST, LOCAL_RUNNER_ENV = bin, dir, host, env
+	})
+
+	if err := templates.Load(filepath.Join("..", "..", "..", "..", "templates")); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := store.NewMemoryStore("")
+	if err := quota.SeedPlans(rs); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := s3test.NewServer(t)
+	return NewLocal(s3.NewS3ClientAt(fake.URL), rs), fake, rs
+}
+
+// TestLocalLifecycle runs activate -> use -> deactivate without a cluster
+func TestLocalLifecycle(t *testing.T) {
+	prov, fake, rs := newLocal(t)
+	fake.Put("repl/alice/repl-1/main.py", []byte("print('hi')"))
+
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	if err := store.Transition(rs, "repl-1", models.ReplPending, ""); err != nil {
+		t.Fatal(err)
+	}
+	repl, _ := rs.GetRepl("repl-1")
+
+	Provision(rs, prov, "alice", repl)
+
+	repl, _ = rs.GetRepl("repl-1")
+	if repl.State.Status != models.ReplReady {
+		t.Fatalf("status after provisioning = %+v", repl.State)
+	}
+	if status, _ := prov.Status("repl-1"); status != StatusRunning {
+		t.Errorf("Status = %s, want running", status)
+	}
+	if data, err := os.ReadFile(filepath.Join(LOCAL_WORKSPACES_DIR, "repl-1", "main.py")); err != nil || string(data) != "print('hi')" {
+		t.Errorf("downloaded main.py = %q, %v", data, err)
+	}
+
+	resp, err := http.Get(prov.Endpoint("repl-1") + "/ping")
+	if err != nil {
+		t.Fatalf("ping runner: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("ping status = %d", resp.StatusCode)
+	}
+
+	if err := prov.Delete("alice", "repl-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	want := []string{"repl/alice/repl-1/edited.py", "repl/alice/repl-1/main.py"}
+	if keys := fake.Keys("repl/alice/"); !slices.Equal(keys, want) {
+		t.Errorf("stored workspace = %v, want %v", keys, want)
+	}
+	if status, _ := prov.Status("repl-1"); status != StatusStopped {
+		t.Errorf("Status after Delete = %s, want stopped", status)
+	}
+	if _, err := os.Stat(filepath.Join(LOCAL_WORKSPACES_DIR, "repl-1")); !os.IsNotExist(err) {
+		t.Errorf("workspace dir left behind: %v", err)
+	}
+}
+
+func TestLocalCreateOnce(t *testing.T) {
+	prov, _, _ := newLocal(t)
+	template, _ := templates.Get("node")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = prov.Create("alice", "repl-1", template)
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(func() { prov.Delete("", "repl-1") })
+
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Errorf("Create errors = %v, want exactly one runner started", errs)
+	}
+}
+
+func TestLocalCreateRejectsTraversal(t *testing.T) {
+	prov, fake, _ := newLocal(t)
+	fake.Put("repl/alice/repl-1/../repl-2/main.py", []byte("not this repl's"))
+	template, _ := templates.Get("node")
+
+	if err := prov.Create("alice", "repl-1", template); err == nil {
+		prov.Delete("", "repl-1")
+		t.Fatal("Create downloaded a key outside the workspace")
+	}
+	if _, err := os.Stat(filepath.Join(LOCAL_WORKSPACES_DIR, "repl-2")); err == nil {
+		t.Error("Create wrote outside the workspace")
+	}
+	if status, _ := prov.Status("repl-1"); status != StatusStopped {
+		t.Errorf("Status = %s, want stopped", status)
+	}
+}
+
+func TestLocalUploadRespectsStorageQuota(t *testing.T) {
+	prov, fake, rs := newLocal(t)
+	rs.SavePlan(models.Plan{Id: "tiny", Name: "Tiny", StorageBytes: 4})
+	rs.SetUserPlan("alice", "tiny")
+	fake.Put("repl/alice/repl-1/main.py", []byte("print('hi')"))
+	template, _ := templates.Get("node")
+
+	if err := prov.Create("alice", "repl-1", template); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { prov.Delete("", "repl-1") })
+
+	var quotaErr *quota.Error
+	if err := prov.Flush("alice", "repl-1"); err == nil || !errors.As(err, &quotaErr) {
+		t.Errorf("Flush over quota = %v, want a quota error", err)
+	}
+	if _, ok := fake.Get("repl/alice/repl-1/edited.py"); ok {
+		t.Error("Flush uploaded past the storage limit")
+	}
+}
+
+func TestLocalDeleteWhileStarting(t *testing.T) {
+	prov, fake, _ := newLocal(t)
+	template, _ := templates.Get("node")
+
+	// Holds the workspace download until the runner was deleted
+	release := make(chan struct{})
+	target, _ := url.Parse(fake.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(slow.Close)
+	prov.s3Client = s3.NewS3ClientAt(slow.URL)
+
+	created := make(chan error)
+	go func() { created <- prov.Create("alice", "repl-1", template) }()
+	for starting := false; !starting; {
+		prov.mu.Lock()
+		starting = prov.starting["repl-1"]
+		prov.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := prov.Delete("alice", "repl-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	close(release)
+
+	if err := <-created; err == nil {
+		prov.Delete("", "repl-1")
+		t.Fatal("Create started a runner deleted while starting")
+	}
+	if status, _ := prov.Status("repl-1"); status != StatusStopped {
+		t.Errorf("Status = %s, want stopped", status)
+	}
+}
@@ -1,4 +1,4 @@
-package repl
+package provisioner
 
 import (
 	"crypto/tls"
@@ -7,23 +7,28 @@ import (
 	log "packages/logging"
 	"net/http"
 	"time"
+
+	"core/models"
 )
 
 // Ping the Runner Service to check whether the container is running or initiating.
-func pingRunner(url string) error {
-	timeout := time.After(1 * time.Minute)
+func pingRunner(url string, timeout time.Duration) error {
+	deadline := time.After(timeout)
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
 
 	for {
 		select {
-		case <-timeout:
-			return fmt.Errorf("timeout: no 'pong' response received from %s", url)
+		case <-deadline:
+			return &models.ReplFailure{
+				Code:    models.FailureUnreachable,
+				Message: fmt.Sprintf("no 'pong' response received from %s", url),
+			}
 
 		case <-ticker.C:
 			resp, err := client.Get(url)
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"fmt"
+	log "packages/logging"
+
+	"core/internal/quota"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+)
+
+// Provision brings up the repl's workspace and records every step in the
+// repl status, callers run it in the background once the repl is pending.
+func Provision(rs store.ReplStore, prov Provisioner, userName string, repl models.Repl) {
+	replId := repl.Id
+
+	if err := store.Transition(rs, replId, models.ReplProvisioning, ""); err != nil {
+		log.Warn("Repl provisioning aborted", "repl_id", replId, "error", err)
+		return
+	}
+
+	plan, err := quota.UserPlan(rs, userName)
+	if err != nil {
+		failRepl(rs, prov, userName, replId, fmt.Errorf("failed to load plan: %w", err))
+		return
+	}
+	template, ok := templates.ForPlan(repl.Template, plan)
+	if !ok {
+		failRepl(rs, prov, userName, replId, fmt.Errorf("unsupported template: %s", repl.Template))
+		return
+	}
+
+	if err := prov.Create(userName, replId, template); err != nil {
+		log.Error("Repl provisioning failed", "repl_id", replId, "user", userName, "template", repl.Template, "provisioner", prov.Name(), "error", err)
+		failRepl(rs, prov, userName, replId, fmt.Errorf("failed to create workspace: %w", err))
+		return
+	}
+	if err := rs.SetRunnerVersion(replId, template.Version); err != nil {
+		log.Warn("Record runner version failed", "repl_id", replId, "version", template.Version, "error", err)
+	}
+
+	if err := prov.WaitReady(replId); err != nil {
+		log.Warn("Repl not ready", "repl_id", replId, "user", userName, "provisioner", prov.Name(), "error", err)
+		failRepl(rs, prov, userName, replId, err)
+		return
+	}
+
+	if err := store.Transition(rs, replId, models.ReplReady, ""); err != nil {
+		// Left running, a repl that couldn't be marked ready would hold its
+		// workspace without anyone stopping it
+		log.Warn("Repl not marked ready", "repl_id", replId, "error", err)
+		failRepl(rs, prov, userName, replId, fmt.Errorf("failed to mark ready: %w", err))
+	}
+}
+
+// failRepl marks the repl as failed with the reason from err and tears down
+// whatever was created, so a failed activation doesn't leave the repl marked
+// active.
+func failRepl(rs store.ReplStore, prov Provisioner, userName, replId string, err error) {
+	if err := store.Fail(rs, replId, err); err != nil {
+		log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+	}
+
+	if err := rs.DeleteReplSession(replId); err != nil {
+		log.Error("Delete repl session failed", "repl_id", replId, "error", err)
+	}
+
+	if err := prov.Delete(userName, replId); err != nil {
+		log.Error("Repl cleanup failed", "repl_id", replId, "user", userName, "provisioner", prov.Name(), "error", err)
+	}
+}
@@ -0,0 +1,104 @@
+package provisioner
+
+import (
+	log "packages/logging"
+	"strings"
+	"time"
+
+	"core/internal/s3"
+	"core/internal/store"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	PROVISIONER = dotenv.EnvString("PROVISIONER", "kubernetes")
+	// How long a new runner may take to become ready, image pulls included
+	REPL_READY_TIMEOUT, _ = time.ParseDuration(dotenv.EnvString("REPL_READY_TIMEOUT", "5m"))
+)
+
+// How long the runner's route may lag behind its ready pod
+const routeTimeout = time.Minute
+
+// Status is what the provisioner knows about a repl's runner, independent of
+// the lifecycle tracked in the repl store
+type Status string
+
+const (
+	StatusStopped  Status = "stopped"
+	StatusStarting Status = "starting"
+	StatusRunning  Status = "running"
+)
+
+// Provisioner runs the runner process of a repl with its workspace
+// loaded from S3, and saves the workspace back when it's torn down.
+type Provisioner interface {
+	// Name identifies the backend in logs and health checks
+	Name() string
+	// Health Check
+	Ping() error
+
+	// Create starts the repl's runner with the workspace from repl/<userName>/<replId>/,
+	// sized by the template's resources
+	Create(userName, replId string, template models.Template) error
+	// Delete uploads the workspace to S3 and removes the runner. An empty
+	// userName discards the workspace, for repls that no longer exist, and so
+	// does an owner out of storage, whose stored workspace stays as it was.
+	Delete(userName, replId string) error
+	// Flush uploads the live workspace to S3 without stopping the runner,
+	// failing with a *quota.Error when the owner is out of storage
+	Flush(userName, replId string) error
+	// Save uploads the persistent workspace of a stopped repl to S3 and keeps
+	// its volume, Archive also frees the volume. Workspaces that already live
+	// in S3 are left alone. Callers hold the repl with Archiving.
+	Save(userName, replId string) error
+	Archive(userName, replId string) error
+
+	// WaitReady blocks until the runner created by Create serves requests. It
+	// returns a *models.ReplFailure when the runner can't start.
+	WaitReady(replId string) error
+	Status(replId string) (Status, error)
+	// List returns every runner the backend knows about, including partly
+	// created or orphaned ones
+	List() ([]Workspace, error)
+	// Prune deletes what the backend set up for runners once none uses it,
+	// like empty tenant namespaces, keeping anything used within minAge. It
+	// returns the names of what it deleted.
+	Prune(minAge time.Duration) ([]string, error)
+	// Endpoint is the runner's base URL, serving /ping and /api/v1/repl/ws
+	Endpoint(replId string) string
+	// PortEndpoint is the URL of the user's app listening on port
+	PortEndpoint(replId string, port int32) string
+}
+
+// Workspace is a repl's runner as seen by the provisioner
+type Workspace struct {
+	ReplId string
+	Status Status
+	// Every resource of the runner exists, a failed create or delete can leave
+	// only some of them behind
+	Complete bool
+	// Only the persistent workspace volume is left, the runner is stopped
+	VolumeOnly bool
+}
+
+var (
+	_ Provisioner = (*Kubernetes)(nil)
+	_ Provisioner = (*Local)(nil)
+)
+
+// NewProvisioner returns the backend selected by PROVISIONER ("kubernetes" or
+// "local"). Both check the owner's storage quota before uploading a workspace,
+// the kubernetes one also reads users' organizations from the store.
+func NewProvisioner(s3Client *s3.S3Client, rs store.ReplStore) Provisioner {
+	switch strings.ToLower(PROVISIONER) {
+	case "local":
+		log.Info("Using local runner processes", "bin", LOCAL_RUNNER_BIN, "dir", LOCAL_WORKSPACES_DIR)
+		return NewLocal(s3Client, rs)
+	case "kubernetes", "k8s":
+		return NewKubernetes(s3Client, rs)
+	default:
+		log.Warn("Unknown provisioner, falling back to kubernetes", "provisioner", PROVISIONER)
+		return NewKubernetes(s3Client, rs)
+	}
+}
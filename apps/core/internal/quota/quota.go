@@ -0,0 +1,278 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	log "packages/logging"
+	"time"
+
+	"core/internal/s3"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	DEFAULT_PLAN = dotenv.EnvString("DEFAULT_PLAN", "free")
+	PLANS_FILE   = dotenv.EnvString("PLANS_FILE", "")
+)
+
+// Plans seeded into the store when they don't exist yet
+var defaultPlans = []models.Plan{
+	{
+		Id:                   "free",
+		Name:                 "Free",
+		MaxRepls:             2,
+		MaxActiveSessions:    1,
+		StorageBytes:         512 << 20,
+		SessionHoursPerMonth: 20,
+	},
+	{
+		Id:                   "internal",
+		Name:                 "Internal",
+		MaxRepls:             20,
+		MaxActiveSessions:    5,
+		StorageBytes:         10 << 30,
+		SessionHoursPerMonth: 0,
+	},
+}
+
+// Error is a quota violation with the HTTP status it should be reported with
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func forbidden(format string, args ...any) *Error {
+	return &Error{Status: http.StatusForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+func tooMany(format string, args ...any) *Error {
+	return &Error{Status: http.StatusTooManyRequests, Message: fmt.Sprintf(format, args...)}
+}
+
+// SeedPlans stores the default plans that are missing, then every plan of
+// PLANS_FILE (a JSON array of plans), which always overwrites the stored ones.
+func SeedPlans(rs store.ReplStore) error {
+	for _, plan := range defaultPlans {
+		if _, err := rs.GetPlan(plan.Id); err == nil {
+			continue
+		}
+		if err := rs.SavePlan(plan); err != nil {
+			return err
+		}
+	}
+
+	if PLANS_FILE == "" {
+		return nil
+	}
+
+	bytes, err := os.ReadFile(PLANS_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read plans file: %w", err)
+	}
+	var plans []models.Plan
+	if err := json.Unmarshal(bytes, &plans); err != nil {
+		return fmt.Errorf("failed to decode plans file: %w", err)
+	}
+	for _, plan := range plans {
+		if plan.Id == "" {
+			return fmt.Errorf("plan without id in %s", PLANS_FILE)
+		}
+		if err := templates.ValidateResources(plan.Resources); err != nil {
+			return fmt.Errorf("plan %s: %w", plan.Id, err)
+		}
+		if plan.Storage != "" && !plan.Storage.IsValid() {
+			return fmt.Errorf("plan %s: invalid storage %q", plan.Id, plan.Storage)
+		}
+		if err := templates.ValidateSecurity(plan.Security, plan.RuntimeClass); err != nil {
+			return fmt.Errorf("plan %s: %w", plan.Id, err)
+		}
+		if err := rs.SavePlan(plan); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Plans loaded", "file", PLANS_FILE, "count", len(plans))
+	return nil
+}
+
+// UserPlan returns the plan assigned to the user, or DEFAULT_PLAN
+func UserPlan(rs store.ReplStore, userName string) (models.Plan, error) {
+	planId, err := rs.GetUserPlan(userName)
+	if err != nil {
+		return models.Plan{}, err
+	}
+	if planId == "" {
+		planId = DEFAULT_PLAN
+	}
+	return rs.GetPlan(planId)
+}
+
+// Usage reports the user's current consumption. Storage is only measured when
+// s3Client is given, since it lists every object the user owns.
+func Usage(rs store.ReplStore, s3Client *s3.S3Client, userName string) (models.PlanUsage, error) {
+	var usage models.PlanUsage
+
+	replIds, err := rs.GetUserRepls(userName)
+	if err != nil {
+		return usage, err
+	}
+	usage.Repls = len(replIds)
+
+	// Running sessions count too, like DeleteReplSession they go to the month
+	// they end in
+	now := time.Now()
+	var running time.Duration
+	for _, id := range replIds {
+		repl, err := rs.GetRepl(id)
+		if err != nil {
+			continue
+		}
+		if repl.IsActive {
+			usage.ActiveSessions++
+			if !repl.SessionStartedAt.IsZero() {
+				running += now.Sub(repl.SessionStartedAt)
+			}
+		}
+	}
+
+	used, err := rs.GetSessionUsage(userName, now)
+	if err != nil {
+		return usage, err
+	}
+	usage.SessionHours = (used + running).Hours()
+
+	if s3Client != nil {
+		usage.StorageBytes, err = storageBytes(s3Client, userName, nil)
+		if err != nil {
+			return usage, err
+		}
+	}
+
+	return usage, nil
+}
+
+// CheckCreate enforces the repl count, template and storage limits before a
+// new repl (or fork) is created for the user.
+func CheckCreate(rs store.ReplStore, s3Client *s3.S3Client, userName, template string) error {
+	plan, err := UserPlan(rs, userName)
+	if err != nil {
+		return err
+	}
+
+	if !plan.AllowsTemplate(template) {
+		return forbidden("The %s template isn't available on the %s plan", template, plan.Name)
+	}
+
+	replIds, err := rs.GetUserRepls(userName)
+	if err != nil {
+		return err
+	}
+	if plan.MaxRepls > 0 && len(replIds) >= plan.MaxRepls {
+		log.Warn("Repl limit reached", "user", userName, "plan", plan.Id, "limit", plan.MaxRepls)
+		return forbidden("The %s plan is limited to %d repls", plan.Name, plan.MaxRepls)
+	}
+
+	return checkStorage(s3Client, plan, userName)
+}
+
+// CheckActivate enforces the concurrent session and monthly session hour limits
+func CheckActivate(rs store.ReplStore, userName string) error {
+	plan, err := UserPlan(rs, userName)
+	if err != nil {
+		return err
+	}
+
+	usage, err := Usage(rs, nil, userName)
+	if err != nil {
+		return err
+	}
+
+	if plan.MaxActiveSessions > 0 && usage.ActiveSessions >= plan.MaxActiveSessions {
+		return tooMany("The %s plan allows %d active repls at a time, stop one first", plan.Name, plan.MaxActiveSessions)
+	}
+	if plan.SessionHoursPerMonth > 0 && usage.SessionHours >= plan.SessionHoursPerMonth {
+		return tooMany("You have used all %.0f session hours of the %s plan this month", plan.SessionHoursPerMonth, plan.Name)
+	}
+
+	return nil
+}
+
+// CheckStorage enforces the storage limit before more data is written to S3:
+// snapshots, workspace uploads and runner syncs
+func CheckStorage(rs store.ReplStore, s3Client *s3.S3Client, userName string) error {
+	plan, err := UserPlan(rs, userName)
+	if err != nil {
+		return err
+	}
+	return checkStorage(s3Client, plan, userName)
+}
+
+func checkStorage(s3Client *s3.S3Client, plan models.Plan, userName string) error {
+	if plan.StorageBytes <= 0 {
+		return nil
+	}
+
+	used, err := storageBytes(s3Client, userName, nil)
+	if err != nil {
+		return err
+	}
+	if used >= plan.StorageBytes {
+		return forbidden("The %s plan's %d MB of storage is used up", plan.Name, plan.StorageBytes>>20)
+	}
+	return nil
+}
+
+// CheckUpload is CheckStorage for writing objects of known sizes, keyed by
+// their S3 key: it fails when they don't fit in the storage left. The objects
+// they replace are only counted once.
+func CheckUpload(rs store.ReplStore, s3Client *s3.S3Client, userName string, sizes map[string]int64) error {
+	plan, err := UserPlan(rs, userName)
+	if err != nil {
+		return err
+	}
+	if plan.StorageBytes <= 0 {
+		return nil
+	}
+
+	used, err := storageBytes(s3Client, userName, sizes)
+	if err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		used += size
+	}
+	if used > plan.StorageBytes {
+		return forbidden("The upload doesn't fit in the %s plan's %d MB of storage", plan.Name, plan.StorageBytes>>20)
+	}
+	return nil
+}
+
+// storageBytes sums the user's workspaces and snapshots, leaving out the
+// objects in skip
+func storageBytes(s3Client *s3.S3Client, userName string, skip map[string]int64) (int64, error) {
+	var total int64
+	for _, prefix := range []string{
+		fmt.Sprintf("repl/%s/", userName),
+		fmt.Sprintf("snapshots/%s/", userName),
+	} {
+		objects, err := s3Client.ListFolder(prefix)
+		if err != nil {
+			return 0, err
+		}
+		for _, obj := range objects {
+			if _, ok := skip[prefix+obj.Key]; !ok {
+				total += obj.Size
+			}
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,42 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+
+	"core/internal/s3"
+	"core/internal/s3/s3test"
+	"core/internal/store"
+	"core/models"
+)
+
+func TestCheckUpload(t *testing.T) {
+	fake := s3test.NewServer(t)
+	fake.Put("repl/alice/repl-1/main.py", []byte("0123456789"))
+	s3Client := s3.NewS3ClientAt(fake.URL)
+
+	rs := store.NewMemoryStore("")
+	rs.SavePlan(models.Plan{Id: "tiny", Name: "Tiny", StorageBytes: 16})
+	rs.SetUserPlan("alice", "tiny")
+
+	for _, tc := range []struct {
+		name  string
+		sizes map[string]int64
+		fits  bool
+	}{
+		{"fits", map[string]int64{"repl/alice/repl-1/new.py": 6}, true},
+		{"too big", map[string]int64{"repl/alice/repl-1/new.py": 7}, false},
+		{"replaces", map[string]int64{"repl/alice/repl-1/main.py": 16}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckUpload(rs, s3Client, "alice", tc.sizes)
+			var quotaErr *Error
+			if tc.fits && err != nil {
+				t.Errorf("CheckUpload = %v, want nil", err)
+			}
+			if !tc.fits && !errors.As(err, &quotaErr) {
+				t.Errorf("CheckUpload = %v, want a quota error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	log "packages/logging"
+	"sync"
+	"time"
+
+	"core/internal/provisioner"
+	"core/internal/s3"
+	"core/internal/snapshot"
+	"core/internal/store"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	// Time between passes, 0 disables the background reconciler
+	RECONCILE_INTERVAL, _ = time.ParseDuration(dotenv.EnvString("RECONCILE_INTERVAL", "5m"))
+	// How long a repl may stay pending, provisioning or stopping before it's
+	// considered stuck
+	RECONCILE_GRACE, _ = time.ParseDuration(dotenv.EnvString("RECONCILE_GRACE", "10m"))
+	// How long a stopped repl keeps its persistent volume before the workspace
+	// is archived to S3, 0 keeps volumes forever
+	WORKSPACE_ARCHIVE_AFTER, _ = time.ParseDuration(dotenv.EnvString("WORKSPACE_ARCHIVE_AFTER", "168h"))
+)
+
+// Action is one change made by a reconcile pass
+type Action struct {
+	ReplId string `json:"replId,omitempty"`
+	// Set instead of ReplId on actions that aren't about one repl
+	Namespace string `json:"namespace,omitempty"`
+	User      string `json:"user,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+	Error     string `json:"error,omitempty"`
+}
+
+const (
+	ActionDeletedOrphan  = "deleted-orphan"
+	ActionStoppedIdle    = "stopped-idle"
+	ActionMarkedFailed   = "marked-failed"
+	ActionMarkedStopped  = "marked-stopped"
+	ActionClearedSession = "cleared-session"
+	ActionArchived       = "archived-workspace"
+	ActionPruned         = "deleted-namespace"
+)
+
+// Report summarises a reconcile pass
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Workspaces int       `json:"workspaces"`
+	Repls      int       `json:"repls"`
+	Actions    []Action  `json:"actions"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Reconciler brings the repl store and the provisioned runners back in line:
+// it deletes runners without a live repl (flushing their workspaces first),
+// stops runners whose idle shutdown never reached core, fixes repls that
+// are marked active without a runner and deletes tenant namespaces no repl
+// uses anymore.
+type Reconciler struct {
+	rs       store.ReplStore
+	s3Client *s3.S3Client
+	prov     provisioner.Provisioner
+
+	mu   sync.Mutex // one pass at a time
+	last Report
+}
+
+func NewReconciler(rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner) *Reconciler {
+	return &Reconciler{
+		rs:       rs,
+		s3Client: s3Client,
+		prov:     prov,
+	}
+}
+
+// Start runs a pass now and then every RECONCILE_INTERVAL until the context
+// is done
+func (rc *Reconciler) Start(ctx context.Context) {
+	if RECONCILE_INTERVAL <= 0 {
+		log.Info("Reconciler disabled")
+		return
+	}
+
+	log.Info("Reconciler started", "interval", RECONCILE_INTERVAL, "grace", RECONCILE_GRACE)
+	ticker := time.NewTicker(RECONCILE_INTERVAL)
+	defer ticker.Stop()
+
+	// Whatever a restart left behind is fixed without waiting a whole interval
+	rc.Run()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rc.Run()
+		}
+	}
+}
+
+// LastReport returns the report of the latest pass
+func (rc *Reconciler) LastReport() Report {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.last
+}
+
+// Run makes a single pass and returns its report
+func (rc *Reconciler) Run() Report {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	report := Report{StartedAt: time.Now().UTC(), Actions: []Action{}}
+	if err := rc.reconcile(&report); err != nil {
+		report.Error = err.Error()
+		log.Error("Reconcile failed", "error", err)
+	}
+	report.FinishedAt = time.Now().UTC()
+	rc.last = report
+
+	if len(report.Actions) > 0 || report.Error != "" {
+		log.Info("Reconcile finished", "workspaces", report.Workspaces, "repls", report.Repls, "actions", len(report.Actions))
+	}
+	return report
+}
+
+func (rc *Reconciler) reconcile(report *Report) error {
+	listedAt := time.Now().UTC()
+	workspaces, err := rc.prov.List()
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+	repls, err := rc.rs.ListRepls()
+	if err != nil {
+		return fmt.Errorf("failed to list repls: %w", err)
+	}
+	report.Workspaces = len(workspaces)
+	report.Repls = len(repls)
+
+	byId := make(map[string]models.Repl, len(repls))
+	for _, repl := range repls {
+		byId[repl.Id] = repl
+	}
+
+	// A repl that changed since the workspaces were listed may have a runner
+	// the list doesn't show yet, it's left to the next pass
+	changed := func(repl models.Repl) bool {
+		return repl.State.UpdatedAt.After(listedAt)
+	}
+
+	provisioned := make(map[string]bool, len(workspaces))
+	for _, workspace := range workspaces {
+		provisioned[workspace.ReplId] = true
+
+		repl, ok := byId[workspace.ReplId]
+		if !ok {
+			// The repl was deleted, there is no workspace to keep
+			rc.deleteOrphan(report, workspace.ReplId, "", "repl no longer exists")
+			continue
+		}
+		if changed(repl) {
+			continue
+		}
+		if workspace.VolumeOnly {
+			// A stopped persistent workspace, there is no runner
+			rc.reconcileRepl(report, repl)
+			rc.archiveIdle(report, repl)
+			continue
+		}
+		rc.reconcileWorkspace(report, repl, workspace)
+	}
+
+	// Repls that think they're running without a runner
+	for _, repl := range repls {
+		if provisioned[repl.Id] || changed(repl) {
+			continue
+		}
+		rc.reconcileRepl(report, repl)
+	}
+
+	rc.prune(report)
+	return nil
+}
+
+// prune deletes what the provisioner keeps for runners that are all gone,
+// giving a namespace as long as a stuck activation before it counts as unused
+func (rc *Reconciler) prune(report *Report) {
+	pruned, err := rc.prov.Prune(RECONCILE_GRACE)
+	for _, name := range pruned {
+		rc.record(report, Action{Namespace: name, Action: ActionPruned, Reason: "no repls left"})
+	}
+	if err != nil {
+		rc.record(report, Action{Action: ActionPruned, Reason: "prune unused namespaces", Error: err.Error()})
+	}
+}
+
+func (rc *Reconciler) reconcileWorkspace(report *Report, repl models.Repl, workspace provisioner.Workspace) {
+	status := repl.State.Status
+
+	switch {
+	case status == models.ReplStopped || status == models.ReplFailed:
+		if rc.deleteRunner(report, repl, fmt.Sprintf("repl is %s", status)) && repl.IsActive {
+			rc.clearSession(report, repl, "session of a stopped repl")
+		}
+
+	case !rc.stuck(repl):
+		// Activation or shutdown in progress
+
+	case status == models.ReplPending || status == models.ReplProvisioning:
+		if rc.fail(report, repl, fmt.Sprintf("%s for over %s", status, RECONCILE_GRACE)) {
+			rc.deleteOrphan(report, repl.Id, repl.User, "stuck activation")
+		}
+
+	case status == models.ReplStopping:
+		// Stopping can't move to archiving, the repl is stopped first
+		if !rc.markStopped(report, repl, "shutdown never finished") {
+			return
+		}
+		if stopped, err := rc.rs.GetRepl(repl.Id); err == nil {
+			rc.deleteRunner(report, stopped, fmt.Sprintf("stopping for over %s", RECONCILE_GRACE))
+		}
+
+	case status == models.ReplReady && (!workspace.Complete || workspace.Status == provisioner.StatusStopped):
+		if rc.fail(report, repl, "workspace resources missing") {
+			rc.deleteOrphan(report, repl.Id, repl.User, "incomplete workspace")
+		}
+
+	case status == models.ReplReady && workspace.Status == provisioner.StatusRunning:
+		if idle, err := runnerShutDown(rc.prov.Endpoint(repl.Id)); err == nil && idle {
+			rc.stopIdle(report, repl)
+		}
+	}
+}
+
+func (rc *Reconciler) reconcileRepl(report *Report, repl models.Repl) {
+	status := repl.State.Status
+
+	switch {
+	case status == models.ReplReady:
+		rc.fail(report, repl, "workspace missing")
+
+	case (status == models.ReplPending || status == models.ReplProvisioning) && rc.stuck(repl):
+		rc.fail(report, repl, fmt.Sprintf("%s for over %s without a workspace", status, RECONCILE_GRACE))
+
+	case status == models.ReplStopping && rc.stuck(repl):
+		rc.markStopped(report, repl, "shutdown never finished")
+
+	case status == models.ReplArchiving && rc.stuck(repl):
+		// Core restarted while saving the volume, which is left as it was
+		rc.markStopped(report, repl, "archive never finished")
+
+	case !status.IsLive() && status != models.ReplStopping && repl.IsActive:
+		rc.clearSession(report, repl, "stale active flag")
+	}
+}
+
+// stuck reports whether the repl has been in its current status for longer
+// than RECONCILE_GRACE
+func (rc *Reconciler) stuck(repl models.Repl) bool {
+	return time.Since(repl.State.UpdatedAt) > RECONCILE_GRACE
+}
+
+// deleteRunner deletes the runner of a repl the pass saw stopped or failed.
+// The repl is held archiving meanwhile, so it can't be activated onto the
+// runner being deleted, and a repl activated since keeps its runner.
+func (rc *Reconciler) deleteRunner(report *Report, repl models.Repl, reason string) bool {
+	held := false
+	err := provisioner.Archiving(rc.rs, repl, func() error {
+		held = true
+		rc.deleteOrphan(report, repl.Id, repl.User, reason)
+		return nil
+	})
+	if !held {
+		rc.record(report, Action{ReplId: repl.Id, User: repl.User, Action: ActionDeletedOrphan, Reason: reason, Error: err.Error()})
+	}
+	return held
+}
+
+func (rc *Reconciler) deleteOrphan(report *Report, replId, userName, reason string) {
+	action := Action{ReplId: replId, User: userName, Action: ActionDeletedOrphan, Reason: reason}
+	if err := rc.prov.Delete(userName, replId); err != nil {
+		action.Error = err.Error()
+	}
+	rc.record(report, action)
+}
+
+// stopIdle finishes the idle shutdown the runner couldn't report
+func (rc *Reconciler) stopIdle(report *Report, repl models.Repl) {
+	action := Action{ReplId: repl.Id, User: repl.User, Action: ActionStoppedIdle, Reason: "runner shut down but core was never told"}
+
+	if err := store.TransitionFrom(rc.rs, repl.Id, repl.State.Status, models.ReplStopping, "idle shutdown"); err != nil {
+		action.Error = err.Error()
+		rc.record(report, action)
+		return
+	}
+	if err := rc.rs.DeleteReplSession(repl.Id); err != nil {
+		log.Warn("Delete repl session failed", "repl_id", repl.Id, "error", err)
+	}
+
+	snapshot.Auto(rc.s3Client, rc.rs, repl, "Before shutdown")
+
+	if err := rc.prov.Delete(repl.User, repl.Id); err != nil {
+		action.Error = err.Error()
+		if err := store.Transition(rc.rs, repl.Id, models.ReplFailed, err.Error()); err != nil {
+			log.Warn("Update repl status failed", "repl_id", repl.Id, "error", err)
+		}
+	} else if err := store.Transition(rc.rs, repl.Id, models.ReplStopped, "idle shutdown"); err != nil {
+		log.Warn("Update repl status failed", "repl_id", repl.Id, "error", err)
+	}
+	rc.record(report, action)
+}
+
+// archiveIdle moves the persistent workspace of a long stopped repl to S3
+func (rc *Reconciler) archiveIdle(report *Report, repl models.Repl) {
+	status := repl.State.Status
+	if WORKSPACE_ARCHIVE_AFTER <= 0 || (status != models.ReplStopped && status != models.ReplFailed) {
+		return
+	}
+	if time.Since(repl.State.UpdatedAt) < WORKSPACE_ARCHIVE_AFTER {
+		return
+	}
+
+	action := Action{ReplId: repl.Id, User: repl.User, Action: ActionArchived, Reason: fmt.Sprintf("stopped for over %s", WORKSPACE_ARCHIVE_AFTER)}
+	err := provisioner.Archiving(rc.rs, repl, func() error {
+		return rc.prov.Archive(repl.User, repl.Id)
+	})
+	if err != nil {
+		action.Error = err.Error()
+	}
+	rc.record(report, action)
+}
+
+// fail marks the repl failed, only while it still has the status the pass
+// saw, and reports whether it did
+func (rc *Reconciler) fail(report *Report, repl models.Repl, reason string) bool {
+	return rc.settle(report, repl, models.ReplFailed, Action{ReplId: repl.Id, User: repl.User, Action: ActionMarkedFailed, Reason: reason})
+}
+
+func (rc *Reconciler) markStopped(report *Report, repl models.Repl, reason string) bool {
+	return rc.settle(report, repl, models.ReplStopped, Action{ReplId: repl.Id, User: repl.User, Action: ActionMarkedStopped, Reason: reason})
+}
+
+// settle moves a repl the pass saw stuck to a final status and ends its
+// session, a repl that moved on meanwhile is left alone
+func (rc *Reconciler) settle(report *Report, repl models.Repl, to models.ReplStatus, action Action) bool {
+	if err := store.TransitionFrom(rc.rs, repl.Id, repl.State.Status, to, action.Reason); err != nil {
+		action.Error = err.Error()
+		rc.record(report, action)
+		return false
+	}
+	if err := rc.rs.DeleteReplSession(repl.Id); err != nil {
+		log.Warn("Delete repl session failed", "repl_id", repl.Id, "error", err)
+	}
+	rc.record(report, action)
+	return true
+}
+
+func (rc *Reconciler) clearSession(report *Report, repl models.Repl, reason string) {
+	action := Action{ReplId: repl.Id, User: repl.User, Action: ActionClearedSession, Reason: reason}
+	if err := rc.rs.DeleteReplSession(repl.Id); err != nil {
+		action.Error = err.Error()
+	}
+	rc.record(report, action)
+}
+
+func (rc *Reconciler) record(report *Report, action Action) {
+	if action.Error != "" {
+		log.Warn("Reconcile action failed", "repl_id", action.ReplId, "namespace", action.Namespace, "action", action.Action, "reason", action.Reason, "error", action.Error)
+	} else {
+		log.Info("Reconcile action", "repl_id", action.ReplId, "namespace", action.Namespace, "action", action.Action, "reason", action.Reason)
+	}
+	report.Actions = append(report.Actions, action)
+}
+
+var statusClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// runnerShutDown asks the runner whether its idle shutdown already fired
+func runnerShutDown(endpoint string) (bool, error) {
+	resp, err := statusClient.Get(endpoint + "/status")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var status struct {
+		Shutdown bool `json:"shutdown"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, err
+	}
+	return status.Shutdown, nil
+}
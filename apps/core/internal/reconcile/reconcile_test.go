@@ -0,0 +1,230 @@
+package reconcile
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"core/internal/provisioner"
+	"core/internal/store"
+	"core/models"
+)
+
+// fakeProvisioner has a runner for every repl in workspaces and records the
+// runners it's asked to delete
+type fakeProvisioner struct {
+	provisioner.Provisioner
+
+	mu         sync.Mutex
+	workspaces []provisioner.Workspace
+	deleted    []string
+	// Returned by Prune, which records the minimum age it was given
+	unused []string
+	minAge time.Duration
+	// Called while deleting, outside the lock
+	onDelete func(replId string)
+}
+
+func (f *fakeProvisioner) List() ([]provisioner.Workspace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.workspaces), nil
+}
+
+func (f *fakeProvisioner) Delete(userName, replId string) error {
+	if f.onDelete != nil {
+		f.onDelete(replId)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, replId)
+	return nil
+}
+
+func (f *fakeProvisioner) Prune(minAge time.Duration) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.minAge = minAge
+	pruned := f.unused
+	f.unused = nil
+	return pruned, nil
+}
+
+func (f *fakeProvisioner) Endpoint(replId string) string {
+	return "http://127.0.0.1:0"
+}
+
+func (f *fakeProvisioner) Deleted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.deleted)
+}
+
+// staleStore lists the repls as they were before the last status changes,
+// like a pass that read them just before a user activated one
+type staleStore struct {
+	store.ReplStore
+	listed []models.Repl
+}
+
+func (s *staleStore) ListRepls() ([]models.Repl, error) {
+	return s.listed, nil
+}
+
+func running(replIds ...string) *fakeProvisioner {
+	prov := &fakeProvisioner{}
+	for _, replId := range replIds {
+		prov.workspaces = append(prov.workspaces, provisioner.Workspace{ReplId: replId, Status: provisioner.StatusRunning, Complete: true})
+	}
+	return prov
+}
+
+func setStatus(t *testing.T, rs store.ReplStore, replId string, statuses ...models.ReplStatus) {
+	t.Helper()
+	for _, status := range statuses {
+		if err := store.Transition(rs, replId, status, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconcileDeletesRunnerOfStoppedRepl(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	prov := running("repl-1", "repl-gone")
+
+	report := NewReconciler(rs, nil, prov).Run()
+
+	if deleted := prov.Deleted(); !slices.Equal(deleted, []string{"repl-1", "repl-gone"}) {
+		t.Errorf("deleted runners = %v, report %+v", deleted, report)
+	}
+}
+
+func TestReconcileKeepsRunnerOfReactivatedRepl(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	before, _ := rs.ListRepls()
+
+	// Activated after the pass listed it as stopped
+	setStatus(t, rs, "repl-1", models.ReplPending, models.ReplProvisioning, models.ReplReady)
+	prov := running("repl-1")
+
+	report := NewReconciler(&staleStore{ReplStore: rs, listed: before}, nil, prov).Run()
+
+	if deleted := prov.Deleted(); len(deleted) > 0 {
+		t.Errorf("deleted the runner of a ready repl: %v", deleted)
+	}
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplReady {
+		t.Errorf("status = %s, want ready", repl.State.Status)
+	}
+	if len(report.Actions) != 1 || report.Actions[0].Error == "" {
+		t.Errorf("actions = %+v, want one failed delete", report.Actions)
+	}
+}
+
+func TestReconcileHoldsReplWhileDeletingRunner(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	prov := running("repl-1")
+	prov.onDelete = func(replId string) {
+		if err := store.Transition(rs, replId, models.ReplPending, ""); err == nil {
+			t.Error("repl activated while its runner was deleted")
+		}
+	}
+
+	NewReconciler(rs, nil, prov).Run()
+
+	if deleted := prov.Deleted(); !slices.Equal(deleted, []string{"repl-1"}) {
+		t.Errorf("deleted runners = %v", deleted)
+	}
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplStopped {
+		t.Errorf("status after delete = %s, want stopped", repl.State.Status)
+	}
+}
+
+func TestReconcileDoesNotFailRecoveredRepl(t *testing.T) {
+	grace := RECONCILE_GRACE
+	RECONCILE_GRACE = 0
+	t.Cleanup(func() { RECONCILE_GRACE = grace })
+
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	setStatus(t, rs, "repl-1", models.ReplPending)
+	before, _ := rs.ListRepls()
+
+	// Provisioning finished after the pass saw the repl pending for too long
+	setStatus(t, rs, "repl-1", models.ReplProvisioning, models.ReplReady)
+	prov := running("repl-1")
+
+	NewReconciler(&staleStore{ReplStore: rs, listed: before}, nil, prov).Run()
+
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplReady {
+		t.Errorf("status = %s, want ready", repl.State.Status)
+	}
+	if deleted := prov.Deleted(); len(deleted) > 0 {
+		t.Errorf("deleted the runner of a ready repl: %v", deleted)
+	}
+}
+
+func TestReconcileFailsStuckActivation(t *testing.T) {
+	grace := RECONCILE_GRACE
+	RECONCILE_GRACE = 0
+	t.Cleanup(func() { RECONCILE_GRACE = grace })
+
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	setStatus(t, rs, "repl-1", models.ReplPending)
+	prov := running("repl-1")
+
+	NewReconciler(rs, nil, prov).Run()
+
+	if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplFailed {
+		t.Errorf("status = %s, want failed", repl.State.Status)
+	}
+	if deleted := prov.Deleted(); !slices.Equal(deleted, []string{"repl-1"}) {
+		t.Errorf("deleted runners = %v", deleted)
+	}
+}
+
+func TestStartRunsImmediately(t *testing.T) {
+	interval := RECONCILE_INTERVAL
+	RECONCILE_INTERVAL = time.Hour
+	t.Cleanup(func() { RECONCILE_INTERVAL = interval })
+
+	rc := NewReconciler(store.NewMemoryStore(""), nil, running())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rc.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rc.LastReport().StartedAt.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("Start didn't run a pass before the first interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconcilePrunesUnusedNamespaces(t *testing.T) {
+	prov := running()
+	prov.unused = []string{"devex-user-bob"}
+
+	report := NewReconciler(store.NewMemoryStore(""), nil, prov).Run()
+
+	want := Action{Namespace: "devex-user-bob", Action: ActionPruned, Reason: "no repls left"}
+	if len(report.Actions) != 1 || report.Actions[0] != want {
+		t.Errorf("actions = %+v, want %+v", report.Actions, want)
+	}
+	if prov.minAge != RECONCILE_GRACE {
+		t.Errorf("Prune kept namespaces used within %s, want %s", prov.minAge, RECONCILE_GRACE)
+	}
+}
@@ -2,9 +2,15 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "packages/logging"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
 	"core/models"
 	"core/pkg/dotenv"
 
@@ -46,11 +52,13 @@ func (r *Redis) Ping() error {
 // Helper Functinos
 func (r *Redis) CreateRepl(template, username, replName, replId string) error {
 	if err := r.client.HSet(r.ctx, "repl:"+replId, map[string]string{
-		"id":       replId,
-		"name":     replName,
-		"user":     username,
-		"template": template,
-		"isActive": "false",
+		"id":              replId,
+		"name":            replName,
+		"user":            username,
+		"template":        template,
+		"isActive":        "false",
+		"status":          string(models.ReplStopped),
+		"statusUpdatedAt": time.Now().UTC().Format(time.RFC3339),
 	}).Err(); err != nil {
 		return err
 	}
@@ -83,8 +91,19 @@ func (r *Redis) DeleteRepl(replId string) error {
 		return fmt.Errorf("failed to remove repl from user set: %w", err)
 	}
 
+	// Unshare the repl
+	collaborators, err := r.client.HKeys(r.ctx, "collaborators:"+replId).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get collaborators: %w", err)
+	}
+	for _, collaborator := range collaborators {
+		if err := r.client.SRem(r.ctx, "shared:"+collaborator, replId).Err(); err != nil {
+			return fmt.Errorf("failed to remove repl from shared set: %w", err)
+		}
+	}
+
 	// Delete the repl hash
-	if err := r.client.Del(r.ctx, "repl:"+replId).Err(); err != nil {
+	if err := r.client.Del(r.ctx, "repl:"+replId, "collaborators:"+replId).Err(); err != nil {
 		return fmt.Errorf("failed to delete repl: %w", err)
 	}
 
@@ -108,11 +127,34 @@ func (r *Redis) GetRepl(replId string) (models.Repl, error) {
 		User:     data["user"],
 		Template: data["template"],
 		IsActive: data["isActive"] == "true",
+		State:    replState(data),
+
+		RunnerVersion: data["runnerVersion"],
+	}
+	if t, err := time.Parse(time.RFC3339, data["sessionStartedAt"]); err == nil {
+		repl.SessionStartedAt = t
 	}
 
 	return repl, nil
 }
 
+// ListRepls returns every repl, used by background jobs
+func (r *Redis) ListRepls() ([]models.Repl, error) {
+	var repls []models.Repl
+	iter := r.client.Scan(r.ctx, 0, "repl:*", 100).Iterator()
+	for iter.Next(r.ctx) {
+		repl, err := r.GetRepl(strings.TrimPrefix(iter.Val(), "repl:"))
+		if err != nil {
+			continue
+		}
+		repls = append(repls, repl)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return repls, nil
+}
+
 // user-repl relationship
 func (r *Redis) CreateUserRepl(username, replId string) error {
 	return r.client.SAdd(r.ctx, "user:"+username, replId).Err()
@@ -122,11 +164,682 @@ func (r *Redis) GetUserRepls(username string) ([]string, error) {
 	return r.client.SMembers(r.ctx, "user:"+username).Result()
 }
 
+func (r *Redis) SetReplOwner(replId, username string) error {
+	owner, err := r.client.HGet(r.ctx, "repl:"+replId, "user").Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.ctx, "repl:"+replId, "user", username)
+		pipe.SRem(r.ctx, "user:"+owner, replId)
+		pipe.SAdd(r.ctx, "user:"+username, replId)
+		return nil
+	})
+	return err
+}
+
 // Repl Session
 func (r *Redis) CreateReplSession(replId string) error {
-	return r.client.HSet(r.ctx, "repl:"+replId, "isActive", "true").Err()
+	return r.client.HSet(r.ctx, "repl:"+replId, map[string]string{
+		"isActive":         "true",
+		"sessionStartedAt": time.Now().UTC().Format(time.RFC3339),
+	}).Err()
 }
 
+// DeleteReplSession ends the session and adds its duration to the owner's
+// session usage for the current month.
 func (r *Redis) DeleteReplSession(replId string) error {
-	return r.client.HSet(r.ctx, "repl:"+replId, "isActive", "false").Err()
+	data, err := r.client.HMGet(r.ctx, "repl:"+replId, "user", "sessionStartedAt").Result()
+	if err != nil {
+		return err
+	}
+
+	if err := r.client.HSet(r.ctx, "repl:"+replId, "isActive", "false").Err(); err != nil {
+		return err
+	}
+
+	// Only the caller that actually removes the start time records the usage
+	removed, err := r.client.HDel(r.ctx, "repl:"+replId, "sessionStartedAt").Result()
+	if err != nil || removed == 0 {
+		return err
+	}
+
+	username, _ := data[0].(string)
+	startedAt, _ := data[1].(string)
+	start, err := time.Parse(time.RFC3339, startedAt)
+	if username == "" || err != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	seconds := int64(now.Sub(start).Seconds())
+	return r.client.IncrBy(r.ctx, usageKey(username, now), seconds).Err()
+}
+
+func (r *Redis) GetSessionUsage(username string, month time.Time) (time.Duration, error) {
+	seconds, err := r.client.Get(r.ctx, usageKey(username, month)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func (r *Redis) SetRunnerVersion(replId, version string) error {
+	return r.client.HSet(r.ctx, "repl:"+replId, "runnerVersion", version).Err()
+}
+
+func usageKey(username string, month time.Time) string {
+	return fmt.Sprintf("usage:%s:%s", username, month.UTC().Format("2006-01"))
+}
+
+// Repl Status
+func (r *Redis) SetReplStatus(replId string, state models.ReplState) error {
+	exists, err := r.client.Exists(r.ctx, "repl:"+replId).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+
+	return r.client.HSet(r.ctx, "repl:"+replId, map[string]string{
+		"status":          string(state.Status),
+		"statusReason":    state.Reason,
+		"statusFailure":   string(state.Failure),
+		"statusUpdatedAt": time.Now().UTC().Format(time.RFC3339),
+	}).Err()
+}
+
+// compareAndSetStatus sets the status fields only while the repl has the
+// expected status, falling back to isActive like replState does.
+// Returns -1 for a missing repl, 0 when the status differs and 1 when set.
+var compareAndSetStatus = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local status = redis.call("HGET", KEYS[1], "status")
+if not status or status == "" then
+	if redis.call("HGET", KEYS[1], "isActive") == "true" then
+		status = ARGV[7]
+	else
+		status = ARGV[6]
+	end
+end
+if status ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "status", ARGV[2], "statusReason", ARGV[3], "statusFailure", ARGV[4], "statusUpdatedAt", ARGV[5])
+return 1
+`)
+
+func (r *Redis) CompareAndSetReplStatus(replId string, from models.ReplStatus, state models.ReplState) (bool, error) {
+	result, err := compareAndSetStatus.Run(r.ctx, r.client, []string{"repl:" + replId},
+		string(from),
+		string(state.Status),
+		state.Reason,
+		string(state.Failure),
+		time.Now().UTC().Format(time.RFC3339),
+		string(models.ReplStopped),
+		string(models.ReplReady),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	if result < 0 {
+		return false, fmt.Errorf("repl not found: %s", replId)
+	}
+	return result == 1, nil
+}
+
+// replState reads the status fields of a repl hash. Repls created before
+// statuses existed only carry isActive, so it is used as the fallback.
+func replState(data map[string]string) models.ReplState {
+	state := models.ReplState{
+		Status:  models.ReplStatus(data["status"]),
+		Reason:  data["statusReason"],
+		Failure: models.FailureCode(data["statusFailure"]),
+	}
+	if state.Status == "" {
+		state.Status = models.ReplStopped
+		if data["isActive"] == "true" {
+			state.Status = models.ReplReady
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, data["statusUpdatedAt"]); err == nil {
+		state.UpdatedAt = t
+	}
+	return state
+}
+
+// Repl Snapshots
+func (r *Redis) CreateSnapshot(snapshot models.Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(r.ctx, "snapshots:"+snapshot.ReplId, snapshot.Id, data).Err()
+}
+
+func (r *Redis) GetSnapshot(replId, snapshotId string) (models.Snapshot, error) {
+	data, err := r.client.HGet(r.ctx, "snapshots:"+replId, snapshotId).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Snapshot{}, errors.New("No such Snapshot Found")
+	}
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+
+	var snapshot models.Snapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		return models.Snapshot{}, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// GetSnapshots returns the repl's snapshots, newest first
+func (r *Redis) GetSnapshots(replId string) ([]models.Snapshot, error) {
+	data, err := r.client.HGetAll(r.ctx, "snapshots:"+replId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]models.Snapshot, 0, len(data))
+	for id, raw := range data {
+		var snapshot models.Snapshot
+		if err := json.Unmarshal([]byte(raw), &snapshot); err != nil {
+			log.Warn("Skipping undecodable snapshot", "repl_id", replId, "snapshot_id", id, "error", err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func (r *Redis) DeleteSnapshot(replId, snapshotId string) error {
+	return r.client.HDel(r.ctx, "snapshots:"+replId, snapshotId).Err()
+}
+
+// Plans
+func (r *Redis) SavePlan(plan models.Plan) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Set(r.ctx, "plan:"+plan.Id, data, 0).Err(); err != nil {
+		return err
+	}
+	return r.client.SAdd(r.ctx, "plans", plan.Id).Err()
+}
+
+func (r *Redis) GetPlan(planId string) (models.Plan, error) {
+	data, err := r.client.Get(r.ctx, "plan:"+planId).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Plan{}, fmt.Errorf("plan not found: %s", planId)
+	}
+	if err != nil {
+		return models.Plan{}, err
+	}
+
+	var plan models.Plan
+	if err := json.Unmarshal([]byte(data), &plan); err != nil {
+		return models.Plan{}, fmt.Errorf("failed to decode plan: %w", err)
+	}
+	return plan, nil
+}
+
+func (r *Redis) GetPlans() ([]models.Plan, error) {
+	ids, err := r.client.SMembers(r.ctx, "plans").Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	plans := make([]models.Plan, 0, len(ids))
+	for _, id := range ids {
+		plan, err := r.GetPlan(id)
+		if err != nil {
+			log.Warn("Plan listed but not found", "plan_id", id, "error", err)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// GetUserPlan returns the id of the user's plan, or "" if none was assigned
+func (r *Redis) GetUserPlan(username string) (string, error) {
+	planId, err := r.client.Get(r.ctx, "user-plan:"+username).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return planId, err
+}
+
+func (r *Redis) SetUserPlan(username, planId string) error {
+	return r.client.Set(r.ctx, "user-plan:"+username, planId, 0).Err()
+}
+
+// GetUserOrg returns the user's organization, or "" if they have none
+func (r *Redis) GetUserOrg(username string) (string, error) {
+	org, err := r.client.Get(r.ctx, "user-org:"+username).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return org, err
+}
+
+// SetUserOrg moves the user to the organization, an empty org removes them
+func (r *Redis) SetUserOrg(username, org string) error {
+	if org == "" {
+		return r.client.Del(r.ctx, "user-org:"+username).Err()
+	}
+	return r.client.Set(r.ctx, "user-org:"+username, org, 0).Err()
+}
+
+// Repl Collaborators
+func (r *Redis) AddCollaborator(replId string, collaborator models.Collaborator) error {
+	data, err := json.Marshal(collaborator)
+	if err != nil {
+		return err
+	}
+	if err := r.client.HSet(r.ctx, "collaborators:"+replId, collaborator.User, data).Err(); err != nil {
+		return err
+	}
+	return r.client.SAdd(r.ctx, "shared:"+collaborator.User, replId).Err()
+}
+
+func (r *Redis) GetCollaborator(replId, username string) (models.Collaborator, error) {
+	data, err := r.client.HGet(r.ctx, "collaborators:"+replId, username).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Collaborator{}, errors.New("No such Collaborator Found")
+	}
+	if err != nil {
+		return models.Collaborator{}, err
+	}
+
+	var collaborator models.Collaborator
+	if err := json.Unmarshal([]byte(data), &collaborator); err != nil {
+		return models.Collaborator{}, fmt.Errorf("failed to decode collaborator: %w", err)
+	}
+	return collaborator, nil
+}
+
+func (r *Redis) GetCollaborators(replId string) ([]models.Collaborator, error) {
+	data, err := r.client.HGetAll(r.ctx, "collaborators:"+replId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	collaborators := make([]models.Collaborator, 0, len(data))
+	for user, raw := range data {
+		var collaborator models.Collaborator
+		if err := json.Unmarshal([]byte(raw), &collaborator); err != nil {
+			log.Warn("Skipping undecodable collaborator", "repl_id", replId, "user", user, "error", err)
+			continue
+		}
+		collaborators = append(collaborators, collaborator)
+	}
+
+	sort.Slice(collaborators, func(i, j int) bool {
+		return collaborators[i].AddedAt.Before(collaborators[j].AddedAt)
+	})
+	return collaborators, nil
+}
+
+func (r *Redis) RemoveCollaborator(replId, username string) error {
+	if err := r.client.HDel(r.ctx, "collaborators:"+replId, username).Err(); err != nil {
+		return err
+	}
+	return r.client.SRem(r.ctx, "shared:"+username, replId).Err()
+}
+
+// GetSharedRepls returns the ids of repls shared with the user
+func (r *Redis) GetSharedRepls(username string) ([]string, error) {
+	return r.client.SMembers(r.ctx, "shared:"+username).Result()
+}
+
+// Personal access tokens, stored under the hash of their secret and indexed
+// by user in a hash of token id to secret hash
+func (r *Redis) CreateAccessToken(hash string, token models.AccessToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Set(r.ctx, "access-token:"+hash, data, 0).Err(); err != nil {
+		return err
+	}
+	return r.client.HSet(r.ctx, "access-tokens:"+token.User.ID, token.Id, hash).Err()
+}
+
+func (r *Redis) GetAccessToken(hash string) (models.AccessToken, error) {
+	data, err := r.client.Get(r.ctx, "access-token:"+hash).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.AccessToken{}, errors.New("No such Access Token Found")
+	}
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	var token models.AccessToken
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return models.AccessToken{}, fmt.Errorf("failed to decode access token: %w", err)
+	}
+	return token, nil
+}
+
+// ListAccessTokens returns the user's tokens, newest first
+func (r *Redis) ListAccessTokens(userId string) ([]models.AccessToken, error) {
+	hashes, err := r.client.HGetAll(r.ctx, "access-tokens:"+userId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]models.AccessToken, 0, len(hashes))
+	for id, hash := range hashes {
+		token, err := r.GetAccessToken(hash)
+		if err != nil {
+			log.Warn("Access token listed but not found", "user", userId, "token_id", id, "error", err)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (r *Redis) DeleteAccessToken(userId, tokenId string) error {
+	hash, err := r.client.HGet(r.ctx, "access-tokens:"+userId, tokenId).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.client.Del(r.ctx, "access-token:"+hash).Err(); err != nil {
+		return err
+	}
+	return r.client.HDel(r.ctx, "access-tokens:"+userId, tokenId).Err()
+}
+
+func (r *Redis) SetAccessTokenUsed(hash string, at time.Time) error {
+	token, err := r.GetAccessToken(hash)
+	if err != nil {
+		return err
+	}
+	token.LastUsedAt = at.UTC()
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	// Only while the token exists, a revoke may have raced the request
+	return r.client.SetXX(r.ctx, "access-token:"+hash, data, redis.KeepTTL).Err()
+}
+
+// Login sessions, stored under the hash of their cookie secret until they
+// expire and indexed by user in a hash of session id to secret hash
+func (r *Redis) CreateSession(hash string, session models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return errors.New("session already expired")
+	}
+	if err := r.client.Set(r.ctx, "login-session:"+hash, data, ttl).Err(); err != nil {
+		return err
+	}
+	return r.client.HSet(r.ctx, "login-sessions:"+session.TokenInfo.User.ID, session.Id, hash).Err()
+}
+
+func (r *Redis) GetSession(hash string) (models.Session, error) {
+	data, err := r.client.Get(r.ctx, "login-session:"+hash).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Session{}, errors.New("No such Session Found")
+	}
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	var session models.Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return models.Session{}, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return session, nil
+}
+
+func (r *Redis) UpdateSession(hash string, session models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	// Only while the session exists, a revoke may have raced the request
+	return r.client.SetXX(r.ctx, "login-session:"+hash, data, redis.KeepTTL).Err()
+}
+
+// ListSessions returns the user's live sessions, most recently seen first.
+// Index entries of sessions that expired are dropped on the way.
+func (r *Redis) ListSessions(userId string) ([]models.Session, error) {
+	hashes, err := r.client.HGetAll(r.ctx, "login-sessions:"+userId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]models.Session, 0, len(hashes))
+	for id, hash := range hashes {
+		session, err := r.GetSession(hash)
+		if err != nil {
+			r.client.HDel(r.ctx, "login-sessions:"+userId, id)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (r *Redis) DeleteSession(userId, sessionId string) error {
+	hash, err := r.client.HGet(r.ctx, "login-sessions:"+userId, sessionId).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.client.Del(r.ctx, "login-session:"+hash).Err(); err != nil {
+		return err
+	}
+	return r.client.HDel(r.ctx, "login-sessions:"+userId, sessionId).Err()
+}
+
+// DeleteSessions revokes every session of the user
+func (r *Redis) DeleteSessions(userId string) error {
+	hashes, err := r.client.HGetAll(r.ctx, "login-sessions:"+userId).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{"login-sessions:" + userId}
+	for _, hash := range hashes {
+		keys = append(keys, "login-session:"+hash)
+	}
+	return r.client.Del(r.ctx, keys...).Err()
+}
+
+// User registry. Accounts are stored by id, handles and identities are
+// claimed with SETNX so two accounts can never share one.
+func (r *Redis) CreateUser(account models.Account) error {
+	ok, err := r.client.SetNX(r.ctx, "account-handle:"+account.Handle, account.Id, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return models.ErrHandleTaken
+	}
+
+	claimed := []string{"account-handle:" + account.Handle}
+	for _, identity := range account.Identities {
+		key := identityKey(identity.Provider, identity.Subject)
+		ok, err := r.client.SetNX(r.ctx, key, account.Id, 0).Result()
+		if err != nil || !ok {
+			r.client.Del(r.ctx, claimed...)
+			if err != nil {
+				return err
+			}
+			return models.ErrIdentityLinked
+		}
+		claimed = append(claimed, key)
+	}
+
+	return r.saveUser(account)
+}
+
+func (r *Redis) GetUser(userId string) (models.Account, error) {
+	data, err := r.client.Get(r.ctx, "account:"+userId).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Account{}, errors.New("No such User Found")
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+
+	var account models.Account
+	if err := json.Unmarshal([]byte(data), &account); err != nil {
+		return models.Account{}, fmt.Errorf("failed to decode user: %w", err)
+	}
+	return account, nil
+}
+
+func (r *Redis) GetUserByHandle(handle string) (models.Account, error) {
+	userId, err := r.client.Get(r.ctx, "account-handle:"+handle).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Account{}, errors.New("No such User Found")
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+	return r.GetUser(userId)
+}
+
+func (r *Redis) GetUserByIdentity(provider models.IdentityProvider, subject string) (models.Account, error) {
+	userId, err := r.client.Get(r.ctx, identityKey(provider, subject)).Result()
+	if errors.Is(err, redis.Nil) {
+		return models.Account{}, errors.New("No such User Found")
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+	return r.GetUser(userId)
+}
+
+// LinkIdentity adds a sign-in identity to the account, linking one the
+// account already has is a no-op
+func (r *Redis) LinkIdentity(userId string, identity models.Identity) error {
+	account, err := r.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	key := identityKey(identity.Provider, identity.Subject)
+	ok, err := r.client.SetNX(r.ctx, key, userId, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		owner, err := r.client.Get(r.ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if owner != userId {
+			return models.ErrIdentityLinked
+		}
+		return nil
+	}
+
+	account.Identities = append(account.Identities, identity)
+	return r.saveUser(account)
+}
+
+func (r *Redis) UnlinkIdentity(userId string, provider models.IdentityProvider, subject string) error {
+	account, err := r.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if !account.HasIdentity(provider, subject) {
+		return errors.New("No such Identity Found")
+	}
+	account.Identities = slices.DeleteFunc(account.Identities, func(identity models.Identity) bool {
+		return identity.Provider == provider && identity.Subject == subject
+	})
+
+	if err := r.saveUser(account); err != nil {
+		return err
+	}
+	return r.client.Del(r.ctx, identityKey(provider, subject)).Err()
+}
+
+func (r *Redis) saveUser(account models.Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.ctx, "account:"+account.Id, data, 0).Err()
+}
+
+func identityKey(provider models.IdentityProvider, subject string) string {
+	return fmt.Sprintf("account-identity:%s:%s", provider, subject)
+}
+
+// Magic links are kept until they expire, consuming one deletes it
+func (r *Redis) SaveMagicLink(jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return errors.New("magic link already expired")
+	}
+	return r.client.Set(r.ctx, "magic-link:"+jti, "1", ttl).Err()
+}
+
+// ConsumeMagicLink reports whether the link was still unused
+func (r *Redis) ConsumeMagicLink(jti string) (bool, error) {
+	deleted, err := r.client.Del(r.ctx, "magic-link:"+jti).Result()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
+
+// countAttempt increments the key and starts its window on the first attempt,
+// in one step so a key can't be left without expiry. Keys left without one
+// by the old two-step count get it on their next attempt.
+var countAttempt = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 or redis.call("PTTL", KEYS[1]) < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// CountAttempt records an attempt and returns the attempts of the key in the
+// current window, which starts with the first one
+func (r *Redis) CountAttempt(key string, window time.Duration) (int64, error) {
+	return countAttempt.Run(r.ctx, r.client, []string{"rate-limit:" + key}, window.Milliseconds()).Int64()
 }
@@ -0,0 +1,204 @@
+// Package runnersync lets runners checkpoint their workspace to S3 through
+// core: a runner holds a sync token scoped to its repl, and core triggers a
+// final checkpoint before tearing the runner down. Core also sends notices
+// to the runners' connected users.
+package runnersync
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"core/pkg/dotenv"
+	"packages/utils/token"
+)
+
+var (
+	// Signs the runners' sync tokens. It never leaves core, like
+	// RUNNER_TOKEN_SECRET runners only get a key derived for their repl from.
+	RUNNER_SYNC_SECRET = dotenv.EnvString("RUNNER_SYNC_SECRET", "")
+	// Where runners reach core, handed to them as CORE_URL
+	RUNNER_CORE_URL = dotenv.EnvString("RUNNER_CORE_URL", "")
+	// How often runners checkpoint their workspace, 0 only syncs on demand
+	RUNNER_SYNC_INTERVAL = dotenv.EnvString("RUNNER_SYNC_INTERVAL", "30s")
+
+	RUNNER_TOKEN_SECRET = dotenv.EnvString("RUNNER_TOKEN_SECRET", "")
+)
+
+// TokenKey is the key the repl's runner verifies tokens with, empty without
+// RUNNER_TOKEN_SECRET
+func TokenKey(replId string) string {
+	if RUNNER_TOKEN_SECRET == "" {
+		return ""
+	}
+	return token.ReplKey(RUNNER_TOKEN_SECRET, replId)
+}
+
+const (
+	role = "sync"
+	// Outlives any session, the token is only good for the repl's own prefix
+	tokenTTL = 7 * 24 * time.Hour
+)
+
+// Enabled reports whether runners get a sync token, they need core's URL to
+// use it
+func Enabled() bool {
+	return RUNNER_SYNC_SECRET != "" && RUNNER_CORE_URL != ""
+}
+
+// Sign issues the token a runner presents to the sync routes
+func Sign(userName, replId string) (string, error) {
+	return token.Sign(RUNNER_SYNC_SECRET, token.Claims{
+		ReplId:    replId,
+		User:      userName,
+		Role:      role,
+		ExpiresAt: time.Now().Add(tokenTTL).Unix(),
+	})
+}
+
+// Verify checks that the token was issued for the repl's runner. Local
+// runners reach core without RUNNER_CORE_URL, only the secret is needed.
+func Verify(tok, replId string) error {
+	if RUNNER_SYNC_SECRET == "" {
+		return fmt.Errorf("runner sync is disabled")
+	}
+	claims, err := token.Verify(RUNNER_SYNC_SECRET, tok)
+	if err != nil {
+		return err
+	}
+	if claims.Role != role || claims.ReplId != replId {
+		return fmt.Errorf("token issued for %s", claims.ReplId)
+	}
+	return nil
+}
+
+var client = &http.Client{
+	// A checkpoint after a long idle period can take a while
+	Timeout: 10 * time.Minute,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// Checkpoint asks the runner at endpoint to sync its workspace now and waits
+// for it. It fails for runners without sync, callers then fall back to
+// uploading the workspace themselves. Runners only take the request with an
+// owner token, so it needs RUNNER_TOKEN_SECRET.
+func Checkpoint(endpoint, replId string) error {
+	if RUNNER_TOKEN_SECRET == "" {
+		return fmt.Errorf("runner sync needs RUNNER_TOKEN_SECRET")
+	}
+	url, err := runnerURL(endpoint, "/api/v1/repl/sync", replId)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("runner sync failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("runner sync failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notice is shown to everyone connected to a runner
+type Notice struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at,omitzero"`
+}
+
+const NoticeRestart = "restart"
+
+// Notify sends the notice to the users connected to the runner at endpoint
+// and returns how many sessions got it
+func Notify(endpoint, replId string, notice Notice) (int, error) {
+	url, err := runnerURL(endpoint, "/api/v1/repl/notice", replId)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("runner notice failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("runner notice failed with status %d", resp.StatusCode)
+	}
+	var res struct {
+		Delivered int `json:"delivered"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, err
+	}
+	return res.Delivered, nil
+}
+
+// Claim hands the warm runner poolId, now routed at endpoint, to the repl
+// and waits until it restored the workspace. The runner swaps the pool's
+// token key for the repl's. Requests are retried while the new route isn't
+// serving yet.
+func Claim(endpoint, poolId, replId, syncToken string, timeout time.Duration) error {
+	body, err := json.Marshal(map[string]string{"replId": replId, "syncToken": syncToken, "tokenKey": TokenKey(replId)})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// Tokens are short-lived, sign one per attempt
+		url, err := runnerURL(endpoint, "/api/v1/pool/claim", poolId)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				return nil
+			case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				err = fmt.Errorf("route not ready, status %d", resp.StatusCode)
+			default:
+				return fmt.Errorf("runner claim failed with status %d", resp.StatusCode)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("runner claim failed: %w", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// runnerURL is the URL of a runner route, with the short-lived owner token
+// runners check when RUNNER_TOKEN_SECRET is set
+func runnerURL(endpoint, path, replId string) (string, error) {
+	url := endpoint + path
+	if RUNNER_TOKEN_SECRET == "" {
+		return url, nil
+	}
+	tok, err := token.Sign(TokenKey(replId), token.Claims{
+		ReplId:    replId,
+		User:      "core",
+		Role:      "owner",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return url + "?token=" + tok, nil
+}
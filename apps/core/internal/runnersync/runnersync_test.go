@@ -0,0 +1,34 @@
+package runnersync
+
+import (
+	"net/url"
+	"testing"
+
+	"packages/utils/token"
+)
+
+func TestTokenKey(t *testing.T) {
+	RUNNER_TOKEN_SECRET = ""
+	if key := TokenKey("repl-1"); key != "" {
+		t.Errorf("TokenKey without a secret = %q", key)
+	}
+
+	RUNNER_TOKEN_SECRET = "secret"
+	t.Cleanup(func() { RUNNER_TOKEN_SECRET = "" })
+	if TokenKey("repl-1") == TokenKey("repl-2") || TokenKey("repl-1") == RUNNER_TOKEN_SECRET {
+		t.Fatal("repls share a token key")
+	}
+
+	raw, err := runnerURL("http://runner", "/api/v1/repl/sync", "repl-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(raw)
+	tok := u.Query().Get("token")
+	if _, err := token.Verify(TokenKey("repl-1"), tok); err != nil {
+		t.Errorf("token rejected by its repl's key: %v", err)
+	}
+	if _, err := token.Verify(TokenKey("repl-2"), tok); err == nil {
+		t.Error("token accepted by another repl's key")
+	}
+}
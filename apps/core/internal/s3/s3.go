@@ -2,6 +2,7 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	log "packages/logging"
 	"path"
@@ -30,6 +31,12 @@ type S3Client struct {
 }
 
 func NewS3Client() *S3Client {
+	return NewS3ClientAt(endpoint)
+}
+
+// NewS3ClientAt connects to another S3 compatible endpoint than S3_ENDPOINT,
+// like a fake one in tests
+func NewS3ClientAt(endpoint string) *S3Client {
 	ctx := context.TODO()
 
 	cfg, err := config.LoadDefaultConfig(ctx,
@@ -66,6 +73,8 @@ func (s *S3Client) Ping() error {
 
 func (s *S3Client) CopyFolder(sourcePrefix, destinationPrefix string) error {
 	var continuationToken *string
+	// Every object is tried, the ones that failed are reported together
+	var copyErrs []error
 
 	for {
 		// Step 1: List objects
@@ -111,6 +120,7 @@ func (s *S3Client) CopyFolder(sourcePrefix, destinationPrefix string) error {
 			_, err := s.client.CopyObject(s.ctx, copyInput)
 			if err != nil {
 				log.Error("Copy object failed", "bucket", bucket, "source_key", sourceKey, "dest_key", destinationKey, "error", err)
+				copyErrs = append(copyErrs, fmt.Errorf("copy %s: %w", sourceKey, err))
 				continue
 			}
 
@@ -125,6 +135,9 @@ func (s *S3Client) CopyFolder(sourcePrefix, destinationPrefix string) error {
 		}
 	}
 
+	if len(copyErrs) > 0 {
+		return fmt.Errorf("failed to copy %d objects: %w", len(copyErrs), errors.Join(copyErrs...))
+	}
 	return nil
 }
 
@@ -199,3 +212,58 @@ func (s *S3Client) DeleteFolder(folderPrefix string) error {
 
 	return nil
 }
+
+// Object is an S3 object listed under a folder prefix
+type Object struct {
+	Key  string `json:"key"` // relative to the listed prefix
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// ListFolder returns every object under the prefix, keyed relative to it
+func (s *S3Client) ListFolder(folderPrefix string) ([]Object, error) {
+	var objects []Object
+	var continuationToken *string
+
+	for {
+		output, err := s.client.ListObjectsV2(s.ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(folderPrefix),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, obj := range output.Contents {
+			key := strings.TrimPrefix(strings.TrimPrefix(*obj.Key, folderPrefix), "/")
+			if key == "" || strings.HasSuffix(key, "/") {
+				continue
+			}
+			objects = append(objects, Object{
+				Key:  key,
+				Size: aws.ToInt64(obj.Size),
+				ETag: strings.Trim(aws.ToString(obj.ETag), `"`),
+			})
+		}
+
+		if output.IsTruncated != nil && *output.IsTruncated {
+			continuationToken = output.NextContinuationToken
+		} else {
+			break
+		}
+	}
+
+	return objects, nil
+}
+
+func (s *S3Client) DeleteObject(key string) error {
+	_, err := s.client.DeleteObject(s.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Package s3test is an in-memory S3 endpoint for tests. It serves the
+// path-style requests S3Client makes: list, get, put, copy, delete and head
+// bucket.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Server struct {
+	URL string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewServer starts a server that's closed with the test
+func NewServer(t *testing.T) *Server {
+	s := &Server{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(srv.Close)
+	s.URL = srv.URL
+	return s
+}
+
+// Put stores an object, keys don't include the bucket
+func (s *Server) Put(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+}
+
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+// Keys returns the stored keys under the prefix, sorted
+func (s *Server) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+type listResult struct {
+	XMLName     xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string       `xml:"Name"`
+	Prefix      string       `xml:"Prefix"`
+	KeyCount    int          `xml:"KeyCount"`
+	MaxKeys     int          `xml:"MaxKeys"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	Contents    []listObject `xml:"Contents"`
+}
+
+type listObject struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+type copyResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodGet:
+		data, ok := s.Get(key)
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Write(data)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r.Header.Get("X-Amz-Copy-Source"), key)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Put(key, data)
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// copy serves CopyObject, the source is "<bucket>/<key>", escaped
+func (s *Server) copy(w http.ResponseWriter, source, key string) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	data, ok := s.Get(sourceKey)
+	if !ok {
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+		return
+	}
+	s.Put(key, data)
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(copyResult{ETag: etag(data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket, prefix string) {
+	result := listResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	for _, key := range s.Keys(prefix) {
+		data, _ := s.Get(key)
+		result.Contents = append(result.Contents, listObject{
+			Key:          key,
+			Size:         int64(len(data)),
+			ETag:         etag(data),
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	log "packages/logging"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DownloadFolder writes every object under the prefix into dir, keeping the
+// relative layout. Keys that would land outside dir, like "../x", fail it.
+func (s *S3Client) DownloadFolder(folderPrefix, dir string) error {
+	objects, err := s.ListFolder(folderPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		rel := filepath.FromSlash(obj.Key)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("object %s resolves outside %s", obj.Key, dir)
+		}
+		if err := s.downloadObject(path.Join(folderPrefix, obj.Key), filepath.Join(dir, rel)); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Downloaded folder", "bucket", bucket, "prefix", folderPrefix, "dir", dir, "objects", len(objects))
+	return nil
+}
+
+func (s *S3Client) downloadObject(key, dest string) error {
+	output, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, output.Body); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	return nil
+}
+
+// UploadFolder mirrors dir to the prefix: every local file is uploaded and
+// objects without a local file are deleted
+func (s *S3Client) UploadFolder(dir, folderPrefix string) error {
+	existing, err := s.ListFolder(folderPrefix)
+	if err != nil {
+		return err
+	}
+	stale := make(map[string]bool, len(existing))
+	for _, obj := range existing {
+		stale[obj.Key] = true
+	}
+
+	uploaded := 0
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := s.client.PutObject(s.ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(path.Join(folderPrefix, key)),
+			Body:   file,
+		}); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+
+		delete(stale, key)
+		uploaded++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range stale {
+		if err := s.DeleteObject(path.Join(folderPrefix, key)); err != nil {
+			log.Warn("Delete stale object failed", "bucket", bucket, "key", key, "error", err)
+		}
+	}
+
+	log.Info("Uploaded folder", "bucket", bucket, "prefix", folderPrefix, "dir", dir, "objects", uploaded, "deleted", len(stale))
+	return nil
+}
+
+// PresignPut returns a URL that uploads the object with a plain PUT until it
+// expires, so runners can write their workspace without S3 credentials. The
+// size is signed, S3 refuses a body of any other length.
+func (s *S3Client) PresignPut(key string, size int64, expires time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s.client).PresignPutObject(s.ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return req.URL, nil
+}
+
+// PresignGet returns a URL that downloads the object with a plain GET until it
+// expires, so warm runners can restore a workspace without S3 credentials
+func (s *S3Client) PresignGet(key string, expires time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(s.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return req.URL, nil
+}
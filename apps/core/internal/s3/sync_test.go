@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"core/internal/s3/s3test"
+)
+
+func TestDownloadFolder(t *testing.T) {
+	fake := s3test.NewServer(t)
+	fake.Put("repl/alice/repl-1/main.py", []byte("print('hi')"))
+	fake.Put("repl/alice/repl-1/src/lib.py", []byte("x = 1"))
+	fake.Put("repl/alice/repl-2/other.py", []byte("other repl"))
+
+	dir := t.TempDir()
+	if err := NewS3ClientAt(fake.URL).DownloadFolder("repl/alice/repl-1/", dir); err != nil {
+		t.Fatalf("DownloadFolder: %v", err)
+	}
+
+	for file, want := range map[string]string{"main.py": "print('hi')", "src/lib.py": "x = 1"} {
+		got, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", file, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.py")); err == nil {
+		t.Error("DownloadFolder wrote another repl's file")
+	}
+}
+
+func TestDownloadFolderRejectsTraversal(t *testing.T) {
+	for _, key := range []string{
+		"repl/alice/repl-1/../escape",
+		"repl/alice/repl-1/src/../../escape",
+	} {
+		t.Run(key, func(t *testing.T) {
+			fake := s3test.NewServer(t)
+			fake.Put(key, []byte("outside"))
+
+			root := t.TempDir()
+			dir := filepath.Join(root, "workspace")
+			err := NewS3ClientAt(fake.URL).DownloadFolder("repl/alice/repl-1/", dir)
+			if err == nil {
+				t.Error("DownloadFolder accepted a key outside the folder")
+			}
+			if _, err := os.Stat(filepath.Join(root, "escape")); err == nil {
+				t.Error("DownloadFolder wrote outside the folder")
+			}
+		})
+	}
+}
+
+func TestUploadFolder(t *testing.T) {
+	fake := s3test.NewServer(t)
+	fake.Put("repl/alice/repl-1/deleted.py", []byte("gone locally"))
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	os.WriteFile(filepath.Join(dir, "main.py"), []byte("print('hi')"), 0o644)
+	os.WriteFile(filepath.Join(dir, "src", "lib.py"), []byte("x = 1"), 0o644)
+
+	if err := NewS3ClientAt(fake.URL).UploadFolder(dir, "repl/alice/repl-1/"); err != nil {
+		t.Fatalf("UploadFolder: %v", err)
+	}
+
+	want := []string{"repl/alice/repl-1/main.py", "repl/alice/repl-1/src/lib.py"}
+	if keys := fake.Keys("repl/"); !slices.Equal(keys, want) {
+		t.Errorf("keys after upload = %v, want %v", keys, want)
+	}
+	if data, _ := fake.Get("repl/alice/repl-1/src/lib.py"); string(data) != "x = 1" {
+		t.Errorf("uploaded lib.py = %q", data)
+	}
+}
+
+func TestPresignPutSignsSize(t *testing.T) {
+	fake := s3test.NewServer(t)
+
+	presigned, err := NewS3ClientAt(fake.URL).PresignPut("repl/alice/repl-1/main.py", 11, time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut: %v", err)
+	}
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed := u.Query().Get("X-Amz-SignedHeaders"); !slices.Contains(strings.Split(signed, ";"), "content-length") {
+		t.Errorf("signed headers = %q, want content-length", signed)
+	}
+}
@@ -2,84 +2,254 @@
 package session
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	log "packages/logging"
+	"strings"
+	"time"
 
+	"core/internal/store"
 	"core/models"
 	"core/pkg/dotenv"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 )
 
 const SessionName = "oauth-session"
 
-var Store = sessions.NewCookieStore([]byte(dotenv.EnvString("SESSION_SECRET", "dont-use-this-in-prod")))
+const (
+	// Lifetime is how long a login lasts, whatever the provider's tokens say
+	Lifetime = 7 * 24 * time.Hour
+	// Last-seen times are only written this often, not on every request
+	touchInterval = time.Minute
+)
+
+var ErrNoSession = errors.New("no session")
+
+// Store signs the short-lived cookies that aren't logins, like the OAuth
+// state. Logins are kept server side, see SaveSession.
+var Store = sessions.NewCookieStore(cookieSecret())
 
 func init() {
 	Store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
+		MaxAge:   int(Lifetime.Seconds()),
 		HttpOnly: true,
-		Secure:   dotenv.EnvString("ENVIRONMENT", "development") == "production",
+		Secure:   secureCookies(),
 		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-func SaveSession(w http.ResponseWriter, r *http.Request, tokenInfo *models.TokenInfo) error {
-	session, err := Store.Get(r, SessionName)
-	if err != nil {
-		return err
+// cookieSecret falls back to a random key, cookies signed with it don't
+// survive a restart but can't be forged with a well known default either
+func cookieSecret() []byte {
+	if secret := dotenv.EnvString("SESSION_SECRET", ""); secret != "" {
+		return []byte(secret)
 	}
 
-	sessionData, err := json.Marshal(tokenInfo)
-	if err != nil {
-		return err
+	log.Warn("SESSION_SECRET not set, signing cookies with a random key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate cookie key: %v", err))
 	}
+	return key
+}
+
+func secureCookies() bool {
+	return dotenv.EnvString("ENVIRONMENT", "development") == "production"
+}
 
-	session.Values["token_info"] = string(sessionData)
-	session.Values["user_id"] = tokenInfo.User.ID
-	session.Values["authenticated"] = true
+// SaveSession starts a new login session for the token info and hands the
+// browser its secret. A session the request already carried is revoked, so a
+// fixed cookie can't outlive the login.
+func SaveSession(rs store.ReplStore, w http.ResponseWriter, r *http.Request, tokenInfo *models.TokenInfo) error {
+	if secret, ok := cookieValue(r); ok {
+		if old, err := rs.GetSession(hash(secret)); err == nil {
+			rs.DeleteSession(old.TokenInfo.User.ID, old.Id)
+		}
+	}
 
-	return session.Save(r, w)
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	s := models.Session{
+		Id:         fmt.Sprintf("sess-%s", uuid.New().String()),
+		TokenInfo:  *tokenInfo,
+		UserAgent:  r.UserAgent(),
+		IP:         ClientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(Lifetime),
+	}
+	if err := rs.CreateSession(hash(secret), s); err != nil {
+		return err
+	}
+
+	setCookie(w, secret, int(Lifetime.Seconds()))
+	return nil
 }
 
-func GetSession(r *http.Request) (*models.TokenInfo, error) {
-	session, err := Store.Get(r, SessionName)
+// GetSession returns the live session of the request's cookie and records
+// that it was seen
+func GetSession(rs store.ReplStore, r *http.Request) (*models.Session, error) {
+	secret, ok := cookieValue(r)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	h := hash(secret)
+	s, err := rs.GetSession(h)
 	if err != nil {
-		return nil, err
+		return nil, ErrNoSession
 	}
 
-	tokenInfoStr, ok := session.Values["token_info"].(string)
-	if !ok {
-		return nil, err
+	now := time.Now().UTC()
+	if s.Expired(now) {
+		return nil, ErrNoSession
 	}
 
-	var tokenInfo models.TokenInfo
-	if err := json.Unmarshal([]byte(tokenInfoStr), &tokenInfo); err != nil {
-		return nil, err
+	if now.Sub(s.LastSeenAt) > touchInterval {
+		s.LastSeenAt = now
+		s.UserAgent = r.UserAgent()
+		s.IP = ClientIP(r)
+		if err := rs.UpdateSession(h, s); err != nil {
+			log.Warn("Record session use failed", "session_id", s.Id, "error", err)
+		}
 	}
+	return &s, nil
+}
 
-	return &tokenInfo, nil
+// UpdateSession stores changes to the request's session, like refreshed
+// OAuth tokens
+func UpdateSession(rs store.ReplStore, r *http.Request, s *models.Session) error {
+	secret, ok := cookieValue(r)
+	if !ok {
+		return ErrNoSession
+	}
+	return rs.UpdateSession(hash(secret), *s)
 }
 
-func ClearSession(w http.ResponseWriter, r *http.Request) error {
-	session, err := Store.Get(r, SessionName)
+// ClearSession revokes the request's session and drops its cookie
+func ClearSession(rs store.ReplStore, w http.ResponseWriter, r *http.Request) error {
+	setCookie(w, "", -1)
+
+	secret, ok := cookieValue(r)
+	if !ok {
+		return nil
+	}
+	s, err := rs.GetSession(hash(secret))
 	if err != nil {
-		return err
+		return nil
 	}
+	return rs.DeleteSession(s.TokenInfo.User.ID, s.Id)
+}
 
-	session.Values = make(map[any]any)
-	session.Options.MaxAge = -1
+func IsAuthenticated(rs store.ReplStore, r *http.Request) bool {
+	_, err := GetSession(rs, r)
+	return err == nil
+}
 
-	return session.Save(r, w)
+// TRUSTED_PROXIES are the comma separated IPs or CIDRs of the proxies in
+// front of core, like the ingress. X-Forwarded-For is only read from them.
+var TRUSTED_PROXIES = parseProxies(dotenv.EnvString("TRUSTED_PROXIES", ""))
+
+func parseProxies(value string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				panic(fmt.Sprintf("invalid TRUSTED_PROXIES entry %q: %v", entry, err))
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies
 }
 
-func IsAuthenticated(r *http.Request) bool {
-	session, err := Store.Get(r, SessionName)
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
 		return false
 	}
+	addr = addr.Unmap()
+	for _, proxy := range TRUSTED_PROXIES {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the peer's address or, when the peer is a trusted proxy, the
+// last X-Forwarded-For entry that isn't one. Entries left of it come from
+// the client and can't be trusted for rate limits.
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	// Every hop is a proxy, the first one is as close to the client as it gets
+	return ip
+}
+
+func cookieValue(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func setCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
 
-	auth, ok := session.Values["authenticated"].(bool)
-	return ok && auth
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
 }
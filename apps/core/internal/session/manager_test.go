@@ -0,0 +1,38 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := TRUSTED_PROXIES
+	TRUSTED_PROXIES = parseProxies("10.0.0.0/8, 192.168.1.1")
+	t.Cleanup(func() { TRUSTED_PROXIES = proxies })
+
+	for _, tc := range []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed without proxy", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"through proxy", "10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed through proxy", "10.1.2.3:80", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chained proxies", "10.1.2.3:80", []string{"1.1.1.1, 198.51.100.1", "192.168.1.1"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:80", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"proxy without header", "10.1.2.3:80", nil, "10.1.2.3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.peer
+			for _, header := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := ClientIP(r); got != tc.want {
+				t.Errorf("ClientIP = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
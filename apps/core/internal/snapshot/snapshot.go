@@ -0,0 +1,220 @@
+package snapshot
+
+import (
+	"fmt"
+	log "packages/logging"
+	"strconv"
+	"strings"
+	"time"
+
+	"core/internal/s3"
+	"core/internal/store"
+	"core/models"
+	"core/pkg/dotenv"
+
+	"github.com/google/uuid"
+)
+
+// Number of automatic snapshots kept per repl, 0 disables them
+var SNAPSHOT_AUTO_RETENTION, _ = strconv.Atoi(dotenv.EnvString("SNAPSHOT_AUTO_RETENTION", "5"))
+
+func workspacePrefix(userName, replId string) string {
+	return fmt.Sprintf("repl/%s/%s/", userName, replId)
+}
+
+func snapshotPrefix(userName, replId, snapshotId string) string {
+	return fmt.Sprintf("snapshots/%s/%s/%s/", userName, replId, snapshotId)
+}
+
+// Create copies the repl's stored workspace to its own snapshot prefix.
+// Live workspaces must be flushed to S3 by the caller first.
+func Create(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl, name string, kind models.SnapshotKind) (models.Snapshot, error) {
+	snapshot := models.Snapshot{
+		Id:        fmt.Sprintf("snap-%s", uuid.New().String()),
+		ReplId:    repl.Id,
+		Name:      strings.TrimSpace(name),
+		Kind:      kind,
+		CreatedAt: time.Now().UTC(),
+	}
+	if snapshot.Name == "" {
+		snapshot.Name = snapshot.CreatedAt.Format("2006-01-02 15:04:05")
+	}
+
+	prefix := snapshotPrefix(repl.User, repl.Id, snapshot.Id)
+	if err := s3Client.CopyFolder(workspacePrefix(repl.User, repl.Id), prefix); err != nil {
+		// A partial copy isn't a snapshot
+		s3Client.DeleteFolder(prefix)
+		return models.Snapshot{}, fmt.Errorf("failed to copy workspace: %w", err)
+	}
+
+	objects, err := s3Client.ListFolder(prefix)
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+	for _, obj := range objects {
+		snapshot.Size += obj.Size
+	}
+	snapshot.Files = len(objects)
+
+	if err := rs.CreateSnapshot(snapshot); err != nil {
+		s3Client.DeleteFolder(prefix)
+		return models.Snapshot{}, err
+	}
+
+	log.Info("Snapshot created", "repl_id", repl.Id, "snapshot_id", snapshot.Id, "kind", kind, "size", snapshot.Size, "files", snapshot.Files)
+
+	if kind == models.SnapshotAuto {
+		prune(s3Client, rs, repl)
+	}
+	return snapshot, nil
+}
+
+// Auto takes an automatic snapshot when they are enabled, e.g. right before a
+// shutdown upload overwrites the stored workspace. Failures are only logged.
+func Auto(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl, name string) {
+	if SNAPSHOT_AUTO_RETENTION <= 0 {
+		return
+	}
+	if _, err := Create(s3Client, rs, repl, name, models.SnapshotAuto); err != nil {
+		log.Warn("Automatic snapshot failed", "repl_id", repl.Id, "error", err)
+	}
+}
+
+// Restore replaces the stored workspace with the snapshot's contents. The
+// current workspace is kept as an automatic snapshot first.
+func Restore(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl, snapshotId string) error {
+	snapshot, err := rs.GetSnapshot(repl.Id, snapshotId)
+	if err != nil {
+		return err
+	}
+
+	Auto(s3Client, rs, repl, fmt.Sprintf("Before restoring %s", snapshot.Name))
+
+	workspace := workspacePrefix(repl.User, repl.Id)
+	prefix := snapshotPrefix(repl.User, repl.Id, snapshot.Id)
+
+	snapshotObjects, err := s3Client.ListFolder(prefix)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(snapshotObjects))
+	for _, obj := range snapshotObjects {
+		keep[obj.Key] = true
+	}
+
+	if err := s3Client.CopyFolder(prefix, workspace); err != nil {
+		return fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+
+	// Drop files created after the snapshot was taken
+	workspaceObjects, err := s3Client.ListFolder(workspace)
+	if err != nil {
+		return err
+	}
+	for _, obj := range workspaceObjects {
+		if keep[obj.Key] {
+			continue
+		}
+		if err := s3Client.DeleteObject(workspace + obj.Key); err != nil {
+			log.Warn("Delete stale workspace file failed", "repl_id", repl.Id, "key", obj.Key, "error", err)
+		}
+	}
+
+	log.Info("Snapshot restored", "repl_id", repl.Id, "snapshot_id", snapshot.Id)
+	return nil
+}
+
+// Diff summarises what changed in the stored workspace since the snapshot
+func Diff(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl, snapshotId string) (models.SnapshotDiff, error) {
+	snapshot, err := rs.GetSnapshot(repl.Id, snapshotId)
+	if err != nil {
+		return models.SnapshotDiff{}, err
+	}
+
+	before, err := s3Client.ListFolder(snapshotPrefix(repl.User, repl.Id, snapshot.Id))
+	if err != nil {
+		return models.SnapshotDiff{}, err
+	}
+	after, err := s3Client.ListFolder(workspacePrefix(repl.User, repl.Id))
+	if err != nil {
+		return models.SnapshotDiff{}, err
+	}
+
+	diff := models.SnapshotDiff{
+		SnapshotId: snapshot.Id,
+		Added:      []string{},
+		Removed:    []string{},
+		Modified:   []string{},
+	}
+
+	previous := make(map[string]s3.Object, len(before))
+	for _, obj := range before {
+		previous[obj.Key] = obj
+	}
+
+	for _, obj := range after {
+		old, ok := previous[obj.Key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, obj.Key)
+		case old.ETag != obj.ETag || old.Size != obj.Size:
+			diff.Modified = append(diff.Modified, obj.Key)
+		default:
+			diff.Unchanged++
+		}
+		delete(previous, obj.Key)
+	}
+	for key := range previous {
+		diff.Removed = append(diff.Removed, key)
+	}
+
+	return diff, nil
+}
+
+func Delete(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl, snapshotId string) error {
+	if err := s3Client.DeleteFolder(snapshotPrefix(repl.User, repl.Id, snapshotId)); err != nil {
+		return err
+	}
+	return rs.DeleteSnapshot(repl.Id, snapshotId)
+}
+
+// DeleteAll removes every snapshot of the repl, used when the repl is deleted
+func DeleteAll(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl) error {
+	snapshots, err := rs.GetSnapshots(repl.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := s3Client.DeleteFolder(fmt.Sprintf("snapshots/%s/%s/", repl.User, repl.Id)); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if err := rs.DeleteSnapshot(repl.Id, snapshot.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune drops the oldest automatic snapshots beyond the retention limit
+func prune(s3Client *s3.S3Client, rs store.ReplStore, repl models.Repl) {
+	snapshots, err := rs.GetSnapshots(repl.Id)
+	if err != nil {
+		log.Warn("List snapshots for pruning failed", "repl_id", repl.Id, "error", err)
+		return
+	}
+
+	kept := 0
+	for _, snapshot := range snapshots {
+		if snapshot.Kind != models.SnapshotAuto {
+			continue
+		}
+		kept++
+		if kept <= SNAPSHOT_AUTO_RETENTION {
+			continue
+		}
+		if err := Delete(s3Client, rs, repl, snapshot.Id); err != nil {
+			log.Warn("Prune snapshot failed", "repl_id", repl.Id, "snapshot_id", snapshot.Id, "error", err)
+		}
+	}
+}
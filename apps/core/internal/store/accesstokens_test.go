@@ -0,0 +1,46 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"core/models"
+)
+
+func TestAccessTokens(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		token := models.AccessToken{
+			Id:        "tok-1",
+			User:      models.User{ID: "usr-1"},
+			Scopes:    []models.TokenScope{models.ScopeReplRead},
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := rs.CreateAccessToken("hash-1", token); err != nil {
+			t.Fatalf("CreateAccessToken: %v", err)
+		}
+
+		got, err := rs.GetAccessToken("hash-1")
+		if err != nil || got.Id != "tok-1" {
+			t.Errorf("GetAccessToken = %+v, %v", got, err)
+		}
+		if err := rs.SetAccessTokenUsed("hash-1", time.Now()); err != nil {
+			t.Errorf("SetAccessTokenUsed: %v", err)
+		}
+		if tokens, _ := rs.ListAccessTokens("usr-1"); len(tokens) != 1 || tokens[0].LastUsedAt.IsZero() {
+			t.Errorf("ListAccessTokens = %+v", tokens)
+		}
+		if tokens, _ := rs.ListAccessTokens("usr-2"); len(tokens) != 0 {
+			t.Errorf("ListAccessTokens of another user = %+v", tokens)
+		}
+
+		// Only the owner can delete a token
+		rs.DeleteAccessToken("usr-2", "tok-1")
+		if _, err := rs.GetAccessToken("hash-1"); err != nil {
+			t.Error("another user deleted the token")
+		}
+		rs.DeleteAccessToken("usr-1", "tok-1")
+		if _, err := rs.GetAccessToken("hash-1"); err == nil {
+			t.Error("GetAccessToken found a deleted token")
+		}
+	})
+}
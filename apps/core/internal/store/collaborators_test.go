@@ -0,0 +1,44 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"core/models"
+)
+
+func TestCollaborators(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		now := time.Now().UTC().Truncate(time.Second)
+		rs.AddCollaborator("repl-1", models.Collaborator{User: "bob", Role: models.RoleEditor, AddedAt: now})
+		rs.AddCollaborator("repl-1", models.Collaborator{User: "carol", Role: models.RoleViewer, AddedAt: now.Add(time.Second)})
+
+		bob, err := rs.GetCollaborator("repl-1", "bob")
+		if err != nil || bob.Role != models.RoleEditor {
+			t.Errorf("GetCollaborator = %+v, %v", bob, err)
+		}
+		collaborators, _ := rs.GetCollaborators("repl-1")
+		if len(collaborators) != 2 || collaborators[0].User != "bob" {
+			t.Errorf("GetCollaborators = %+v", collaborators)
+		}
+		if shared, _ := rs.GetSharedRepls("carol"); !slices.Equal(shared, []string{"repl-1"}) {
+			t.Errorf("GetSharedRepls = %v", shared)
+		}
+
+		if err := rs.RemoveCollaborator("repl-1", "carol"); err != nil {
+			t.Fatalf("RemoveCollaborator: %v", err)
+		}
+		if _, err := rs.GetCollaborator("repl-1", "carol"); err == nil {
+			t.Error("GetCollaborator found a removed collaborator")
+		}
+
+		// Deleting the repl unshares it
+		rs.DeleteRepl("repl-1")
+		if shared, _ := rs.GetSharedRepls("bob"); len(shared) != 0 {
+			t.Errorf("GetSharedRepls after delete = %v", shared)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMagicLinks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		if err := rs.SaveMagicLink("jti-1", time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("SaveMagicLink: %v", err)
+		}
+
+		if unused, err := rs.ConsumeMagicLink("jti-1"); err != nil || !unused {
+			t.Errorf("first ConsumeMagicLink = %v, %v", unused, err)
+		}
+		if unused, err := rs.ConsumeMagicLink("jti-1"); err != nil || unused {
+			t.Errorf("second ConsumeMagicLink = %v, %v", unused, err)
+		}
+		if unused, _ := rs.ConsumeMagicLink("unknown"); unused {
+			t.Error("ConsumeMagicLink accepted an unknown link")
+		}
+	})
+}
+
+func TestCountAttempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		for want := int64(1); want <= 3; want++ {
+			count, err := rs.CountAttempt("login:alice", time.Minute)
+			if err != nil || count != want {
+				t.Fatalf("CountAttempt = %d, %v, want %d", count, err, want)
+			}
+		}
+		if count, _ := rs.CountAttempt("login:bob", time.Minute); count != 1 {
+			t.Errorf("CountAttempt of another key = %d", count)
+		}
+	})
+}
@@ -0,0 +1,855 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	log "packages/logging"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"core/models"
+)
+
+// Memory is an embedded ReplStore kept in process memory. When a file path is
+// given, every write is flushed to that file and it is reloaded on startup.
+type Memory struct {
+	mu   sync.RWMutex
+	path string
+	data *memoryData
+	// Rate limit windows by key, not worth persisting
+	attempts map[string]attemptWindow
+}
+
+type attemptWindow struct {
+	count   int64
+	resetAt time.Time
+}
+
+type memoryData struct {
+	Repls     map[string]models.Repl                `json:"repls"`
+	UserRepls map[string][]string                   `json:"userRepls"`
+	Snapshots map[string]map[string]models.Snapshot `json:"snapshots"`
+	Usage     map[string]int64                      `json:"usage"` // seconds per "user:YYYY-MM"
+	Plans     map[string]models.Plan                `json:"plans"`
+	UserPlans map[string]string                     `json:"userPlans"`
+	UserOrgs  map[string]string                     `json:"userOrgs"`
+
+	Collaborators map[string]map[string]models.Collaborator `json:"collaborators"`
+	SharedRepls   map[string][]string                       `json:"sharedRepls"`
+	// Personal access tokens by the hash of their secret
+	AccessTokens map[string]models.AccessToken `json:"accessTokens"`
+	// User registry by account id
+	Users map[string]models.Account `json:"users"`
+	// Login sessions by the hash of their cookie secret
+	Sessions map[string]models.Session `json:"sessions"`
+	// Expiry of the unused magic links by jti
+	MagicLinks map[string]time.Time `json:"magicLinks"`
+}
+
+func NewMemoryStore(path string) *Memory {
+	m := &Memory{
+		path: path,
+		data: &memoryData{
+			Repls:     make(map[string]models.Repl),
+			UserRepls: make(map[string][]string),
+			Snapshots: make(map[string]map[string]models.Snapshot),
+			Usage:     make(map[string]int64),
+			Plans:     make(map[string]models.Plan),
+			UserPlans: make(map[string]string),
+			UserOrgs:  make(map[string]string),
+
+			Collaborators: make(map[string]map[string]models.Collaborator),
+			SharedRepls:   make(map[string][]string),
+			AccessTokens:  make(map[string]models.AccessToken),
+			Users:         make(map[string]models.Account),
+			Sessions:      make(map[string]models.Session),
+			MagicLinks:    make(map[string]time.Time),
+		},
+		attempts: make(map[string]attemptWindow),
+	}
+
+	if path != "" {
+		if err := m.load(); err != nil {
+			log.Error("Failed to load repl store file", "file", path, "error", err)
+		}
+	}
+
+	return m
+}
+
+// Ping (Health Check)
+func (m *Memory) Ping() error {
+	if m.path == "" {
+		return nil
+	}
+	_, err := os.Stat(filepath.Dir(m.path))
+	return err
+}
+
+func (m *Memory) CreateRepl(template, username, replName, replId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.Repls[replId] = models.Repl{
+		Id:       replId,
+		Name:     replName,
+		User:     username,
+		Template: template,
+		IsActive: false,
+		State: models.ReplState{
+			Status:    models.ReplStopped,
+			UpdatedAt: time.Now().UTC(),
+		},
+	}
+	m.addUserRepl(username, replId)
+
+	return m.persist()
+}
+
+func (m *Memory) DeleteRepl(replId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	if repl.User == "" {
+		return fmt.Errorf("no user found for repl: %s", replId)
+	}
+
+	m.data.UserRepls[repl.User] = removeId(m.data.UserRepls[repl.User], replId)
+	for user := range m.data.Collaborators[replId] {
+		m.data.SharedRepls[user] = removeId(m.data.SharedRepls[user], replId)
+	}
+	delete(m.data.Collaborators, replId)
+	delete(m.data.Repls, replId)
+
+	return m.persist()
+}
+
+func (m *Memory) GetRepl(replId string) (models.Repl, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return models.Repl{}, errors.New("No such Repl Found")
+	}
+	repl.State.Status = replStatus(repl)
+	return repl, nil
+}
+
+// ListRepls returns every repl, used by background jobs
+func (m *Memory) ListRepls() ([]models.Repl, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	repls := make([]models.Repl, 0, len(m.data.Repls))
+	for _, repl := range m.data.Repls {
+		repl.State.Status = replStatus(repl)
+		repls = append(repls, repl)
+	}
+	return repls, nil
+}
+
+// user-repl relationship
+func (m *Memory) CreateUserRepl(username, replId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addUserRepl(username, replId)
+	return m.persist()
+}
+
+func (m *Memory) GetUserRepls(username string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.data.UserRepls[username]), nil
+}
+
+func (m *Memory) SetReplOwner(replId, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	m.data.UserRepls[repl.User] = removeId(m.data.UserRepls[repl.User], replId)
+	repl.User = username
+	m.data.Repls[replId] = repl
+	m.addUserRepl(username, replId)
+
+	return m.persist()
+}
+
+// Repl Session
+func (m *Memory) CreateReplSession(replId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	repl.IsActive = true
+	repl.SessionStartedAt = time.Now().UTC()
+	m.data.Repls[replId] = repl
+
+	return m.persist()
+}
+
+// DeleteReplSession ends the session and adds its duration to the owner's
+// session usage for the current month.
+func (m *Memory) DeleteReplSession(replId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+
+	if !repl.SessionStartedAt.IsZero() {
+		now := time.Now().UTC()
+		m.data.Usage[usageKey(repl.User, now)] += int64(now.Sub(repl.SessionStartedAt).Seconds())
+	}
+	repl.IsActive = false
+	repl.SessionStartedAt = time.Time{}
+	m.data.Repls[replId] = repl
+
+	return m.persist()
+}
+
+func (m *Memory) GetSessionUsage(username string, month time.Time) (time.Duration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return time.Duration(m.data.Usage[usageKey(username, month)]) * time.Second, nil
+}
+
+func usageKey(username string, month time.Time) string {
+	return fmt.Sprintf("%s:%s", username, month.UTC().Format("2006-01"))
+}
+
+// Repl Status
+func (m *Memory) SetRunnerVersion(replId, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	repl.RunnerVersion = version
+	m.data.Repls[replId] = repl
+
+	return m.persist()
+}
+
+func (m *Memory) SetReplStatus(replId string, state models.ReplState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return fmt.Errorf("repl not found: %s", replId)
+	}
+	state.UpdatedAt = time.Now().UTC()
+	repl.State = state
+	m.data.Repls[replId] = repl
+
+	return m.persist()
+}
+
+func (m *Memory) CompareAndSetReplStatus(replId string, from models.ReplStatus, state models.ReplState) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repl, ok := m.data.Repls[replId]
+	if !ok {
+		return false, fmt.Errorf("repl not found: %s", replId)
+	}
+	if replStatus(repl) != from {
+		return false, nil
+	}
+	state.UpdatedAt = time.Now().UTC()
+	repl.State = state
+	m.data.Repls[replId] = repl
+
+	return true, m.persist()
+}
+
+// replStatus falls back to isActive for repls stored before statuses
+// existed, like the Redis store does
+func replStatus(repl models.Repl) models.ReplStatus {
+	switch {
+	case repl.State.Status != "":
+		return repl.State.Status
+	case repl.IsActive:
+		return models.ReplReady
+	default:
+		return models.ReplStopped
+	}
+}
+
+// Repl Snapshots
+func (m *Memory) CreateSnapshot(snapshot models.Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data.Snapshots[snapshot.ReplId] == nil {
+		m.data.Snapshots[snapshot.ReplId] = make(map[string]models.Snapshot)
+	}
+	m.data.Snapshots[snapshot.ReplId][snapshot.Id] = snapshot
+
+	return m.persist()
+}
+
+func (m *Memory) GetSnapshot(replId, snapshotId string) (models.Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot, ok := m.data.Snapshots[replId][snapshotId]
+	if !ok {
+		return models.Snapshot{}, errors.New("No such Snapshot Found")
+	}
+	return snapshot, nil
+}
+
+// GetSnapshots returns the repl's snapshots, newest first
+func (m *Memory) GetSnapshots(replId string) ([]models.Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshots := make([]models.Snapshot, 0, len(m.data.Snapshots[replId]))
+	for _, snapshot := range m.data.Snapshots[replId] {
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b models.Snapshot) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func (m *Memory) DeleteSnapshot(replId, snapshotId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data.Snapshots[replId], snapshotId)
+	if len(m.data.Snapshots[replId]) == 0 {
+		delete(m.data.Snapshots, replId)
+	}
+
+	return m.persist()
+}
+
+// Plans
+func (m *Memory) SavePlan(plan models.Plan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.Plans[plan.Id] = plan
+	return m.persist()
+}
+
+func (m *Memory) GetPlan(planId string) (models.Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	plan, ok := m.data.Plans[planId]
+	if !ok {
+		return models.Plan{}, fmt.Errorf("plan not found: %s", planId)
+	}
+	return plan, nil
+}
+
+func (m *Memory) GetPlans() ([]models.Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	plans := make([]models.Plan, 0, len(m.data.Plans))
+	for _, plan := range m.data.Plans {
+		plans = append(plans, plan)
+	}
+	slices.SortFunc(plans, func(a, b models.Plan) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return plans, nil
+}
+
+// GetUserPlan returns the id of the user's plan, or "" if none was assigned
+func (m *Memory) GetUserPlan(username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data.UserPlans[username], nil
+}
+
+func (m *Memory) SetUserPlan(username, planId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.UserPlans[username] = planId
+	return m.persist()
+}
+
+// GetUserOrg returns the user's organization, or "" if they have none
+func (m *Memory) GetUserOrg(username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data.UserOrgs[username], nil
+}
+
+// SetUserOrg moves the user to the organization, an empty org removes them
+func (m *Memory) SetUserOrg(username, org string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if org == "" {
+		delete(m.data.UserOrgs, username)
+	} else {
+		m.data.UserOrgs[username] = org
+	}
+	return m.persist()
+}
+
+// Repl Collaborators
+func (m *Memory) AddCollaborator(replId string, collaborator models.Collaborator) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data.Collaborators[replId] == nil {
+		m.data.Collaborators[replId] = make(map[string]models.Collaborator)
+	}
+	m.data.Collaborators[replId][collaborator.User] = collaborator
+	if !slices.Contains(m.data.SharedRepls[collaborator.User], replId) {
+		m.data.SharedRepls[collaborator.User] = append(m.data.SharedRepls[collaborator.User], replId)
+	}
+
+	return m.persist()
+}
+
+func (m *Memory) GetCollaborator(replId, username string) (models.Collaborator, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	collaborator, ok := m.data.Collaborators[replId][username]
+	if !ok {
+		return models.Collaborator{}, errors.New("No such Collaborator Found")
+	}
+	return collaborator, nil
+}
+
+func (m *Memory) GetCollaborators(replId string) ([]models.Collaborator, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	collaborators := make([]models.Collaborator, 0, len(m.data.Collaborators[replId]))
+	for _, collaborator := range m.data.Collaborators[replId] {
+		collaborators = append(collaborators, collaborator)
+	}
+	slices.SortFunc(collaborators, func(a, b models.Collaborator) int {
+		return a.AddedAt.Compare(b.AddedAt)
+	})
+	return collaborators, nil
+}
+
+func (m *Memory) RemoveCollaborator(replId, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data.Collaborators[replId], username)
+	if len(m.data.Collaborators[replId]) == 0 {
+		delete(m.data.Collaborators, replId)
+	}
+	m.data.SharedRepls[username] = removeId(m.data.SharedRepls[username], replId)
+
+	return m.persist()
+}
+
+// GetSharedRepls returns the ids of repls shared with the user
+func (m *Memory) GetSharedRepls(username string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.data.SharedRepls[username]), nil
+}
+
+// Personal access tokens
+func (m *Memory) CreateAccessToken(hash string, token models.AccessToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.AccessTokens[hash] = token
+	return m.persist()
+}
+
+func (m *Memory) GetAccessToken(hash string) (models.AccessToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.data.AccessTokens[hash]
+	if !ok {
+		return models.AccessToken{}, errors.New("No such Access Token Found")
+	}
+	return token, nil
+}
+
+// ListAccessTokens returns the user's tokens, newest first
+func (m *Memory) ListAccessTokens(userId string) ([]models.AccessToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := []models.AccessToken{}
+	for _, token := range m.data.AccessTokens {
+		if token.User.ID == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b models.AccessToken) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (m *Memory) DeleteAccessToken(userId, tokenId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.data.AccessTokens {
+		if token.User.ID == userId && token.Id == tokenId {
+			delete(m.data.AccessTokens, hash)
+		}
+	}
+	return m.persist()
+}
+
+func (m *Memory) SetAccessTokenUsed(hash string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.data.AccessTokens[hash]
+	if !ok {
+		return errors.New("No such Access Token Found")
+	}
+	token.LastUsedAt = at.UTC()
+	m.data.AccessTokens[hash] = token
+
+	return m.persist()
+}
+
+// User registry
+func (m *Memory) CreateUser(account models.Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.data.Users {
+		if other.Handle == account.Handle {
+			return models.ErrHandleTaken
+		}
+		for _, identity := range account.Identities {
+			if other.HasIdentity(identity.Provider, identity.Subject) {
+				return models.ErrIdentityLinked
+			}
+		}
+	}
+
+	m.data.Users[account.Id] = account
+	return m.persist()
+}
+
+func (m *Memory) GetUser(userId string) (models.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	account, ok := m.data.Users[userId]
+	if !ok {
+		return models.Account{}, errors.New("No such User Found")
+	}
+	return account, nil
+}
+
+func (m *Memory) GetUserByHandle(handle string) (models.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, account := range m.data.Users {
+		if account.Handle == handle {
+			return account, nil
+		}
+	}
+	return models.Account{}, errors.New("No such User Found")
+}
+
+func (m *Memory) GetUserByIdentity(provider models.IdentityProvider, subject string) (models.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, account := range m.data.Users {
+		if account.HasIdentity(provider, subject) {
+			return account, nil
+		}
+	}
+	return models.Account{}, errors.New("No such User Found")
+}
+
+// LinkIdentity adds a sign-in identity to the account, linking one the
+// account already has is a no-op
+func (m *Memory) LinkIdentity(userId string, identity models.Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.data.Users[userId]
+	if !ok {
+		return errors.New("No such User Found")
+	}
+	if account.HasIdentity(identity.Provider, identity.Subject) {
+		return nil
+	}
+	for _, other := range m.data.Users {
+		if other.HasIdentity(identity.Provider, identity.Subject) {
+			return models.ErrIdentityLinked
+		}
+	}
+
+	account.Identities = append(account.Identities, identity)
+	m.data.Users[userId] = account
+	return m.persist()
+}
+
+func (m *Memory) UnlinkIdentity(userId string, provider models.IdentityProvider, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.data.Users[userId]
+	if !ok {
+		return errors.New("No such User Found")
+	}
+	if !account.HasIdentity(provider, subject) {
+		return errors.New("No such Identity Found")
+	}
+
+	account.Identities = slices.DeleteFunc(slices.Clone(account.Identities), func(identity models.Identity) bool {
+		return identity.Provider == provider && identity.Subject == subject
+	})
+	m.data.Users[userId] = account
+	return m.persist()
+}
+
+// Magic links, expired ones are pruned when another is saved
+func (m *Memory) SaveMagicLink(jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(m.data.MagicLinks, func(_ string, expiry time.Time) bool {
+		return now.After(expiry)
+	})
+	m.data.MagicLinks[jti] = expiresAt
+	return m.persist()
+}
+
+// ConsumeMagicLink reports whether the link was still unused
+func (m *Memory) ConsumeMagicLink(jti string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresAt, ok := m.data.MagicLinks[jti]
+	if !ok {
+		return false, nil
+	}
+	delete(m.data.MagicLinks, jti)
+	if err := m.persist(); err != nil {
+		return false, err
+	}
+	return time.Now().Before(expiresAt), nil
+}
+
+// CountAttempt records an attempt and returns the attempts of the key in the
+// current window, which starts with the first one
+func (m *Memory) CountAttempt(key string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(m.attempts, func(_ string, w attemptWindow) bool {
+		return now.After(w.resetAt)
+	})
+
+	w, ok := m.attempts[key]
+	if !ok {
+		w.resetAt = now.Add(window)
+	}
+	w.count++
+	m.attempts[key] = w
+	return w.count, nil
+}
+
+// Login sessions, expired ones are pruned when another is created
+func (m *Memory) CreateSession(hash string, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(m.data.Sessions, func(_ string, other models.Session) bool {
+		return other.Expired(now)
+	})
+	m.data.Sessions[hash] = session
+	return m.persist()
+}
+
+func (m *Memory) GetSession(hash string) (models.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.data.Sessions[hash]
+	if !ok || session.Expired(time.Now()) {
+		return models.Session{}, errors.New("No such Session Found")
+	}
+	return session, nil
+}
+
+func (m *Memory) UpdateSession(hash string, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.Sessions[hash]; !ok {
+		return errors.New("No such Session Found")
+	}
+	m.data.Sessions[hash] = session
+	return m.persist()
+}
+
+// ListSessions returns the user's live sessions, most recently seen first
+func (m *Memory) ListSessions(userId string) ([]models.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	sessions := []models.Session{}
+	for _, session := range m.data.Sessions {
+		if session.TokenInfo.User.ID == userId && !session.Expired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b models.Session) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *Memory) DeleteSession(userId, sessionId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	maps.DeleteFunc(m.data.Sessions, func(_ string, session models.Session) bool {
+		return session.TokenInfo.User.ID == userId && session.Id == sessionId
+	})
+	return m.persist()
+}
+
+// DeleteSessions revokes every session of the user
+func (m *Memory) DeleteSessions(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	maps.DeleteFunc(m.data.Sessions, func(_ string, session models.Session) bool {
+		return session.TokenInfo.User.ID == userId
+	})
+	return m.persist()
+}
+
+func removeId(ids []string, id string) []string {
+	return slices.DeleteFunc(ids, func(other string) bool {
+		return other == id
+	})
+}
+
+// addUserRepl behaves like SADD; callers must hold the lock.
+func (m *Memory) addUserRepl(username, replId string) {
+	if !slices.Contains(m.data.UserRepls[username], replId) {
+		m.data.UserRepls[username] = append(m.data.UserRepls[username], replId)
+	}
+}
+
+func (m *Memory) load() error {
+	bytes, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bytes, m.data); err != nil {
+		return fmt.Errorf("failed to decode store file: %w", err)
+	}
+	if m.data.Repls == nil {
+		m.data.Repls = make(map[string]models.Repl)
+	}
+	if m.data.UserRepls == nil {
+		m.data.UserRepls = make(map[string][]string)
+	}
+	if m.data.Snapshots == nil {
+		m.data.Snapshots = make(map[string]map[string]models.Snapshot)
+	}
+	if m.data.Usage == nil {
+		m.data.Usage = make(map[string]int64)
+	}
+	if m.data.Plans == nil {
+		m.data.Plans = make(map[string]models.Plan)
+	}
+	if m.data.UserPlans == nil {
+		m.data.UserPlans = make(map[string]string)
+	}
+	if m.data.UserOrgs == nil {
+		m.data.UserOrgs = make(map[string]string)
+	}
+	if m.data.Collaborators == nil {
+		m.data.Collaborators = make(map[string]map[string]models.Collaborator)
+	}
+	if m.data.SharedRepls == nil {
+		m.data.SharedRepls = make(map[string][]string)
+	}
+	if m.data.AccessTokens == nil {
+		m.data.AccessTokens = make(map[string]models.AccessToken)
+	}
+	if m.data.Users == nil {
+		m.data.Users = make(map[string]models.Account)
+	}
+	if m.data.Sessions == nil {
+		m.data.Sessions = make(map[string]models.Session)
+	}
+	if m.data.MagicLinks == nil {
+		m.data.MagicLinks = make(map[string]time.Time)
+	}
+	return nil
+}
+
+// persist writes the store to disk atomically; callers must hold the lock.
+func (m *Memory) persist() error {
+	if m.path == "" {
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(m.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("failed to write store file: %w", err)
+	}
+	return os.Rename(tmp, m.path)
+}
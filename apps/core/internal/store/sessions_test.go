@@ -0,0 +1,68 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"core/models"
+)
+
+func TestLoginSessions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		now := time.Now().UTC()
+		session := func(id, userId string, lastSeen time.Duration) models.Session {
+			return models.Session{
+				Id:         id,
+				TokenInfo:  models.TokenInfo{User: &models.User{ID: userId}},
+				CreatedAt:  now,
+				LastSeenAt: now.Add(lastSeen),
+				ExpiresAt:  now.Add(time.Hour),
+			}
+		}
+
+		rs.CreateSession("hash-1", session("sess-1", "usr-1", 0))
+		rs.CreateSession("hash-2", session("sess-2", "usr-1", time.Minute))
+		rs.CreateSession("hash-3", session("sess-3", "usr-2", 0))
+
+		got, err := rs.GetSession("hash-1")
+		if err != nil || got.Id != "sess-1" {
+			t.Errorf("GetSession = %+v, %v", got, err)
+		}
+
+		got.IP = "192.0.2.1"
+		if err := rs.UpdateSession("hash-1", got); err != nil {
+			t.Errorf("UpdateSession: %v", err)
+		}
+		if got, _ := rs.GetSession("hash-1"); got.IP != "192.0.2.1" {
+			t.Errorf("GetSession after update = %+v", got)
+		}
+
+		sessions, _ := rs.ListSessions("usr-1")
+		if len(sessions) != 2 || sessions[0].Id != "sess-2" {
+			t.Errorf("ListSessions = %+v, want most recently seen first", sessions)
+		}
+
+		// Only the owner can revoke a session
+		rs.DeleteSession("usr-2", "sess-1")
+		if _, err := rs.GetSession("hash-1"); err != nil {
+			t.Error("another user revoked the session")
+		}
+		rs.DeleteSession("usr-1", "sess-1")
+		if _, err := rs.GetSession("hash-1"); err == nil {
+			t.Error("GetSession found a revoked session")
+		}
+		// A request racing the revoke can't bring the session back
+		rs.UpdateSession("hash-1", got)
+		if _, err := rs.GetSession("hash-1"); err == nil {
+			t.Error("UpdateSession brought a revoked session back")
+		}
+
+		rs.DeleteSessions("usr-1")
+		if sessions, _ := rs.ListSessions("usr-1"); len(sessions) != 0 {
+			t.Errorf("ListSessions after revoking all = %+v", sessions)
+		}
+		if _, err := rs.GetSession("hash-3"); err != nil {
+			t.Error("revoking all sessions of a user revoked another user's")
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	log "packages/logging"
+	"strings"
+	"time"
+
+	"core/internal/redis"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+var (
+	REPL_STORE      = dotenv.EnvString("REPL_STORE", "redis")
+	REPL_STORE_FILE = dotenv.EnvString("REPL_STORE_FILE", "")
+)
+
+// ReplStore persists repls, their ownership and their session state.
+type ReplStore interface {
+	// Health Check
+	Ping() error
+
+	// Repl
+	CreateRepl(template, username, replName, replId string) error
+	GetRepl(replId string) (models.Repl, error)
+	DeleteRepl(replId string) error
+	ListRepls() ([]models.Repl, error)
+
+	// user-repl relationship
+	CreateUserRepl(username, replId string) error
+	GetUserRepls(username string) ([]string, error)
+	// SetReplOwner moves the repl to another user's repls
+	SetReplOwner(replId, username string) error
+
+	// Repl Collaborators
+	AddCollaborator(replId string, collaborator models.Collaborator) error
+	GetCollaborator(replId, username string) (models.Collaborator, error)
+	GetCollaborators(replId string) ([]models.Collaborator, error)
+	RemoveCollaborator(replId, username string) error
+	GetSharedRepls(username string) ([]string, error)
+
+	// Repl Session
+	CreateReplSession(replId string) error
+	DeleteReplSession(replId string) error
+	GetSessionUsage(username string, month time.Time) (time.Duration, error)
+	// SetRunnerVersion records the runner version the session started with
+	SetRunnerVersion(replId, version string) error
+
+	// Repl Status
+	SetReplStatus(replId string, state models.ReplState) error
+	// CompareAndSetReplStatus sets the state only while the repl still has
+	// status from, and reports whether it did
+	CompareAndSetReplStatus(replId string, from models.ReplStatus, state models.ReplState) (bool, error)
+
+	// Repl Snapshots
+	CreateSnapshot(snapshot models.Snapshot) error
+	GetSnapshot(replId, snapshotId string) (models.Snapshot, error)
+	GetSnapshots(replId string) ([]models.Snapshot, error)
+	DeleteSnapshot(replId, snapshotId string) error
+
+	// Plans
+	SavePlan(plan models.Plan) error
+	GetPlan(planId string) (models.Plan, error)
+	GetPlans() ([]models.Plan, error)
+	GetUserPlan(username string) (string, error)
+	SetUserPlan(username, planId string) error
+
+	// Organizations, used to group users into shared namespaces
+	GetUserOrg(username string) (string, error)
+	SetUserOrg(username, org string) error
+
+	// Personal access tokens, found by the hash of their secret
+	CreateAccessToken(hash string, token models.AccessToken) error
+	GetAccessToken(hash string) (models.AccessToken, error)
+	ListAccessTokens(userId string) ([]models.AccessToken, error)
+	DeleteAccessToken(userId, tokenId string) error
+	SetAccessTokenUsed(hash string, at time.Time) error
+
+	// User registry, accounts are found by id, handle or a linked identity
+	CreateUser(account models.Account) error
+	GetUser(userId string) (models.Account, error)
+	GetUserByHandle(handle string) (models.Account, error)
+	GetUserByIdentity(provider models.IdentityProvider, subject string) (models.Account, error)
+	LinkIdentity(userId string, identity models.Identity) error
+	UnlinkIdentity(userId string, provider models.IdentityProvider, subject string) error
+
+	// Magic links, recorded by their jti when sent so each works only once
+	SaveMagicLink(jti string, expiresAt time.Time) error
+	ConsumeMagicLink(jti string) (bool, error)
+
+	// Rate limits, attempts counted per key in fixed windows
+	CountAttempt(key string, window time.Duration) (int64, error)
+
+	// Login sessions, found by the hash of their cookie secret
+	CreateSession(hash string, session models.Session) error
+	GetSession(hash string) (models.Session, error)
+	UpdateSession(hash string, session models.Session) error
+	ListSessions(userId string) ([]models.Session, error)
+	DeleteSession(userId, sessionId string) error
+	DeleteSessions(userId string) error
+}
+
+// Transitions retried when the status changes between reading and setting it
+const transitionAttempts = 3
+
+var ErrStatusConflict = errors.New("repl status changed concurrently")
+
+var (
+	_ ReplStore = (*redis.Redis)(nil)
+	_ ReplStore = (*Memory)(nil)
+)
+
+// NewReplStore returns the backend selected by REPL_STORE ("redis" or "memory").
+// The memory backend is persisted to REPL_STORE_FILE when it is set.
+func NewReplStore() ReplStore {
+	switch strings.ToLower(REPL_STORE) {
+	case "memory", "file":
+		log.Info("Using embedded repl store", "file", REPL_STORE_FILE)
+		return NewMemoryStore(REPL_STORE_FILE)
+	case "redis":
+		return redis.NewRedisStore()
+	default:
+		log.Warn("Unknown repl store, falling back to redis", "store", REPL_STORE)
+		return redis.NewRedisStore()
+	}
+}
+
+// Transition moves a repl to the given status, rejecting moves the lifecycle
+// doesn't allow (e.g. a stopped repl becoming ready after a late ping).
+func Transition(rs ReplStore, replId string, to models.ReplStatus, reason string) error {
+	return transition(rs, replId, models.ReplState{Status: to, Reason: reason})
+}
+
+// TransitionFrom is Transition for callers that decided on the move from the
+// status they read earlier: it's only applied while the repl still has status
+// from, else ErrStatusConflict is returned
+func TransitionFrom(rs ReplStore, replId string, from, to models.ReplStatus, reason string) error {
+	if from != to && !from.CanTransition(to) {
+		return fmt.Errorf("invalid repl status transition: %s -> %s", from, to)
+	}
+	ok, err := rs.CompareAndSetReplStatus(replId, from, models.ReplState{Status: to, Reason: reason})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s is no longer %s", ErrStatusConflict, replId, from)
+	}
+	if from != to {
+		log.Info("Repl status changed", "repl_id", replId, "from", from, "to", to, "reason", reason)
+	}
+	return nil
+}
+
+// Fail moves a repl to failed because of err, recording the failure code of
+// a *models.ReplFailure
+func Fail(rs ReplStore, replId string, err error) error {
+	state := models.ReplState{Status: models.ReplFailed, Reason: err.Error()}
+	var failure *models.ReplFailure
+	if errors.As(err, &failure) {
+		state.Reason = failure.Message
+		state.Failure = failure.Code
+	}
+	return transition(rs, replId, state)
+}
+
+// transition checks the move against the status it read and only applies it
+// while the repl still has that status, so two racing transitions can't both
+// pass the check
+func transition(rs ReplStore, replId string, state models.ReplState) error {
+	for attempt := 0; attempt < transitionAttempts; attempt++ {
+		repl, err := rs.GetRepl(replId)
+		if err != nil {
+			return err
+		}
+
+		from, to := repl.State.Status, state.Status
+		if from != to && !from.CanTransition(to) {
+			return fmt.Errorf("invalid repl status transition: %s -> %s", from, to)
+		}
+
+		ok, err := rs.CompareAndSetReplStatus(replId, from, state)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if from != to {
+				log.Info("Repl status changed", "repl_id", replId, "from", from, "to", to, "reason", state.Reason, "failure", state.Failure)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrStatusConflict, replId)
+}
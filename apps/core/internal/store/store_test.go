@@ -0,0 +1,323 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"core/internal/redis"
+	"core/models"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// backends runs every test against each ReplStore implementation, so the
+// memory store can't drift from the Redis one
+var backends = []struct {
+	name string
+	new  func(t *testing.T) ReplStore
+}{
+	{"memory", func(t *testing.T) ReplStore {
+		return NewMemoryStore("")
+	}},
+	{"file", func(t *testing.T) ReplStore {
+		return NewMemoryStore(filepath.Join(t.TempDir(), "store.json"))
+	}},
+	{"redis", func(t *testing.T) ReplStore {
+		mr := miniredis.RunT(t)
+		redis.REDIS_URL = "redis://" + mr.Addr()
+		return redis.NewRedisStore()
+	}},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, rs ReplStore)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.new(t))
+		})
+	}
+}
+
+func TestRepls(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		if err := rs.CreateRepl("node", "alice", "demo", "repl-1"); err != nil {
+			t.Fatalf("CreateRepl: %v", err)
+		}
+
+		repl, err := rs.GetRepl("repl-1")
+		if err != nil {
+			t.Fatalf("GetRepl: %v", err)
+		}
+		if repl.User != "alice" || repl.Name != "demo" || repl.Template != "node" {
+			t.Errorf("GetRepl = %+v", repl)
+		}
+		if repl.State.Status != models.ReplStopped || repl.IsActive {
+			t.Errorf("new repl state = %+v, active %v", repl.State, repl.IsActive)
+		}
+
+		ids, err := rs.GetUserRepls("alice")
+		if err != nil || !slices.Equal(ids, []string{"repl-1"}) {
+			t.Errorf("GetUserRepls = %v, %v", ids, err)
+		}
+
+		repls, err := rs.ListRepls()
+		if err != nil || len(repls) != 1 {
+			t.Errorf("ListRepls = %v, %v", repls, err)
+		}
+
+		if err := rs.DeleteRepl("repl-1"); err != nil {
+			t.Fatalf("DeleteRepl: %v", err)
+		}
+		if _, err := rs.GetRepl("repl-1"); err == nil {
+			t.Error("GetRepl found a deleted repl")
+		}
+		if ids, _ := rs.GetUserRepls("alice"); len(ids) != 0 {
+			t.Errorf("GetUserRepls after delete = %v", ids)
+		}
+		if err := rs.DeleteRepl("repl-1"); err == nil {
+			t.Error("DeleteRepl of a missing repl succeeded")
+		}
+	})
+}
+
+func TestReplStatus(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		if err := Transition(rs, "repl-1", models.ReplReady, ""); err == nil {
+			t.Error("Transition allowed stopped -> ready")
+		}
+		if err := Transition(rs, "repl-1", models.ReplPending, "starting"); err != nil {
+			t.Fatalf("Transition to pending: %v", err)
+		}
+
+		failure := &models.ReplFailure{Code: models.FailureImagePull, Message: "no such image"}
+		if err := Fail(rs, "repl-1", failure); err != nil {
+			t.Fatalf("Fail: %v", err)
+		}
+		repl, _ := rs.GetRepl("repl-1")
+		if repl.State.Status != models.ReplFailed || repl.State.Failure != models.FailureImagePull || repl.State.Reason != "no such image" {
+			t.Errorf("failed state = %+v", repl.State)
+		}
+
+		if err := rs.SetReplStatus("missing", models.ReplState{Status: models.ReplPending}); err == nil {
+			t.Error("SetReplStatus of a missing repl succeeded")
+		}
+	})
+}
+
+func TestCompareAndSetReplStatus(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		ok, err := rs.CompareAndSetReplStatus("repl-1", models.ReplReady, models.ReplState{Status: models.ReplStopping})
+		if err != nil || ok {
+			t.Errorf("CompareAndSetReplStatus from the wrong status = %v, %v", ok, err)
+		}
+		if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplStopped {
+			t.Errorf("status after a failed compare = %s", repl.State.Status)
+		}
+
+		ok, err = rs.CompareAndSetReplStatus("repl-1", models.ReplStopped, models.ReplState{Status: models.ReplPending, Reason: "starting"})
+		if err != nil || !ok {
+			t.Errorf("CompareAndSetReplStatus = %v, %v", ok, err)
+		}
+		if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplPending || repl.State.Reason != "starting" {
+			t.Errorf("state after compare and set = %+v", repl.State)
+		}
+
+		if _, err := rs.CompareAndSetReplStatus("missing", models.ReplStopped, models.ReplState{Status: models.ReplPending}); err == nil {
+			t.Error("CompareAndSetReplStatus of a missing repl succeeded")
+		}
+	})
+}
+
+// Repls stored before statuses existed only carry isActive, both backends
+// read and compare them as ready
+func TestLegacyReplStatus(t *testing.T) {
+	legacy := map[string]func(t *testing.T) ReplStore{
+		"file": func(t *testing.T) ReplStore {
+			path := filepath.Join(t.TempDir(), "store.json")
+			data := `{"repls": {"repl-1": {"id": "repl-1", "user": "alice", "isActive": true}}}`
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			return NewMemoryStore(path)
+		},
+		"redis": func(t *testing.T) ReplStore {
+			mr := miniredis.RunT(t)
+			mr.HSet("repl:repl-1", "id", "repl-1", "user", "alice", "isActive", "true")
+			redis.REDIS_URL = "redis://" + mr.Addr()
+			return redis.NewRedisStore()
+		},
+	}
+	for name, open := range legacy {
+		t.Run(name, func(t *testing.T) {
+			rs := open(t)
+			if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplReady {
+				t.Errorf("legacy status = %q, want ready", repl.State.Status)
+			}
+			ok, err := rs.CompareAndSetReplStatus("repl-1", models.ReplReady, models.ReplState{Status: models.ReplStopping})
+			if err != nil || !ok {
+				t.Errorf("CompareAndSetReplStatus from ready = %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+// staleStore returns a repl status that's already outdated once, like a
+// transition that lost a race between its read and its write
+type staleStore struct {
+	ReplStore
+	stale models.ReplStatus
+}
+
+func (s *staleStore) GetRepl(replId string) (models.Repl, error) {
+	repl, err := s.ReplStore.GetRepl(replId)
+	if s.stale != "" {
+		repl.State.Status, s.stale = s.stale, ""
+	}
+	return repl, err
+}
+
+func TestTransitionRechecksStatus(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		// The repl was stopped after the transition read it as ready
+		stale := &staleStore{ReplStore: rs, stale: models.ReplReady}
+		if err := Transition(stale, "repl-1", models.ReplStopping, ""); err == nil {
+			t.Error("Transition moved a stopped repl to stopping")
+		}
+		if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplStopped {
+			t.Errorf("status after a stale transition = %s", repl.State.Status)
+		}
+	})
+}
+
+func TestTransitionFrom(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		if err := TransitionFrom(rs, "repl-1", models.ReplReady, models.ReplFailed, "stuck"); !errors.Is(err, ErrStatusConflict) {
+			t.Errorf("TransitionFrom a status the repl left = %v, want a conflict", err)
+		}
+		if err := TransitionFrom(rs, "repl-1", models.ReplStopped, models.ReplReady, ""); err == nil {
+			t.Error("TransitionFrom allowed stopped -> ready")
+		}
+		if err := TransitionFrom(rs, "repl-1", models.ReplStopped, models.ReplPending, ""); err != nil {
+			t.Fatalf("TransitionFrom: %v", err)
+		}
+		if repl, _ := rs.GetRepl("repl-1"); repl.State.Status != models.ReplPending {
+			t.Errorf("status = %s, want pending", repl.State.Status)
+		}
+	})
+}
+
+func TestReplSessions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.CreateRepl("node", "alice", "demo", "repl-1")
+
+		if err := rs.CreateReplSession("repl-1"); err != nil {
+			t.Fatalf("CreateReplSession: %v", err)
+		}
+		if err := rs.SetRunnerVersion("repl-1", "v1.2.0"); err != nil {
+			t.Fatalf("SetRunnerVersion: %v", err)
+		}
+		repl, _ := rs.GetRepl("repl-1")
+		if !repl.IsActive || repl.SessionStartedAt.IsZero() || repl.RunnerVersion != "v1.2.0" {
+			t.Errorf("repl in session = %+v", repl)
+		}
+
+		if err := rs.DeleteReplSession("repl-1"); err != nil {
+			t.Fatalf("DeleteReplSession: %v", err)
+		}
+		repl, _ = rs.GetRepl("repl-1")
+		if repl.IsActive || !repl.SessionStartedAt.IsZero() {
+			t.Errorf("repl after session = %+v", repl)
+		}
+
+		usage, err := rs.GetSessionUsage("alice", time.Now())
+		if err != nil || usage < 0 {
+			t.Errorf("GetSessionUsage = %v, %v", usage, err)
+		}
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		now := time.Now().UTC().Truncate(time.Second)
+		rs.CreateSnapshot(models.Snapshot{Id: "snap-1", ReplId: "repl-1", Kind: models.SnapshotManual, CreatedAt: now})
+		rs.CreateSnapshot(models.Snapshot{Id: "snap-2", ReplId: "repl-1", Kind: models.SnapshotAuto, CreatedAt: now.Add(time.Minute)})
+
+		snapshot, err := rs.GetSnapshot("repl-1", "snap-1")
+		if err != nil || snapshot.Kind != models.SnapshotManual {
+			t.Errorf("GetSnapshot = %+v, %v", snapshot, err)
+		}
+
+		snapshots, _ := rs.GetSnapshots("repl-1")
+		if len(snapshots) != 2 || snapshots[0].Id != "snap-2" {
+			t.Errorf("GetSnapshots = %+v, want newest first", snapshots)
+		}
+
+		rs.DeleteSnapshot("repl-1", "snap-2")
+		if _, err := rs.GetSnapshot("repl-1", "snap-2"); err == nil {
+			t.Error("GetSnapshot found a deleted snapshot")
+		}
+	})
+}
+
+func TestPlansAndOrgs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		rs.SavePlan(models.Plan{Id: "pro", Name: "Pro", MaxRepls: 10})
+		rs.SavePlan(models.Plan{Id: "free", Name: "Free", MaxRepls: 2})
+
+		plan, err := rs.GetPlan("pro")
+		if err != nil || plan.MaxRepls != 10 {
+			t.Errorf("GetPlan = %+v, %v", plan, err)
+		}
+		if _, err := rs.GetPlan("missing"); err == nil {
+			t.Error("GetPlan found a missing plan")
+		}
+		plans, _ := rs.GetPlans()
+		if len(plans) != 2 || plans[0].Id != "free" {
+			t.Errorf("GetPlans = %+v, want sorted by id", plans)
+		}
+
+		if planId, _ := rs.GetUserPlan("alice"); planId != "" {
+			t.Errorf("GetUserPlan of a new user = %q", planId)
+		}
+		rs.SetUserPlan("alice", "pro")
+		if planId, _ := rs.GetUserPlan("alice"); planId != "pro" {
+			t.Errorf("GetUserPlan = %q", planId)
+		}
+
+		rs.SetUserOrg("alice", "acme")
+		if org, _ := rs.GetUserOrg("alice"); org != "acme" {
+			t.Errorf("GetUserOrg = %q", org)
+		}
+		rs.SetUserOrg("alice", "")
+		if org, _ := rs.GetUserOrg("alice"); org != "" {
+			t.Errorf("GetUserOrg after leaving = %q", org)
+		}
+	})
+}
+
+func TestMemoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	rs := NewMemoryStore(path)
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	rs.SetUserPlan("alice", "pro")
+
+	reloaded := NewMemoryStore(path)
+	if repl, err := reloaded.GetRepl("repl-1"); err != nil || repl.User != "alice" {
+		t.Errorf("GetRepl after reload = %+v, %v", repl, err)
+	}
+	if planId, _ := reloaded.GetUserPlan("alice"); planId != "pro" {
+		t.Errorf("GetUserPlan after reload = %q", planId)
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"core/models"
+)
+
+func TestUsers(t *testing.T) {
+	github := models.Identity{Provider: models.ProviderGithub, Subject: "42"}
+	email := models.Identity{Provider: models.ProviderEmail, Subject: "alice@example.com"}
+
+	forEachBackend(t, func(t *testing.T, rs ReplStore) {
+		alice := models.Account{Id: "usr-1", Handle: "alice", Identities: []models.Identity{github}}
+		if err := rs.CreateUser(alice); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+
+		err := rs.CreateUser(models.Account{Id: "usr-2", Handle: "alice"})
+		if !errors.Is(err, models.ErrHandleTaken) {
+			t.Errorf("CreateUser with a taken handle = %v", err)
+		}
+		err = rs.CreateUser(models.Account{Id: "usr-2", Handle: "bob", Identities: []models.Identity{github}})
+		if !errors.Is(err, models.ErrIdentityLinked) {
+			t.Errorf("CreateUser with a linked identity = %v", err)
+		}
+		// A failed registration doesn't keep the handle
+		if err := rs.CreateUser(models.Account{Id: "usr-2", Handle: "bob"}); err != nil {
+			t.Errorf("CreateUser after a failed one: %v", err)
+		}
+
+		if account, err := rs.GetUser("usr-1"); err != nil || account.Handle != "alice" {
+			t.Errorf("GetUser = %+v, %v", account, err)
+		}
+		if account, err := rs.GetUserByHandle("alice"); err != nil || account.Id != "usr-1" {
+			t.Errorf("GetUserByHandle = %+v, %v", account, err)
+		}
+		if account, err := rs.GetUserByIdentity(github.Provider, github.Subject); err != nil || account.Id != "usr-1" {
+			t.Errorf("GetUserByIdentity = %+v, %v", account, err)
+		}
+
+		if err := rs.LinkIdentity("usr-1", email); err != nil {
+			t.Fatalf("LinkIdentity: %v", err)
+		}
+		if err := rs.LinkIdentity("usr-1", email); err != nil {
+			t.Errorf("LinkIdentity twice: %v", err)
+		}
+		if err := rs.LinkIdentity("usr-2", email); !errors.Is(err, models.ErrIdentityLinked) {
+			t.Errorf("LinkIdentity of another account's identity = %v", err)
+		}
+
+		if err := rs.UnlinkIdentity("usr-1", github.Provider, github.Subject); err != nil {
+			t.Fatalf("UnlinkIdentity: %v", err)
+		}
+		if _, err := rs.GetUserByIdentity(github.Provider, github.Subject); err == nil {
+			t.Error("GetUserByIdentity found an unlinked identity")
+		}
+		account, _ := rs.GetUser("usr-1")
+		if len(account.Identities) != 1 || account.Identities[0] != email {
+			t.Errorf("identities after unlink = %+v", account.Identities)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	log "packages/logging"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"core/models"
+	"core/pkg/dotenv"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Directory holding templates/<key>/devex.yaml, the repo's templates/ when
+// core runs from apps/core
+var TEMPLATES_DIR = dotenv.EnvString("TEMPLATES_DIR", "../../templates")
+
+const ManifestFile = "devex.yaml"
+
+var (
+	keyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// Applied where a manifest leaves resources unset, so no container runs
+// without limits
+var defaultResources = models.TemplateResources{
+	ContainerResources: models.ContainerResources{
+		CPU:              "1",
+		Memory:           "1Gi",
+		EphemeralStorage: "2Gi",
+	},
+	Workspace: "1Gi",
+	Sidecar: models.ContainerResources{
+		CPU:              "100m",
+		Memory:           "128Mi",
+		EphemeralStorage: "256Mi",
+	},
+}
+
+var (
+	mu        sync.RWMutex
+	templates = map[string]models.Template{}
+)
+
+// Load reads and validates every template manifest under dir, replacing the
+// loaded templates only if all of them are valid
+func Load(dir string) error {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*", ManifestFile))
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("no template manifests found in %s", dir)
+	}
+
+	loaded := make(map[string]models.Template, len(manifests))
+	var errs []error
+	for _, path := range manifests {
+		template, err := load(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		loaded[template.Key] = template
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid template manifests: %w", errors.Join(errs...))
+	}
+
+	mu.Lock()
+	templates = loaded
+	mu.Unlock()
+
+	log.Info("Templates loaded", "dir", dir, "count", len(loaded))
+	return nil
+}
+
+func load(path string) (models.Template, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return models.Template{}, err
+	}
+
+	var template models.Template
+	if err := yaml.Unmarshal(bytes, &template); err != nil {
+		return models.Template{}, err
+	}
+	template.Key = filepath.Base(filepath.Dir(path))
+	if template.Name == "" {
+		template.Name = template.Key
+	}
+	template.Resources = defaultResources.Override(template.Resources)
+	if template.Storage == "" {
+		template.Storage = models.StorageEphemeral
+	}
+	if template.Security == "" {
+		template.Security = models.SecurityRestricted
+	}
+	if template.Version == "" {
+		log.Warn("Template runner version not pinned, using latest", "template", template.Key)
+		template.Version = "latest"
+	}
+
+	return template, validate(template)
+}
+
+func validate(template models.Template) error {
+	var errs []error
+	if !keyPattern.MatchString(template.Key) {
+		errs = append(errs, fmt.Errorf("template key %q must be lowercase letters, digits and dashes", template.Key))
+	}
+	if template.Image == "" {
+		errs = append(errs, errors.New("image is required"))
+	} else if strings.ContainsAny(template.Image[strings.LastIndex(template.Image, "/")+1:], ":@") {
+		errs = append(errs, fmt.Errorf("image %q must not have a tag, set version instead", template.Image))
+	}
+	if !tagPattern.MatchString(template.Version) {
+		errs = append(errs, fmt.Errorf("version %q is not a valid image tag", template.Version))
+	}
+	if template.Port < 1 || template.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", template.Port))
+	}
+	seen := map[int32]bool{template.Port: true, 50051: true, 8080: true}
+	for _, port := range template.Ports {
+		if port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("app port %d is out of range", port))
+		} else if seen[port] {
+			errs = append(errs, fmt.Errorf("app port %d is already used", port))
+		}
+		seen[port] = true
+	}
+	if err := ValidateResources(template.Resources); err != nil {
+		errs = append(errs, err)
+	}
+	if template.WarmPool != nil && *template.WarmPool < 0 {
+		errs = append(errs, fmt.Errorf("warmPool %d can't be negative", *template.WarmPool))
+	}
+	if !template.Storage.IsValid() {
+		errs = append(errs, fmt.Errorf("storage %q must be %q or %q", template.Storage, models.StorageEphemeral, models.StoragePersistent))
+	}
+	if err := ValidateSecurity(template.Security, template.RuntimeClass); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateSecurity checks a set security profile and runtime class
+func ValidateSecurity(security models.SecurityProfile, runtimeClass string) error {
+	var errs []error
+	if security != "" && !security.IsValid() {
+		errs = append(errs, fmt.Errorf("security %q must be %q or %q", security, models.SecurityBaseline, models.SecurityRestricted))
+	}
+	if runtimeClass != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(runtimeClass) {
+			errs = append(errs, fmt.Errorf("runtimeClass %q: %s", runtimeClass, msg))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateResources checks that every set resource is a Kubernetes quantity
+func ValidateResources(res models.TemplateResources) error {
+	var errs []error
+	for name, value := range map[string]string{
+		"resources.cpu":                      res.CPU,
+		"resources.memory":                   res.Memory,
+		"resources.ephemeralStorage":         res.EphemeralStorage,
+		"resources.workspace":                res.Workspace,
+		"resources.sidecar.cpu":              res.Sidecar.CPU,
+		"resources.sidecar.memory":           res.Sidecar.Memory,
+		"resources.sidecar.ephemeralStorage": res.Sidecar.EphemeralStorage,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func Get(key string) (models.Template, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	template, ok := templates[key]
+	return template, ok
+}
+
+// ForPlan returns the template with the plan's resource, storage and security
+// overrides applied
+func ForPlan(key string, plan models.Plan) (models.Template, bool) {
+	template, ok := Get(key)
+	if !ok {
+		return models.Template{}, false
+	}
+	template.Resources = template.Resources.Override(plan.Resources)
+	if plan.Storage != "" {
+		template.Storage = plan.Storage
+	}
+	if plan.Security != "" {
+		template.Security = plan.Security
+	}
+	if plan.RuntimeClass != "" {
+		template.RuntimeClass = plan.RuntimeClass
+	}
+	return template, true
+}
+
+// List returns the loaded templates ordered by key
+func List() []models.Template {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	list := make([]models.Template, 0, len(templates))
+	for _, template := range templates {
+		list = append(list, template)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
@@ -0,0 +1,299 @@
+// Package upgrade rolls running repls onto their template's current runner
+// version, one repl at a time: connected users are warned, the workspace is
+// flushed to S3 and the runner is recreated from the new image.
+package upgrade
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	log "packages/logging"
+	"slices"
+	"sync"
+	"time"
+
+	"core/internal/provisioner"
+	"core/internal/runnersync"
+	"core/internal/s3"
+	"core/internal/snapshot"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+// How long connected users are warned before their runner restarts
+var UPGRADE_WARNING, _ = time.ParseDuration(dotenv.EnvString("UPGRADE_WARNING", "1m"))
+
+var ErrRunning = errors.New("an upgrade is already running")
+
+// Outdated is a running repl whose runner isn't on its template's version
+type Outdated struct {
+	ReplId        string `json:"replId"`
+	User          string `json:"user"`
+	Template      string `json:"template"`
+	Version       string `json:"version"`
+	TargetVersion string `json:"targetVersion"`
+}
+
+const (
+	ResultUpgraded = "upgraded"
+	ResultSkipped  = "skipped"
+	ResultFailed   = "failed"
+)
+
+// Result is the outcome of rolling one repl
+type Result struct {
+	Outdated
+	Result string `json:"result"`
+	// Sessions that got the warning
+	Notified   int       `json:"notified"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Rollout is the progress of an upgrade
+type Rollout struct {
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt time.Time  `json:"finishedAt,omitzero"`
+	Running    bool       `json:"running"`
+	Pending    []Outdated `json:"pending"`
+	Results    []Result   `json:"results"`
+}
+
+// Request selects the repls to roll, all outdated repls when empty
+type Request struct {
+	Template string   `json:"template,omitempty"`
+	ReplIds  []string `json:"replIds,omitempty"`
+}
+
+// Upgrader runs one rollout at a time and keeps the latest one's progress
+type Upgrader struct {
+	rs       store.ReplStore
+	s3Client *s3.S3Client
+	prov     provisioner.Provisioner
+
+	mu      sync.Mutex
+	rollout Rollout
+}
+
+func NewUpgrader(rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner) *Upgrader {
+	return &Upgrader{
+		rs:       rs,
+		s3Client: s3Client,
+		prov:     prov,
+	}
+}
+
+// Outdated lists the ready repls of the template (every template when empty)
+// whose runner version differs from the template's
+func (u *Upgrader) Outdated(template string) ([]Outdated, error) {
+	repls, err := u.rs.ListRepls()
+	if err != nil {
+		return nil, err
+	}
+
+	outdated := []Outdated{}
+	for _, repl := range repls {
+		if o, ok := outdatedRepl(repl); ok && (template == "" || repl.Template == template) {
+			outdated = append(outdated, o)
+		}
+	}
+	slices.SortFunc(outdated, func(a, b Outdated) int {
+		return cmp.Or(cmp.Compare(a.Template, b.Template), cmp.Compare(a.ReplId, b.ReplId))
+	})
+	return outdated, nil
+}
+
+func outdatedRepl(repl models.Repl) (Outdated, bool) {
+	if repl.State.Status != models.ReplReady {
+		return Outdated{}, false
+	}
+	template, ok := templates.Get(repl.Template)
+	if !ok || repl.RunnerVersion == template.Version {
+		return Outdated{}, false
+	}
+	return Outdated{
+		ReplId:        repl.Id,
+		User:          repl.User,
+		Template:      repl.Template,
+		Version:       repl.RunnerVersion,
+		TargetVersion: template.Version,
+	}, true
+}
+
+// Rollout returns the progress of the running or latest rollout
+func (u *Upgrader) Rollout() Rollout {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	rollout := u.rollout
+	rollout.Pending = slices.Clone(rollout.Pending)
+	rollout.Results = slices.Clone(rollout.Results)
+	return rollout
+}
+
+// Start rolls the selected outdated repls in the background
+func (u *Upgrader) Start(req Request) (Rollout, error) {
+	outdated, err := u.Outdated(req.Template)
+	if err != nil {
+		return Rollout{}, err
+	}
+	if len(req.ReplIds) > 0 {
+		outdated = slices.DeleteFunc(outdated, func(o Outdated) bool {
+			return !slices.Contains(req.ReplIds, o.ReplId)
+		})
+	}
+
+	u.mu.Lock()
+	if u.rollout.Running {
+		u.mu.Unlock()
+		return Rollout{}, ErrRunning
+	}
+	u.rollout = Rollout{
+		StartedAt: time.Now().UTC(),
+		Running:   true,
+		Pending:   outdated,
+		Results:   []Result{},
+	}
+	u.mu.Unlock()
+
+	log.Info("Runner upgrade started", "repls", len(outdated), "template", req.Template)
+	go u.run()
+	return u.Rollout(), nil
+}
+
+func (u *Upgrader) run() {
+	for {
+		u.mu.Lock()
+		if len(u.rollout.Pending) == 0 {
+			u.rollout.Running = false
+			u.rollout.FinishedAt = time.Now().UTC()
+			rolled := len(u.rollout.Results)
+			u.mu.Unlock()
+			log.Info("Runner upgrade finished", "repls", rolled)
+			return
+		}
+		next := u.rollout.Pending[0]
+		u.mu.Unlock()
+
+		result := u.roll(next)
+		result.FinishedAt = time.Now().UTC()
+		switch {
+		case result.Error != "":
+			log.Warn("Runner upgrade failed", "repl_id", next.ReplId, "version", next.TargetVersion, "result", result.Result, "error", result.Error)
+		case result.Result == ResultUpgraded:
+			log.Info("Runner upgraded", "repl_id", next.ReplId, "from", next.Version, "to", next.TargetVersion)
+		default:
+			log.Info("Runner upgrade skipped", "repl_id", next.ReplId)
+		}
+
+		u.mu.Lock()
+		u.rollout.Pending = u.rollout.Pending[1:]
+		u.rollout.Results = append(u.rollout.Results, result)
+		u.mu.Unlock()
+	}
+}
+
+// roll warns the repl's users, flushes its workspace and recreates its runner
+// on the template's version. Repls stopped or upgraded in the meantime are
+// skipped, and a failed flush leaves the old runner running.
+func (u *Upgrader) roll(target Outdated) Result {
+	result := Result{Outdated: target, Result: ResultSkipped}
+
+	repl, err := u.rs.GetRepl(target.ReplId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	current, ok := outdatedRepl(repl)
+	if !ok {
+		return result
+	}
+	result.Outdated = current
+	replId := repl.Id
+	endpoint := u.prov.Endpoint(replId)
+
+	notified, err := runnersync.Notify(endpoint, replId, runnersync.Notice{
+		Kind:    runnersync.NoticeRestart,
+		Message: fmt.Sprintf("This workspace restarts in %s to update its runner. Your files are saved first.", UPGRADE_WARNING),
+		At:      time.Now().Add(UPGRADE_WARNING).UTC(),
+	})
+	if err != nil {
+		log.Warn("Upgrade warning not sent", "repl_id", replId, "error", err)
+	}
+	result.Notified = notified
+	// Nobody to warn, no reason to wait
+	if notified > 0 {
+		time.Sleep(UPGRADE_WARNING)
+
+		// Its users had time to stop it
+		repl, err = u.rs.GetRepl(replId)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if _, ok := outdatedRepl(repl); !ok {
+			return result
+		}
+	}
+
+	snapshot.Auto(u.s3Client, u.rs, repl, "Before upgrade")
+
+	if err := u.prov.Flush(repl.User, replId); err != nil {
+		result.Result = ResultFailed
+		result.Error = fmt.Sprintf("flush failed, runner left on %s: %v", current.Version, err)
+		return result
+	}
+
+	reason := fmt.Sprintf("upgrading runner to %s", current.TargetVersion)
+	if err := store.Transition(u.rs, replId, models.ReplStopping, reason); err != nil {
+		// Stopped by its users while they were warned
+		return result
+	}
+	result.Result = ResultFailed
+	if err := u.rs.DeleteReplSession(replId); err != nil {
+		log.Warn("Delete repl session failed", "repl_id", replId, "error", err)
+	}
+
+	if err := u.prov.Delete(repl.User, replId); err != nil {
+		u.fail(replId, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	if err := store.Transition(u.rs, replId, models.ReplStopped, reason); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := store.Transition(u.rs, replId, models.ReplPending, reason); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := u.rs.CreateReplSession(replId); err != nil {
+		u.fail(replId, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	provisioner.Provision(u.rs, u.prov, repl.User, repl)
+
+	repl, err = u.rs.GetRepl(replId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if repl.State.Status != models.ReplReady {
+		result.Error = fmt.Sprintf("repl is %s: %s", repl.State.Status, repl.State.Reason)
+		return result
+	}
+	result.Result = ResultUpgraded
+	return result
+}
+
+// fail marks the repl failed after a roll step errored
+func (u *Upgrader) fail(replId string, err error) {
+	if err := store.Transition(u.rs, replId, models.ReplFailed, err.Error()); err != nil {
+		log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+	}
+}
@@ -0,0 +1,162 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	log "packages/logging"
+	"strings"
+
+	"core/internal/provisioner"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/models"
+)
+
+var ErrNotLegacy = errors.New("not a user from before the registry")
+
+// Migration is what MigrateLegacy moved to the account
+type Migration struct {
+	UserId string   `json:"userId"`
+	Handle string   `json:"handle"`
+	Repls  []string `json:"repls"`
+	Shared []string `json:"shared"`
+}
+
+// MigrateLegacy moves a user from before the registry, whose repls are owned
+// by their login, to the account the identity signs in to: repl ownership,
+// workspaces and snapshots in S3, shares, plan and organization. Admins run
+// it once per legacy user after they signed in again. Repls are moved one at
+// a time while archiving, running ones fail the migration; running it again
+// picks up where it stopped.
+func MigrateLegacy(rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner, legacyUser string, provider models.IdentityProvider, subject string) (Migration, error) {
+	if legacyUser == "" || strings.HasPrefix(legacyUser, idPrefix) {
+		return Migration{}, ErrNotLegacy
+	}
+	if _, err := rs.GetUser(legacyUser); err == nil {
+		return Migration{}, ErrNotLegacy
+	}
+
+	account, err := rs.GetUserByIdentity(provider, subject)
+	if err != nil {
+		return Migration{}, err
+	}
+	migration := Migration{UserId: account.Id, Handle: account.Handle, Repls: []string{}, Shared: []string{}}
+
+	replIds, err := rs.GetUserRepls(legacyUser)
+	if err != nil {
+		return migration, err
+	}
+	for _, replId := range replIds {
+		repl, err := rs.GetRepl(replId)
+		if err != nil {
+			return migration, err
+		}
+		err = provisioner.Archiving(rs, repl, func() error {
+			return moveRepl(rs, s3Client, prov, legacyUser, account.Id, replId)
+		})
+		if err != nil {
+			return migration, fmt.Errorf("migrate repl %s: %w", replId, err)
+		}
+		migration.Repls = append(migration.Repls, replId)
+	}
+
+	shared, err := rs.GetSharedRepls(legacyUser)
+	if err != nil {
+		return migration, err
+	}
+	for _, replId := range shared {
+		if err := moveShare(rs, legacyUser, account, replId); err != nil {
+			return migration, fmt.Errorf("migrate share of %s: %w", replId, err)
+		}
+		migration.Shared = append(migration.Shared, replId)
+	}
+
+	if err := movePlan(rs, legacyUser, account.Id); err != nil {
+		return migration, err
+	}
+
+	log.Info("Legacy user migrated", "legacy_user", legacyUser, "user_id", account.Id, "repls", len(migration.Repls), "shared", len(migration.Shared))
+	return migration, nil
+}
+
+// moveRepl copies the repl's workspace and snapshots to the account's
+// prefixes before handing it over, the old copies are only deleted after.
+// Persistent volumes live in the legacy user's namespace, they're archived to
+// S3 first so their content moves too.
+func moveRepl(rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner, legacyUser, userId, replId string) error {
+	if err := prov.Archive(legacyUser, replId); err != nil {
+		return err
+	}
+
+	prefixes := []string{"repl/%s/%s/", "snapshots/%s/%s/"}
+	for _, prefix := range prefixes {
+		if err := s3Client.CopyFolder(fmt.Sprintf(prefix, legacyUser, replId), fmt.Sprintf(prefix, userId, replId)); err != nil {
+			return err
+		}
+	}
+	if err := rs.SetReplOwner(replId, userId); err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		if err := s3Client.DeleteFolder(fmt.Sprintf(prefix, legacyUser, replId)); err != nil {
+			log.Warn("Delete legacy objects failed", "repl_id", replId, "prefix", fmt.Sprintf(prefix, legacyUser, replId), "error", err)
+		}
+	}
+	return nil
+}
+
+// moveShare gives the account the legacy user's access to a repl shared with
+// them, unless it's now the account's own
+func moveShare(rs store.ReplStore, legacyUser string, account models.Account, replId string) error {
+	collaborator, err := rs.GetCollaborator(replId, legacyUser)
+	if err != nil {
+		return err
+	}
+	repl, err := rs.GetRepl(replId)
+	if err != nil {
+		return err
+	}
+
+	if repl.User != account.Id {
+		collaborator.User = account.Id
+		collaborator.Handle = account.Handle
+		if err := rs.AddCollaborator(replId, collaborator); err != nil {
+			return err
+		}
+	}
+	return rs.RemoveCollaborator(replId, legacyUser)
+}
+
+// movePlan carries the legacy user's plan and organization over, unless the
+// account already has its own
+func movePlan(rs store.ReplStore, legacyUser, userId string) error {
+	if plan, err := rs.GetUserPlan(legacyUser); err != nil {
+		return err
+	} else if plan != "" {
+		current, err := rs.GetUserPlan(userId)
+		if err != nil {
+			return err
+		}
+		if current == "" {
+			if err := rs.SetUserPlan(userId, plan); err != nil {
+				return err
+			}
+		}
+	}
+
+	org, err := rs.GetUserOrg(legacyUser)
+	if err != nil || org == "" {
+		return err
+	}
+	current, err := rs.GetUserOrg(userId)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		if err := rs.SetUserOrg(userId, org); err != nil {
+			return err
+		}
+	}
+	return rs.SetUserOrg(legacyUser, "")
+}
@@ -0,0 +1,114 @@
+package users
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"core/internal/provisioner"
+	"core/internal/s3"
+	"core/internal/s3/s3test"
+	"core/internal/store"
+	"core/models"
+)
+
+func TestMigrateLegacy(t *testing.T) {
+	fake := s3test.NewServer(t)
+	s3Client := s3.NewS3ClientAt(fake.URL)
+	rs := store.NewMemoryStore("")
+	prov := provisioner.NewLocal(s3Client, rs)
+
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	fake.Put("repl/alice/repl-1/main.py", []byte("print('hi')"))
+	fake.Put("snapshots/alice/repl-1/snap-1/main.py", []byte("print('old')"))
+	rs.CreateRepl("node", "bob", "shared", "repl-2")
+	rs.AddCollaborator("repl-2", models.Collaborator{User: "alice", Role: models.RoleEditor})
+	rs.SetUserPlan("alice", "internal")
+
+	identity := models.Identity{Provider: models.ProviderGithub, Subject: "42"}
+	user, err := SignIn(rs, identity, models.User{Login: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.ID, idPrefix) {
+		t.Fatalf("legacy login got id %q, want a fresh one", user.ID)
+	}
+
+	migration, err := MigrateLegacy(rs, s3Client, prov, "alice", identity.Provider, identity.Subject)
+	if err != nil {
+		t.Fatalf("MigrateLegacy: %v", err)
+	}
+	if !slices.Equal(migration.Repls, []string{"repl-1"}) || !slices.Equal(migration.Shared, []string{"repl-2"}) {
+		t.Errorf("migration = %+v", migration)
+	}
+
+	repl, _ := rs.GetRepl("repl-1")
+	if repl.User != user.ID || repl.State.Status != models.ReplStopped {
+		t.Errorf("repl-1 = %s, %s, want owned by %s and stopped", repl.User, repl.State.Status, user.ID)
+	}
+	if repls, _ := rs.GetUserRepls(user.ID); !slices.Equal(repls, []string{"repl-1"}) {
+		t.Errorf("account repls = %v", repls)
+	}
+	if repls, _ := rs.GetUserRepls("alice"); len(repls) != 0 {
+		t.Errorf("legacy repls = %v, want none", repls)
+	}
+
+	want := []string{
+		"repl/" + user.ID + "/repl-1/main.py",
+		"snapshots/" + user.ID + "/repl-1/snap-1/main.py",
+	}
+	if keys := append(fake.Keys("repl/"), fake.Keys("snapshots/")...); !slices.Equal(keys, want) {
+		t.Errorf("stored keys = %v, want %v", keys, want)
+	}
+
+	if _, err := rs.GetCollaborator("repl-2", user.ID); err != nil {
+		t.Errorf("account lost the share: %v", err)
+	}
+	if _, err := rs.GetCollaborator("repl-2", "alice"); err == nil {
+		t.Error("legacy user still collaborates on repl-2")
+	}
+	if plan, _ := rs.GetUserPlan(user.ID); plan != "internal" {
+		t.Errorf("account plan = %q, want internal", plan)
+	}
+}
+
+func TestMigrateLegacyRejectsRunningRepls(t *testing.T) {
+	fake := s3test.NewServer(t)
+	s3Client := s3.NewS3ClientAt(fake.URL)
+	rs := store.NewMemoryStore("")
+
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	rs.SetReplStatus("repl-1", models.ReplState{Status: models.ReplReady})
+	identity := models.Identity{Provider: models.ProviderGithub, Subject: "42"}
+	user, _ := SignIn(rs, identity, models.User{Login: "alice"})
+
+	_, err := MigrateLegacy(rs, s3Client, provisioner.NewLocal(s3Client, rs), "alice", identity.Provider, identity.Subject)
+	if !errors.Is(err, store.ErrStatusConflict) {
+		t.Errorf("MigrateLegacy = %v, want a status conflict", err)
+	}
+	if repl, _ := rs.GetRepl("repl-1"); repl.User != "alice" {
+		t.Errorf("running repl moved to %s", repl.User)
+	}
+
+	if _, err := MigrateLegacy(rs, s3Client, nil, user.ID, identity.Provider, identity.Subject); !errors.Is(err, ErrNotLegacy) {
+		t.Errorf("MigrateLegacy of an account = %v, want ErrNotLegacy", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	user, err := SignIn(rs, models.Identity{Provider: models.ProviderEmail, Subject: "usr-x@example.com"}, models.User{Login: "usr-x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(user.Login, idPrefix) {
+		t.Errorf("handle %q passes for an id", user.Login)
+	}
+
+	for _, ref := range []string{user.ID, user.Login, "@" + user.Login} {
+		if account, err := Lookup(rs, ref); err != nil || account.Id != user.ID {
+			t.Errorf("Lookup(%q) = %+v, %v", ref, account, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package users is the account registry. Sign-ins resolve to an account
+// through the identity they were made with; an identity seen for the first
+// time gets a new account with an immutable id and a unique handle.
+package users
+
+import (
+	"errors"
+	"fmt"
+	log "packages/logging"
+	"regexp"
+	"strings"
+	"time"
+
+	"core/internal/store"
+	"core/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Account ids are the prefix and a uuid, handles never start with it
+	idPrefix = "usr-"
+	// Suffixed handles tried before falling back to a random suffix
+	numberedHandles = 5
+	handleAttempts  = 10
+)
+
+var ErrLastIdentity = errors.New("can't unlink the only identity of an account")
+
+var invalidHandle = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// SignIn returns the account linked to the identity, registering one when
+// there's none. The profile's Login is the preferred handle.
+func SignIn(rs store.ReplStore, identity models.Identity, profile models.User) (models.User, error) {
+	if account, err := rs.GetUserByIdentity(identity.Provider, identity.Subject); err == nil {
+		return account.User(), nil
+	}
+
+	now := time.Now().UTC()
+	identity.LinkedAt = now
+	base := handleBase(profile.Login)
+
+	account := models.Account{
+		Id:         idPrefix + uuid.New().String(),
+		Name:       profile.Name,
+		Email:      profile.Email,
+		AvatarURL:  profile.AvatarURL,
+		Identities: []models.Identity{identity},
+		CreatedAt:  now,
+	}
+
+	for attempt := 0; attempt < handleAttempts; attempt++ {
+		account.Handle = handleCandidate(base, attempt)
+
+		err := rs.CreateUser(account)
+		switch {
+		case errors.Is(err, models.ErrHandleTaken):
+			continue
+		case errors.Is(err, models.ErrIdentityLinked):
+			// Another sign-in with the same identity registered first
+			existing, err := rs.GetUserByIdentity(identity.Provider, identity.Subject)
+			return existing.User(), err
+		case err != nil:
+			return models.User{}, err
+		}
+
+		log.Info("User registered", "user_id", account.Id, "handle", account.Handle, "provider", identity.Provider)
+		return account.User(), nil
+	}
+	return models.User{}, fmt.Errorf("no free handle for %q", base)
+}
+
+// IsId reports whether ref is an account id rather than a handle
+func IsId(ref string) bool {
+	return strings.HasPrefix(ref, idPrefix)
+}
+
+// Lookup finds an account by its id (usr-...) or handle, as given in API
+// paths and requests
+func Lookup(rs store.ReplStore, ref string) (models.Account, error) {
+	ref = strings.TrimSpace(ref)
+	if IsId(ref) {
+		return rs.GetUser(ref)
+	}
+	return rs.GetUserByHandle(strings.ToLower(strings.TrimPrefix(ref, "@")))
+}
+
+// Link adds the identity to the account, so either signs in to it
+func Link(rs store.ReplStore, userId string, identity models.Identity) error {
+	identity.LinkedAt = time.Now().UTC()
+	if err := rs.LinkIdentity(userId, identity); err != nil {
+		return err
+	}
+	log.Info("Identity linked", "user_id", userId, "provider", identity.Provider)
+	return nil
+}
+
+// Unlink removes a sign-in identity, an account always keeps at least one
+func Unlink(rs store.ReplStore, userId string, provider models.IdentityProvider, subject string) error {
+	account, err := rs.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if len(account.Identities) <= 1 {
+		return ErrLastIdentity
+	}
+
+	if err := rs.UnlinkIdentity(userId, provider, subject); err != nil {
+		return err
+	}
+	log.Info("Identity unlinked", "user_id", userId, "provider", provider)
+	return nil
+}
+
+// handleBase turns a login or email name into a handle: lowercase letters,
+// digits and dashes
+func handleBase(login string) string {
+	base := strings.Trim(invalidHandle.ReplaceAllString(strings.ToLower(login), "-"), "-")
+	// Handles can't pass for ids
+	for strings.HasPrefix(base, idPrefix) {
+		base = strings.TrimLeft(strings.TrimPrefix(base, idPrefix), "-")
+	}
+	if len(base) > 32 {
+		base = strings.TrimRight(base[:32], "-")
+	}
+	if base == "" {
+		return "user"
+	}
+	return base
+}
+
+func handleCandidate(base string, attempt int) string {
+	switch {
+	case attempt == 0:
+		return base
+	case attempt < numberedHandles:
+		return fmt.Sprintf("%s-%d", base, attempt+1)
+	default:
+		return fmt.Sprintf("%s-%s", base, uuid.New().String()[:6])
+	}
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// IdentityProvider is "github", "email" or the name of an OIDC provider
+type IdentityProvider string
+
+const (
+	ProviderGithub IdentityProvider = "github"
+	ProviderEmail  IdentityProvider = "email"
+)
+
+var (
+	ErrHandleTaken    = errors.New("handle already taken")
+	ErrIdentityLinked = errors.New("identity already linked to another account")
+)
+
+// Identity is a way to sign in to an account. Subject is what the provider
+// identifies the user by: the GitHub user id or the lowercased email.
+type Identity struct {
+	Provider IdentityProvider `json:"provider"`
+	Subject  string           `json:"subject"`
+	// GitHub login or email address, for display
+	Name     string    `json:"name"`
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+// Account is a user in the registry. Id never changes and owns the user's
+// repls, namespaces and S3 paths; Handle is unique and what others share with.
+type Account struct {
+	Id         string     `json:"id"`
+	Handle     string     `json:"handle"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	AvatarURL  string     `json:"avatarUrl"`
+	Identities []Identity `json:"identities"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func (a Account) User() User {
+	return User{
+		ID:        a.Id,
+		Login:     a.Handle,
+		Name:      a.Name,
+		Email:     a.Email,
+		AvatarURL: a.AvatarURL,
+		CreatedAt: a.CreatedAt,
+	}
+}
+
+func (a Account) HasIdentity(provider IdentityProvider, subject string) bool {
+	return slices.ContainsFunc(a.Identities, func(identity Identity) bool {
+		return identity.Provider == provider && identity.Subject == subject
+	})
+}
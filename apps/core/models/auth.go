@@ -6,8 +6,10 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// User is the signed in account. ID is its immutable registry id and Login
+// its unique handle, see Account.
 type User struct {
-	ID        int64     `json:"id"`
+	ID        string    `json:"id"`
 	Login     string    `json:"login"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
@@ -15,16 +17,26 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Session is a login kept server side. The browser only holds an opaque
+// secret, the session is stored under its hash.
 type Session struct {
-	UserID       int64     `json:"user_id"`
-	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
-	TokenExpiry  time.Time `json:"token_expiry"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	Id         string    `json:"id"`
+	TokenInfo  TokenInfo `json:"token_info"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (s Session) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
 }
 
 type TokenInfo struct {
+	// Login provider the token is from, empty for magic links and older
+	// GitHub sessions
+	Provider  string        `json:"provider,omitempty"`
 	Token     *oauth2.Token `json:"token"`
 	User      *User         `json:"user"`
 	ExpiresAt time.Time     `json:"expires_at"`
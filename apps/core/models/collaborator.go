@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type CollaboratorRole string
+
+const (
+	RoleOwner  CollaboratorRole = "owner"
+	RoleEditor CollaboratorRole = "editor"
+	RoleViewer CollaboratorRole = "viewer"
+)
+
+var roleRanks = map[CollaboratorRole]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// Allows reports whether the role grants at least the access of need
+func (r CollaboratorRole) Allows(need CollaboratorRole) bool {
+	return roleRanks[r] >= roleRanks[need] && roleRanks[r] > 0
+}
+
+func (r CollaboratorRole) IsValid() bool {
+	return roleRanks[r] > 0
+}
+
+// Collaborator is a user the repl is shared with. The owner is not stored as
+// a collaborator; it is derived from Repl.User.
+type Collaborator struct {
+	User string `json:"user"`
+	// Handle of the user, for display
+	Handle    string           `json:"handle,omitempty"`
+	Role      CollaboratorRole `json:"role"`
+	InvitedBy string           `json:"invitedBy,omitempty"`
+	AddedAt   time.Time        `json:"addedAt"`
+}
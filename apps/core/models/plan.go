@@ -0,0 +1,42 @@
+package models
+
+// Plan sets the limits of a user's account. A zero limit means unlimited, an
+// empty AllowedTemplates list allows every template and unset Resources,
+// Storage, Security and RuntimeClass keep the template's.
+type Plan struct {
+	Id                   string   `json:"id"`
+	Name                 string   `json:"name"`
+	MaxRepls             int      `json:"maxRepls"`
+	MaxActiveSessions    int      `json:"maxActiveSessions"`
+	StorageBytes         int64    `json:"storageBytes"`
+	SessionHoursPerMonth float64  `json:"sessionHoursPerMonth"`
+	AllowedTemplates     []string `json:"allowedTemplates"`
+
+	// Overrides the resources of every template for the plan's repls
+	Resources TemplateResources `json:"resources"`
+	// Overrides the storage mode of every template for the plan's repls
+	Storage StorageMode `json:"storage,omitempty"`
+	// Overrides the security profile and runtime class of every template
+	Security     SecurityProfile `json:"security,omitempty"`
+	RuntimeClass string          `json:"runtimeClass,omitempty"`
+}
+
+func (p Plan) AllowsTemplate(template string) bool {
+	if len(p.AllowedTemplates) == 0 {
+		return true
+	}
+	for _, t := range p.AllowedTemplates {
+		if t == template {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanUsage is how much of a plan a user currently consumes
+type PlanUsage struct {
+	Repls          int     `json:"repls"`
+	ActiveSessions int     `json:"activeSessions"`
+	StorageBytes   int64   `json:"storageBytes"`
+	SessionHours   float64 `json:"sessionHours"`
+}
@@ -1,9 +1,99 @@
 package models
 
+import (
+	"fmt"
+	"time"
+)
+
 type Repl struct {
-	User     string `json:"user"`
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	Template string `json:"template"`
-	IsActive bool   `json:"isActive"`
+	User     string    `json:"user"`
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Template string    `json:"template"`
+	IsActive bool      `json:"isActive"`
+	State    ReplState `json:"state"`
+
+	// Start of the current session, counted towards the plan's session hours
+	SessionStartedAt time.Time `json:"sessionStartedAt"`
+	// Runner version the current session started with, see Template.Version
+	RunnerVersion string `json:"runnerVersion,omitempty"`
+}
+
+// ReplStatus is the lifecycle state of a repl's workspace.
+//
+//	stopped/failed -> pending -> provisioning -> ready -> stopping -> stopped
+//
+// Any non-terminal state can move to failed, and pending/provisioning can be
+// stopped before they become ready. A stopped or failed repl is archiving
+// while its persistent volume is uploaded or freed, and can't be started
+// until it has its status back.
+type ReplStatus string
+
+const (
+	ReplPending      ReplStatus = "pending"
+	ReplProvisioning ReplStatus = "provisioning"
+	ReplReady        ReplStatus = "ready"
+	ReplFailed       ReplStatus = "failed"
+	ReplStopping     ReplStatus = "stopping"
+	ReplStopped      ReplStatus = "stopped"
+	ReplArchiving    ReplStatus = "archiving"
+)
+
+type ReplState struct {
+	Status ReplStatus `json:"status"`
+	Reason string     `json:"reason,omitempty"`
+	// Set on failed repls when the cause is known, Reason has the details
+	Failure   FailureCode `json:"failure,omitempty"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+// FailureCode classifies why a repl's workspace couldn't start, so clients
+// can tell a broken template from a full cluster
+type FailureCode string
+
+const (
+	FailureImagePull     FailureCode = "image_pull_failed"
+	FailureS3Download    FailureCode = "s3_download_failed"
+	FailureInitContainer FailureCode = "init_container_failed"
+	FailureCrashLoop     FailureCode = "crash_loop"
+	FailureOOMKilled     FailureCode = "oom_killed"
+	FailureConfig        FailureCode = "config_error"
+	FailureUnschedulable FailureCode = "unschedulable"
+	FailureUnreachable   FailureCode = "runner_unreachable"
+	FailureTimeout       FailureCode = "timeout"
+)
+
+// ReplFailure is the error of a workspace that couldn't start
+type ReplFailure struct {
+	Code    FailureCode
+	Message string
+}
+
+func (f *ReplFailure) Error() string {
+	return fmt.Sprintf("%s: %s", f.Code, f.Message)
+}
+
+var replTransitions = map[ReplStatus][]ReplStatus{
+	ReplStopped:      {ReplPending, ReplArchiving},
+	ReplFailed:       {ReplPending, ReplStopping, ReplArchiving},
+	ReplPending:      {ReplProvisioning, ReplFailed, ReplStopping},
+	ReplProvisioning: {ReplReady, ReplFailed, ReplStopping},
+	ReplReady:        {ReplStopping, ReplFailed},
+	ReplStopping:     {ReplStopped, ReplFailed},
+	ReplArchiving:    {ReplStopped, ReplFailed},
+}
+
+// CanTransition reports whether a repl in status s may move to status to.
+func (s ReplStatus) CanTransition(to ReplStatus) bool {
+	for _, next := range replTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLive reports whether the repl has (or is getting) a running workspace.
+func (s ReplStatus) IsLive() bool {
+	return s == ReplPending || s == ReplProvisioning || s == ReplReady
 }
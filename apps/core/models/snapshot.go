@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+type SnapshotKind string
+
+const (
+	SnapshotManual SnapshotKind = "manual"
+	SnapshotAuto   SnapshotKind = "auto"
+)
+
+type Snapshot struct {
+	Id        string       `json:"id"`
+	ReplId    string       `json:"replId"`
+	Name      string       `json:"name"`
+	Kind      SnapshotKind `json:"kind"`
+	Size      int64        `json:"size"`
+	Files     int          `json:"files"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// SnapshotDiff summarises how the current workspace differs from a snapshot
+type SnapshotDiff struct {
+	SnapshotId string   `json:"snapshotId"`
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+	Modified   []string `json:"modified"`
+	Unchanged  int      `json:"unchanged"`
+}
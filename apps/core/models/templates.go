@@ -1,23 +1,106 @@
 package models
 
-// Template configuration
-type TemplateConfig struct {
-	BaseImage string
-	Port      int32
-}
-
-var TemplateConfigs = map[string]TemplateConfig{
-	"node": {
-		BaseImage: "node:20-slim",
-		Port:      8081,
-	},
-	"python": {
-		BaseImage: "python:3.11-slim",
-		Port:      8081,
-	},
-	"go": {
-		BaseImage: "golang:1.24-alpine",
-		Port:      8081,
-	},
-	// Add more templates as needed
+// Template is a starter template, loaded from templates/<key>/devex.yaml
+type Template struct {
+	Key         string `yaml:"-" json:"key"`
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description"`
+	Icon        string `yaml:"icon" json:"icon"`
+	Image       string `yaml:"image" json:"image"` // runner image repository
+	// Version is the runner image's tag. Repls record the version they
+	// started with, so they can be rolled to a new one.
+	Version string `yaml:"version" json:"version"`
+	Port    int32  `yaml:"port" json:"port"` // runner port
+	// Ports the user's app listens on, each reachable on its own host when
+	// repls are routed by subdomain
+	Ports      []int32           `yaml:"ports" json:"ports,omitempty"`
+	Run        string            `yaml:"run" json:"run"` // command that starts the user's app
+	Entrypoint string            `yaml:"entrypoint" json:"entrypoint"`
+	Resources  TemplateResources `yaml:"resources" json:"resources"`
+	Storage    StorageMode       `yaml:"storage" json:"storage"`
+	Security   SecurityProfile   `yaml:"security" json:"security"`
+	// RuntimeClass runs the pod in a sandboxed runtime such as gVisor or
+	// Kata, empty uses the cluster's default runtime
+	RuntimeClass string `yaml:"runtimeClass" json:"runtimeClass,omitempty"`
+	// WarmPool is how many idle runners are kept started for the template,
+	// unset uses the WARM_POOL_SIZE default
+	WarmPool *int `yaml:"warmPool" json:"warmPool,omitempty"`
+}
+
+// ImageRef is the runner image pinned to the template's version
+func (t Template) ImageRef() string {
+	return t.Image + ":" + t.Version
+}
+
+// StorageMode is where a repl's workspace lives while it isn't running
+type StorageMode string
+
+const (
+	// The workspace is copied from S3 into an empty volume on start and
+	// uploaded back on stop
+	StorageEphemeral StorageMode = "ephemeral"
+	// The workspace stays on the repl's own persistent volume across stops,
+	// S3 only holds snapshots and archived workspaces
+	StoragePersistent StorageMode = "persistent"
+)
+
+func (m StorageMode) IsValid() bool {
+	return m == StorageEphemeral || m == StoragePersistent
+}
+
+// SecurityProfile hardens the repl's pod. Every profile runs as a non-root
+// user with all capabilities dropped, the RuntimeDefault seccomp profile and
+// no service account token.
+type SecurityProfile string
+
+const (
+	// The runner can write anywhere in its image, e.g. to install tools
+	SecurityBaseline SecurityProfile = "baseline"
+	// The runner's root filesystem is read-only, only the workspace, /tmp
+	// and its home directory are writable
+	SecurityRestricted SecurityProfile = "restricted"
+)
+
+func (p SecurityProfile) IsValid() bool {
+	return p == SecurityBaseline || p == SecurityRestricted
+}
+
+// ContainerResources are Kubernetes quantities, e.g. "500m" CPU or "512Mi".
+// Each one is both requested and used as the container's limit.
+type ContainerResources struct {
+	CPU              string `yaml:"cpu" json:"cpu,omitempty"`
+	Memory           string `yaml:"memory" json:"memory,omitempty"`
+	EphemeralStorage string `yaml:"ephemeralStorage" json:"ephemeralStorage,omitempty"`
+}
+
+// TemplateResources size a repl's pod: the runner gets the inline resources,
+// the s3-downloader and MCP sidecar get Sidecar, and Workspace caps the
+// workspace volume.
+type TemplateResources struct {
+	ContainerResources `yaml:",inline"`
+	Workspace          string             `yaml:"workspace" json:"workspace,omitempty"`
+	Sidecar            ContainerResources `yaml:"sidecar" json:"sidecar"`
+}
+
+// Override returns r with every field that is set in o replaced
+func (r TemplateResources) Override(o TemplateResources) TemplateResources {
+	r.ContainerResources = r.ContainerResources.Override(o.ContainerResources)
+	r.Sidecar = r.Sidecar.Override(o.Sidecar)
+	if o.Workspace != "" {
+		r.Workspace = o.Workspace
+	}
+	return r
+}
+
+func (r ContainerResources) Override(o ContainerResources) ContainerResources {
+	if o.CPU != "" {
+		r.CPU = o.CPU
+	}
+	if o.Memory != "" {
+		r.Memory = o.Memory
+	}
+	if o.EphemeralStorage != "" {
+		r.EphemeralStorage = o.EphemeralStorage
+	}
+	return r
 }
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+type TokenScope string
+
+const (
+	ScopeReplRead  TokenScope = "repl:read"
+	ScopeReplWrite TokenScope = "repl:write"
+	ScopeReplAdmin TokenScope = "repl:admin"
+)
+
+var scopeRanks = map[TokenScope]int{
+	ScopeReplRead:  1,
+	ScopeReplWrite: 2,
+	ScopeReplAdmin: 3,
+}
+
+// Allows reports whether the scope grants at least the access of need
+func (s TokenScope) Allows(need TokenScope) bool {
+	return scopeRanks[s] >= scopeRanks[need] && scopeRanks[s] > 0
+}
+
+func (s TokenScope) IsValid() bool {
+	return scopeRanks[s] > 0
+}
+
+// AccessToken is a personal access token, acting as User with its scopes.
+// Only the hash of its secret is stored, the secret is shown once.
+type AccessToken struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Start of the secret, to tell tokens apart
+	Prefix     string       `json:"prefix"`
+	User       User         `json:"user"`
+	Scopes     []TokenScope `json:"scopes"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	ExpiresAt  time.Time    `json:"expiresAt,omitzero"`
+	LastUsedAt time.Time    `json:"lastUsedAt,omitzero"`
+}
+
+// Allows reports whether one of the token's scopes grants need
+func (t AccessToken) Allows(need TokenScope) bool {
+	return slices.ContainsFunc(t.Scopes, func(scope TokenScope) bool {
+		return scope.Allows(need)
+	})
+}
+
+func (t AccessToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
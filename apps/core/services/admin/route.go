@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	log "packages/logging"
+	"strings"
+
+	"core/cmd/middleware"
+	"core/internal/provisioner"
+	"core/internal/reconcile"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/internal/upgrade"
+	"core/internal/users"
+	"core/models"
+	"packages/utils/json"
+)
+
+func NewHandler(rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner, rc *reconcile.Reconciler, up *upgrade.Upgrader) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /plans", func(w http.ResponseWriter, r *http.Request) {
+		getPlans(w, r, rs)
+	})
+	mux.HandleFunc("POST /plans", func(w http.ResponseWriter, r *http.Request) {
+		savePlan(w, r, rs)
+	})
+	mux.HandleFunc("PUT /users/{userName}/plan", func(w http.ResponseWriter, r *http.Request) {
+		setUserPlan(w, r, rs)
+	})
+	mux.HandleFunc("PUT /users/{userName}/org", func(w http.ResponseWriter, r *http.Request) {
+		setUserOrg(w, r, rs)
+	})
+	mux.HandleFunc("POST /users/{userName}/migrate", func(w http.ResponseWriter, r *http.Request) {
+		migrateUser(w, r, rs, s3Client, prov)
+	})
+	mux.HandleFunc("GET /reconcile", func(w http.ResponseWriter, r *http.Request) {
+		json.WriteJSON(w, http.StatusOK, rc.LastReport())
+	})
+	mux.HandleFunc("POST /reconcile", func(w http.ResponseWriter, r *http.Request) {
+		json.WriteJSON(w, http.StatusOK, rc.Run())
+	})
+	mux.HandleFunc("GET /upgrades", func(w http.ResponseWriter, r *http.Request) {
+		getUpgrades(w, r, up)
+	})
+	mux.HandleFunc("POST /upgrades", func(w http.ResponseWriter, r *http.Request) {
+		startUpgrade(w, r, up)
+	})
+
+	// Admins' access tokens need repl:admin on top of the admin's login
+	return middleware.RequireScope(func(r *http.Request) models.TokenScope {
+		return models.ScopeReplAdmin
+	}, mux)
+}
+
+func getPlans(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	plans, err := rs.GetPlans()
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.WriteJSON(w, http.StatusOK, plans)
+}
+
+// savePlan creates or replaces a plan
+func savePlan(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	var plan models.Plan
+	if err := json.ReadJSON(r, &plan); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plan.Id = strings.TrimSpace(plan.Id)
+	if plan.Id == "" {
+		json.WriteError(w, http.StatusBadRequest, "Plan id is required")
+		return
+	}
+	if plan.MaxRepls < 0 || plan.MaxActiveSessions < 0 || plan.StorageBytes < 0 || plan.SessionHoursPerMonth < 0 {
+		json.WriteError(w, http.StatusBadRequest, "Plan limits can't be negative")
+		return
+	}
+	if err := templates.ValidateResources(plan.Resources); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if plan.Storage != "" && !plan.Storage.IsValid() {
+		json.WriteError(w, http.StatusBadRequest, "Plan storage must be ephemeral or persistent")
+		return
+	}
+	if err := templates.ValidateSecurity(plan.Security, plan.RuntimeClass); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := rs.SavePlan(plan); err != nil {
+		log.Error("Save plan failed", "plan_id", plan.Id, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	json.WriteJSON(w, http.StatusOK, plan)
+}
+
+func setUserPlan(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	var req setUserPlanRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	account, err := users.Lookup(rs, r.PathValue("userName"))
+	if err != nil {
+		json.WriteError(w, http.StatusNotFound, "No such User Found")
+		return
+	}
+	userName := account.Id
+
+	if _, err := rs.GetPlan(req.PlanId); err != nil {
+		json.WriteError(w, http.StatusBadRequest, "This Plan doesn't exists")
+		return
+	}
+
+	if err := rs.SetUserPlan(userName, req.PlanId); err != nil {
+		log.Error("Set user plan failed", "user", userName, "plan_id", req.PlanId, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("User plan changed", "user", userName, "plan_id", req.PlanId)
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
+
+// setUserOrg moves the user's future repls into the organization's namespace
+// when NAMESPACE_STRATEGY is "org". An empty org removes the user from theirs.
+func setUserOrg(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	var req setUserOrgRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	account, err := users.Lookup(rs, r.PathValue("userName"))
+	if err != nil {
+		json.WriteError(w, http.StatusNotFound, "No such User Found")
+		return
+	}
+	userName := account.Id
+	org := strings.ToLower(strings.TrimSpace(req.Org))
+
+	if err := rs.SetUserOrg(userName, org); err != nil {
+		log.Error("Set user org failed", "user", userName, "org", org, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("User org changed", "user", userName, "org", org)
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
+
+// migrateUser moves a user from before the registry, identified by the login
+// their repls are owned by, to the account they sign in to now
+func migrateUser(w http.ResponseWriter, r *http.Request, rs store.ReplStore, s3Client *s3.S3Client, prov provisioner.Provisioner) {
+	var req migrateUserRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Provider == "" || req.Subject == "" {
+		json.WriteError(w, http.StatusBadRequest, "Provider and subject are required")
+		return
+	}
+	if _, err := rs.GetUserByIdentity(req.Provider, req.Subject); err != nil {
+		json.WriteError(w, http.StatusNotFound, "No account signs in with this identity")
+		return
+	}
+
+	legacyUser := r.PathValue("userName")
+	migration, err := users.MigrateLegacy(rs, s3Client, prov, legacyUser, req.Provider, req.Subject)
+	switch {
+	case errors.Is(err, users.ErrNotLegacy):
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, store.ErrStatusConflict):
+		json.WriteError(w, http.StatusConflict, "Stop the user's repls first: "+err.Error())
+	case err != nil:
+		log.Error("Migrate legacy user failed", "legacy_user", legacyUser, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+	default:
+		json.WriteJSON(w, http.StatusOK, migration)
+	}
+}
+
+// getUpgrades lists the running repls not on their template's runner version,
+// with the progress of the latest rollout
+func getUpgrades(w http.ResponseWriter, r *http.Request, up *upgrade.Upgrader) {
+	outdated, err := up.Outdated(r.URL.Query().Get("template"))
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.WriteJSON(w, http.StatusOK, map[string]any{
+		"outdated": outdated,
+		"rollout":  up.Rollout(),
+	})
+}
+
+// startUpgrade rolls outdated repls, optionally only those of a template or
+// the given ids, onto their template's runner version
+func startUpgrade(w http.ResponseWriter, r *http.Request, up *upgrade.Upgrader) {
+	var req upgrade.Request
+	if r.ContentLength != 0 {
+		if err := json.ReadJSON(r, &req); err != nil {
+			json.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Template != "" {
+		if _, ok := templates.Get(req.Template); !ok {
+			json.WriteError(w, http.StatusBadRequest, "Unknown template")
+			return
+		}
+	}
+
+	rollout, err := up.Start(req)
+	if errors.Is(err, upgrade.ErrRunning) {
+		json.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error("Start upgrade failed", "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.WriteJSON(w, http.StatusAccepted, rollout)
+}
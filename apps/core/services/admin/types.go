@@ -0,0 +1,17 @@
+package admin
+
+import "core/models"
+
+type setUserPlanRequest struct {
+	PlanId string `json:"planId"`
+}
+
+type setUserOrgRequest struct {
+	Org string `json:"org"`
+}
+
+// migrateUserRequest is the identity the legacy user signs in with now
+type migrateUserRequest struct {
+	Provider models.IdentityProvider `json:"provider"`
+	Subject  string                  `json:"subject"`
+}
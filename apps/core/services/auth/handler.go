@@ -6,30 +6,67 @@ import (
 	"net/http"
 
 	sessionManager "core/internal/session"
+	"core/internal/store"
 	"core/pkg/resend"
 )
 
-func NewAuthHandler() http.Handler {
+func NewAuthHandler(rs store.ReplStore) http.Handler {
 	mux := http.NewServeMux()
 	resend := resend.NewClient()
 
-	mux.HandleFunc("GET /github/login", githubLoginHandler)
-	mux.HandleFunc("GET /github/callback", githubCallbackHandler)
+	// GitHub and the OIDC providers
+	mux.HandleFunc("GET /providers", providersHandler)
+	mux.HandleFunc("GET /{provider}/login", oauthLoginHandler)
+	mux.HandleFunc("GET /{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		oauthCallbackHandler(w, r, rs)
+	})
+	mux.HandleFunc("GET /{provider}/link", func(w http.ResponseWriter, r *http.Request) {
+		oauthLinkHandler(w, r, rs)
+	})
 
 	mux.HandleFunc("POST /magiclink/login", func(w http.ResponseWriter, r *http.Request) {
-		magiclinkLoginHandler(w, r, resend)
+		magiclinkLoginHandler(w, r, rs, resend)
+	})
+	mux.HandleFunc("POST /magiclink/link", func(w http.ResponseWriter, r *http.Request) {
+		magiclinkLinkHandler(w, r, rs, resend)
+	})
+	mux.HandleFunc("GET /magiclink/verify", magiclinkConfirmHandler)
+	mux.HandleFunc("POST /magiclink/verify", func(w http.ResponseWriter, r *http.Request) {
+		magiclinkCallbackHandler(w, r, rs)
+	})
+
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		logoutHandler(w, r, rs)
+	})
+	mux.HandleFunc("POST /logout-all", func(w http.ResponseWriter, r *http.Request) {
+		logoutAllHandler(w, r, rs)
+	})
+	mux.HandleFunc("GET /me", func(w http.ResponseWriter, r *http.Request) {
+		meHandler(w, r, rs)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, rs)
 	})
-	mux.HandleFunc("GET /magiclink/verify", magiclinkCallbackHandler)
 
-	mux.HandleFunc("POST /logout", logoutHandler)
-	mux.HandleFunc("GET /me", meHandler)
-	mux.HandleFunc("GET /status", statusHandler)
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		listSessionsHandler(w, r, rs)
+	})
+	mux.HandleFunc("DELETE /sessions/{sessionId}", func(w http.ResponseWriter, r *http.Request) {
+		revokeSessionHandler(w, r, rs)
+	})
+
+	mux.HandleFunc("GET /identities", func(w http.ResponseWriter, r *http.Request) {
+		listIdentitiesHandler(w, r, rs)
+	})
+	mux.HandleFunc("DELETE /identities/{provider}/{subject}", func(w http.ResponseWriter, r *http.Request) {
+		unlinkIdentityHandler(w, r, rs)
+	})
 
 	return mux
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	if err := sessionManager.ClearSession(w, r); err != nil {
+func logoutHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	if err := sessionManager.ClearSession(rs, w, r); err != nil {
 		log.Error("Clear session failed", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -39,30 +76,27 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
 }
 
-func meHandler(w http.ResponseWriter, r *http.Request) {
-	tokenInfo, err := sessionManager.GetSession(r)
-	if err != nil || tokenInfo == nil {
+func meHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	session, err := sessionManager.GetSession(rs, r)
+	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tokenInfo.User)
+	json.NewEncoder(w).Encode(session.TokenInfo.User)
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	isAuth := sessionManager.IsAuthenticated(r)
+func statusHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	session, err := sessionManager.GetSession(rs, r)
 
 	response := map[string]any{
-		"authenticated": isAuth,
+		"authenticated": err == nil,
 	}
 
-	if isAuth {
-		tokenInfo, err := sessionManager.GetSession(r)
-		if err == nil && tokenInfo != nil {
-			response["user"] = tokenInfo.User
-			response["token_expires_at"] = tokenInfo.ExpiresAt
-		}
+	if err == nil {
+		response["user"] = session.TokenInfo.User
+		response["token_expires_at"] = session.TokenInfo.ExpiresAt
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	log "packages/logging"
+
+	sessionManager "core/internal/session"
+	"core/internal/store"
+	"core/internal/users"
+	"core/models"
+	"core/pkg/dotenv"
+)
+
+// linkIdentity finishes a link started by the user: the identity is added to
+// their account if the callback runs in the session that started it
+func linkIdentity(w http.ResponseWriter, r *http.Request, rs store.ReplStore, userId string, identity models.Identity) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil || current.TokenInfo.User.ID != userId {
+		log.Warn("Link callback outside the linking session", "provider", identity.Provider, "user_id", userId)
+		redirectWithError(w, r, "link_session_mismatch")
+		return
+	}
+
+	if err := users.Link(rs, userId, identity); err != nil {
+		if errors.Is(err, models.ErrIdentityLinked) {
+			redirectWithError(w, r, "identity_already_linked")
+			return
+		}
+		log.Error("Link identity failed", "provider", identity.Provider, "user_id", userId, "error", err)
+		redirectWithError(w, r, "link_failed")
+		return
+	}
+
+	frontendURL := dotenv.EnvString("FRONTEND_URL", "http://localhost:3000")
+	http.Redirect(w, r, frontendURL+"/dashboard?linked="+string(identity.Provider), http.StatusSeeOther)
+}
+
+func listIdentitiesHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	account, err := rs.GetUser(current.TokenInfo.User.ID)
+	if err != nil {
+		log.Error("Get user failed", "user_id", current.TokenInfo.User.ID, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	writeJSON(w, account.Identities)
+}
+
+func unlinkIdentityHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userId := current.TokenInfo.User.ID
+	provider := models.IdentityProvider(r.PathValue("provider"))
+	subject := r.PathValue("subject")
+
+	account, err := rs.GetUser(userId)
+	if err != nil {
+		log.Error("Get user failed", "user_id", userId, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !account.HasIdentity(provider, subject) {
+		writeError(w, http.StatusNotFound, "No such Identity Found")
+		return
+	}
+
+	if err := users.Unlink(rs, userId, provider, subject); err != nil {
+		if errors.Is(err, users.ErrLastIdentity) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.Error("Unlink identity failed", "provider", provider, "user_id", userId, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	writeJSON(w, map[string]string{"message": "Identity unlinked"})
+}
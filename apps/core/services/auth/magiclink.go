@@ -2,7 +2,9 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	log "packages/logging"
 	"math/rand"
 	"net/http"
@@ -11,6 +13,8 @@ import (
 
 	"core/internal/email"
 	sessionManager "core/internal/session"
+	"core/internal/store"
+	"core/internal/users"
 	"core/models"
 	"core/pkg/dotenv"
 	"core/pkg/resend"
@@ -31,62 +35,85 @@ type LoginResponse struct {
 	Success bool   `json:"success"`
 }
 
-const (
-	TokenLength     = 32
-	TokenLifetime   = 15 * time.Minute
-	RateLimitWindow = 1 * time.Minute
-	MaxAttempts     = 3
-)
+func magiclinkLoginHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore, resend *resend.Resend) {
+	norm_email, ok := readLoginEmail(w, r, rs)
+	if !ok {
+		return
+	}
 
-func magiclinkLoginHandler(w http.ResponseWriter, r *http.Request, resend *resend.Resend) {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Warn("Decode login request failed", "error", err)
-		writeError(w, http.StatusBadRequest, "Invalid request body")
+	// Generate secure token
+	token, err := email.GenerateToken(rs, norm_email)
+	if err != nil {
+		log.Error("Generate token failed", "email", norm_email, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	// Validate email
-	if err := email.ValidateEmail(req.Email); err != nil {
-		log.Warn("Invalid email", "email", req.Email, "error", err)
-		writeError(w, http.StatusBadRequest, "Invalid email address")
+	if !sendMagicLink(w, resend, norm_email, token) {
 		return
 	}
 
-	// Normalize email
-	norm_email := strings.ToLower(strings.TrimSpace(req.Email))
+	// Always return success to prevent email enumeration
+	writeJSON(w, LoginResponse{
+		Message: "Magic link sent! Check your email and click the link to sign in.",
+		Success: true,
+	})
+}
 
-	// Check rate limiting
-	if err := email.CheckRateLimit(r, norm_email); err != nil {
-		log.Warn("Rate limit exceeded", "email", norm_email, "error", err)
-		writeError(w, http.StatusTooManyRequests, "Too many requests. Please try again later.")
+// magiclinkLinkHandler emails a magic link that adds the address to the
+// signed in user's account instead of signing in
+func magiclinkLinkHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore, resend *resend.Resend) {
+	session, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	// Generate secure token
-	token, err := email.GenerateToken(req.Email)
+	norm_email, ok := readLoginEmail(w, r, rs)
+	if !ok {
+		return
+	}
+
+	token, err := email.GenerateLinkToken(rs, norm_email, session.TokenInfo.User.ID)
 	if err != nil {
 		log.Error("Generate token failed", "email", norm_email, "error", err)
 		writeError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	// Send magic link email
-	subject, body := email.GenerateMagicLink(norm_email, token)
-	if err := resend.SendEmail(norm_email, subject, body); err != nil {
-		log.Error("Send magic link email failed", "email", norm_email, "error", err)
-		writeError(w, http.StatusInternalServerError, "Failed to send magic link")
+	if !sendMagicLink(w, resend, norm_email, token) {
 		return
 	}
 
-	// Always return success to prevent email enumeration
 	writeJSON(w, LoginResponse{
-		Message: "Magic link sent! Check your email and click the link to sign in.",
+		Message: "Magic link sent! Click the link in your email to add it to your account.",
 		Success: true,
 	})
 }
 
-func magiclinkCallbackHandler(w http.ResponseWriter, r *http.Request) {
+// confirmPage posts the link's token back, so only a click signs in: mail
+// scanners that follow the link would otherwise use it up
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>Sign in to DevEx</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+</head>
+<body style="margin: 0; padding: 80px 20px; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background: #0a0a0a; color: #ffffff; text-align: center;">
+	<h1 style="color: #10b981; font-size: 28px;">DevEx</h1>
+	<p style="color: #d1d5db; font-size: 16px;">{{if .LinkTo}}Add {{.Email}} to your account?{{else}}Sign in as {{.Email}}?{{end}}</p>
+	<form method="POST">
+		<input type="hidden" name="token" value="{{.Token}}">
+		<button type="submit" style="background: #059669; color: #ffffff; border: none; border-radius: 8px; padding: 12px 32px; font-size: 16px; cursor: pointer;">Continue</button>
+	</form>
+</body>
+</html>
+`))
+
+// magiclinkConfirmHandler is where the emailed link lands. It checks the
+// link but leaves it unused, the confirm page's POST uses it.
+func magiclinkConfirmHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
 		log.Warn("Missing token in verification request")
@@ -94,32 +121,79 @@ func magiclinkCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	validatedEmail, err := email.ValidateToken(token)
+	claims, err := email.ParseToken(token)
 	if err != nil {
 		log.Warn("Validate token failed", "error", err)
 		redirectWithError(w, r, "invalid_token")
 		return
 	}
-	name := email.ExtractNameFromEmail(validatedEmail)
 
-	// TODO: Complete User Info
-	user := &models.User{
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := confirmPage.Execute(w, map[string]string{
+		"Token":  token,
+		"Email":  claims.Email,
+		"LinkTo": claims.LinkTo,
+	}); err != nil {
+		log.Error("Render magic link confirm page failed", "error", err)
+	}
+}
+
+// magiclinkCallbackHandler signs in with the token posted by the confirm
+// page and uses the link up
+func magiclinkCallbackHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	token := r.PostFormValue("token")
+	if token == "" {
+		log.Warn("Missing token in verification request")
+		redirectWithError(w, r, "missing_token")
+		return
+	}
+
+	claims, err := email.ValidateToken(rs, token)
+	if errors.Is(err, email.ErrTokenUsed) {
+		redirectWithError(w, r, "token_used")
+		return
+	}
+	if err != nil {
+		log.Warn("Validate token failed", "error", err)
+		redirectWithError(w, r, "invalid_token")
+		return
+	}
+	validatedEmail := strings.ToLower(strings.TrimSpace(claims.Email))
+
+	identity := models.Identity{
+		Provider: models.ProviderEmail,
+		Subject:  validatedEmail,
+		Name:     validatedEmail,
+	}
+	if claims.LinkTo != "" {
+		linkIdentity(w, r, rs, claims.LinkTo, identity)
+		return
+	}
+
+	name := email.ExtractNameFromEmail(validatedEmail)
+	user, err := users.SignIn(rs, identity, models.User{
 		Name:      name,
 		Login:     name,
 		Email:     validatedEmail,
 		AvatarURL: getAvatarUrl(),
-		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Error("Sign in failed", "provider", models.ProviderEmail, "error", err)
+		redirectWithError(w, r, "user_registration_failed")
+		return
 	}
 
 	// Create token info for session (magic link doesn't use OAuth tokens)
 	tokenInfo := &models.TokenInfo{
 		Token:     nil, // No OAuth token for magic link
-		User:      user,
+		User:      &user,
 		ExpiresAt: time.Now().Add(24 * time.Hour), // 24 hour session
 	}
 
 	// Save session
-	if err := sessionManager.SaveSession(w, r, tokenInfo); err != nil {
+	if err := sessionManager.SaveSession(rs, w, r, tokenInfo); err != nil {
 		log.Error("Save session failed", "error", err)
 		redirectWithError(w, r, "session_save_failed")
 		return
@@ -127,13 +201,61 @@ func magiclinkCallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Redirect to frontend dashboard
 	frontendURL := dotenv.EnvString("FRONTEND_URL", "http://localhost:3000")
-	http.Redirect(w, r, frontendURL+"/dashboard", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, frontendURL+"/dashboard", http.StatusSeeOther)
+}
+
+// readLoginEmail decodes, validates and rate limits the email of a magic link
+// request. It writes the error response itself and returns false on failure.
+func readLoginEmail(w http.ResponseWriter, r *http.Request, rs store.ReplStore) (string, bool) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Warn("Decode login request failed", "error", err)
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return "", false
+	}
+
+	// Validate email
+	if err := email.ValidateEmail(req.Email); err != nil {
+		log.Warn("Invalid email", "email", req.Email, "error", err)
+		writeError(w, http.StatusBadRequest, "Invalid email address")
+		return "", false
+	}
+
+	// Normalize email
+	norm_email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	// Check rate limiting
+	if err := email.CheckRateLimit(rs, r, norm_email); err != nil {
+		if errors.Is(err, email.ErrRateLimited) {
+			log.Warn("Rate limit exceeded", "email", norm_email, "ip", sessionManager.ClientIP(r))
+			writeError(w, http.StatusTooManyRequests, "Too many requests. Please try again later.")
+			return "", false
+		}
+		log.Error("Check rate limit failed", "email", norm_email, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return "", false
+	}
+
+	return norm_email, true
+}
+
+func sendMagicLink(w http.ResponseWriter, resend *resend.Resend, norm_email, token string) bool {
+	subject, body := email.GenerateMagicLink(norm_email, token)
+	if err := resend.SendEmail(norm_email, subject, body); err != nil {
+		log.Error("Send magic link email failed", "email", norm_email, "error", err)
+		writeError(w, http.StatusInternalServerError, "Failed to send magic link")
+		return false
+	}
+	return true
 }
 
 // Helper methods
+
+// redirectWithError sends the browser to the frontend with a GET, also from
+// the magic link's POST
 func redirectWithError(w http.ResponseWriter, r *http.Request, errorType string) {
 	frontendURL := dotenv.EnvString("FRONTEND_URL", "http://localhost:3000")
-	http.Redirect(w, r, fmt.Sprintf("%s?error=%s", frontendURL, errorType), http.StatusTemporaryRedirect)
+	http.Redirect(w, r, fmt.Sprintf("%s?error=%s", frontendURL, errorType), http.StatusSeeOther)
 }
 
 func writeJSON(w http.ResponseWriter, data any) {
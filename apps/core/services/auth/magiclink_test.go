@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"core/internal/email"
+	"core/internal/store"
+)
+
+func TestMagicLinkNeedsConfirmation(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	handler := NewAuthHandler(rs)
+	token, err := email.GenerateToken(rs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/magiclink/verify?token="+url.QueryEscape(token), nil))
+		return w
+	}
+	post := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/magiclink/verify"+query, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A scanner following the link only gets the confirm page
+	for range 2 {
+		w := get(token)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `method="POST"`) || !strings.Contains(w.Body.String(), token) {
+			t.Fatalf("GET: status %d, body %s", w.Code, w.Body)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		response *httptest.ResponseRecorder
+		location string
+	}{
+		{"bad link", get(token + "x"), "?error=invalid_token"},
+		{"token in the query only", post("?token="+url.QueryEscape(token), ""), "?error=missing_token"},
+		{"confirmed", post("", token), "/dashboard"},
+		{"replayed", post("", token), "?error=token_used"},
+	}
+	for _, tt := range tests {
+		if tt.response.Code != http.StatusSeeOther || !strings.HasSuffix(tt.response.Header().Get("Location"), tt.location) {
+			t.Errorf("%s: status %d to %q, want a redirect to %s", tt.name, tt.response.Code, tt.response.Header().Get("Location"), tt.location)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"net/http"
+	log "packages/logging"
+	"time"
+
+	"core/internal/oauth"
+	sessionManager "core/internal/session"
+	"core/internal/store"
+	"core/internal/users"
+	"core/models"
+	"core/pkg/dotenv"
+
+	"golang.org/x/oauth2"
+)
+
+// ProviderResponse is a login provider the frontend can offer
+type ProviderResponse struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+func providersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := oauth.List()
+	response := make([]ProviderResponse, 0, len(providers))
+	for _, provider := range providers {
+		response = append(response, ProviderResponse{Name: provider.Name(), DisplayName: provider.DisplayName()})
+	}
+	writeJSON(w, response)
+}
+
+func oauthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oauth.Get(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	log.Info("OAuth login handler invoked", "provider", provider.Name())
+	startOAuth(w, r, provider, "")
+}
+
+// oauthLinkHandler adds the provider's account to the signed in user's
+// account instead of signing in
+func oauthLinkHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	provider, ok := oauth.Get(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	startOAuth(w, r, provider, current.TokenInfo.User.ID)
+}
+
+// startOAuth redirects to the provider. A non empty linkTo is the account
+// the callback links the identity to.
+func startOAuth(w http.ResponseWriter, r *http.Request, provider oauth.Provider, linkTo string) {
+	config, err := provider.Config(r.Context())
+	if err != nil {
+		log.Error("Get oauth config failed", "provider", provider.Name(), "error", err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Generate state for CSRF protection, and a PKCE verifier so a stolen
+	// code can't be exchanged
+	state := oauth.GenerateStateCookie()
+	verifier := oauth2.GenerateVerifier()
+
+	// Store state in session for verification
+	session, err := sessionManager.Store.Get(r, "oauth-state")
+	if err != nil {
+		log.Error("Get oauth session failed", "provider", provider.Name(), "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	session.Values["state"] = state
+	session.Values["provider"] = provider.Name()
+	session.Values["verifier"] = verifier
+	session.Values["link"] = linkTo
+	session.Options.MaxAge = 600 // 10 minutes
+	if err := session.Save(r, w); err != nil {
+		log.Error("Save oauth session failed", "provider", provider.Name(), "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	url := config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+func oauthCallbackHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	provider, ok := oauth.Get(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	state := r.FormValue("state")
+
+	// Verify state
+	session, err := sessionManager.Store.Get(r, "oauth-state")
+	if err != nil {
+		log.Error("Get oauth state session failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "session_error")
+		return
+	}
+
+	savedState, ok := session.Values["state"].(string)
+	savedProvider, _ := session.Values["provider"].(string)
+	if !ok || savedState != state || savedProvider != provider.Name() {
+		log.Warn("Invalid oauth state", "provider", provider.Name())
+		redirectWithError(w, r, "invalid_state")
+		return
+	}
+	verifier, _ := session.Values["verifier"].(string)
+	linkTo, _ := session.Values["link"].(string)
+
+	// Clear state session
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+
+	config, err := provider.Config(r.Context())
+	if err != nil {
+		log.Error("Get oauth config failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "provider_unavailable")
+		return
+	}
+
+	code := r.FormValue("code")
+	token, err := config.Exchange(r.Context(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Error("OAuth code exchange failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "exchange_failed")
+		return
+	}
+
+	// Get user info from the provider
+	profile, err := provider.Profile(r.Context(), token)
+	if err != nil {
+		log.Error("Fetch user failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "user_fetch_failed")
+		return
+	}
+
+	identity := models.Identity{
+		Provider: models.IdentityProvider(provider.Name()),
+		Subject:  profile.Subject,
+		Name:     profile.Login,
+	}
+	if linkTo != "" {
+		linkIdentity(w, r, rs, linkTo, identity)
+		return
+	}
+
+	user, err := users.SignIn(rs, identity, models.User{
+		Login:     profile.Login,
+		Name:      profile.Name,
+		Email:     profile.Email,
+		AvatarURL: profile.AvatarURL,
+	})
+	if err != nil {
+		log.Error("Sign in failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "user_registration_failed")
+		return
+	}
+
+	// The login lasts as long as the server side session, not the provider's
+	// access token, which OIDC providers issue for minutes
+	tokenInfo := &models.TokenInfo{
+		Provider:  provider.Name(),
+		Token:     token,
+		User:      &user,
+		ExpiresAt: time.Now().Add(sessionManager.Lifetime),
+	}
+
+	// Save session
+	if err := sessionManager.SaveSession(rs, w, r, tokenInfo); err != nil {
+		log.Error("Save session failed", "provider", provider.Name(), "error", err)
+		redirectWithError(w, r, "session_save_failed")
+		return
+	}
+
+	// Redirect to frontend
+	frontendURL := dotenv.EnvString("FRONTEND_URL", "http://localhost:3000")
+	http.Redirect(w, r, frontendURL+"/dashboard", http.StatusTemporaryRedirect)
+}
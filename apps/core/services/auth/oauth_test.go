@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"core/internal/oauth"
+	"core/internal/store"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeIssuer is an OIDC provider that hands out a code per login and only
+// exchanges it with the verifier of that login's challenge
+type fakeIssuer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	challenges map[string]string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"userinfo_endpoint":      f.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		challenge, ok := f.challenges[r.FormValue("code")]
+		f.mu.Unlock()
+		if !ok || oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier")) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	})
+	// A callback that gets to the profile passed the state and PKCE checks
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// authorize is the provider's side of the redirect from startOAuth, it
+// returns the state and the code to call back with
+func (f *fakeIssuer) authorize(t *testing.T, location string) (string, string) {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login redirect lacks a S256 challenge: %s", location)
+	}
+
+	code := "code-" + q.Get("state")
+	f.mu.Lock()
+	f.challenges[code] = q.Get("code_challenge")
+	f.mu.Unlock()
+	return q.Get("state"), code
+}
+
+type login struct {
+	cookie *http.Cookie
+	state  string
+	code   string
+}
+
+func TestOAuthCallbackChecksStateAndVerifier(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	providers := oauth.OIDC_PROVIDERS
+	oauth.OIDC_PROVIDERS = "test,other"
+	t.Setenv("OIDC_TEST_ISSUER", issuer.URL)
+	t.Setenv("OIDC_TEST_CLIENT_ID", "client")
+	t.Setenv("OIDC_OTHER_ISSUER", issuer.URL)
+	t.Setenv("OIDC_OTHER_CLIENT_ID", "client")
+	if err := oauth.LoadProviders(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		oauth.OIDC_PROVIDERS = providers
+		oauth.LoadProviders()
+	})
+
+	rs := store.NewMemoryStore("")
+	handler := NewAuthHandler(rs)
+
+	start := func(provider string) login {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+provider+"/login", nil))
+		if w.Code != http.StatusTemporaryRedirect || len(w.Result().Cookies()) != 1 {
+			t.Fatalf("%s login: status %d, cookies %v", provider, w.Code, w.Result().Cookies())
+		}
+		state, code := issuer.authorize(t, w.Header().Get("Location"))
+		return login{cookie: w.Result().Cookies()[0], state: state, code: code}
+	}
+	first, second, other := start("test"), start("test"), start("other")
+	if first.state == second.state {
+		t.Fatal("logins share a state")
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		state  string
+		code   string
+		error  string
+	}{
+		{"valid", first.cookie, first.state, first.code, "user_fetch_failed"},
+		{"no state cookie", nil, first.state, first.code, "invalid_state"},
+		{"wrong state", first.cookie, second.state, first.code, "invalid_state"},
+		{"other provider's login", other.cookie, other.state, other.code, "invalid_state"},
+		{"code of another login", first.cookie, first.state, second.code, "exchange_failed"},
+	}
+	for _, tt := range tests {
+		q := url.Values{"state": {tt.state}, "code": {tt.code}}
+		r := httptest.NewRequest(http.MethodGet, "/test/callback?"+q.Encode(), nil)
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || location.Query().Get("error") != tt.error {
+			t.Errorf("%s: redirected to %q, want error %s", tt.name, w.Header().Get("Location"), tt.error)
+		}
+	}
+}
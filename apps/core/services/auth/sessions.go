@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"net/http"
+	log "packages/logging"
+	"slices"
+	"time"
+
+	sessionManager "core/internal/session"
+	"core/internal/store"
+	"core/models"
+)
+
+// SessionResponse describes a login without its OAuth tokens
+type SessionResponse struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Whether this is the session the request was made with
+	Current bool `json:"current"`
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessions, err := rs.ListSessions(current.TokenInfo.User.ID)
+	if err != nil {
+		log.Error("List sessions failed", "user_id", current.TokenInfo.User.ID, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionResponse{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.Id == current.Id,
+		})
+	}
+	writeJSON(w, response)
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userId := current.TokenInfo.User.ID
+	sessionId := r.PathValue("sessionId")
+
+	sessions, err := rs.ListSessions(userId)
+	if err != nil {
+		log.Error("List sessions failed", "user_id", userId, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !slices.ContainsFunc(sessions, func(session models.Session) bool { return session.Id == sessionId }) {
+		writeError(w, http.StatusNotFound, "No such Session Found")
+		return
+	}
+
+	if sessionId == current.Id {
+		err = sessionManager.ClearSession(rs, w, r)
+	} else {
+		err = rs.DeleteSession(userId, sessionId)
+	}
+	if err != nil {
+		log.Error("Revoke session failed", "user_id", userId, "session_id", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	log.Info("Session revoked", "user_id", userId, "session_id", sessionId)
+	writeJSON(w, map[string]string{"message": "Session revoked"})
+}
+
+// logoutAllHandler revokes every session of the user, this one included
+func logoutAllHandler(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	current, err := sessionManager.GetSession(rs, r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userId := current.TokenInfo.User.ID
+
+	if err := rs.DeleteSessions(userId); err != nil {
+		log.Error("Revoke sessions failed", "user_id", userId, "error", err)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	sessionManager.ClearSession(rs, w, r)
+
+	log.Info("Logged out everywhere", "user_id", userId)
+	writeJSON(w, map[string]string{"message": "Logged out of all sessions"})
+}
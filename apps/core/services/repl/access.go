@@ -0,0 +1,68 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"core/cmd/middleware"
+	"core/internal/quota"
+	"core/internal/store"
+	"core/models"
+	"packages/utils/json"
+)
+
+// userRepl loads the {replId} of the request and checks that the caller has
+// at least the needed role on it, as its owner or a collaborator. It writes the
+// error response itself and returns false on failure. The returned collaborator
+// is the caller with their role.
+func userRepl(w http.ResponseWriter, r *http.Request, rs store.ReplStore, need models.CollaboratorRole) (models.Repl, models.Collaborator, bool) {
+
+	user, _ := middleware.GetUserFromContext(r.Context())
+	userName := user.ID
+
+	replId := r.PathValue("replId")
+
+	repl, err := rs.GetRepl(replId)
+	if err != nil {
+		json.WriteError(w, http.StatusBadRequest, "This Repl Id doesn't exists")
+		return models.Repl{}, models.Collaborator{User: userName}, false
+	}
+
+	caller, ok := replRole(rs, repl, userName)
+	if !ok {
+		json.WriteError(w, http.StatusUnauthorized, "This User doesn't have access to this Repl")
+		return models.Repl{}, caller, false
+	}
+	if !caller.Role.Allows(need) {
+		json.WriteError(w, http.StatusForbidden, fmt.Sprintf("This action needs the %s role on this Repl", need))
+		return models.Repl{}, caller, false
+	}
+
+	return repl, caller, true
+}
+
+// replRole returns the user's role on the repl, the owner is never stored as
+// a collaborator
+func replRole(rs store.ReplStore, repl models.Repl, userName string) (models.Collaborator, bool) {
+	if repl.User == userName {
+		return models.Collaborator{User: userName, Role: models.RoleOwner}, true
+	}
+
+	collaborator, err := rs.GetCollaborator(repl.Id, userName)
+	if err != nil {
+		return models.Collaborator{User: userName}, false
+	}
+	return collaborator, true
+}
+
+// writeQuotaError reports plan violations with their own status (403/429)
+// and anything else as an internal error.
+func writeQuotaError(w http.ResponseWriter, err error) {
+	var quotaErr *quota.Error
+	if errors.As(err, &quotaErr) {
+		json.WriteError(w, quotaErr.Status, quotaErr.Message)
+		return
+	}
+	json.WriteError(w, http.StatusInternalServerError, err.Error())
+}
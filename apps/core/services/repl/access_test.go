@@ -0,0 +1,52 @@
+package repl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"core/cmd/middleware"
+	"core/internal/store"
+	"core/models"
+)
+
+func TestUserRepl(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	rs.AddCollaborator("repl-1", models.Collaborator{User: "bob", Role: models.RoleEditor})
+	rs.AddCollaborator("repl-1", models.Collaborator{User: "carol", Role: models.RoleViewer})
+
+	tests := []struct {
+		user   string
+		replId string
+		need   models.CollaboratorRole
+		status int
+		role   models.CollaboratorRole
+	}{
+		{"alice", "repl-1", models.RoleOwner, http.StatusOK, models.RoleOwner},
+		{"bob", "repl-1", models.RoleEditor, http.StatusOK, models.RoleEditor},
+		{"bob", "repl-1", models.RoleOwner, http.StatusForbidden, models.RoleEditor},
+		{"carol", "repl-1", models.RoleViewer, http.StatusOK, models.RoleViewer},
+		{"carol", "repl-1", models.RoleEditor, http.StatusForbidden, models.RoleViewer},
+		{"dave", "repl-1", models.RoleViewer, http.StatusUnauthorized, ""},
+		{"alice", "repl-2", models.RoleViewer, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+tt.replId, nil)
+		r.SetPathValue("replId", tt.replId)
+		r = r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, &models.User{ID: tt.user}))
+		w := httptest.NewRecorder()
+
+		repl, caller, ok := userRepl(w, r, rs, tt.need)
+		if ok != (tt.status == http.StatusOK) || (!ok && w.Code != tt.status) {
+			t.Errorf("%s needing %s on %s: ok %v, status %d, want %d", tt.user, tt.need, tt.replId, ok, w.Code, tt.status)
+		}
+		if caller.Role != tt.role {
+			t.Errorf("%s on %s: role %q, want %q", tt.user, tt.replId, caller.Role, tt.role)
+		}
+		if ok && repl.Id != tt.replId {
+			t.Errorf("%s on %s: got repl %q", tt.user, tt.replId, repl.Id)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package repl
+
+import (
+	"errors"
+	"net/http"
+	log "packages/logging"
+	"time"
+
+	"core/internal/provisioner"
+	"core/internal/quota"
+	"core/internal/store"
+	"core/models"
+	"packages/utils/json"
+)
+
+// How long a request waits for a stopped repl's volume to be saved. Volumes
+// take minutes, the request is then answered 202 and the work finishes in
+// the background.
+const saveWait = 3 * time.Second
+
+// response is the reply of work that may outlive its request
+type response struct {
+	status int
+	body   any
+}
+
+func (res response) write(w http.ResponseWriter) {
+	if message, ok := res.body.(string); ok && res.status >= http.StatusBadRequest {
+		json.WriteError(w, res.status, message)
+		return
+	}
+	json.WriteJSON(w, res.status, res.body)
+}
+
+// inBackground runs work and writes its response when it's done within
+// saveWait, else the request gets 202 with the accepted message
+func inBackground(w http.ResponseWriter, accepted string, work func() response) {
+	done := make(chan response, 1)
+	go func() { done <- work() }()
+
+	select {
+	case res := <-done:
+		res.write(w)
+	case <-time.After(saveWait):
+		json.WriteJSON(w, http.StatusAccepted, map[string]string{"message": accepted})
+	}
+}
+
+// withSavedWorkspace runs next once the stored workspace in S3 is up to date:
+// a live workspace is only there as of its last upload, and a stopped
+// persistent one as of its last save. A volume is saved with the repl
+// archiving, next runs before it gets its status back.
+func withSavedWorkspace(w http.ResponseWriter, rs store.ReplStore, prov provisioner.Provisioner, repl models.Repl, accepted string, next func() response) {
+	switch repl.State.Status {
+	case models.ReplReady:
+		if err := prov.Flush(repl.User, repl.Id); err != nil {
+			saveFailed(repl, err).write(w)
+			return
+		}
+		next().write(w)
+
+	case models.ReplStopped, models.ReplFailed:
+		inBackground(w, accepted, func() response {
+			return whileArchiving(rs, repl, func() error {
+				return prov.Save(repl.User, repl.Id)
+			}, next)
+		})
+
+	case models.ReplArchiving:
+		saveFailed(repl, store.ErrStatusConflict).write(w)
+
+	default:
+		next().write(w)
+	}
+}
+
+// whileArchiving runs save and then next, holding the repl archiving
+func whileArchiving(rs store.ReplStore, repl models.Repl, save func() error, next func() response) response {
+	var res response
+	err := provisioner.Archiving(rs, repl, func() error {
+		if err := save(); err != nil {
+			return err
+		}
+		res = next()
+		return nil
+	})
+	if err != nil {
+		return saveFailed(repl, err)
+	}
+	return res
+}
+
+// saveFailed is the response to a workspace that couldn't be saved
+func saveFailed(repl models.Repl, err error) response {
+	var quotaErr *quota.Error
+	switch {
+	case errors.As(err, &quotaErr):
+		return response{quotaErr.Status, quotaErr.Message}
+	case errors.Is(err, store.ErrStatusConflict):
+		return response{http.StatusConflict, "The workspace is being saved or the Repl was started, try again shortly"}
+	default:
+		log.Error("Save workspace failed", "repl_id", repl.Id, "user", repl.User, "error", err)
+		return response{http.StatusInternalServerError, "Unable to save the workspace"}
+	}
+}
@@ -0,0 +1,131 @@
+package repl
+
+import (
+	"net/http"
+	log "packages/logging"
+	"strings"
+	"time"
+
+	"core/internal/store"
+	"core/internal/users"
+	"core/models"
+	"packages/utils/json"
+)
+
+// getCollaborators lists everyone with access to the repl, owner first
+func getCollaborators(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	repl, _, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	collaborators, err := rs.GetCollaborators(repl.Id)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	owner := models.Collaborator{User: repl.User, Role: models.RoleOwner}
+	collaborators = append([]models.Collaborator{owner}, collaborators...)
+	for i := range collaborators {
+		if account, err := rs.GetUser(collaborators[i].User); err == nil {
+			collaborators[i].Handle = account.Handle
+		}
+	}
+	json.WriteJSON(w, http.StatusOK, collaborators)
+}
+
+// addCollaborator shares the repl with a user, or changes their role if it
+// is already shared with them
+func addCollaborator(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	var req addCollaboratorRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	repl, caller, ok := userRepl(w, r, rs, models.RoleOwner)
+	if !ok {
+		return
+	}
+
+	if strings.TrimSpace(req.User) == "" {
+		json.WriteError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	account, err := users.Lookup(rs, req.User)
+	if err != nil {
+		json.WriteError(w, http.StatusNotFound, "No such User Found")
+		return
+	}
+	userName := account.Id
+	if userName == repl.User {
+		json.WriteError(w, http.StatusBadRequest, "The owner already has access to this Repl")
+		return
+	}
+	if req.Role != models.RoleEditor && req.Role != models.RoleViewer {
+		json.WriteError(w, http.StatusBadRequest, "role must be editor or viewer")
+		return
+	}
+
+	collaborator := models.Collaborator{
+		User:      userName,
+		Handle:    account.Handle,
+		Role:      req.Role,
+		InvitedBy: caller.User,
+		AddedAt:   time.Now().UTC(),
+	}
+	if existing, err := rs.GetCollaborator(repl.Id, userName); err == nil {
+		collaborator.InvitedBy = existing.InvitedBy
+		collaborator.AddedAt = existing.AddedAt
+	}
+
+	if err := rs.AddCollaborator(repl.Id, collaborator); err != nil {
+		log.Error("Add collaborator failed", "repl_id", repl.Id, "user", userName, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("Repl shared", "repl_id", repl.Id, "user", userName, "role", req.Role, "invited_by", caller.User)
+	json.WriteJSON(w, http.StatusOK, collaborator)
+}
+
+// removeCollaborator revokes a user's access. Owners can remove anyone and
+// collaborators can remove themselves.
+func removeCollaborator(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	repl, caller, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	// The path names the collaborator by handle or id
+	userName := r.PathValue("userName")
+	if account, err := users.Lookup(rs, userName); err == nil {
+		userName = account.Id
+	}
+	if caller.Role != models.RoleOwner && caller.User != userName {
+		json.WriteError(w, http.StatusForbidden, "Only the owner can remove other collaborators")
+		return
+	}
+	if userName == repl.User {
+		json.WriteError(w, http.StatusBadRequest, "The owner can't be removed from this Repl")
+		return
+	}
+
+	if _, err := rs.GetCollaborator(repl.Id, userName); err != nil {
+		json.WriteError(w, http.StatusNotFound, "This User isn't a collaborator on this Repl")
+		return
+	}
+
+	if err := rs.RemoveCollaborator(repl.Id, userName); err != nil {
+		log.Error("Remove collaborator failed", "repl_id", repl.Id, "user", userName, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("Repl unshared", "repl_id", repl.Id, "user", userName, "removed_by", caller.User)
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
@@ -0,0 +1,82 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	log "packages/logging"
+	"strings"
+
+	"core/internal/provisioner"
+	"core/internal/quota"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+	"packages/utils/json"
+
+	"github.com/google/uuid"
+)
+
+// forkRepl creates a new repl for the caller from a copy of an existing repl's
+// workspace, leaving the original untouched. Viewers of a shared repl may fork
+// it into their own account.
+func forkRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
+
+	var req forkReplRequest
+	if err := json.ReadJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	source, caller, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+	userName := caller.User
+
+	if _, ok := templates.Get(source.Template); !ok {
+		json.WriteError(w, http.StatusBadRequest, fmt.Sprintf("The %s template is no longer available", source.Template))
+		return
+	}
+
+	if err := quota.CheckCreate(rs, s3Client, userName, source.Template); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	replName := strings.TrimSpace(req.ReplName)
+	if replName == "" {
+		replName = source.Name + "-fork"
+	}
+
+	id := uuid.New()
+	replId := fmt.Sprintf("repl-%s", strings.TrimSpace(id.String()))
+
+	// Fork what the user currently sees, not the last upload
+	withSavedWorkspace(w, rs, prov, source, "The Repl is forked once the workspace is saved", func() response {
+		sourcePrefix := fmt.Sprintf("repl/%s/%s/", source.User, source.Id)
+		destinationPrefix := fmt.Sprintf("repl/%s/%s/", userName, replId)
+
+		if err := s3Client.CopyFolder(sourcePrefix, destinationPrefix); err != nil {
+			log.Error("S3 copy repl failed", "user", userName, "source_repl_id", source.Id, "repl_id", replId, "error", err)
+			s3Client.DeleteFolder(destinationPrefix)
+			return response{http.StatusInternalServerError, err.Error()}
+		}
+
+		if err := rs.CreateRepl(source.Template, userName, replName, replId); err != nil {
+			log.Error("Create repl record failed", "user", userName, "repl_id", replId, "template", source.Template, "error", err)
+			s3Client.DeleteFolder(destinationPrefix)
+			return response{http.StatusInternalServerError, err.Error()}
+		}
+
+		log.Info("Repl forked", "user", userName, "source_repl_id", source.Id, "repl_id", replId)
+
+		repl, err := rs.GetRepl(replId)
+		if err != nil {
+			return response{http.StatusInternalServerError, err.Error()}
+		}
+		return response{http.StatusCreated, repl}
+	})
+}
@@ -7,17 +7,19 @@ import (
 	"strings"
 
 	"core/cmd/middleware"
-	"core/internal/k8s"
-	"core/internal/redis"
+	"core/internal/provisioner"
+	"core/internal/quota"
 	"core/internal/s3"
+	"core/internal/snapshot"
+	"core/internal/store"
+	"core/internal/templates"
 	"core/models"
-	"core/pkg/dotenv"
 	"packages/utils/json"
 
 	"github.com/google/uuid"
 )
 
-func NewHandler(s3Client *s3.S3Client, rds *redis.Redis) http.Handler {
+func NewHandler(s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /test", func(w http.ResponseWriter, r *http.Request) {
@@ -26,25 +28,93 @@ func NewHandler(s3Client *s3.S3Client, rds *redis.Redis) http.Handler {
 	})
 
 	mux.HandleFunc("POST /new", func(w http.ResponseWriter, r *http.Request) {
-		newRepl(w, r, s3Client, rds)
+		newRepl(w, r, s3Client, rs)
 	})
-	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		getUserRepls(w, r, rds)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		getUserRepls(w, r, rs)
+	})
+	mux.HandleFunc("GET /quota", func(w http.ResponseWriter, r *http.Request) {
+		getUserQuota(w, r, s3Client, rs)
 	})
 	mux.HandleFunc("GET /session/{replId}", func(w http.ResponseWriter, r *http.Request) {
-		activateRepl(w, r, rds)
+		activateRepl(w, r, rs, prov)
 	})
 	mux.HandleFunc("DELETE /session/{replId}", func(w http.ResponseWriter, r *http.Request) {
-		deactivateRepl(w, r, rds)
+		deactivateRepl(w, r, s3Client, rs, prov)
 	})
 	mux.HandleFunc("DELETE /{replId}", func(w http.ResponseWriter, r *http.Request) {
-		deleteRepl(w, r, s3Client, rds)
+		deleteRepl(w, r, s3Client, rs, prov)
 	})
 
-	return mux
+	// Per-repl resources live under /{replId}/... in their own mux, since
+	// "GET /{replId}/status" would otherwise conflict with "GET /session/{replId}"
+	replMux := http.NewServeMux()
+	replMux.HandleFunc("GET /{replId}/status", func(w http.ResponseWriter, r *http.Request) {
+		getReplStatus(w, r, rs)
+	})
+	replMux.HandleFunc("GET /{replId}/status/events", func(w http.ResponseWriter, r *http.Request) {
+		streamReplStatus(w, r, rs)
+	})
+	replMux.HandleFunc("POST /{replId}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		createSnapshot(w, r, s3Client, rs, prov)
+	})
+	replMux.HandleFunc("GET /{replId}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		getSnapshots(w, r, rs)
+	})
+	replMux.HandleFunc("GET /{replId}/snapshots/{snapshotId}/diff", func(w http.ResponseWriter, r *http.Request) {
+		getSnapshotDiff(w, r, s3Client, rs)
+	})
+	replMux.HandleFunc("POST /{replId}/snapshots/{snapshotId}/restore", func(w http.ResponseWriter, r *http.Request) {
+		restoreSnapshot(w, r, s3Client, rs, prov)
+	})
+	replMux.HandleFunc("DELETE /{replId}/snapshots/{snapshotId}", func(w http.ResponseWriter, r *http.Request) {
+		deleteSnapshot(w, r, s3Client, rs)
+	})
+	replMux.HandleFunc("POST /{replId}/fork", func(w http.ResponseWriter, r *http.Request) {
+		forkRepl(w, r, s3Client, rs, prov)
+	})
+	replMux.HandleFunc("GET /{replId}/collaborators", func(w http.ResponseWriter, r *http.Request) {
+		getCollaborators(w, r, rs)
+	})
+	replMux.HandleFunc("POST /{replId}/collaborators", func(w http.ResponseWriter, r *http.Request) {
+		addCollaborator(w, r, rs)
+	})
+	replMux.HandleFunc("DELETE /{replId}/collaborators/{userName}", func(w http.ResponseWriter, r *http.Request) {
+		removeCollaborator(w, r, rs)
+	})
+	mux.Handle("/{replId}/", replMux)
+
+	return middleware.RequireScope(requiredScope, mux)
+}
+
+// requiredScope is the access token scope a request needs: repl:read to look
+// at repls, repl:admin to delete them, change who they're shared with and
+// restore or delete snapshots, repl:write for anything else, starting a
+// session included
+func requiredScope(r *http.Request) models.TokenScope {
+	// {replId}, {replId}/collaborators/{userName}, {replId}/snapshots/{snapshotId}/restore...
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	resource := ""
+	if len(path) > 1 {
+		resource = path[1]
+	}
+
+	switch {
+	case r.Method == http.MethodDelete && len(path) == 1 && path[0] != "":
+		return models.ScopeReplAdmin
+	case resource == "collaborators" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		return models.ScopeReplAdmin
+	case resource == "snapshots" && r.Method == http.MethodDelete && len(path) == 3:
+		return models.ScopeReplAdmin
+	case resource == "snapshots" && r.Method == http.MethodPost && len(path) == 4 && path[3] == "restore":
+		return models.ScopeReplAdmin
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && path[0] != "session":
+		return models.ScopeReplRead
+	}
+	return models.ScopeReplWrite
 }
 
-func newRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rds *redis.Redis) {
+func newRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
 
 	var repl *newReplRequest
 	if err := json.ReadJSON(r, &repl); err != nil {
@@ -54,11 +124,16 @@ func newRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rds
 
 	// Get User from auth
 	user, _ := middleware.GetUserFromContext(r.Context())
-	userName := strings.ToLower(user.Login)
+	userName := user.ID
 
-	if userRepls, err := rds.GetUserRepls(userName); err == nil && len(userRepls) == 2 {
-		log.Warn("Repl limit reached", "user", userName, "limit", 2)
-		json.WriteError(w, http.StatusInternalServerError, "Free Account Limit Reached")
+	// Reject unknown templates before anything is copied to S3
+	if _, ok := templates.Get(repl.Template); !ok {
+		json.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Unknown template: %s", repl.Template))
+		return
+	}
+
+	if err := quota.CheckCreate(rs, s3Client, userName, repl.Template); err != nil {
+		writeQuotaError(w, err)
 		return
 	}
 
@@ -71,12 +146,13 @@ func newRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rds
 
 	if err := s3Client.CopyFolder(sourcePrefix, destinationPrefix); err != nil {
 		log.Error("S3 copy template failed", "user", userName, "repl_id", replId, "template", repl.Template, "error", err)
+		s3Client.DeleteFolder(destinationPrefix)
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// Create Repl in Store
-	if err := rds.CreateRepl(repl.Template, userName, repl.ReplName, replId); err != nil {
+	if err := rs.CreateRepl(repl.Template, userName, repl.ReplName, replId); err != nil {
 		log.Error("Create repl record failed", "user", userName, "repl_id", replId, "template", repl.Template, "error", err)
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -85,30 +161,36 @@ func newRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rds
 	json.WriteJSON(w, http.StatusOK, "Success")
 }
 
-func deleteRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rds *redis.Redis) {
-
-	user, _ := middleware.GetUserFromContext(r.Context())
-	userName := strings.ToLower(user.Login)
+func deleteRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
 
-	replId := r.PathValue("replId")
-
-	repl, err := rds.GetRepl(replId)
-	if err != nil {
-		json.WriteError(w, http.StatusBadRequest, "This Repl Id doesn't exists")
+	repl, _, ok := userRepl(w, r, rs, models.RoleOwner)
+	if !ok {
 		return
 	}
-	if repl.User != userName {
-		json.WriteError(w, http.StatusUnauthorized, "This User doesn't have access to this Repl")
+	replId := repl.Id
+	userName := repl.User
+
+	// The volume is being read or deleted
+	if repl.State.Status == models.ReplArchiving {
+		json.WriteError(w, http.StatusConflict, "The workspace is being saved, try again shortly")
 		return
 	}
 
 	if repl.IsActive == true {
-		if err := rds.DeleteReplSession(replId); err != nil {
+		if err := rs.DeleteReplSession(replId); err != nil {
 			json.WriteError(w, http.StatusInternalServerError, "Unable to Create Repl Session")
 			return
 		}
 	}
 
+	// The workspace is deleted with the repl, so tear the runner and any
+	// persistent volume down without flushing them
+	if err := prov.Delete("", replId); err != nil {
+		log.Error("Repl teardown failed", "repl_id", replId, "provisioner", prov.Name(), "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	destination := fmt.Sprintf("repl/%s/%s/", userName, repl.Id)
 	if err := s3Client.DeleteFolder(destination); err != nil {
 		log.Error("S3 delete failed", "user", userName, "repl_id", repl.Id, "error", err)
@@ -116,8 +198,14 @@ func deleteRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, r
 		return
 	}
 
+	if err := snapshot.DeleteAll(s3Client, rs, repl); err != nil {
+		log.Error("Delete repl snapshots failed", "user", userName, "repl_id", repl.Id, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	// Create Repl in Store
-	if err := rds.DeleteRepl(repl.Id); err != nil {
+	if err := rs.DeleteRepl(repl.Id); err != nil {
 		log.Error("Delete repl record failed", "user", userName, "repl_id", repl.Id, "error", err)
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -126,97 +214,169 @@ func deleteRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, r
 	json.WriteJSON(w, http.StatusOK, "Success")
 }
 
-func getUserRepls(w http.ResponseWriter, r *http.Request, rds *redis.Redis) {
+func getUserRepls(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
 
 	user, _ := middleware.GetUserFromContext(r.Context())
-	userName := strings.ToLower(user.Login)
+	userName := user.ID
 
-	replIds, err := rds.GetUserRepls(userName)
+	replIds, err := rs.GetUserRepls(userName)
 	if err != nil {
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	var repls []models.Repl
+	sharedIds, err := rs.GetSharedRepls(userName)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var repls []userReplResponse
 	for _, id := range replIds {
-		repl, err := rds.GetRepl(id)
+		repl, err := rs.GetRepl(id)
 		if err != nil {
 			log.Warn("Repl ID does not exist for user", "repl_id", id, "user", userName, "error", err)
 			continue
 		}
-		repls = append(repls, repl)
+		repls = append(repls, userReplResponse{Repl: repl, Role: models.RoleOwner})
+	}
+
+	// Repls shared with the user
+	for _, id := range sharedIds {
+		repl, err := rs.GetRepl(id)
+		if err != nil {
+			log.Warn("Shared repl does not exist", "repl_id", id, "user", userName, "error", err)
+			continue
+		}
+		collaborator, err := rs.GetCollaborator(id, userName)
+		if err != nil {
+			continue
+		}
+		repls = append(repls, userReplResponse{Repl: repl, Role: collaborator.Role})
 	}
 
 	json.WriteJSON(w, http.StatusOK, repls)
 }
 
-func activateRepl(w http.ResponseWriter, r *http.Request, rds *redis.Redis) {
-
-	user, _ := middleware.GetUserFromContext(r.Context())
-	userName := strings.ToLower(user.Login)
+func activateRepl(w http.ResponseWriter, r *http.Request, rs store.ReplStore, prov provisioner.Provisioner) {
 
-	replId := r.PathValue("replId")
+	repl, caller, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+	replId := repl.Id
+	// Sessions run in the owner's workspace and count towards their plan
+	userName := repl.User
+
+	// Without runner tokens the runner can't tell viewers apart and would give
+	// them full access
+	if !caller.Role.Allows(models.RoleEditor) && RUNNER_TOKEN_SECRET == "" {
+		json.WriteError(w, http.StatusForbidden, "Read-only sessions are disabled, RUNNER_TOKEN_SECRET isn't set")
+		return
+	}
 
-	repl, err := rds.GetRepl(replId)
-	if err != nil {
-		log.Warn("Invalid repl id", "repl_id", replId, "error", err)
-		json.WriteError(w, http.StatusBadRequest, "This Repl Id doesn't exists")
+	// Already activating or running: report the current state instead of provisioning twice
+	if repl.State.Status.IsLive() {
+		json.WriteJSON(w, http.StatusAccepted, activationResponse(prov, repl, caller))
 		return
 	}
-	if repl.User != userName {
-		json.WriteError(w, http.StatusUnauthorized, "This User doesn't have access to this Repl")
+
+	// Viewers can only join a workspace someone else started
+	if !caller.Role.Allows(models.RoleEditor) {
+		json.WriteError(w, http.StatusForbidden, "This Repl isn't running, ask its owner or an editor to start it")
 		return
 	}
 
-	if err := rds.CreateReplSession(replId); err != nil {
-		json.WriteError(w, http.StatusInternalServerError, "Unable to Create Repl Session")
+	if err := quota.CheckActivate(rs, userName); err != nil {
+		writeQuotaError(w, err)
+		return
 	}
 
-	if err := k8s.CreateReplDeploymentAndService(userName, replId, repl.Template); err != nil {
-		log.Error("K8s deployment failed", "repl_id", replId, "user", userName, "template", repl.Template, "error", err)
-		json.WriteError(w, http.StatusInternalServerError, err.Error())
+	// Archiving can't move to pending, so the transition below fails as well
+	// if archiving starts meanwhile
+	if repl.State.Status == models.ReplArchiving {
+		json.WriteError(w, http.StatusConflict, "The workspace is being saved, try again shortly")
 		return
 	}
 
-	url := fmt.Sprintf("https://%s/%s/ping", dotenv.EnvString("RUNNER_CLUSTER_IP", "localhost:8081"), replId)
+	if err := store.Transition(rs, replId, models.ReplPending, ""); err != nil {
+		json.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
 
-	if err := pingRunner(url); err != nil {
-		json.WriteError(w, http.StatusInternalServerError, err.Error())
+	if err := rs.CreateReplSession(replId); err != nil {
+		// Pending can't go back to stopped, failed lets the repl be started again
+		if err := store.TransitionFrom(rs, replId, models.ReplPending, models.ReplFailed, "failed to create session"); err != nil {
+			log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+		}
+		json.WriteError(w, http.StatusInternalServerError, "Unable to Create Repl Session")
 		return
 	}
 
-	json.WriteJSON(w, http.StatusOK, map[string]string{
-		"replId":   replId,
-		"replName": repl.Name,
-	})
+	go provisioner.Provision(rs, prov, userName, repl)
+
+	repl, _ = rs.GetRepl(replId)
+	json.WriteJSON(w, http.StatusAccepted, activationResponse(prov, repl, caller))
 }
 
-func deactivateRepl(w http.ResponseWriter, r *http.Request, rds *redis.Redis) {
+func deactivateRepl(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
 
-	user, _ := middleware.GetUserFromContext(r.Context())
-	userName := strings.ToLower(user.Login)
+	repl, _, ok := userRepl(w, r, rs, models.RoleEditor)
+	if !ok {
+		return
+	}
+	replId := repl.Id
+	// The workspace lives under the owner, whoever stops it
+	userName := repl.User
 
-	replId := r.PathValue("replId")
+	if err := store.Transition(rs, replId, models.ReplStopping, ""); err != nil {
+		json.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
 
-	repl, err := rds.GetRepl(replId)
-	if err != nil {
-		json.WriteError(w, http.StatusBadRequest, "This Repl Id doesn't exists")
+	if err := rs.DeleteReplSession(replId); err != nil {
+		json.WriteError(w, http.StatusInternalServerError, "Unable to Delete Repl Session")
 		return
 	}
-	if repl.User != userName {
-		json.WriteError(w, http.StatusUnauthorized, "This User doesn't have access to this Repl")
+
+	// Keep the workspace as it was before this session, the upload below overwrites it
+	snapshot.Auto(s3Client, rs, repl, "Before shutdown")
+
+	if err := prov.Delete(userName, replId); err != nil {
+		log.Error("Repl teardown failed", "repl_id", replId, "user", userName, "provisioner", prov.Name(), "error", err)
+		if err := store.Transition(rs, replId, models.ReplFailed, err.Error()); err != nil {
+			log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+		}
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	if err := rds.DeleteReplSession(replId); err != nil {
-		json.WriteError(w, http.StatusInternalServerError, "Unable to Create Repl Session")
+	if err := store.Transition(rs, replId, models.ReplStopped, ""); err != nil {
+		log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+	}
+
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
+
+func getUserQuota(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+
+	user, _ := middleware.GetUserFromContext(r.Context())
+	userName := user.ID
+
+	plan, err := quota.UserPlan(rs, userName)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	if err := k8s.DeleteReplDeploymentAndService(userName, replId); err != nil {
-		log.Error("K8s repl deletion failed", "repl_id", replId, "user", userName, "error", err)
+	usage, err := quota.Usage(rs, s3Client, userName)
+	if err != nil {
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	json.WriteJSON(w, http.StatusOK, "Success")
+	json.WriteJSON(w, http.StatusOK, map[string]any{
+		"plan":  plan,
+		"usage": usage,
+	})
 }
@@ -0,0 +1,76 @@
+package repl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"core/cmd/middleware"
+	"core/internal/store"
+	"core/models"
+)
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		scope  models.TokenScope
+	}{
+		{http.MethodGet, "/", models.ScopeReplRead},
+		{http.MethodGet, "/quota", models.ScopeReplRead},
+		{http.MethodGet, "/repl-1/status", models.ScopeReplRead},
+		{http.MethodGet, "/repl-1/snapshots/snap-1/diff", models.ScopeReplRead},
+		{http.MethodGet, "/repl-1/collaborators", models.ScopeReplRead},
+		{http.MethodPost, "/new", models.ScopeReplWrite},
+		{http.MethodGet, "/session/repl-1", models.ScopeReplWrite},
+		{http.MethodDelete, "/session/repl-1", models.ScopeReplWrite},
+		{http.MethodPost, "/repl-1/snapshots", models.ScopeReplWrite},
+		{http.MethodPost, "/repl-1/fork", models.ScopeReplWrite},
+		{http.MethodDelete, "/repl-1", models.ScopeReplAdmin},
+		{http.MethodPost, "/repl-1/collaborators", models.ScopeReplAdmin},
+		{http.MethodDelete, "/repl-1/collaborators/bob", models.ScopeReplAdmin},
+		{http.MethodPost, "/repl-1/snapshots/snap-1/restore", models.ScopeReplAdmin},
+		{http.MethodDelete, "/repl-1/snapshots/snap-1", models.ScopeReplAdmin},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if scope := requiredScope(r); scope != tt.scope {
+			t.Errorf("%s %s needs %s, want %s", tt.method, tt.path, scope, tt.scope)
+		}
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	rs := store.NewMemoryStore("")
+	rs.CreateRepl("node", "alice", "demo", "repl-1")
+	handler := NewHandler(nil, rs, nil)
+
+	tests := []struct {
+		scope  models.TokenScope
+		method string
+		path   string
+		status int
+	}{
+		{models.ScopeReplRead, http.MethodGet, "/repl-1/status", http.StatusOK},
+		{models.ScopeReplRead, http.MethodGet, "/session/repl-1", http.StatusForbidden},
+		{models.ScopeReplRead, http.MethodPost, "/repl-1/collaborators", http.StatusForbidden},
+		{models.ScopeReplWrite, http.MethodDelete, "/repl-1", http.StatusForbidden},
+		{models.ScopeReplWrite, http.MethodPost, "/repl-1/collaborators", http.StatusForbidden},
+		{models.ScopeReplWrite, http.MethodDelete, "/repl-1/snapshots/snap-1", http.StatusForbidden},
+		// Past the scope check, the snapshot doesn't exist
+		{models.ScopeReplAdmin, http.MethodDelete, "/repl-1/snapshots/snap-1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		user := models.User{ID: "alice"}
+		token := models.AccessToken{User: user, Scopes: []models.TokenScope{tt.scope}}
+		ctx := context.WithValue(context.Background(), middleware.UserContextKey, &user)
+		ctx = context.WithValue(ctx, middleware.TokenContextKey, &token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil).WithContext(ctx))
+		if w.Code != tt.status {
+			t.Errorf("%s token: %s %s = %d, want %d", tt.scope, tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package repl
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	log "packages/logging"
+
+	"core/internal/provisioner"
+	"core/internal/quota"
+	"core/internal/s3"
+	"core/internal/snapshot"
+	"core/internal/store"
+	"core/models"
+	"packages/utils/json"
+)
+
+func createSnapshot(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
+
+	// The body is optional, unnamed snapshots are named after their timestamp
+	var req newSnapshotRequest
+	if err := json.ReadJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	repl, caller, ok := userRepl(w, r, rs, models.RoleEditor)
+	if !ok {
+		return
+	}
+
+	// Snapshots count towards the owner's storage
+	if err := quota.CheckStorage(rs, s3Client, repl.User); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	withSavedWorkspace(w, rs, prov, repl, "The snapshot is taken once the workspace is saved", func() response {
+		snap, err := snapshot.Create(s3Client, rs, repl, req.Name, models.SnapshotManual)
+		if err != nil {
+			log.Error("Create snapshot failed", "repl_id", repl.Id, "user", caller.User, "error", err)
+			return response{http.StatusInternalServerError, err.Error()}
+		}
+		return response{http.StatusCreated, snap}
+	})
+}
+
+func getSnapshots(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	repl, _, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	snapshots, err := rs.GetSnapshots(repl.Id)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	json.WriteJSON(w, http.StatusOK, snapshots)
+}
+
+func getSnapshotDiff(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+
+	repl, _, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	snapshotId := r.PathValue("snapshotId")
+	if _, err := rs.GetSnapshot(repl.Id, snapshotId); err != nil {
+		json.WriteError(w, http.StatusNotFound, "This Snapshot doesn't exists")
+		return
+	}
+
+	diff, err := snapshot.Diff(s3Client, rs, repl, snapshotId)
+	if err != nil {
+		log.Error("Snapshot diff failed", "repl_id", repl.Id, "snapshot_id", snapshotId, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	json.WriteJSON(w, http.StatusOK, diff)
+}
+
+func restoreSnapshot(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
+
+	repl, caller, ok := userRepl(w, r, rs, models.RoleEditor)
+	if !ok {
+		return
+	}
+
+	snapshotId := r.PathValue("snapshotId")
+	if _, err := rs.GetSnapshot(repl.Id, snapshotId); err != nil {
+		json.WriteError(w, http.StatusNotFound, "This Snapshot doesn't exists")
+		return
+	}
+
+	// The running pod would upload its workspace over the restored one on shutdown
+	if repl.State.Status.IsLive() || repl.State.Status == models.ReplStopping {
+		json.WriteError(w, http.StatusConflict, "Stop the Repl before restoring a Snapshot")
+		return
+	}
+
+	// A persistent workspace is archived first, so the restored files are what
+	// the next start loads. The repl stays archiving until they're in place.
+	inBackground(w, "The snapshot is restored once the workspace is archived", func() response {
+		return whileArchiving(rs, repl, func() error {
+			return prov.Archive(repl.User, repl.Id)
+		}, func() response {
+			if err := snapshot.Restore(s3Client, rs, repl, snapshotId); err != nil {
+				log.Error("Restore snapshot failed", "repl_id", repl.Id, "user", caller.User, "snapshot_id", snapshotId, "error", err)
+				return response{http.StatusInternalServerError, err.Error()}
+			}
+			return response{http.StatusOK, "Success"}
+		})
+	})
+}
+
+func deleteSnapshot(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+
+	repl, caller, ok := userRepl(w, r, rs, models.RoleOwner)
+	if !ok {
+		return
+	}
+
+	snapshotId := r.PathValue("snapshotId")
+	if _, err := rs.GetSnapshot(repl.Id, snapshotId); err != nil {
+		json.WriteError(w, http.StatusNotFound, "This Snapshot doesn't exists")
+		return
+	}
+
+	if err := snapshot.Delete(s3Client, rs, repl, snapshotId); err != nil {
+		log.Error("Delete snapshot failed", "repl_id", repl.Id, "user", caller.User, "snapshot_id", snapshotId, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
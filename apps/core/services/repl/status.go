@@ -0,0 +1,140 @@
+package repl
+
+import (
+	stdjson "encoding/json"
+	"fmt"
+	"net/http"
+	log "packages/logging"
+	"strconv"
+	"time"
+
+	"core/internal/provisioner"
+	"core/internal/store"
+	"core/internal/templates"
+	"core/models"
+	"core/pkg/dotenv"
+	"packages/utils/json"
+	"packages/utils/token"
+)
+
+var (
+	// Runners get a key derived from it for their repl and reject websockets
+	// without a valid token when it is set
+	RUNNER_TOKEN_SECRET = dotenv.EnvString("RUNNER_TOKEN_SECRET", "")
+	RUNNER_TOKEN_TTL, _ = time.ParseDuration(dotenv.EnvString("RUNNER_TOKEN_TTL", "12h"))
+)
+
+// activationResponse reports the repl status along with the caller's role,
+// the runner's and app ports' URLs and the token the runner checks before
+// accepting their websocket.
+func activationResponse(prov provisioner.Provisioner, repl models.Repl, caller models.Collaborator) map[string]any {
+	res := map[string]any{
+		"replId":   repl.Id,
+		"replName": repl.Name,
+		"status":   repl.State.Status,
+		"role":     caller.Role,
+	}
+	if repl.State.Status == models.ReplFailed {
+		res["reason"] = repl.State.Reason
+		if repl.State.Failure != "" {
+			res["failure"] = repl.State.Failure
+		}
+	}
+	if url := prov.Endpoint(repl.Id); url != "" {
+		res["runnerUrl"] = url
+	}
+	if template, ok := templates.Get(repl.Template); ok && len(template.Ports) > 0 {
+		appUrls := map[string]string{}
+		for _, port := range template.Ports {
+			if url := prov.PortEndpoint(repl.Id, port); url != "" {
+				appUrls[strconv.Itoa(int(port))] = url
+			}
+		}
+		res["appUrls"] = appUrls
+	}
+
+	if RUNNER_TOKEN_SECRET != "" {
+		accessToken, err := token.Sign(token.ReplKey(RUNNER_TOKEN_SECRET, repl.Id), token.Claims{
+			ReplId:    repl.Id,
+			User:      caller.User,
+			Role:      string(caller.Role),
+			ExpiresAt: time.Now().Add(RUNNER_TOKEN_TTL).Unix(),
+		})
+		if err != nil {
+			log.Error("Sign runner token failed", "repl_id", repl.Id, "user", caller.User, "error", err)
+		} else {
+			res["accessToken"] = accessToken
+		}
+	}
+
+	return res
+}
+
+func getReplStatus(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	repl, _, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	json.WriteJSON(w, http.StatusOK, repl.State)
+}
+
+// streamReplStatus sends the repl status as Server-Sent Events, emitting a
+// "status" event on connect and whenever the status changes.
+func streamReplStatus(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+
+	repl, _, ok := userRepl(w, r, rs, models.RoleViewer)
+	if !ok {
+		return
+	}
+	replId := repl.Id
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		json.WriteError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(state models.ReplState) {
+		data, _ := stdjson.Marshal(state)
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	last := repl.State
+	send(last)
+
+	poll := time.NewTicker(1 * time.Second)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-poll.C:
+			repl, err := rs.GetRepl(replId)
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+				return
+			}
+			if repl.State != last {
+				last = repl.State
+				send(last)
+			}
+		}
+	}
+}
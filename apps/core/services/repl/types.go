@@ -1,7 +1,28 @@
 package repl
 
+import "core/models"
+
 type newReplRequest struct {
 	UserName string `json:"userName"`
 	Template string `json:"template"`
 	ReplName string `json:"replName"`
 }
+
+type newSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+type forkReplRequest struct {
+	ReplName string `json:"replName"`
+}
+
+type addCollaboratorRequest struct {
+	User string                  `json:"user"`
+	Role models.CollaboratorRole `json:"role"`
+}
+
+// userReplResponse is a repl listed for a user, with the user's role on it
+type userReplResponse struct {
+	models.Repl
+	Role models.CollaboratorRole `json:"role"`
+}
@@ -4,41 +4,70 @@ import (
 	log "packages/logging"
 	"net/http"
 
-	"core/internal/k8s"
-	"core/internal/redis"
+	"core/internal/provisioner"
+	"core/internal/s3"
+	"core/internal/snapshot"
+	"core/internal/store"
+	"core/models"
 	"packages/utils/json"
 )
 
-func NewHandler(rds *redis.Redis) http.Handler {
+func NewHandler(s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) http.Handler {
 	mux := http.NewServeMux()
 
+	// Idle shutdown and workspace sync, authorized by the runner's sync token
 	mux.HandleFunc("DELETE /{replId}", func(w http.ResponseWriter, r *http.Request) {
-		endReplSession(w, r, rds)
+		endReplSession(w, r, s3Client, rs, prov)
+	})
+	mux.HandleFunc("GET /{replId}/sync/manifest", func(w http.ResponseWriter, r *http.Request) {
+		syncManifest(w, r, s3Client, rs)
+	})
+	mux.HandleFunc("POST /{replId}/sync/uploads", func(w http.ResponseWriter, r *http.Request) {
+		syncUploads(w, r, s3Client, rs)
+	})
+	mux.HandleFunc("POST /{replId}/sync/downloads", func(w http.ResponseWriter, r *http.Request) {
+		syncDownloads(w, r, s3Client, rs)
+	})
+	mux.HandleFunc("POST /{replId}/sync/deletes", func(w http.ResponseWriter, r *http.Request) {
+		syncDeletes(w, r, s3Client, rs)
 	})
 
 	return mux
 }
 
-func endReplSession(w http.ResponseWriter, r *http.Request, rds *redis.Redis) {
-
-	replId := r.PathValue("replId")
+func endReplSession(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore, prov provisioner.Provisioner) {
 
-	repl, err := rds.GetRepl(replId)
-	if err != nil {
-		json.WriteError(w, http.StatusBadRequest, "This Repl Id doesn't exists")
+	repl, ok := syncRepl(w, r, rs)
+	if !ok {
 		return
 	}
+	replId := repl.Id
 	userName := repl.User
 
-	if err := rds.DeleteReplSession(replId); err != nil {
-		json.WriteError(w, http.StatusInternalServerError, "Unable to Create Repl Session")
+	if err := store.Transition(rs, replId, models.ReplStopping, "idle shutdown"); err != nil {
+		json.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	if err := rs.DeleteReplSession(replId); err != nil {
+		json.WriteError(w, http.StatusInternalServerError, "Unable to Delete Repl Session")
+		return
 	}
 
-	if err := k8s.DeleteReplDeploymentAndService(userName, replId); err != nil {
-		log.Error("K8s repl deletion failed", "repl_id", replId, "user", userName, "error", err)
+	snapshot.Auto(s3Client, rs, repl, "Before shutdown")
+
+	if err := prov.Delete(userName, replId); err != nil {
+		log.Error("Repl teardown failed", "repl_id", replId, "user", userName, "provisioner", prov.Name(), "error", err)
+		if err := store.Transition(rs, replId, models.ReplFailed, err.Error()); err != nil {
+			log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+		}
 		json.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if err := store.Transition(rs, replId, models.ReplStopped, "idle shutdown"); err != nil {
+		log.Warn("Update repl status failed", "repl_id", replId, "error", err)
+	}
+
 	json.WriteJSON(w, http.StatusOK, "Success")
 }
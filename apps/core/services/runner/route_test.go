@@ -0,0 +1,75 @@
+package runner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"core/internal/provisioner"
+	"core/internal/runnersync"
+	"core/internal/s3"
+	"core/internal/s3/s3test"
+	"core/internal/store"
+	"core/models"
+)
+
+// fakeProvisioner records the runners it's asked to delete
+type fakeProvisioner struct {
+	provisioner.Provisioner
+	deleted []string
+}
+
+func (f *fakeProvisioner) Name() string {
+	return "fake"
+}
+
+func (f *fakeProvisioner) Delete(userName, replId string) error {
+	f.deleted = append(f.deleted, replId)
+	return nil
+}
+
+func TestEndReplSessionNeedsSyncToken(t *testing.T) {
+	secret := runnersync.RUNNER_SYNC_SECRET
+	runnersync.RUNNER_SYNC_SECRET = "secret"
+	t.Cleanup(func() { runnersync.RUNNER_SYNC_SECRET = secret })
+
+	rs := store.NewMemoryStore("")
+	for _, replId := range []string{"repl-1", "repl-2"} {
+		rs.CreateRepl("node", "alice", "demo", replId)
+		for _, status := range []models.ReplStatus{models.ReplPending, models.ReplProvisioning, models.ReplReady} {
+			store.Transition(rs, replId, status, "")
+		}
+	}
+	prov := &fakeProvisioner{}
+	handler := NewHandler(s3.NewS3ClientAt(s3test.NewServer(t).URL), rs, prov)
+
+	otherRepl, _ := runnersync.Sign("alice", "repl-2")
+	ownRepl, _ := runnersync.Sign("alice", "repl-1")
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"other repl's token", otherRepl, http.StatusUnauthorized},
+		{"own token", ownRepl, http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodDelete, "/repl-1", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	if len(prov.deleted) != 1 || prov.deleted[0] != "repl-1" {
+		t.Errorf("deleted runners = %v, want only repl-1", prov.deleted)
+	}
+	if repl, _ := rs.GetRepl("repl-2"); repl.State.Status != models.ReplReady {
+		t.Errorf("repl-2 status = %s, want ready", repl.State.Status)
+	}
+}
@@ -0,0 +1,182 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	log "packages/logging"
+	"path"
+	"strings"
+	"time"
+
+	"core/internal/quota"
+	"core/internal/runnersync"
+	"core/internal/s3"
+	"core/internal/store"
+	"core/models"
+	"packages/utils/json"
+)
+
+const (
+	transferURLTTL = 15 * time.Minute
+	// Runners batch their changes, anything bigger is split by them
+	maxSyncKeys = 500
+)
+
+// syncRepl checks the runner's sync token and returns the repl it was
+// issued for
+func syncRepl(w http.ResponseWriter, r *http.Request, rs store.ReplStore) (models.Repl, bool) {
+	replId := r.PathValue("replId")
+
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || runnersync.Verify(tok, replId) != nil {
+		json.WriteError(w, http.StatusUnauthorized, "Invalid sync token")
+		return models.Repl{}, false
+	}
+
+	repl, err := rs.GetRepl(replId)
+	if err != nil {
+		json.WriteError(w, http.StatusNotFound, "Repl not found")
+		return models.Repl{}, false
+	}
+	return repl, true
+}
+
+func workspacePrefix(repl models.Repl) string {
+	return fmt.Sprintf("repl/%s/%s/", repl.User, repl.Id)
+}
+
+// readKeys decodes a sync request, rejecting keys that would escape the
+// repl's workspace
+func readKeys(w http.ResponseWriter, r *http.Request) (syncKeysRequest, bool) {
+	var req syncKeysRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, "Invalid request body")
+		return req, false
+	}
+	if len(req.Keys) > maxSyncKeys {
+		json.WriteError(w, http.StatusBadRequest, fmt.Sprintf("At most %d keys per request", maxSyncKeys))
+		return req, false
+	}
+	for _, key := range req.Keys {
+		if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+			json.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Invalid key %q", key))
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// syncManifest lists the workspace as stored in S3, runners seed their
+// manifest from it
+func syncManifest(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+	repl, ok := syncRepl(w, r, rs)
+	if !ok {
+		return
+	}
+
+	objects, err := s3Client.ListFolder(workspacePrefix(repl))
+	if err != nil {
+		log.Error("List workspace failed", "repl_id", repl.Id, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, "Unable to list workspace")
+		return
+	}
+	if objects == nil {
+		objects = []s3.Object{}
+	}
+
+	json.WriteJSON(w, http.StatusOK, objects)
+}
+
+// syncUploads presigns a PUT of the announced size for every changed file,
+// so runners never hold S3 credentials nor write past the storage limit
+func syncUploads(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+	repl, ok := syncRepl(w, r, rs)
+	if !ok {
+		return
+	}
+	req, ok := readKeys(w, r)
+	if !ok {
+		return
+	}
+
+	prefix := workspacePrefix(repl)
+	sizes := make(map[string]int64, len(req.Keys))
+	for _, key := range req.Keys {
+		size, ok := req.Sizes[key]
+		if !ok || size < 0 {
+			json.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Missing size of %q", key))
+			return
+		}
+		sizes[prefix+key] = size
+	}
+
+	if err := quota.CheckUpload(rs, s3Client, repl.User, sizes); err != nil {
+		var quotaErr *quota.Error
+		if errors.As(err, &quotaErr) {
+			json.WriteError(w, quotaErr.Status, quotaErr.Message)
+			return
+		}
+		log.Error("Check storage failed", "repl_id", repl.Id, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, "Unable to check storage")
+		return
+	}
+
+	presignKeys(w, repl, req.Keys, "upload", func(key string, expires time.Duration) (string, error) {
+		return s3Client.PresignPut(key, sizes[key], expires)
+	})
+}
+
+// syncDownloads presigns a GET for every file, warm runners restore the
+// workspace with them
+func syncDownloads(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+	repl, ok := syncRepl(w, r, rs)
+	if !ok {
+		return
+	}
+	req, ok := readKeys(w, r)
+	if !ok {
+		return
+	}
+	presignKeys(w, repl, req.Keys, "download", s3Client.PresignGet)
+}
+
+func presignKeys(w http.ResponseWriter, repl models.Repl, keys []string, kind string, presign func(key string, expires time.Duration) (string, error)) {
+	prefix := workspacePrefix(repl)
+	urls := make(map[string]string, len(keys))
+	for _, key := range keys {
+		url, err := presign(prefix+key, transferURLTTL)
+		if err != nil {
+			log.Error("Presign "+kind+" failed", "repl_id", repl.Id, "key", key, "error", err)
+			json.WriteError(w, http.StatusInternalServerError, "Unable to presign "+kind+"s")
+			return
+		}
+		urls[key] = url
+	}
+
+	json.WriteJSON(w, http.StatusOK, syncURLsResponse{URLs: urls})
+}
+
+// syncDeletes removes the files deleted from the workspace since the last sync
+func syncDeletes(w http.ResponseWriter, r *http.Request, s3Client *s3.S3Client, rs store.ReplStore) {
+	repl, ok := syncRepl(w, r, rs)
+	if !ok {
+		return
+	}
+	req, ok := readKeys(w, r)
+	if !ok {
+		return
+	}
+
+	prefix := workspacePrefix(repl)
+	for _, key := range req.Keys {
+		if err := s3Client.DeleteObject(prefix + key); err != nil {
+			log.Error("Delete synced object failed", "repl_id", repl.Id, "key", key, "error", err)
+			json.WriteError(w, http.StatusInternalServerError, "Unable to delete objects")
+			return
+		}
+	}
+
+	log.Debug("Synced deletes", "repl_id", repl.Id, "objects", len(req.Keys))
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
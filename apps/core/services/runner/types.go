@@ -0,0 +1,10 @@
+package runner
+
+type syncKeysRequest struct {
+	Keys  []string         `json:"keys"`            // relative to the repl's workspace
+	Sizes map[string]int64 `json:"sizes,omitempty"` // bytes per key, required for uploads
+}
+
+type syncURLsResponse struct {
+	URLs map[string]string `json:"urls"` // presigned PUT or GET per key
+}
@@ -0,0 +1,26 @@
+package templates
+
+import (
+	"net/http"
+
+	"core/internal/templates"
+	"packages/utils/json"
+)
+
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		json.WriteJSON(w, http.StatusOK, templates.List())
+	})
+	mux.HandleFunc("GET /{key}", func(w http.ResponseWriter, r *http.Request) {
+		template, ok := templates.Get(r.PathValue("key"))
+		if !ok {
+			json.WriteError(w, http.StatusNotFound, "This Template doesn't exists")
+			return
+		}
+		json.WriteJSON(w, http.StatusOK, template)
+	})
+
+	return mux
+}
@@ -0,0 +1,114 @@
+package tokens
+
+import (
+	"net/http"
+	log "packages/logging"
+	"slices"
+	"strings"
+	"time"
+
+	"core/cmd/middleware"
+	"core/internal/accesstoken"
+	"core/internal/store"
+	"core/models"
+	"packages/utils/json"
+)
+
+// NewHandler manages the caller's personal access tokens. Only cookie
+// sessions can, a leaked token can't mint or revoke others.
+func NewHandler(rs store.ReplStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		listTokens(w, r, rs)
+	})
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		createToken(w, r, rs)
+	})
+	mux.HandleFunc("DELETE /{tokenId}", func(w http.ResponseWriter, r *http.Request) {
+		revokeToken(w, r, rs)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := middleware.GetTokenFromContext(r.Context()); ok {
+			json.WriteError(w, http.StatusForbidden, "Access tokens can't manage access tokens")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	user, _ := middleware.GetUserFromContext(r.Context())
+
+	tokens, err := rs.ListAccessTokens(user.ID)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.WriteJSON(w, http.StatusOK, tokens)
+}
+
+func createToken(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	var req createTokenRequest
+	if err := json.ReadJSON(r, &req); err != nil {
+		json.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		json.WriteError(w, http.StatusBadRequest, "Token name is required")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		json.WriteError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !scope.IsValid() {
+			json.WriteError(w, http.StatusBadRequest, "Unknown scope "+string(scope)+", use repl:read, repl:write or repl:admin")
+			return
+		}
+	}
+	if !req.ExpiresAt.IsZero() && !req.ExpiresAt.After(time.Now()) {
+		json.WriteError(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+
+	user, _ := middleware.GetUserFromContext(r.Context())
+	slices.Sort(req.Scopes)
+	token, secret, err := accesstoken.Create(rs, *user, req.Name, slices.Compact(req.Scopes), req.ExpiresAt.UTC())
+	if err != nil {
+		log.Error("Create access token failed", "user", user.ID, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("Access token created", "user", user.ID, "token_id", token.Id, "scopes", token.Scopes, "expires_at", token.ExpiresAt)
+	json.WriteJSON(w, http.StatusCreated, createTokenResponse{AccessToken: token, Token: secret})
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, rs store.ReplStore) {
+	user, _ := middleware.GetUserFromContext(r.Context())
+	tokenId := r.PathValue("tokenId")
+
+	tokens, err := rs.ListAccessTokens(user.ID)
+	if err != nil {
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !slices.ContainsFunc(tokens, func(token models.AccessToken) bool { return token.Id == tokenId }) {
+		json.WriteError(w, http.StatusNotFound, "No such Access Token Found")
+		return
+	}
+
+	if err := rs.DeleteAccessToken(user.ID, tokenId); err != nil {
+		log.Error("Revoke access token failed", "user", user.ID, "token_id", tokenId, "error", err)
+		json.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("Access token revoked", "user", user.ID, "token_id", tokenId)
+	json.WriteJSON(w, http.StatusOK, "Success")
+}
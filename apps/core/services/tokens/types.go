@@ -0,0 +1,20 @@
+package tokens
+
+import (
+	"time"
+
+	"core/models"
+)
+
+type createTokenRequest struct {
+	Name   string              `json:"name"`
+	Scopes []models.TokenScope `json:"scopes"`
+	// Optional, the token never expires without it
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// createTokenResponse is the only time the token's secret is shown
+type createTokenResponse struct {
+	models.AccessToken
+	Token string `json:"token"`
+}
@@ -7,10 +7,13 @@ import (
 	"net/http"
 	"packages/utils/json"
 	"runner/cmd/proxy"
+	"runner/pkg/checkpoint"
 	"runner/pkg/dotenv"
+	"runner/pkg/fs"
 	"runner/pkg/shutdown"
 	"runner/services/mcp"
 	"runner/services/repl"
+	"sync/atomic"
 
 	"github.com/rs/cors"
 	"golang.org/x/sync/errgroup"
@@ -50,13 +53,53 @@ func (api *APIServer) RunGRPC() error {
 
 }
 
+// Warm pool runners start without a repl and wait for core to claim one
+var WARM_POOL = dotenv.EnvString("WARM_POOL", "false") == "true"
+
 func (api *APIServer) RunHTTP() error {
 
 	router := http.NewServeMux()
-	sm := shutdown.NewShutdownManager(dotenv.EnvString("REPL_ID", "repl_id_not_found"), shutdownCallback)
+	// Set by core, without it the runner can't sync its workspace
+	coreURL := dotenv.EnvString("CORE_URL", "")
+	if coreURL == "" {
+		log.Warn("CORE_URL not set, workspace sync and idle shutdown reports are disabled")
+	}
 
-	// background repl services
-	router.Handle("/api/v1/repl/", http.StripPrefix("/api/v1/repl", repl.NewHandler(sm)))
+	// Set once the runner serves a repl
+	var (
+		sm     atomic.Pointer[shutdown.ShutdownManager]
+		syncer atomic.Pointer[checkpoint.Syncer]
+	)
+	// coreToken authorizes the runner's idle shutdown report
+	serve := func(replId, coreToken string, s *checkpoint.Syncer) {
+		manager := shutdown.NewShutdownManager(replId, func(replId string) error {
+			return shutdownCallback(replId, coreToken)
+		})
+		sm.Store(manager)
+		syncer.Store(s)
+
+		// Checkpoints the workspace until the idle shutdown, core asks for a
+		// final sync before deleting the pod
+		go s.Start(manager.Context())
+
+		// background repl services
+		router.Handle("/api/v1/repl/", http.StripPrefix("/api/v1/repl", repl.NewHandler(manager, s)))
+	}
+
+	if WARM_POOL {
+		// The workspace is restored before anything can sync it back
+		router.Handle("/api/v1/pool/", http.StripPrefix("/api/v1/pool", repl.NewClaimHandler(func(ctx context.Context, req repl.ClaimRequest) error {
+			s := checkpoint.NewSyncer(req.ReplId, coreURL, fs.WORKSPACE_DIR, req.SyncToken)
+			if _, err := s.Restore(ctx); err != nil {
+				return err
+			}
+			serve(req.ReplId, req.SyncToken, s)
+			return nil
+		})))
+	} else {
+		replId := dotenv.EnvString("REPL_ID", "repl_id_not_found")
+		serve(replId, dotenv.EnvString("CORE_TOKEN", ""), checkpoint.NewSyncer(replId, coreURL, fs.WORKSPACE_DIR, checkpoint.SYNC_TOKEN))
+	}
 
 	// user app usage
 	router.HandleFunc("/user-app/", proxy.ReverseProxyHandler)
@@ -66,6 +109,20 @@ func (api *APIServer) RunHTTP() error {
 		json.WriteJSON(w, http.StatusOK, "pong")
 	})
 
+	// Lets core find runners whose idle shutdown callback never reached it
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		manager, s := sm.Load(), syncer.Load()
+		if manager == nil {
+			json.WriteJSON(w, http.StatusOK, map[string]any{"warm": true})
+			return
+		}
+		json.WriteJSON(w, http.StatusOK, map[string]any{
+			"shutdown":  manager.IsShutdown(),
+			"connected": manager.HasActiveConnection(),
+			"sync":      s.Status(),
+		})
+	})
+
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
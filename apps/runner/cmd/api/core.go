@@ -4,10 +4,17 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"runner/pkg/dotenv"
 )
 
-func shutdownCallback(replId string) error {
-	baseURL := "https://api.devx.parthkapoor.me"
+// shutdownCallback reports the idle shutdown to core, which only takes it
+// with the repl's token
+func shutdownCallback(replId, token string) error {
+	baseURL := dotenv.EnvString("CORE_URL", "")
+	if baseURL == "" {
+		return fmt.Errorf("CORE_URL not set")
+	}
 	url := fmt.Sprintf("%s/api/runner/%s", baseURL, replId)
 
 	req, err := http.NewRequest(http.MethodDelete, url, nil)
@@ -16,6 +23,7 @@ func shutdownCallback(replId string) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	client := &http.Client{
 		Timeout: 5 * time.Second,
@@ -3,11 +3,15 @@ package main
 import (
 	log "packages/logging"
 	"runner/cmd/api"
+	"runner/pkg/dotenv"
 )
 
 func main() {
 	log.Init("runner")
-	if err := api.NewAPIServer(":8081", ":50051").Run(); err != nil {
+
+	httpAddr := ":" + dotenv.EnvString("PORT", "8081")
+	grpcAddr := ":" + dotenv.EnvString("GRPC_PORT", "50051")
+	if err := api.NewAPIServer(httpAddr, grpcAddr).Run(); err != nil {
 		log.Fatal("Server exited with error", "error", err)
 	}
 }
@@ -0,0 +1,604 @@
+// Package checkpoint syncs the workspace to S3 while the repl runs. It keeps
+// a manifest of the content hashes stored in S3 and only uploads changed
+// files and removes deleted ones, through URLs presigned by core, so the
+// runner never holds S3 credentials.
+package checkpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	log "packages/logging"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"runner/pkg/dotenv"
+)
+
+var (
+	// Issued by core for this repl, sync is disabled without it
+	SYNC_TOKEN = dotenv.EnvString("SYNC_TOKEN", "")
+	// How often the workspace is checkpointed, 0 only syncs on demand
+	SYNC_INTERVAL = dotenv.EnvString("SYNC_INTERVAL", "30s")
+)
+
+var ErrDisabled = errors.New("workspace sync is disabled")
+
+const (
+	// Files per request to core, below its limit of 500
+	batchSize = 100
+	// Concurrent uploads to and downloads from S3
+	transferWorkers = 4
+)
+
+type Phase string
+
+const (
+	PhaseScanning  Phase = "scanning"
+	PhaseUploading Phase = "uploading"
+	PhaseDeleting  Phase = "deleting"
+	PhaseDone      Phase = "done"
+	PhaseFailed    Phase = "failed"
+)
+
+// Progress of a running sync, Done out of Total files in the current phase
+type Progress struct {
+	Phase Phase  `json:"phase"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Error string `json:"error,omitempty"`
+}
+
+// Result of a finished sync
+type Result struct {
+	Uploaded int       `json:"uploaded"`
+	Deleted  int       `json:"deleted"`
+	SyncedAt time.Time `json:"syncedAt"`
+}
+
+type Status struct {
+	Enabled      bool       `json:"enabled"`
+	Syncing      bool       `json:"syncing"`
+	LastSyncedAt *time.Time `json:"lastSyncedAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// file is the last seen state of a workspace file, so unchanged files
+// aren't hashed again
+type file struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+type Syncer struct {
+	replId  string
+	coreURL string
+	token   string
+	dir     string
+	client  *http.Client
+
+	syncMu   sync.Mutex        // one sync at a time
+	manifest map[string]string // key -> md5 of the object in S3, nil until seeded
+	files    map[string]file   // key -> last seen state
+
+	mu          sync.RWMutex
+	status      Status
+	subscribers map[int]func(Progress)
+	nextSub     int
+}
+
+// NewSyncer syncs dir to the repl's workspace through core at coreURL with
+// the sync token core issued for the repl, usually SYNC_TOKEN
+func NewSyncer(replId, coreURL, dir, token string) *Syncer {
+	return &Syncer{
+		replId:      replId,
+		coreURL:     coreURL,
+		token:       token,
+		dir:         dir,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		files:       make(map[string]file),
+		status:      Status{Enabled: token != "" && coreURL != ""},
+		subscribers: make(map[int]func(Progress)),
+	}
+}
+
+func (s *Syncer) Enabled() bool {
+	return s.token != "" && s.coreURL != ""
+}
+
+func (s *Syncer) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// Subscribe calls fn with the progress of every sync until the returned
+// func is called
+func (s *Syncer) Subscribe(fn func(Progress)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextSub
+	s.nextSub++
+	s.subscribers[id] = fn
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+func (s *Syncer) report(p Progress) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, fn := range s.subscribers {
+		fn(p)
+	}
+}
+
+// Start syncs on SYNC_INTERVAL until ctx is done
+func (s *Syncer) Start(ctx context.Context) {
+	if !s.Enabled() {
+		log.Info("Workspace sync disabled", "repl_id", s.replId)
+		return
+	}
+	interval, err := time.ParseDuration(SYNC_INTERVAL)
+	if err != nil {
+		log.Warn("Invalid SYNC_INTERVAL, syncing on demand only", "value", SYNC_INTERVAL, "error", err)
+		return
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info("Workspace sync started", "repl_id", s.replId, "interval", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sync(ctx); err != nil {
+				log.Warn("Workspace sync failed", "repl_id", s.replId, "error", err)
+			}
+		}
+	}
+}
+
+// Sync checkpoints the changes since the last sync
+func (s *Syncer) Sync(ctx context.Context) (Result, error) {
+	if !s.Enabled() {
+		return Result{}, ErrDisabled
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	s.status.Syncing = true
+	s.mu.Unlock()
+
+	result, err := s.sync(ctx)
+
+	s.mu.Lock()
+	s.status.Syncing = false
+	if err != nil {
+		s.status.Error = err.Error()
+	} else {
+		s.status.Error = ""
+		s.status.LastSyncedAt = &result.SyncedAt
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.report(Progress{Phase: PhaseFailed, Error: err.Error()})
+		return result, err
+	}
+	s.report(Progress{Phase: PhaseDone, Done: result.Uploaded + result.Deleted, Total: result.Uploaded + result.Deleted})
+	return result, nil
+}
+
+func (s *Syncer) sync(ctx context.Context) (Result, error) {
+	if s.manifest == nil {
+		manifest, err := s.fetchManifest(ctx)
+		if err != nil {
+			return Result{}, err
+		}
+		s.manifest = manifest
+	}
+
+	s.report(Progress{Phase: PhaseScanning})
+	current, err := s.scan()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to scan workspace: %w", err)
+	}
+
+	var changed, deleted []string
+	for key, hash := range current {
+		if s.manifest[key] != hash {
+			changed = append(changed, key)
+		}
+	}
+	for key := range s.manifest {
+		if _, ok := current[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+
+	var result Result
+	for start := 0; start < len(changed); start += batchSize {
+		batch := changed[start:min(start+batchSize, len(changed))]
+		if err := s.upload(ctx, batch, current); err != nil {
+			return result, err
+		}
+		result.Uploaded += len(batch)
+		s.report(Progress{Phase: PhaseUploading, Done: result.Uploaded, Total: len(changed)})
+	}
+
+	for start := 0; start < len(deleted); start += batchSize {
+		batch := deleted[start:min(start+batchSize, len(deleted))]
+		if err := s.post(ctx, "deletes", syncRequest{Keys: batch}, nil); err != nil {
+			return result, err
+		}
+		for _, key := range batch {
+			delete(s.manifest, key)
+		}
+		result.Deleted += len(batch)
+		s.report(Progress{Phase: PhaseDeleting, Done: result.Deleted, Total: len(deleted)})
+	}
+
+	result.SyncedAt = time.Now()
+	if result.Uploaded > 0 || result.Deleted > 0 {
+		log.Info("Workspace synced", "repl_id", s.replId, "uploaded", result.Uploaded, "deleted", result.Deleted)
+	}
+	return result, nil
+}
+
+// scan hashes every regular file in the workspace, reusing the hash of
+// files whose size and modification time didn't change
+func (s *Syncer) scan() (map[string]string, error) {
+	current := make(map[string]string)
+	seen := make(map[string]file)
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while the user's code runs
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		f, ok := s.files[key]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			hash, err := hashFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			f = file{size: info.Size(), modTime: info.ModTime(), hash: hash}
+		}
+
+		seen[key] = f
+		current[key] = f.hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.files = seen
+	return current, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// S3 reports the MD5 as the ETag of objects uploaded in one part
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upload puts the batch to S3 and records the hashes they were scanned with
+func (s *Syncer) upload(ctx context.Context, keys []string, hashes map[string]string) error {
+	// Core signs the scanned sizes, only what fits the storage limit is
+	// accepted
+	sizes := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		sizes[key] = s.files[key].size
+	}
+	var resp struct {
+		URLs map[string]string `json:"urls"`
+	}
+	if err := s.post(ctx, "uploads", syncRequest{Keys: keys, Sizes: sizes}, &resp); err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, transferWorkers)
+	)
+	for _, key := range keys {
+		url, ok := resp.URLs[key]
+		if !ok {
+			return fmt.Errorf("no upload url for %s", key)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := s.put(ctx, url, filepath.Join(s.dir, filepath.FromSlash(key)), sizes[key])
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				// Deleted since the scan, the next sync removes it
+			case errors.Is(err, errResized):
+				// Written since the scan, the next sync uploads it
+			case err != nil:
+				errs = append(errs, fmt.Errorf("failed to upload %s: %w", key, err))
+			default:
+				s.manifest[key] = hashes[key]
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// errResized is returned for files whose size no longer matches the one the
+// upload URL was signed for
+var errResized = errors.New("file size changed since the scan")
+
+func (s *Syncer) put(ctx context.Context, url, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return errResized
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, io.LimitReader(f, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Restore downloads the workspace from S3 into dir, for runners started
+// without the init container's download, and seeds the manifest with it
+func (s *Syncer) Restore(ctx context.Context) (int, error) {
+	if !s.Enabled() {
+		return 0, ErrDisabled
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	manifest, err := s.fetchManifest(ctx)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(manifest))
+	for key := range manifest {
+		keys = append(keys, key)
+	}
+
+	restored := 0
+	for start := 0; start < len(keys); start += batchSize {
+		batch := keys[start:min(start+batchSize, len(keys))]
+		if err := s.download(ctx, batch); err != nil {
+			return restored, err
+		}
+		restored += len(batch)
+	}
+
+	s.manifest = manifest
+	log.Info("Workspace restored", "repl_id", s.replId, "files", restored)
+	return restored, nil
+}
+
+// download gets the batch from S3 into the workspace
+func (s *Syncer) download(ctx context.Context, keys []string) error {
+	var resp struct {
+		URLs map[string]string `json:"urls"`
+	}
+	if err := s.post(ctx, "downloads", syncRequest{Keys: keys}, &resp); err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, transferWorkers)
+	)
+	for _, key := range keys {
+		url, ok := resp.URLs[key]
+		if !ok {
+			return fmt.Errorf("no download url for %s", key)
+		}
+		if !filepath.IsLocal(filepath.FromSlash(key)) {
+			return fmt.Errorf("invalid key %q", key)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := s.get(ctx, url, filepath.Join(s.dir, filepath.FromSlash(key))); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("failed to download %s: %w", key, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Syncer) get(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type object struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+}
+
+// fetchManifest seeds the manifest with what the workspace was restored from
+func (s *Syncer) fetchManifest(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url("manifest"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []object
+	if err := s.do(req, &objects); err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	manifest := make(map[string]string, len(objects))
+	for _, obj := range objects {
+		manifest[obj.Key] = obj.ETag
+	}
+	return manifest, nil
+}
+
+// syncRequest is the body of core's sync routes
+type syncRequest struct {
+	Keys  []string         `json:"keys"`
+	Sizes map[string]int64 `json:"sizes,omitempty"`
+}
+
+func (s *Syncer) post(ctx context.Context, route string, body syncRequest, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url(route), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := s.do(req, out); err != nil {
+		return fmt.Errorf("sync %s failed: %w", route, err)
+	}
+	return nil
+}
+
+func (s *Syncer) url(route string) string {
+	return fmt.Sprintf("%s/api/runner/%s/sync/%s", s.coreURL, s.replId, route)
+}
+
+func (s *Syncer) do(req *http.Request, out any) error {
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -6,9 +6,15 @@ import (
 	"os"
 	"path/filepath"
 
+	"runner/pkg/dotenv"
+
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
+// Root of the user's files, a volume mount in the pod or a plain directory
+// when the runner is started by the local provisioner
+var WORKSPACE_DIR = dotenv.EnvString("WORKSPACE_DIR", "/workspaces")
+
 var clipboard *Clipboard
 
 func FetchDir(basePath, relativePath string) ([]DirEntry, error) {
@@ -7,12 +7,15 @@ import (
 	log "packages/logging"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"runner/pkg/fs"
+
 	"github.com/creack/pty"
 )
 
@@ -44,6 +47,33 @@ type PTYConfig struct {
 	Rows        int               // Initial terminal rows
 }
 
+// Variables terminals inherit from the runner. Anything else, like the token
+// key and sync token core hands the runner, stays out of the user's shell.
+var inheritedEnv = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "SHELL": true,
+	"HOSTNAME": true, "LANG": true, "LANGUAGE": true, "TZ": true,
+	"REPL_ID": true, "TEMPLATE": true, "WORKSPACE_DIR": true,
+	// Set by the template images' toolchains
+	"GOPATH": true, "GOROOT": true, "GOTOOLCHAIN": true,
+	"NODE_VERSION": true, "NODE_PATH": true, "YARN_VERSION": true, "NPM_CONFIG_PREFIX": true,
+	"PYTHON_VERSION": true, "PYTHONPATH": true, "PYTHONUNBUFFERED": true, "VIRTUAL_ENV": true,
+	"JAVA_HOME": true, "JAVA_VERSION": true,
+	"CARGO_HOME": true, "RUSTUP_HOME": true, "RUST_VERSION": true,
+	"BUN_INSTALL": true, "DENO_DIR": true,
+}
+
+// terminalEnv is the allowlisted part of the runner's environment
+func terminalEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if inheritedEnv[key] || strings.HasPrefix(key, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
 // NewPTYManager creates a new PTY manager
 func NewPTYManager() *PTYManager {
 	return &PTYManager{
@@ -82,11 +112,11 @@ func (pm *PTYManager) CreateSession(sessionID string, config *PTYConfig) (*PTYSe
 	if config.WorkingDir != "" {
 		cmd.Dir = config.WorkingDir
 	} else {
-		cmd.Dir = "/workspaces"
+		cmd.Dir = fs.WORKSPACE_DIR
 	}
 
 	// Set environment
-	cmd.Env = os.Environ()
+	cmd.Env = terminalEnv()
 	cmd.Env = append(cmd.Env,
 		"TERM=xterm-256color",
 		fmt.Sprintf("COLUMNS=%d", config.Cols),
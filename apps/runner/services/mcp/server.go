@@ -19,13 +19,13 @@ func NewGrpcServer(lis net.Listener) error {
 	server := grpc.NewServer()
 	pb.RegisterReplServiceServer(server, &grpcServer{})
 
-	log.Info("Starting gRPC server", "addr", ":50051")
+	log.Info("Starting gRPC server", "addr", lis.Addr().String())
 	return server.Serve(lis)
 }
 
 func (s *grpcServer) FetchContent(ctx context.Context, in *pb.FetchContentRequest) (*pb.FetchContentResponse, error) {
 
-	fullPath := fmt.Sprintf("/workspaces/%s", in.Path)
+	fullPath := fmt.Sprintf("%s/%s", fs.WORKSPACE_DIR, in.Path)
 	data, err := fs.FetchFileContent(fullPath)
 	if err != nil {
 		log.Error("Fetch file content failed", "path", in.Path, "full_path", fullPath, "error", err)
@@ -0,0 +1,91 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"packages/utils/token"
+	"runner/pkg/dotenv"
+)
+
+var (
+	// The pod's name on warm pool runners, until core claims them for a repl
+	REPL_ID = dotenv.EnvString("REPL_ID", "")
+	// Verifies core's tokens, core derives it from its secret for REPL_ID
+	RUNNER_TOKEN_KEY = dotenv.EnvString("RUNNER_TOKEN_KEY", "")
+
+	replIdMu sync.RWMutex
+)
+
+func replId() string {
+	replIdMu.RLock()
+	defer replIdMu.RUnlock()
+	return REPL_ID
+}
+
+func tokenKey() string {
+	replIdMu.RLock()
+	defer replIdMu.RUnlock()
+	return RUNNER_TOKEN_KEY
+}
+
+// Events that change the workspace or run code, refused on read-only sessions
+var mutatingEvents = map[string]string{
+	"updateContent":   "updateContentResponse",
+	"createFile":      "createFileResponse",
+	"createFolder":    "createFolderResponse",
+	"delete":          "deleteResponse",
+	"rename":          "renameResponse",
+	"copy":            "copyResponse",
+	"cut":             "cutResponse",
+	"paste":           "pasteResponse",
+	"requestTerminal": "terminalError",
+	"terminalInput":   "terminalError",
+	"terminalResize":  "terminalError",
+	"closeTerminal":   "terminalError",
+	"run":             "terminalError",
+	"sync":            "syncResponse",
+}
+
+// authorize checks the ?token= core issued on activation and reports whether
+// the session is read-only. Without RUNNER_TOKEN_KEY core issues no tokens
+// and every connection gets full access, so a token means core signs them
+// and might have issued it to a viewer: it is refused rather than ignored.
+func authorize(r *http.Request) (readOnly bool, err error) {
+	key := tokenKey()
+	if key == "" {
+		if r.URL.Query().Get("token") != "" {
+			return false, errors.New("can't verify tokens without RUNNER_TOKEN_KEY")
+		}
+		return false, nil
+	}
+
+	claims, err := token.Verify(key, r.URL.Query().Get("token"))
+	if err != nil {
+		return false, err
+	}
+	if id := replId(); id != "" && claims.ReplId != id {
+		return false, fmt.Errorf("token issued for %s", claims.ReplId)
+	}
+
+	return claims.Role == "viewer", nil
+}
+
+// authorizeCore checks the owner token core signs for the routes only it
+// calls. Unlike the websocket they're refused without RUNNER_TOKEN_KEY,
+// anyone who can reach the runner could call them otherwise.
+func authorizeCore(r *http.Request) error {
+	if tokenKey() == "" {
+		return errors.New("RUNNER_TOKEN_KEY not set")
+	}
+	readOnly, err := authorize(r)
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		return errors.New("token is read-only")
+	}
+	return nil
+}
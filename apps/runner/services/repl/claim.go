@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"context"
+	"net/http"
+	log "packages/logging"
+	"packages/utils/json"
+	"sync/atomic"
+)
+
+// ClaimRequest assigns a warm pool runner to a repl
+type ClaimRequest struct {
+	ReplId    string `json:"replId"`
+	SyncToken string `json:"syncToken"`
+	// Replaces the pool's token key, empty when core signs no tokens
+	TokenKey string `json:"tokenKey"`
+}
+
+// NewClaimHandler serves warm pool runners until core claims them. Only the
+// first claim is accepted: the runner switches to the repl and start restores
+// its workspace and serves it.
+func NewClaimHandler(start func(ctx context.Context, req ClaimRequest) error) http.Handler {
+	mux := http.NewServeMux()
+	var claimed atomic.Bool
+
+	mux.HandleFunc("POST /claim", func(w http.ResponseWriter, r *http.Request) {
+		readOnly, err := authorize(r)
+		if err != nil || readOnly {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req ClaimRequest
+		if err := json.ReadJSON(r, &req); err != nil || req.ReplId == "" || req.SyncToken == "" {
+			json.WriteError(w, http.StatusBadRequest, "replId and syncToken are required")
+			return
+		}
+		// Tokens for the repl are signed with its own key
+		if tokenKey() != "" && req.TokenKey == "" {
+			json.WriteError(w, http.StatusBadRequest, "tokenKey is required")
+			return
+		}
+		if !claimed.CompareAndSwap(false, true) {
+			json.WriteError(w, http.StatusConflict, "Runner already claimed")
+			return
+		}
+
+		replIdMu.Lock()
+		REPL_ID = req.ReplId
+		RUNNER_TOKEN_KEY = req.TokenKey
+		replIdMu.Unlock()
+		log.Info("Warm runner claimed", "repl_id", req.ReplId)
+
+		if err := start(r.Context(), req); err != nil {
+			// Core deletes runners it couldn't claim
+			log.Error("Start claimed repl failed", "repl_id", req.ReplId, "error", err)
+			json.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.WriteJSON(w, http.StatusOK, "Success")
+	})
+	return mux
+}
@@ -0,0 +1,53 @@
+package repl
+
+import (
+	"sync"
+	"time"
+)
+
+// Notice is a message from core to everyone connected to the runner, such as
+// a warning that the runner is about to restart
+type Notice struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// When the announced change happens, if it's scheduled
+	At time.Time `json:"at,omitzero"`
+}
+
+// noticeHub fans notices out to the open websockets
+type noticeHub struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func(Notice)
+}
+
+var notices = &noticeHub{subs: map[int]func(Notice){}}
+
+func (h *noticeHub) subscribe(fn func(Notice)) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.next
+	h.next++
+	h.subs[id] = fn
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, id)
+	}
+}
+
+// broadcast sends the notice to every websocket and reports how many got it
+func (h *noticeHub) broadcast(notice Notice) int {
+	h.mu.Lock()
+	subs := make([]func(Notice), 0, len(h.subs))
+	for _, fn := range h.subs {
+		subs = append(subs, fn)
+	}
+	h.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(notice)
+	}
+	return len(subs)
+}
@@ -1,15 +1,18 @@
 package repl
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"fmt"
+	"errors"
 	log "packages/logging"
 	"net/http"
+	"packages/utils/json"
 	"path/filepath"
 	"strings"
 	"sync"
 
+	"runner/pkg/checkpoint"
 	"runner/pkg/fs"
 	"runner/pkg/pty"
 	"runner/pkg/shutdown"
@@ -29,13 +32,60 @@ func getPTYManager() *pty.PTYManager {
 	return ptyManager
 }
 
-func NewHandler(sm *shutdown.ShutdownManager) http.Handler {
+func NewHandler(sm *shutdown.ShutdownManager, syncer *checkpoint.Syncer) http.Handler {
 	mux := http.NewServeMux()
+
+	// Checkpoints the workspace now, core calls it before stopping the repl
+	mux.HandleFunc("POST /sync", func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizeCore(r); err != nil {
+			log.Warn("Sync request rejected", "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		result, err := syncer.Sync(r.Context())
+		if errors.Is(err, checkpoint.ErrDisabled) {
+			json.WriteError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Error("Workspace sync failed", "error", err)
+			json.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.WriteJSON(w, http.StatusOK, result)
+	})
+
+	// Core warns the connected users before it restarts or upgrades the runner
+	mux.HandleFunc("POST /notice", func(w http.ResponseWriter, r *http.Request) {
+		readOnly, err := authorize(r)
+		if err != nil || readOnly {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var notice Notice
+		if err := json.ReadJSON(r, &notice); err != nil {
+			json.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		delivered := notices.broadcast(notice)
+		log.Info("Notice sent", "kind", notice.Kind, "sessions", delivered)
+		json.WriteJSON(w, http.StatusOK, map[string]int{"delivered": delivered})
+	})
+
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		readOnly, err := authorize(r)
+		if err != nil {
+			log.Warn("WebSocket rejected", "host", r.Host, "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		wsHandler := ws.NewWSHandler(strings.Split(r.Host, ".")[0], sm)
 		ptyManager = getPTYManager()
 		defer ptyManager.Cleanup()
-		handleWs(w, r, wsHandler, ptyManager)
+		handleWs(w, r, wsHandler, ptyManager, syncer, readOnly)
 	})
 	return mux
 }
@@ -49,26 +99,40 @@ func generateSessionID() string {
 	return hex.EncodeToString(bytes)
 }
 
-func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManager *pty.PTYManager) {
-	if err := ws.Init(w, r); err != nil {
-		log.Error("WebSocket init failed", "host", r.Host, "error", err)
-		return
-	}
-
+func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManager *pty.PTYManager, syncer *checkpoint.Syncer, readOnly bool) {
 	ws.On("Connection", func(data any) {
-		rootContents, err := fs.FetchDir("/workspaces", "")
+		rootContents, err := fs.FetchDir(fs.WORKSPACE_DIR, "")
 		if err != nil {
 			ws.Emit("error", map[string]any{"message": "Failed to load directory"})
 			return
 		}
 		ws.Emit("Loaded", map[string]any{
 			"rootContents": rootContents,
+			"readOnly":     readOnly,
+			"sync":         syncer.Status(),
+			"entrypoint":   ENTRYPOINT,
+			"runCommand":   RUN_COMMAND,
 		})
 	})
 
+	// Workspace sync, progress of every sync is pushed to the client
+	unsubscribe := syncer.Subscribe(func(p checkpoint.Progress) {
+		ws.Emit("syncProgress", p)
+		if p.Phase == checkpoint.PhaseDone || p.Phase == checkpoint.PhaseFailed {
+			ws.Emit("syncStatus", syncer.Status())
+		}
+	})
+	unsubscribeNotices := notices.subscribe(func(n Notice) {
+		ws.Emit("notice", n)
+	})
+	ws.On("disconnect", func(data any) {
+		unsubscribe()
+		unsubscribeNotices()
+	})
+
 	// File Tree Actions
 	OnTyped(ws, "fetchDir", func(req FetchDirRequest) {
-		contents, err := fs.FetchDir("/workspaces", req.Dir)
+		contents, err := fs.FetchDir(fs.WORKSPACE_DIR, req.Dir)
 		if err != nil {
 			log.Error("Fetch directory failed", "path", req.Dir, "error", err)
 			ws.Emit("fetchDirResponse", map[string]any{"error": err.Error()})
@@ -78,7 +142,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "fetchContent", func(req FetchContentRequest) {
-		fullPath := fmt.Sprintf("/workspaces/%s", req.Path)
+		fullPath := filepath.Join(fs.WORKSPACE_DIR, req.Path)
 		data, err := fs.FetchFileContent(fullPath)
 		if err != nil {
 			log.Error("Fetch file content failed", "path", req.Path, "full_path", fullPath, "error", err)
@@ -88,8 +152,40 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 		ws.Emit("fetchContentResponse", map[string]string{"content": data, "path": req.Path})
 	})
 
+	// Viewers can browse and read files, but not change them or use a
+	// terminal: their sessions never get the handlers that would
+	if readOnly {
+		rejectMutations(ws)
+	} else {
+		handleMutations(ws, ptyManager, syncer)
+	}
+
+	// Every handler is in place before the read loop starts, so no event can
+	// reach one the session isn't allowed
+	if err := ws.Init(w, r); err != nil {
+		log.Error("WebSocket init failed", "host", r.Host, "error", err)
+		unsubscribe()
+		unsubscribeNotices()
+		return
+	}
+}
+
+// handleMutations registers the events that change the workspace or run code
+func handleMutations(ws *ws.WSHandler, ptyManager *pty.PTYManager, syncer *checkpoint.Syncer) {
+	ws.On("sync", func(data any) {
+		go func() {
+			// Not the request's context, it ends once the websocket is set up
+			result, err := syncer.Sync(context.Background())
+			if err != nil {
+				ws.Emit("syncResponse", map[string]any{"error": err.Error()})
+				return
+			}
+			ws.Emit("syncResponse", map[string]any{"success": true, "result": result})
+		}()
+	})
+
 	OnTyped(ws, "updateContent", func(req UpdateContentRequest) {
-		fullPath := fmt.Sprintf("/workspaces/%s", req.Path)
+		fullPath := filepath.Join(fs.WORKSPACE_DIR, req.Path)
 		err := fs.SaveFileDiffs(fullPath, req.Patch)
 		if err != nil {
 			log.Error("Save file failed", "path", req.Path, "full_path", fullPath, "error", err)
@@ -100,7 +196,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "createFile", func(req CreateFileRequest) {
-		fullPath := filepath.Join("/workspaces", req.Path)
+		fullPath := filepath.Join(fs.WORKSPACE_DIR, req.Path)
 		err := fs.CreateFile(fullPath)
 		if err != nil {
 			log.Error("Create file failed", "path", req.Path, "full_path", fullPath, "error", err)
@@ -111,7 +207,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "createFolder", func(req CreateFolderRequest) {
-		fullPath := filepath.Join("/workspaces", req.Path)
+		fullPath := filepath.Join(fs.WORKSPACE_DIR, req.Path)
 		err := fs.CreateFolder(fullPath)
 		if err != nil {
 			log.Error("Create folder failed", "path", req.Path, "full_path", fullPath, "error", err)
@@ -122,7 +218,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "delete", func(req DeleteRequest) {
-		fullPath := filepath.Join("/workspaces", req.Path)
+		fullPath := filepath.Join(fs.WORKSPACE_DIR, req.Path)
 		err := fs.Delete(fullPath)
 		if err != nil {
 			log.Error("Delete failed", "path", req.Path, "full_path", fullPath, "error", err)
@@ -133,8 +229,8 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "rename", func(req RenameRequest) {
-		oldFullPath := filepath.Join("/workspaces", req.OldPath)
-		newFullPath := filepath.Join("/workspaces", req.NewPath)
+		oldFullPath := filepath.Join(fs.WORKSPACE_DIR, req.OldPath)
+		newFullPath := filepath.Join(fs.WORKSPACE_DIR, req.NewPath)
 		err := fs.Rename(oldFullPath, newFullPath)
 		if err != nil {
 			log.Error("Rename failed", "old_path", req.OldPath, "new_path", req.NewPath, "error", err)
@@ -149,8 +245,8 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "copy", func(req CopyRequest) {
-		sourceFullPath := filepath.Join("/workspaces", req.SourcePath)
-		targetFullPath := filepath.Join("/workspaces", req.TargetPath)
+		sourceFullPath := filepath.Join(fs.WORKSPACE_DIR, req.SourcePath)
+		targetFullPath := filepath.Join(fs.WORKSPACE_DIR, req.TargetPath)
 		err := fs.Copy(sourceFullPath, targetFullPath)
 		if err != nil {
 			log.Error("Copy failed", "source_path", req.SourcePath, "target_path", req.TargetPath, "error", err)
@@ -165,7 +261,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "cut", func(req CutRequest) {
-		sourceFullPath := filepath.Join("/workspaces", req.SourcePath)
+		sourceFullPath := filepath.Join(fs.WORKSPACE_DIR, req.SourcePath)
 		err := fs.Cut(sourceFullPath)
 		if err != nil {
 			log.Error("Cut failed", "source_path", req.SourcePath, "error", err)
@@ -179,7 +275,7 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 	})
 
 	OnTyped(ws, "paste", func(req PasteRequest) {
-		targetFullPath := filepath.Join("/workspaces", req.TargetPath)
+		targetFullPath := filepath.Join(fs.WORKSPACE_DIR, req.TargetPath)
 		err := fs.Paste(targetFullPath)
 		if err != nil {
 			log.Error("Paste failed", "target_path", req.TargetPath, "error", err)
@@ -194,28 +290,11 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 
 	// Terminal Actions
 	ws.On("requestTerminal", func(data any) {
-		sessionID := generateSessionID()
-		if sessionID == "" {
-			ws.Emit("terminalError", map[string]string{"error": "Failed to generate session ID"})
-			return
-		}
-
-		session, err := ptyManager.CreateSession(sessionID, nil)
-		if err != nil {
-			ws.Emit("terminalError", map[string]string{"error": "Failed to create terminal session"})
-			return
-		}
-
-		ws.Emit("terminalConnected", map[string]string{"sessionId": sessionID})
-
-		session.SetOnDataCallback(func(data []byte) {
-			ws.Emit("terminalResponse", string(data))
-		})
+		startTerminal(ws, ptyManager)
+	})
 
-		session.SetOnCloseCallback(func() {
-			ws.Emit("terminalClosed", nil)
-			ptyManager.RemoveSession(sessionID)
-		})
+	ws.On("run", func(data any) {
+		runApp(ws, ptyManager)
 	})
 
 	OnTyped(ws, "closeTerminal", func(req TerminalCloseRequest) {
@@ -242,3 +321,12 @@ func handleWs(w http.ResponseWriter, r *http.Request, ws *ws.WSHandler, ptyManag
 		session.Resize(req.Cols, req.Rows)
 	})
 }
+
+// rejectMutations answers every mutating event with an error
+func rejectMutations(ws *ws.WSHandler) {
+	for event, response := range mutatingEvents {
+		ws.On(event, func(data any) {
+			ws.Emit(response, map[string]any{"error": "This session is read-only"})
+		})
+	}
+}
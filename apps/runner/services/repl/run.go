@@ -0,0 +1,62 @@
+package repl
+
+import (
+	"strings"
+
+	"runner/pkg/dotenv"
+	"runner/pkg/pty"
+	"runner/pkg/ws"
+)
+
+var (
+	// From the template's devex.yaml: how its app is started and the file
+	// the editor opens first. Core sets both on every runner.
+	RUN_COMMAND = dotenv.EnvString("RUN_COMMAND", "")
+	ENTRYPOINT  = dotenv.EnvString("ENTRYPOINT", "")
+)
+
+// startTerminal opens a terminal session whose output is streamed to the
+// client, nil when it couldn't be started and the client was told so
+func startTerminal(ws *ws.WSHandler, ptyManager *pty.PTYManager) *pty.PTYSession {
+	sessionID := generateSessionID()
+	if sessionID == "" {
+		ws.Emit("terminalError", map[string]string{"error": "Failed to generate session ID"})
+		return nil
+	}
+
+	session, err := ptyManager.CreateSession(sessionID, nil)
+	if err != nil {
+		ws.Emit("terminalError", map[string]string{"error": "Failed to create terminal session"})
+		return nil
+	}
+
+	ws.Emit("terminalConnected", map[string]string{"sessionId": sessionID})
+
+	session.SetOnDataCallback(func(data []byte) {
+		ws.Emit("terminalResponse", string(data))
+	})
+
+	session.SetOnCloseCallback(func() {
+		ws.Emit("terminalClosed", nil)
+		ptyManager.RemoveSession(sessionID)
+	})
+	return session
+}
+
+// runApp starts the template's RUN_COMMAND in a new terminal, the user sees
+// its output and can stop it like any other command
+func runApp(ws *ws.WSHandler, ptyManager *pty.PTYManager) {
+	command := strings.TrimSpace(RUN_COMMAND)
+	if command == "" {
+		ws.Emit("terminalError", map[string]string{"error": "This template has no run command"})
+		return
+	}
+
+	session := startTerminal(ws, ptyManager)
+	if session == nil {
+		return
+	}
+	if err := session.WriteString(command + "\n"); err != nil {
+		ws.Emit("terminalError", map[string]string{"error": "Failed to start the run command"})
+	}
+}
@@ -54,6 +54,11 @@ export default function ReplPage() {
       toast.success("Workspace loaded successfully");
     });
 
+    // Messages from core, e.g. a restart warning before a runner upgrade
+    on("notice", (data) => {
+      toast.warning(data.message);
+    });
+
     on("error", (data) => {
       console.error("WebSocket error:", data);
       toast.error(data.message || "An error occurred");
@@ -217,6 +222,7 @@ export default function ReplPage() {
     return () => {
       off("Loaded");
       off("error");
+      off("notice");
       off("fetchDirResponse");
       off("fetchContentResponse");
       off("updateContentResponse");
@@ -18,9 +18,9 @@ import Waves from "@/components/ui/waves";
 // The backend returns "ok", "degraded" for the api, and "ok" or an error string for others.
 interface PingResponse {
   api: "ok" | "degraded" | "unreachable";
-  k8s: string;
+  provisioner: string;
   s3: string;
-  redis: string;
+  store: string;
 }
 
 // A simplified type for clarity. "ok" means healthy, anything else is an error string or a special state.
@@ -51,8 +51,8 @@ export default function StatusPage() {
       // Set a clear error state when the API is unreachable
       setStatus({
         api: "unreachable",
-        k8s: "Error fetching status",
-        redis: "Error fetching status",
+        provisioner: "Error fetching status",
+        store: "Error fetching status",
         s3: "Error fetching status",
       });
     } finally {
@@ -127,16 +127,16 @@ export default function StatusPage() {
   const services: ServiceItem[] = status
     ? [
         {
-          name: "K8s Cluster",
+          name: "Provisioner",
           icon: Server,
-          status: status.k8s,
-          description: "Kubernetes Cluster",
+          status: status.provisioner,
+          description: "Kubernetes cluster or local runners",
         },
         {
-          name: "Redis Cache",
+          name: "Repl Store",
           icon: Database,
-          status: status.redis,
-          description: "In-memory data store",
+          status: status.store,
+          description: "Redis or embedded data store",
         },
         {
           name: "S3 Storage",
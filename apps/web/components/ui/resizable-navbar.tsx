@@ -61,7 +61,7 @@ interface MobileNavMenuProps {
 
 interface UserProfileDropdownProps {
   user: {
-    id: number;
+    id: string;
     login: string;
     name: string;
     email: string;
@@ -75,7 +75,7 @@ interface UserProfileDropdownProps {
 
 interface MobileUserProfileProps {
   user: {
-    id: number;
+    id: string;
     login: string;
     name: string;
     email: string;
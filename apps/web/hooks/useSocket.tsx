@@ -38,7 +38,14 @@ export function useRunnerSocket(replId: string) {
 
   useEffect(() => {
     const protocol = window.location.protocol === "https:" ? "wss" : "ws";
-    const url = `${protocol}://${process.env.NEXT_PUBLIC_RUNNER_DOMAIN_NAME}/${replId}/api/v1/repl/ws`;
+    const token = sessionStorage.getItem(`runner-token:${replId}`);
+    const query = token ? `?token=${encodeURIComponent(token)}` : "";
+    // Local runners listen on their own port, reported on activation
+    const runnerUrl = sessionStorage.getItem(`runner-url:${replId}`);
+    const base = runnerUrl
+      ? runnerUrl.replace(/^http/, "ws")
+      : `${protocol}://${process.env.NEXT_PUBLIC_RUNNER_DOMAIN_NAME}/${replId}`;
+    const url = `${base}/api/v1/repl/ws${query}`;
     const testingUrl = "ws://localhost:8081/api/v1/repl/ws";
 
     const socket: Socket = new WebSocket(url);
@@ -1,5 +1,5 @@
 import { AuthStatus, User } from "@/types/auth";
-import { StoredRepl } from "@/types/dashboard";
+import { ReplState, StoredRepl, Template } from "@/types/dashboard";
 import axios from "axios";
 
 const API_BASE_URL =
@@ -128,6 +128,20 @@ export class CoreService {
     }
   }
 
+  async getTemplates() {
+    try {
+      const response = await axios.get(this.url("/api/templates/"), {
+        headers: {
+          "Content-Type": "application/json",
+        },
+      });
+      return (response.data as Template[]) || [];
+    } catch (error) {
+      console.log("error:", error);
+      throw error;
+    }
+  }
+
   async getRepls() {
     try {
       const response = await axios.get(this.url("/api/repl"), {
@@ -161,9 +175,12 @@ export class CoreService {
     }
   }
 
-  async startRepl(replName: string) {
+  async startRepl(
+    replName: string,
+    onStatus?: (state: ReplState) => void,
+  ) {
     try {
-      return (
+      const data = (
         await axios.get(this.url(`/api/repl/session/${replName}`), {
           withCredentials: true,
           headers: {
@@ -171,12 +188,49 @@ export class CoreService {
           },
         })
       ).data;
+      // Picked up by useRunnerSocket, the runner checks the token on connect
+      if (data.accessToken) {
+        sessionStorage.setItem(`runner-token:${data.replId}`, data.accessToken);
+      }
+      if (data.runnerUrl) {
+        sessionStorage.setItem(`runner-url:${data.replId}`, data.runnerUrl);
+      }
+      await this.waitForRepl(data.replId, onStatus);
+      return data;
     } catch (error) {
       console.log("error:", error);
       throw error;
     }
   }
 
+  // Resolves once the repl is ready, rejects with the failure reason
+  waitForRepl(replId: string, onStatus?: (state: ReplState) => void) {
+    return new Promise<ReplState>((resolve, reject) => {
+      const events = new EventSource(
+        this.url(`/api/repl/${replId}/status/events`),
+        { withCredentials: true },
+      );
+
+      events.addEventListener("status", (event) => {
+        const state = JSON.parse((event as MessageEvent).data) as ReplState;
+        onStatus?.(state);
+
+        if (state.status === "ready") {
+          events.close();
+          resolve(state);
+        } else if (state.status === "failed" || state.status === "stopped") {
+          events.close();
+          reject(new Error(state.reason || `Repl ${state.status}`));
+        }
+      });
+
+      events.onerror = () => {
+        events.close();
+        reject(new Error("Lost connection to repl status stream"));
+      };
+    });
+  }
+
   async deleteReplSession(replName: string) {
     try {
       await axios.delete(this.url(`/api/repl/session/${replName}`), {
@@ -5,12 +5,47 @@ export interface Repl {
   createdAt: string;
 }
 
+export type ReplStatus =
+  | "pending"
+  | "provisioning"
+  | "ready"
+  | "failed"
+  | "stopping"
+  | "stopped"
+  | "archiving";
+
+export interface ReplState {
+  status: ReplStatus;
+  reason?: string;
+  updatedAt: string;
+}
+
+export interface Template {
+  key: string;
+  name: string;
+  description: string;
+  icon: string;
+  image: string;
+  port: number;
+  run: string;
+  entrypoint: string;
+  resources: {
+    cpu?: string;
+    memory?: string;
+    ephemeralStorage?: string;
+    workspace?: string;
+    sidecar: { cpu?: string; memory?: string; ephemeralStorage?: string };
+  };
+}
+
 export interface StoredRepl {
   id: string;
   name: string;
   user: string;
   isActive: bool;
   templateKey?: string;
+  state?: ReplState;
+  role?: "owner" | "editor" | "viewer";
 }
 
 export interface HistoryEntry {
@@ -0,0 +1,74 @@
+// Package token signs the short-lived access tokens core hands out on repl
+// activation, which the runner verifies before accepting a websocket.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Claims struct {
+	ReplId    string `json:"replId"`
+	User      string `json:"user"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var (
+	ErrMalformed = errors.New("malformed token")
+	ErrSignature = errors.New("invalid token signature")
+	ErrExpired   = errors.New("token expired")
+)
+
+// Sign encodes the claims as <payload>.<signature>, both base64url encoded
+func Sign(secret string, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sign(secret, encoded), nil
+}
+
+// Verify checks the signature and expiry and returns the claims
+func Verify(secret, token string) (Claims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Claims{}, ErrMalformed
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(secret, encoded))) {
+		return Claims{}, ErrSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrMalformed
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return Claims{}, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// ReplKey derives the key tokens for one repl are signed with. Runners only
+// get their repl's key, so a runner can't sign tokens for other repls.
+func ReplKey(secret, replId string) string {
+	return sign(secret, "repl:"+replId)
+}
+
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}